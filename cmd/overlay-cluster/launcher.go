@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+	"github.com/TheJ0lly/Overlay-Network/internal/node"
+	"github.com/TheJ0lly/Overlay-Network/internal/topology"
+)
+
+// launcher runs the nodes of a cluster. Node i listens on BasePort+i, and keeps its key file between restarts, thus its ID too.
+type launcher interface {
+	// start starts node i, which joins the network through bootstrap, unless it is nil.
+	start(i int, c NodeConfig, bootstrap *network.IpPortPair) error
+	// kill stops node i right away, without telling the network.
+	kill(i int) error
+	// leave makes node i announce that it leaves the network, and stop.
+	leave(i int) error
+	running(i int) bool
+	// stats returns the stats of node i, as JSON.
+	stats(i int) ([]byte, error)
+	// vision returns the vision of node i, for topology.Check.
+	vision(i int) (topology.Vision, error)
+}
+
+// run is the results directory of a run, and what the launchers share.
+type run struct {
+	s        *Scenario
+	dir      string
+	timeline *timeline
+}
+
+func (r *run) address(i int) network.IpPortPair {
+	return network.IpPortPair{Ip: net.ParseIP(r.s.IP), Port: r.s.BasePort + uint16(i)}
+}
+
+func (r *run) keyFile(i int) string {
+	return filepath.Join(r.dir, "keys", fmt.Sprintf("Key_Node_%d.pem", r.s.BasePort+uint16(i)))
+}
+
+func (r *run) statsDir() string {
+	return filepath.Join(r.dir, "stats")
+}
+
+func (r *run) logsDir() string {
+	return filepath.Join(r.dir, "logs")
+}
+
+// processLauncher runs each node as an overlay process, logging to its own file, and reached through its admin API.
+type processLauncher struct {
+	*run
+	binary string
+	http   *http.Client
+
+	mu    sync.Mutex
+	procs map[int]*process
+}
+
+// process is a running node, and exited is closed once it exited.
+type process struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+func newProcessLauncher(r *run, binary string) *processLauncher {
+	return &processLauncher{run: r, binary: binary, http: &http.Client{Timeout: 5 * time.Second}, procs: map[int]*process{}}
+}
+
+func (l *processLauncher) adminAddress(i int) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(l.s.BasePort+l.s.AdminOffset)+i))
+}
+
+func (l *processLauncher) start(i int, c NodeConfig, bootstrap *network.IpPortPair) error {
+	addr := l.address(i)
+	args := []string{
+		"-ip", l.s.IP,
+		"-port", strconv.Itoa(int(addr.Port)),
+		"-conncap", strconv.Itoa(int(c.ConnCap)),
+		"-queuecap", strconv.Itoa(int(c.QueueCap)),
+		"-lifeline", strconv.Itoa(int(c.LifeLine)),
+		"-death", strconv.Itoa(int(c.Death)),
+		"-depth", strconv.Itoa(int(c.Depth)),
+		"-keyfile", l.keyFile(i),
+		"-statsdir", l.statsDir(),
+		"-statsinterval", strconv.Itoa(int(l.s.StatsInterval)),
+		"-admin", l.adminAddress(i),
+	}
+	if l.s.Debug {
+		args = append(args, "-debug")
+	}
+	if bootstrap != nil {
+		args = append(args, "-newnet", "-connip", bootstrap.Ip.String(), "-connport", strconv.Itoa(int(bootstrap.Port)))
+	}
+	args = append(args, c.Args...)
+
+	logFile, err := os.OpenFile(filepath.Join(l.logsDir(), fmt.Sprintf("node_%d.log", addr.Port)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o666)
+	if err != nil {
+		return fmt.Errorf("could not open log file - %s", err)
+	}
+
+	cmd := exec.Command(l.binary, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err = cmd.Start(); err != nil {
+		logFile.Close()
+		return fmt.Errorf("could not start node - %s", err)
+	}
+
+	p := &process{cmd: cmd, exited: make(chan struct{})}
+	l.mu.Lock()
+	l.procs[i] = p
+	l.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		logFile.Close()
+		close(p.exited)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		// A node that was killed has been taken out already.
+		if l.procs[i] == p {
+			delete(l.procs, i)
+			l.timeline.log("node %d exited - %v", i, err)
+		}
+	}()
+	return nil
+}
+
+func (l *processLauncher) kill(i int) error {
+	l.mu.Lock()
+	p, ok := l.procs[i]
+	delete(l.procs, i)
+	l.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("node is not running")
+	}
+	if err := p.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	// The node may be restarted right away, on the same port.
+	select {
+	case <-p.exited:
+		return nil
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("node did not exit")
+	}
+}
+
+func (l *processLauncher) leave(i int) error {
+	resp, err := l.http.Post("http://"+l.adminAddress(i)+"/actions/leave", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s - %s", resp.Status, b)
+	}
+	return nil
+}
+
+func (l *processLauncher) running(i int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.procs[i]
+	return ok
+}
+
+func (l *processLauncher) stats(i int) ([]byte, error) {
+	resp, err := l.http.Get("http://" + l.adminAddress(i) + "/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (l *processLauncher) vision(i int) (topology.Vision, error) {
+	v := topology.Vision{}
+	resp, err := l.http.Get("http://" + l.adminAddress(i) + "/topology?format=vision")
+	if err != nil {
+		return v, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return v, fmt.Errorf("%s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	return v, err
+}
+
+// inProcessLauncher runs all the nodes in this process. They all log to the same file, each with its own ID.
+// Each node has its own network, with plain TCP links, but they all share the clock and the logging setup of the process,
+// thus the extra flags of the nodes cannot be applied, and the scenario is refused when it has some.
+type inProcessLauncher struct {
+	*run
+
+	mu    sync.Mutex
+	nodes map[int]*node.Node
+	// joining has the nodes still joining, which are run by the goroutine of the join until their main loop starts.
+	joining map[*node.Node]bool
+}
+
+func newInProcessLauncher(r *run) *inProcessLauncher {
+	return &inProcessLauncher{run: r, nodes: map[int]*node.Node{}, joining: map[*node.Node]bool{}}
+}
+
+func (l *inProcessLauncher) start(i int, c NodeConfig, bootstrap *network.IpPortPair) error {
+	addr := l.address(i)
+	nd, err := node.Create(l.s.IP, addr.Port, c.ConnCap, c.QueueCap)
+	if err != nil {
+		return err
+	}
+
+	id, err := identity.LoadOrCreate(l.keyFile(i))
+	if err != nil {
+		return err
+	}
+	if err = nd.SetIdentity(id); err != nil {
+		return err
+	}
+	nd.LifeLineTimer = c.LifeLine
+	nd.DeathTimer = c.Death
+	nd.DepthVision = c.Depth
+	nd.StatsInterval = l.s.StatsInterval
+	nd.StatsSinks = []node.StatsSink{node.FileSink{Dir: l.statsDir(), Port: addr.Port}}
+
+	l.mu.Lock()
+	l.nodes[i] = nd
+	l.joining[nd] = bootstrap != nil
+	l.mu.Unlock()
+
+	// The join takes a few seconds, thus it does not hold up the other events. A node killed meanwhile stops once it joined.
+	go func() {
+		if bootstrap != nil {
+			err := nd.Join(*bootstrap, nil)
+			l.mu.Lock()
+			delete(l.joining, nd)
+			l.mu.Unlock()
+			if err != nil {
+				l.timeline.log("node %d could not join - %s", i, err)
+				l.forget(i, nd)
+				return
+			}
+		}
+		if err := nd.MainLoop(); err != nil {
+			l.timeline.log("node %d stopped - %s", i, err)
+		}
+		l.forget(i, nd)
+	}()
+	return nil
+}
+
+// forget takes node i out, unless it has been replaced since.
+func (l *inProcessLauncher) forget(i int, nd *node.Node) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.nodes[i] == nd {
+		delete(l.nodes, i)
+	}
+}
+
+func (l *inProcessLauncher) take(i int) (*node.Node, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nd, ok := l.nodes[i]
+	if !ok {
+		return nil, fmt.Errorf("node is not running")
+	}
+	delete(l.nodes, i)
+	return nd, nil
+}
+
+func (l *inProcessLauncher) kill(i int) error {
+	nd, err := l.take(i)
+	if err != nil {
+		return err
+	}
+	return nd.Stop()
+}
+
+// leave makes node i leave the network. A node still joining has nobody to tell yet, thus it is only stopped.
+func (l *inProcessLauncher) leave(i int) error {
+	nd, err := l.take(i)
+	if err != nil {
+		return err
+	}
+	if l.isJoining(nd) {
+		return nd.Stop()
+	}
+	nd.Do(func() { err = nd.Leave() })
+	return err
+}
+
+func (l *inProcessLauncher) isJoining(nd *node.Node) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.joining[nd]
+}
+
+func (l *inProcessLauncher) running(i int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.nodes[i]
+	return ok
+}
+
+func (l *inProcessLauncher) stats(i int) ([]byte, error) {
+	l.mu.Lock()
+	nd, ok := l.nodes[i]
+	l.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("node is not running")
+	}
+	stats := nd.Stats()
+	return json.MarshalIndent(&stats, "", "\t")
+}
+
+func (l *inProcessLauncher) vision(i int) (topology.Vision, error) {
+	l.mu.Lock()
+	nd, ok := l.nodes[i]
+	l.mu.Unlock()
+	if !ok {
+		return topology.Vision{}, fmt.Errorf("node is not running")
+	}
+	if l.isJoining(nd) {
+		return topology.Vision{}, fmt.Errorf("node is still joining")
+	}
+	return nd.Vision(), nil
+}
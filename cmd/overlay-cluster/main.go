@@ -0,0 +1,328 @@
+// overlay-cluster launches a cluster of nodes from a scenario file, either as overlay processes or all in this process.
+// The scenario sets how many nodes are launched, how far apart they join, how each of them is configured, and when they are killed,
+// leave or are restarted. Everything a run leaves behind goes in its own results directory:
+//
+//	scenario.json  the scenario, with the defaults filled in
+//	events.log     what happened to the nodes, and when
+//	logs/          the logs of the nodes, one file per node, or cluster.log for all of them in the inprocess mode
+//	stats/         the stats of the nodes, as they were when the run ended
+//	keys/          the key files of the nodes, thus a restarted node keeps its ID
+//	summary.json   the ID of each node, and how it ended
+//	check.json     the inconsistencies between the visions of the nodes running when the run ended, see topology.Check
+//
+// Without a scenario file, 20 nodes join 7 seconds apart, run as processes, and are stopped about a minute after the last one joined.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+	"github.com/TheJ0lly/Overlay-Network/internal/topology"
+)
+
+const portMax = (1 << 16) - 1
+
+var logger = logging.Component("cluster")
+
+// timeline writes what happens during the run, with the time since its start, to stdout and to events.log.
+type timeline struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+}
+
+func (t *timeline) log(format string, args ...any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "%7.1fs  %s\n", time.Since(t.start).Seconds(), fmt.Sprintf(format, args...))
+}
+
+// nodeSummary is how a node ended.
+type nodeSummary struct {
+	Node    int             `json:"Node"`
+	Port    uint16          `json:"Port"`
+	ID      identity.NodeID `json:"ID,omitempty"`
+	Running bool            `json:"Running"`
+	Starts  int             `json:"Starts"`
+	Kills   int             `json:"Kills"`
+	Config  NodeConfig      `json:"Config"`
+}
+
+// buildBinary builds the overlay binary from the current directory, into the results directory.
+func buildBinary(dir string) (string, error) {
+	binary, err := filepath.Abs(filepath.Join(dir, "overlay"))
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("could not build the overlay binary - %s: %s", err, out)
+	}
+	return binary, nil
+}
+
+func writeJSON(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o666)
+}
+
+// bootstrapOf returns the node that node i joins through, or nil when it is the only node that runs.
+func bootstrapOf(r *run, l launcher, c NodeConfig) *network.IpPortPair {
+	via := 0
+	if c.JoinVia != nil {
+		via = *c.JoinVia
+	}
+	if via != c.Node && l.running(via) {
+		addr := r.address(via)
+		return &addr
+	}
+	for j := range r.s.Nodes {
+		if j != c.Node && l.running(j) {
+			addr := r.address(j)
+			return &addr
+		}
+	}
+	return nil
+}
+
+// checkVisions writes the inconsistencies between the visions to check.json, and counts them by kind in the timeline.
+// A node whose vision could not be collected is taken as gone, thus it may show up as a ghost.
+func checkVisions(r *run, visions []topology.Vision) {
+	incs := topology.Check(visions)
+	if incs == nil {
+		incs = []topology.Inconsistency{}
+	}
+	if err := writeJSON(filepath.Join(r.dir, "check.json"), incs); err != nil {
+		logger.Error("could not write check - %s", err)
+	}
+
+	if len(incs) == 0 {
+		r.timeline.log("the visions of the %d nodes running are consistent", len(visions))
+		return
+	}
+	kinds := map[string]int{}
+	for _, inc := range incs {
+		kinds[inc.Kind]++
+	}
+	r.timeline.log("found %d inconsistencies between the visions of the %d nodes running: %v", len(incs), len(visions), kinds)
+}
+
+func main() {
+	resultsDir := flag.String("results", "./results", "the directory the results directory of the run is created in")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: overlay-cluster [-results dir] [scenario.json]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logging.Setup(logging.Config{Writer: os.Stderr, Level: slog.LevelInfo})
+
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	s, err := loadScenario(flag.Arg(0))
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+	if s.Name == "" {
+		s.Name = "cluster"
+		if flag.NArg() == 1 {
+			s.Name = strings.TrimSuffix(filepath.Base(flag.Arg(0)), filepath.Ext(flag.Arg(0)))
+		}
+	}
+
+	dir := filepath.Join(*resultsDir, fmt.Sprintf("%s-%s", s.Name, time.Now().Format("20060102-150405")))
+	for _, sub := range []string{"logs", "stats", "keys"} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			logger.ErrorWithExit("could not create results directory - %s", err)
+		}
+	}
+	if err = writeJSON(filepath.Join(dir, "scenario.json"), &s); err != nil {
+		logger.ErrorWithExit("could not write scenario - %s", err)
+	}
+
+	events, err := os.Create(filepath.Join(dir, "events.log"))
+	if err != nil {
+		logger.ErrorWithExit("could not create events log - %s", err)
+	}
+	defer events.Close()
+
+	r := &run{s: &s, dir: dir, timeline: &timeline{w: io.MultiWriter(os.Stdout, events)}}
+
+	var l launcher
+	switch s.Mode {
+	case modeProcess:
+		binary := s.Binary
+		if binary == "" {
+			logger.Info("building the overlay binary")
+			if binary, err = buildBinary(dir); err != nil {
+				logger.ErrorWithExit("%s", err)
+			}
+		}
+		l = newProcessLauncher(r, binary)
+	case modeInProcess:
+		logFile, err := os.Create(filepath.Join(dir, "logs", "cluster.log"))
+		if err != nil {
+			logger.ErrorWithExit("could not create log file - %s", err)
+		}
+		defer logFile.Close()
+
+		level := slog.LevelInfo
+		if s.Debug {
+			level = slog.LevelDebug
+		}
+		// All the nodes log through the same loggers, thus they all log to the same file.
+		logging.Setup(logging.Config{Writer: logFile, Level: level})
+		l = newInProcessLauncher(r)
+	}
+
+	// The random timers are picked once, thus a restarted node keeps them.
+	rng := rand.New(rand.NewPCG(s.Seed, s.Seed))
+	if s.Seed == 0 {
+		rng = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+	summaries := make([]nodeSummary, s.Nodes)
+	for i := range summaries {
+		summaries[i] = nodeSummary{Node: i, Port: r.address(i).Port, Config: s.configOf(i, rng)}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("results of the run in %s\n", dir)
+	r.timeline.start = time.Now()
+
+	startNode := func(i int) {
+		c := summaries[i].Config
+		bootstrap := bootstrapOf(r, l, c)
+		if err := l.start(i, c, bootstrap); err != nil {
+			r.timeline.log("could not start node %d - %s", i, err)
+			return
+		}
+		summaries[i].Starts++
+		if bootstrap == nil {
+			r.timeline.log("started node %d on port %d, lifeline=%d death=%d depth=%d, in a new network", i, summaries[i].Port, c.LifeLine, c.Death, c.Depth)
+		} else {
+			r.timeline.log("started node %d on port %d, lifeline=%d death=%d depth=%d, joining through %s", i, summaries[i].Port, c.LifeLine, c.Death, c.Depth, bootstrap.NetString())
+		}
+	}
+
+	end := r.timeline.start.Add(time.Duration(s.Duration * float64(time.Second)))
+	for _, e := range s.schedule() {
+		at := r.timeline.start.Add(time.Duration(e.At * float64(time.Second)))
+		if at.After(end) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(at)):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		switch e.Action {
+		case actionStart:
+			startNode(e.Node)
+		case actionKill:
+			if err := l.kill(e.Node); err != nil {
+				r.timeline.log("could not kill node %d - %s", e.Node, err)
+				continue
+			}
+			summaries[e.Node].Kills++
+			r.timeline.log("killed node %d", e.Node)
+		case actionLeave:
+			if err := l.leave(e.Node); err != nil {
+				r.timeline.log("could not make node %d leave - %s", e.Node, err)
+				continue
+			}
+			r.timeline.log("node %d left the network", e.Node)
+		case actionRestart:
+			if l.running(e.Node) {
+				if err := l.kill(e.Node); err != nil {
+					r.timeline.log("could not kill node %d to restart it - %s", e.Node, err)
+					continue
+				}
+				summaries[e.Node].Kills++
+				r.timeline.log("killed node %d to restart it", e.Node)
+			}
+			startNode(e.Node)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		r.timeline.log("interrupted - ending the run")
+	case <-time.After(time.Until(end)):
+		r.timeline.log("ending the run")
+	}
+
+	// The stats and visions are collected from all the nodes before any of them is stopped, thus none of them sees the others die.
+	var visions []topology.Vision
+	for i := range summaries {
+		if !l.running(i) {
+			continue
+		}
+		summaries[i].Running = true
+		b, err := l.stats(i)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(r.statsDir(), fmt.Sprintf("Stats_Node_%d.json", summaries[i].Port)), b, 0o666)
+		}
+		if err != nil {
+			r.timeline.log("could not collect the stats of node %d - %s", i, err)
+		}
+
+		v, err := l.vision(i)
+		if err != nil {
+			r.timeline.log("could not collect the vision of node %d - %s", i, err)
+			continue
+		}
+		visions = append(visions, v)
+	}
+	checkVisions(r, visions)
+	for i := range summaries {
+		if summaries[i].Running {
+			if err := l.kill(i); err != nil {
+				r.timeline.log("could not stop node %d - %s", i, err)
+			}
+		}
+		// A node that never ran has no key file.
+		if _, err := os.Stat(r.keyFile(i)); err == nil {
+			if id, err := identity.LoadOrCreate(r.keyFile(i)); err == nil {
+				summaries[i].ID = id.ID()
+			}
+		}
+	}
+
+	if err = writeJSON(filepath.Join(dir, "summary.json"), summaries); err != nil {
+		logger.Error("could not write summary - %s", err)
+	}
+
+	t := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "NODE\tPORT\tID\tRUNNING\tSTARTS\tKILLS")
+	for _, ns := range summaries {
+		fmt.Fprintf(t, "%d\t%d\t%s\t%v\t%d\t%d\n", ns.Node, ns.Port, ns.ID.Short(), ns.Running, ns.Starts, ns.Kills)
+	}
+	t.Flush()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/node"
+)
+
+// The modes the nodes can be launched in.
+const (
+	modeProcess   = "process"
+	modeInProcess = "inprocess"
+)
+
+// The actions of the events.
+const (
+	actionStart   = "start"
+	actionKill    = "kill"
+	actionLeave   = "leave"
+	actionRestart = "restart"
+)
+
+// NodeConfig is how a node is run. In Overrides, Node is the index of the node the values are for, and only the values that are set are used.
+type NodeConfig struct {
+	Node     int    `json:"Node,omitempty"`
+	ConnCap  uint8  `json:"ConnCap,omitempty"`
+	QueueCap uint16 `json:"QueueCap,omitempty"`
+	LifeLine uint8  `json:"LifeLine,omitempty"`
+	Death    uint8  `json:"Death,omitempty"`
+	Depth    uint8  `json:"Depth,omitempty"`
+	// JoinVia is the index of the node the join query is sent to. When it is not running, the first running node is used.
+	JoinVia *int `json:"JoinVia,omitempty"`
+	// Args are extra flags for the node, in the process mode only.
+	Args []string `json:"Args,omitempty"`
+}
+
+func (c NodeConfig) merge(o NodeConfig) NodeConfig {
+	if o.ConnCap != 0 {
+		c.ConnCap = o.ConnCap
+	}
+	if o.QueueCap != 0 {
+		c.QueueCap = o.QueueCap
+	}
+	if o.LifeLine != 0 {
+		c.LifeLine = o.LifeLine
+	}
+	if o.Death != 0 {
+		c.Death = o.Death
+	}
+	if o.Depth != 0 {
+		c.Depth = o.Depth
+	}
+	if o.JoinVia != nil {
+		c.JoinVia = o.JoinVia
+	}
+	c.Args = append(slices.Clone(c.Args), o.Args...)
+	return c
+}
+
+// TimerRange makes each node pick its lifeline and death timers at random, between Min and Max seconds.
+type TimerRange struct {
+	Min uint8 `json:"Min"`
+	Max uint8 `json:"Max"`
+}
+
+// Event is something done to a node At seconds after the start of the run.
+type Event struct {
+	At     float64 `json:"At"`
+	Action string  `json:"Action"`
+	Node   int     `json:"Node"`
+}
+
+// Scenario is what a run does: how many nodes are launched, how they are paced and configured, and what happens to them.
+// Node i is started i*JoinInterval seconds after the start of the run, and the run ends Duration seconds after its start.
+type Scenario struct {
+	Name string `json:"Name,omitempty"`
+	Mode string `json:"Mode"`
+	// Binary is the overlay binary run in the process mode. When missing, it is built from the current directory.
+	Binary        string  `json:"Binary,omitempty"`
+	IP            string  `json:"IP"`
+	BasePort      uint16  `json:"BasePort"`
+	AdminOffset   uint16  `json:"AdminOffset"`
+	Nodes         int     `json:"Nodes"`
+	JoinInterval  float64 `json:"JoinInterval"`
+	Duration      float64 `json:"Duration"`
+	StatsInterval uint8   `json:"StatsInterval"`
+	Debug         bool    `json:"Debug,omitempty"`
+
+	Defaults     NodeConfig   `json:"Defaults"`
+	Overrides    []NodeConfig `json:"Overrides,omitempty"`
+	RandomTimers *TimerRange  `json:"RandomTimers,omitempty"`
+	Seed         uint64       `json:"Seed,omitempty"`
+	Events       []Event      `json:"Events,omitempty"`
+}
+
+// defaultScenario starts 20 processes 7 seconds apart, and lets them run for about a minute once the last one joined.
+func defaultScenario() Scenario {
+	return Scenario{
+		Mode:          modeProcess,
+		IP:            "127.0.0.1",
+		BasePort:      9000,
+		AdminOffset:   1000,
+		Nodes:         20,
+		JoinInterval:  7,
+		Duration:      200,
+		StatsInterval: node.DefaultStatsInterval,
+		Defaults:      NodeConfig{ConnCap: 3, QueueCap: 1000, LifeLine: 2, Death: 4, Depth: 3},
+	}
+}
+
+// loadScenario reads the scenario file, on top of the default scenario.
+func loadScenario(path string) (Scenario, error) {
+	s := defaultScenario()
+	if path == "" {
+		return s, s.validate()
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	if err = json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("could not parse scenario %s - %s", path, err)
+	}
+	return s, s.validate()
+}
+
+func (s *Scenario) validate() error {
+	if s.Mode != modeProcess && s.Mode != modeInProcess {
+		return fmt.Errorf("mode must be %q or %q, got %q", modeProcess, modeInProcess, s.Mode)
+	}
+	if s.Nodes <= 0 {
+		return fmt.Errorf("nodes is %d - must be greater than 0", s.Nodes)
+	}
+	if int(s.BasePort)+s.Nodes > portMax || (s.Mode == modeProcess && int(s.BasePort)+int(s.AdminOffset)+s.Nodes > portMax) {
+		return fmt.Errorf("the ports of the nodes go over %d", portMax)
+	}
+	if s.Mode == modeProcess && s.AdminOffset < uint16(s.Nodes) {
+		return fmt.Errorf("admin offset must be at least the number of nodes, such that the admin ports do not clash with the nodes")
+	}
+	if s.JoinInterval < 0 || s.Duration <= 0 {
+		return fmt.Errorf("join interval must not be negative, and duration must be greater than 0")
+	}
+	if s.StatsInterval == 0 {
+		return fmt.Errorf("stats interval is 0 - must be greater than 0")
+	}
+	if s.RandomTimers != nil && (s.RandomTimers.Min == 0 || s.RandomTimers.Min > s.RandomTimers.Max) {
+		return fmt.Errorf("random timers must be between a minimum greater than 0 and a maximum")
+	}
+
+	for _, o := range s.Overrides {
+		if o.Node < 0 || o.Node >= s.Nodes {
+			return fmt.Errorf("override for node %d, but there are %d nodes", o.Node, s.Nodes)
+		}
+	}
+	for i := range s.Nodes {
+		c := s.configOf(i, nil)
+		if s.Mode == modeInProcess && len(c.Args) != 0 {
+			return fmt.Errorf("node %d: extra flags %v are only used in the %q mode", i, c.Args, modeProcess)
+		}
+		if c.ConnCap == 0 || c.QueueCap == 0 || c.LifeLine == 0 || c.Death == 0 {
+			return fmt.Errorf("node %d: conns capacity, queue capacity, lifeline and death must be greater than 0", i)
+		}
+		if c.Depth < 2 {
+			return fmt.Errorf("node %d: depth vision must be at least 2", i)
+		}
+		if c.JoinVia != nil && (*c.JoinVia < 0 || *c.JoinVia >= s.Nodes) {
+			return fmt.Errorf("node %d joins via node %d, but there are %d nodes", i, *c.JoinVia, s.Nodes)
+		}
+	}
+
+	for _, e := range s.Events {
+		if e.Node < 0 || e.Node >= s.Nodes {
+			return fmt.Errorf("event at %vs for node %d, but there are %d nodes", e.At, e.Node, s.Nodes)
+		}
+		if e.Action != actionKill && e.Action != actionLeave && e.Action != actionRestart {
+			return fmt.Errorf("event at %vs: action must be %q, %q or %q, got %q", e.At, actionKill, actionLeave, actionRestart, e.Action)
+		}
+	}
+	return nil
+}
+
+// configOf returns the configuration of node i. The random timers are picked with rng, when it is not nil.
+func (s *Scenario) configOf(i int, rng *rand.Rand) NodeConfig {
+	c := s.Defaults
+	for _, o := range s.Overrides {
+		if o.Node == i {
+			c = c.merge(o)
+		}
+	}
+	if s.RandomTimers != nil && rng != nil {
+		c.LifeLine = s.RandomTimers.Min + uint8(rng.IntN(int(s.RandomTimers.Max-s.RandomTimers.Min)+1))
+		c.Death = s.RandomTimers.Min + uint8(rng.IntN(int(s.RandomTimers.Max-s.RandomTimers.Min)+1))
+	}
+	c.Node = i
+	return c
+}
+
+// schedule returns the starts of the nodes and the events of the scenario, in the order they happen.
+func (s *Scenario) schedule() []Event {
+	events := make([]Event, 0, s.Nodes+len(s.Events))
+	for i := range s.Nodes {
+		events = append(events, Event{At: float64(i) * s.JoinInterval, Action: actionStart, Node: i})
+	}
+	events = append(events, s.Events...)
+	slices.SortStableFunc(events, func(a, b Event) int {
+		switch {
+		case a.At < b.At:
+			return -1
+		case a.At > b.At:
+			return 1
+		}
+		return 0
+	})
+	return events
+}
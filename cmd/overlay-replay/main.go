@@ -0,0 +1,235 @@
+// overlay-replay feeds the envelopes of a capture, the one written by a node started with the "capture" flag, back into a fresh node,
+// in the original order and timing. The node starts from the state it was in once it joined, or when the capture started when it did not join,
+// and nothing it sends leaves the process. The clock of the node is the time each envelope was captured at, such that it judges the liveness
+// of its vision as the captured node did.
+// Only the received envelopes are replayed: the periodical messages, lifelines and death checks, are not.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/capture"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/node"
+)
+
+var logger = logging.Component("replay")
+
+// replayClock is the clock of the replayed node. It is set to the time each envelope was captured at, and what the node does
+// in the background is counted, such that the replay can wait for it before it is done.
+type replayClock struct {
+	mu  sync.Mutex
+	now time.Time
+	wg  sync.WaitGroup
+}
+
+func (c *replayClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep moves the clock forward, the node does not have to actually wait.
+func (c *replayClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *replayClock) Go(f func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+}
+
+// set moves the clock to the time of a record, which cannot be earlier than where a Sleep moved it to.
+func (c *replayClock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// sentLog is what the replayed node records what it sends to, from the goroutines it sends from.
+type sentLog struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (o *sentLog) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.b.Write(p)
+}
+
+func (o *sentLog) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.b.String()
+}
+
+func readCapture(path string) []capture.Record {
+	f, err := os.Open(path)
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+	defer f.Close()
+
+	recs, err := capture.Read(f)
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+	return recs
+}
+
+// countSent counts the envelopes sent in the records, by message type.
+func countSent(recs []capture.Record) map[string]int {
+	counts := map[string]int{}
+	for _, rec := range recs {
+		env := message.MessageEnvelope{}
+		if rec.Direction == capture.Out && json.Unmarshal(rec.Data, &env) == nil {
+			counts[env.Type.String()]++
+		}
+	}
+	return counts
+}
+
+func main() {
+	speed := flag.Float64("speed", 1, "how fast the capture is replayed - 2 is twice as fast as it was captured, 0 is as fast as possible")
+	keyFile := flag.String("keyfile", "", "the key file of the captured node, needed to open the payloads sealed for it")
+	output := flag.String("o", "", "the file to record what the replayed node sends to, in the capture format")
+	debug := flag.Bool("debug", false, "log each replayed envelope, and how the node handles it")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: overlay-replay [-speed x] [-keyfile file] [-o file] capture")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	level := slog.LevelInfo
+	if *debug {
+		level = slog.LevelDebug
+	}
+	logging.Setup(logging.Config{Writer: os.Stderr, Level: level})
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *speed < 0 {
+		logger.ErrorWithExit("speed must not be negative")
+	}
+
+	recs := readCapture(flag.Arg(0))
+	start := slices.IndexFunc(recs, func(rec capture.Record) bool { return rec.Direction == capture.Joined })
+	if start == -1 {
+		start = slices.IndexFunc(recs, func(rec capture.Record) bool { return rec.Direction == capture.Start })
+	}
+	if start == -1 {
+		logger.ErrorWithExit("the capture has no start record - the node did not get to run")
+	}
+
+	// The clock is set before the node is created, since the node takes its start time from it.
+	clk := &replayClock{now: time.UnixMicro(recs[start].Time)}
+	node.SetClock(clk)
+
+	snapshot := node.Snapshot{}
+	if err := json.Unmarshal(recs[start].Data, &snapshot); err != nil {
+		logger.ErrorWithExit("could not read the state of the node - %s", err)
+	}
+	nd, err := node.FromSnapshot(snapshot)
+	if err != nil {
+		logger.ErrorWithExit("could not create the node - %s", err)
+	}
+
+	if *keyFile != "" {
+		if _, err = os.Stat(*keyFile); err != nil {
+			logger.ErrorWithExit("cannot use key file - %s", err)
+		}
+		id, err := identity.LoadOrCreate(*keyFile)
+		if err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
+		if id.ID() != nd.ID {
+			logger.ErrorWithExit("key file belongs to node %s, not to the captured node %s", id.ID().Short(), nd.ID.Short())
+		}
+		if err = nd.SetIdentity(id); err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
+	}
+
+	// Nothing the node sends leaves the process, it is only recorded.
+	replayed := &sentLog{}
+	recorder := capture.NewRecorder(replayed)
+	nd.Net.Transport = capture.Transport{Recorder: recorder}
+
+	logger.Info("replaying the capture of node %s, starting with %d primary connections", nd.ID.Short(), len(nd.Conns))
+
+	var last int64
+	handled := 0
+	for _, rec := range recs[start+1:] {
+		if rec.Direction != capture.In {
+			continue
+		}
+		if last != 0 && *speed > 0 {
+			time.Sleep(time.Duration(float64(rec.Time-last)/(*speed)) * time.Microsecond)
+		}
+		last = rec.Time
+		clk.set(time.UnixMicro(rec.Time))
+
+		env := message.MessageEnvelope{}
+		if err = json.Unmarshal(rec.Data, &env); err != nil {
+			logger.Error("skipping record from %s - %s", rec.Peer, err)
+			continue
+		}
+		logger.Debug("replaying %s from %s", env.Type, env.Sender)
+		if err = nd.HandleEnvelope(&env); err != nil {
+			logger.Error("%s from %s: %s", env.Type, env.Sender, err)
+		}
+		handled++
+	}
+	// The node sends some messages in the background, e.g. the pongs and the updates.
+	clk.wg.Wait()
+
+	if *output != "" {
+		if err = os.WriteFile(*output, []byte(replayed.String()), 0o644); err != nil {
+			logger.ErrorWithExit("could not write what the node sent - %s", err)
+		}
+	}
+
+	newRecs, err := capture.Read(strings.NewReader(replayed.String()))
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+	// The replayed node only sends because of what it received, thus it is compared with what the captured node sent from the same state on.
+	captured, sent := countSent(recs[start:]), countSent(newRecs)
+
+	logger.Info("replayed %d envelopes, the node ends with %d primary connections", handled, len(nd.Conns))
+
+	types := slices.Sorted(maps.Keys(captured))
+	for mt := range sent {
+		if _, ok := captured[mt]; !ok {
+			types = append(types, mt)
+		}
+	}
+	t := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "SENT\tCAPTURED\tREPLAYED")
+	for _, mt := range types {
+		fmt.Fprintf(t, "%s\t%d\t%d\n", mt, captured[mt], sent[mt])
+	}
+	t.Flush()
+}
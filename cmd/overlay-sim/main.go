@@ -0,0 +1,181 @@
+// overlay-sim runs the node protocol on a simulated network, with simulated time, thus a network of thousands of nodes can be run in seconds.
+// The nodes join one after the other, and then come and go with the churn model, while the messages go through the latency and loss models.
+// It reports how long the joins take to converge, how many of the deaths announced are false, how much each node sends, and when the network splits.
+//
+// The simulation is set with a config file, the JSON form of sim.Config, and the flags set on top of it.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/sim"
+)
+
+var logger = logging.Component("sim")
+
+func loadConfig(path string) sim.Config {
+	cfg := sim.DefaultConfig()
+	if path == "" {
+		return cfg
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		logger.ErrorWithExit("could not parse config %s - %s", path, err)
+	}
+	return cfg
+}
+
+func printReport(r *sim.Report) {
+	t := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(t, "simulated\t%v in %v\n", r.SimulatedTime, r.WallTime.Round(time.Millisecond))
+	fmt.Fprintf(t, "nodes up\t%d, %d starts, %d kills, %d leaves\n", r.NodesUp, r.Starts, r.Kills, r.Leaves)
+	fmt.Fprintf(t, "joins\t%d, %d failed\n", r.Joins, r.FailedJoins)
+	fmt.Fprintf(t, "convergence\t%d joins, mean %v, p50 %v, p95 %v, max %v, %d never\n",
+		r.Convergence.Count, r.Convergence.Mean.Round(time.Millisecond), r.Convergence.P50.Round(time.Millisecond),
+		r.Convergence.P95.Round(time.Millisecond), r.Convergence.Max.Round(time.Millisecond), r.NotConverged)
+	fmt.Fprintf(t, "deaths\t%d, %d false (%.1f%%)\n", r.Deaths, r.FalseDeaths, 100*r.FalseDeathRate)
+	fmt.Fprintf(t, "messages\t%d, %d bytes, %d lost, %d send errors\n", r.Messages, r.Bytes, r.MessagesLost, r.SendErrors)
+	fmt.Fprintf(t, "per node\t%.1f messages/s, %.0f bytes/s\n", r.MessagesPerNodeSecond, r.BytesPerNodeSecond)
+	for _, mt := range slices.Sorted(maps.Keys(r.MessagesByType)) {
+		fmt.Fprintf(t, "  %s\t%d\n", mt, r.MessagesByType[mt])
+	}
+	fmt.Fprintf(t, "dropped\t%d duplicates, %d rate limited, %d queue full\n", r.DuplicatesDropped, r.RateLimitDrops, r.QueueDrops)
+	fmt.Fprintf(t, "dead hops\t%d\n", r.DeadHopAttempts)
+	// The partition events are all in the JSON report, thus only the worst one is printed.
+	worst := sim.PartitionEvent{Partitions: 1}
+	for _, e := range r.PartitionEvents {
+		if e.Partitions > worst.Partitions {
+			worst = e
+		}
+	}
+	fmt.Fprintf(t, "partitions\t%d at the end, %d changes\n", len(r.Topology.Partitions), len(r.PartitionEvents))
+	if worst.Partitions > 1 {
+		fmt.Fprintf(t, "  worst\t%d partitions at %v, the biggest of %d nodes\n", worst.Partitions, worst.At.Round(time.Millisecond), worst.Biggest)
+	}
+	fmt.Fprintf(t, "diameter\t%d\n", r.Topology.Diameter)
+	kinds := map[string]int{}
+	for _, inc := range r.Inconsistencies {
+		kinds[inc.Kind]++
+	}
+	fmt.Fprintf(t, "inconsistencies\t%d\n", len(r.Inconsistencies))
+	for _, k := range slices.Sorted(maps.Keys(kinds)) {
+		fmt.Fprintf(t, "  %s\t%d\n", k, kinds[k])
+	}
+	t.Flush()
+}
+
+func main() {
+	def := sim.DefaultConfig()
+	configFile := flag.String("config", "", "the JSON file of the simulation config, whose missing values are the defaults")
+	nodes := flag.Int("nodes", def.Nodes, "the number of nodes")
+	duration := flag.Duration("duration", def.Duration, "the simulated time")
+	joinInterval := flag.Duration("joininterval", def.JoinInterval, "the simulated time between the starts of two nodes")
+	seed := flag.Uint64("seed", def.Seed, "the seed of the random choices of the simulation")
+	connsCap := flag.Uint("conncap", uint(def.ConnCap), "the primary connections capacity of the nodes")
+	lifeline := flag.Uint("lifeline", uint(def.LifeLine), "the lifeline timer of the nodes, in seconds")
+	death := flag.Uint("death", uint(def.Death), "the death timer of the nodes, in seconds")
+	depth := flag.Uint("depth", uint(def.Depth), "the depth vision of the nodes")
+	aggregate := flag.Bool("aggregate", def.AggregateLifeLines, "make the nodes send lifeline digests to their neighbours instead of flooding their lifelines")
+	latencyMin := flag.Duration("latencymin", def.Latency.Min, "the smallest delay of a link")
+	latencyMax := flag.Duration("latencymax", def.Latency.Max, "the greatest delay of a link")
+	jitter := flag.Duration("jitter", def.Latency.Jitter, "the greatest delay added to each message")
+	loss := flag.Float64("loss", def.Loss.Rate, "the share of messages lost")
+	uptime := flag.Duration("uptime", def.Churn.MeanUptime, "the mean time a node stays up once it joined - 0 turns the churn off")
+	downtime := flag.Duration("downtime", def.Churn.MeanDowntime, "the mean time a node stays down before it starts again")
+	leaveRatio := flag.Float64("leaveratio", def.Churn.LeaveRatio, "the share of the nodes going down that leave the network, instead of being killed")
+	output := flag.String("o", "", "the file to write the report to, as JSON")
+	logFile := flag.String("log", "", "the file the nodes log to - by default they do not log")
+	debug := flag.Bool("debug", false, "log at the debug level")
+	flag.Parse()
+
+	logging.Setup(logging.Config{Writer: os.Stderr, Level: slog.LevelInfo})
+
+	cfg := loadConfig(*configFile)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "nodes":
+			cfg.Nodes = *nodes
+		case "duration":
+			cfg.Duration = *duration
+		case "joininterval":
+			cfg.JoinInterval = *joinInterval
+		case "seed":
+			cfg.Seed = *seed
+		case "conncap":
+			cfg.ConnCap = uint8(*connsCap)
+		case "lifeline":
+			cfg.LifeLine = uint8(*lifeline)
+		case "death":
+			cfg.Death = uint8(*death)
+		case "depth":
+			cfg.Depth = uint8(*depth)
+		case "aggregate":
+			cfg.AggregateLifeLines = *aggregate
+		case "latencymin":
+			cfg.Latency.Min = *latencyMin
+		case "latencymax":
+			cfg.Latency.Max = *latencyMax
+		case "jitter":
+			cfg.Latency.Jitter = *jitter
+		case "loss":
+			cfg.Loss.Rate = *loss
+		case "uptime":
+			cfg.Churn.MeanUptime = *uptime
+		case "downtime":
+			cfg.Churn.MeanDowntime = *downtime
+		case "leaveratio":
+			cfg.Churn.LeaveRatio = *leaveRatio
+		}
+	})
+	if *connsCap > 255 || *lifeline > 255 || *death > 255 || *depth > 255 {
+		logger.ErrorWithExit("conns capacity, lifeline, death and depth must be at most 255")
+	}
+
+	s, err := sim.New(cfg)
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+
+	// Without a log file, the level is above all the others, thus the messages of the nodes are not even built.
+	var w io.Writer = io.Discard
+	level := slog.LevelError + 1
+	if *logFile != "" {
+		f, err := os.Create(*logFile)
+		if err != nil {
+			logger.ErrorWithExit("could not create log file - %s", err)
+		}
+		defer f.Close()
+		w = f
+		level = slog.LevelInfo
+		if *debug {
+			level = slog.LevelDebug
+		}
+	}
+	logging.Setup(logging.Config{Writer: w, Level: level})
+
+	r := s.Run()
+	printReport(r)
+
+	if *output != "" {
+		b, err := json.MarshalIndent(r, "", "\t")
+		if err == nil {
+			err = os.WriteFile(*output, b, 0o666)
+		}
+		if err != nil {
+			logger.ErrorWithExit("could not write report - %s", err)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+// overlayctl talks to the admin API of a node running on this machine, the one started with the "admin" flag.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/fault"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/node"
+)
+
+const defaultAdminAddress = "127.0.0.1:9500"
+
+var logger = logging.Component("overlayctl")
+
+const usage = `usage: overlayctl [-admin address] [-json] <command> [arguments]
+
+commands:
+  status                       the configuration of the node and its queue
+  peers                        the primary connections of the node, with their liveness
+  topology [-format f]         the vision of the node, as a tree, a graph (JSON), in Graphviz DOT, or as a graph with the settings of the node
+  crawl [-timeout s] [-format f]
+                               crawl the whole network from the node, and report its shape, or print its graph (JSON) or Graphviz DOT
+  stats                        the stats of the node
+  send [-onion] <dest> <data>  send data, or stdin when data is "-", sealed for the node whose ID starts with dest
+  leave                        make the node leave the network and stop
+  loglevel [-component c] [l]  show the log levels, or change them to l
+  lifeline                     make the node send a lifeline now
+  deathcheck                   make the node look for dead primary connections now
+  faults [set <file> | reset]  show the faults the node injects, inject the ones of the JSON file, or stdin when file is "-", or stop injecting them
+
+flags:
+`
+
+// client calls the admin API of a node.
+type client struct {
+	base    string
+	http    *http.Client
+	rawJSON bool
+}
+
+// call sends the request, and decodes the JSON answer into out, unless out is nil.
+func (c *client) call(method string, path string, query url.Values, body io.Reader, out any) []byte {
+	u := c.base + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		logger.ErrorWithExit("could not reach the admin API of the node - %s", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.ErrorWithExit("could not read the answer of the node - %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := map[string]string{}
+		if json.Unmarshal(b, &apiErr) == nil && apiErr["Error"] != "" {
+			logger.ErrorWithExit("%s", apiErr["Error"])
+		}
+		logger.ErrorWithExit("node answered with %s", resp.Status)
+	}
+
+	if out != nil {
+		if err = json.Unmarshal(b, out); err != nil {
+			logger.ErrorWithExit("could not parse the answer of the node - %s", err)
+		}
+	}
+	return b
+}
+
+// show prints the answer as it is when JSON is wanted, otherwise print prints it for humans.
+func (c *client) show(b []byte, print func()) {
+	if c.rawJSON {
+		os.Stdout.Write(b)
+		return
+	}
+	print()
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func ago(ms int64) string {
+	if ms == 0 {
+		return "never"
+	}
+	return time.Since(time.UnixMilli(ms)).Round(time.Millisecond).String() + " ago"
+}
+
+func status(c *client) {
+	config := node.NodeConfig{}
+	configJSON := c.call(http.MethodGet, "/config", nil, nil, &config)
+	q := node.QueueView{}
+	queueJSON := c.call(http.MethodGet, "/queue", nil, nil, &q)
+
+	// Both answers, as they are, in one JSON object.
+	b, err := json.Marshal(struct {
+		Config json.RawMessage
+		Queue  json.RawMessage
+	}{configJSON, queueJSON})
+	if err != nil {
+		logger.ErrorWithExit("could not encode the status of the node - %s", err)
+	}
+
+	c.show(append(b, '\n'), func() {
+		t := newTable()
+		fmt.Fprintf(t, "ID\t%s\n", config.ID)
+		fmt.Fprintf(t, "Address\t%s\n", config.Address)
+		fmt.Fprintf(t, "Incarnation\t%d\n", config.Incarnation)
+		fmt.Fprintf(t, "Uptime\t%s\n", config.Uptime)
+		fmt.Fprintf(t, "Queue\t%d/%d %v\n", q.Length, q.Capacity, q.Types)
+		fmt.Fprintf(t, "Connections\tat most %d, vision of %d layers\n", config.ConnCap, config.DepthVision)
+		fmt.Fprintf(t, "Timers\tlifeline %ds, death %ds, stats %ds\n", config.LifeLineTimer, config.DeathTimer, config.StatsInterval)
+		fmt.Fprintf(t, "Death quorum\t%d in %ds\n", config.DeathQuorum, config.DeathQuorumWindow)
+		fmt.Fprintf(t, "Lifelines\thealth=%v aggregated=%v\n", config.AdvertiseHealth, config.AggregateLifeLines)
+		fmt.Fprintf(t, "Admission\tnetwork key=%v invitation=%v\n", config.NetworkKey, config.RequireInvitation)
+		fmt.Fprintf(t, "Inbound\tat most %d connections, read in %ds\n", config.MaxInboundConns, config.ReadTimeout)
+		fmt.Fprintf(t, "Rate limit\t%.1f/s in bursts of %.0f, bans of %ds\n", config.RateLimit, config.RateBurst, config.BanDuration)
+		fmt.Fprintf(t, "Onion hops\t%d\n", config.OnionHops)
+		fmt.Fprintf(t, "Log levels\t%v\n", config.LogLevels)
+		t.Flush()
+	})
+}
+
+func peers(c *client) {
+	var views []node.NodeView
+	b := c.call(http.MethodGet, "/peers", nil, nil, &views)
+
+	c.show(b, func() {
+		t := newTable()
+		fmt.Fprintln(t, "ID\tADDRESS\tSTATE\tINCARNATION\tRTT\tJITTER\tLAST SEEN\tKEY")
+		for _, v := range views {
+			fmt.Fprintf(t, "%s\t%s\t%s\t%d\t%.2fms\t%.2fms\t%s\t%v\n", v.ID.Short(), v.Address, v.State, v.Incarnation, v.SmoothedRTT, v.RTTJitter, ago(v.LastTimeAlive), v.EncryptionKey)
+		}
+		t.Flush()
+	})
+}
+
+func printTree(v node.NodeView, prefix string, last bool, root bool) {
+	branch, next := "├── ", "│   "
+	if last {
+		branch, next = "└── ", "    "
+	}
+	if root {
+		branch, next = "", ""
+	}
+
+	fmt.Printf("%s%s%s %s [%s]\n", prefix, branch, v.ID.Short(), v.Address, v.State)
+	for i := range v.Conns {
+		printTree(v.Conns[i], prefix+next, i == len(v.Conns)-1, false)
+	}
+}
+
+func topology(c *client, args []string) {
+	fs := flag.NewFlagSet("topology", flag.ExitOnError)
+	format := fs.String("format", "tree", "how to print the vision: tree, graph (a JSON list of nodes and edges), dot (Graphviz) or vision (the graph along with the conns cap and depth vision of the node)")
+	fs.Parse(args)
+
+	switch *format {
+	case "tree":
+		view := node.NodeView{}
+		b := c.call(http.MethodGet, "/topology", nil, nil, &view)
+		c.show(b, func() { printTree(view, "", true, true) })
+	case "graph", "dot", "vision":
+		os.Stdout.Write(c.call(http.MethodGet, "/topology", url.Values{"format": {*format}}, nil, nil))
+	default:
+		logger.ErrorWithExit("unknown topology format %q - must be tree, graph, dot or vision", *format)
+	}
+}
+
+func crawl(c *client, args []string) {
+	fs := flag.NewFlagSet("crawl", flag.ExitOnError)
+	timeout := fs.Uint("timeout", node.DefaultCrawlTimeout, "how long, in seconds, the nodes at the same distance have to answer")
+	format := fs.String("format", "report", "what to print: report, graph (a JSON list of nodes and edges) or dot (Graphviz)")
+	fs.Parse(args)
+
+	if *timeout == 0 || *timeout > math.MaxUint8 {
+		logger.ErrorWithExit("the crawl timeout must be between 1 and %d seconds", math.MaxUint8)
+	}
+	// The crawl takes as many timeouts as there are steps, the node makes sure it ends.
+	c.http.Timeout = 0
+
+	query := url.Values{"timeout": {strconv.FormatUint(uint64(*timeout), 10)}}
+	switch *format {
+	case "report":
+		res := node.CrawlResult{}
+		b := c.call(http.MethodGet, "/crawl", query, nil, &res)
+		c.show(b, func() { printCrawlReport(&res) })
+	case "graph", "dot":
+		query.Set("format", *format)
+		os.Stdout.Write(c.call(http.MethodGet, "/crawl", query, nil, nil))
+	default:
+		logger.ErrorWithExit("unknown crawl format %q - must be report, graph or dot", *format)
+	}
+}
+
+func shortIDs(ids []identity.NodeID, sep string) string {
+	short := make([]string, 0, len(ids))
+	for _, id := range ids {
+		short = append(short, id.Short())
+	}
+	return strings.Join(short, sep)
+}
+
+func printCrawlReport(res *node.CrawlResult) {
+	r := res.Report
+	t := newTable()
+	fmt.Fprintf(t, "Nodes\t%d alive, %d dead\n", r.Nodes, r.DeadNodes)
+	fmt.Fprintf(t, "Links\t%d\n", r.Links)
+	fmt.Fprintf(t, "Connected\t%v, %d partitions\n", r.Connected, len(r.Partitions))
+	fmt.Fprintf(t, "Diameter\t%d hops\n", r.Diameter)
+	fmt.Fprintf(t, "Degree\tmin %d, max %d, average %.2f\n", r.MinDegree, r.MaxDegree, r.AverageDegree)
+	for _, d := range slices.Sorted(maps.Keys(r.DegreeDistribution)) {
+		fmt.Fprintf(t, "\t%d nodes of degree %d\n", r.DegreeDistribution[d], d)
+	}
+	t.Flush()
+
+	if len(r.Partitions) > 1 {
+		fmt.Println("\npartitions:")
+		for i, part := range r.Partitions {
+			fmt.Printf("  %d: %s\n", i+1, shortIDs(part, " "))
+		}
+	}
+	if len(res.Unreachable) != 0 {
+		fmt.Println("\ndid not answer:")
+		for _, ref := range res.Unreachable {
+			fmt.Printf("  %s\n", ref)
+		}
+	}
+	if res.Truncated {
+		logger.Warn("the crawl stopped before reaching the whole network - the report only covers part of it")
+	}
+	for _, inc := range res.Graph.Inconsistencies {
+		logger.Warn("%s inconsistency about %s: %s", inc.Kind, shortIDs(inc.Nodes, "-"), inc.Detail)
+	}
+}
+
+// flatten turns the JSON stats into rows, the nested objects having their keys joined with dots.
+func flatten(prefix string, v any, rows map[string]string) {
+	switch v := v.(type) {
+	case map[string]any:
+		// Histograms are only summed up.
+		if count, ok := v["Count"].(float64); ok {
+			if _, ok = v["Buckets"]; ok {
+				avg := 0.0
+				if count != 0 {
+					avg = v["Sum"].(float64) / count
+				}
+				rows[prefix] = fmt.Sprintf("count=%v avg=%.3f", count, avg)
+				return
+			}
+		}
+		for k, sub := range v {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flatten(key, sub, rows)
+		}
+	case nil:
+	default:
+		if f, ok := v.(float64); ok && f == 0 {
+			return
+		}
+		rows[prefix] = fmt.Sprint(v)
+	}
+}
+
+func stats(c *client) {
+	var s map[string]any
+	b := c.call(http.MethodGet, "/stats", nil, nil, &s)
+
+	c.show(b, func() {
+		rows := map[string]string{}
+		flatten("", s, rows)
+
+		t := newTable()
+		for _, k := range slices.Sorted(maps.Keys(rows)) {
+			fmt.Fprintf(t, "%s\t%s\n", k, rows[k])
+		}
+		t.Flush()
+	})
+}
+
+func send(c *client, args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	onion := fs.Bool("onion", false, "send the data through an onion, such that the destination does not learn who sent it")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		logger.ErrorWithExit("send needs a destination and the data to send")
+	}
+
+	var data io.Reader = strings.NewReader(fs.Arg(1))
+	if fs.Arg(1) == "-" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			logger.ErrorWithExit("could not read stdin - %s", err)
+		}
+		data = bytes.NewReader(b)
+	}
+
+	query := url.Values{"dest": {fs.Arg(0)}}
+	if *onion {
+		query.Set("onion", "true")
+	}
+
+	result := map[string]any{}
+	b := c.call(http.MethodPost, "/send", query, data, &result)
+	c.show(b, func() { fmt.Printf("sent to %v (onion=%v)\n", result["Destination"], result["Onion"]) })
+}
+
+func loglevel(c *client, args []string) {
+	fs := flag.NewFlagSet("loglevel", flag.ExitOnError)
+	component := fs.String("component", "", "the component to change the level of (node, network, main) - all of them when missing")
+	fs.Parse(args)
+
+	levels := map[string]string{}
+	var b []byte
+	if fs.NArg() == 0 {
+		b = c.call(http.MethodGet, "/loglevel", nil, nil, &levels)
+	} else {
+		query := url.Values{"level": {fs.Arg(0)}}
+		if *component != "" {
+			query.Set("component", *component)
+		}
+		b = c.call(http.MethodPost, "/loglevel", query, nil, &levels)
+	}
+
+	c.show(b, func() {
+		t := newTable()
+		for _, k := range slices.Sorted(maps.Keys(levels)) {
+			fmt.Fprintf(t, "%s\t%s\n", k, levels[k])
+		}
+		t.Flush()
+	})
+}
+
+func faults(c *client, args []string) {
+	s := fault.State{}
+	var b []byte
+	switch {
+	case len(args) == 0:
+		b = c.call(http.MethodGet, "/faults", nil, nil, &s)
+	case args[0] == "reset" && len(args) == 1:
+		b = c.call(http.MethodDelete, "/faults", nil, nil, &s)
+	case args[0] == "set" && len(args) == 2:
+		var body []byte
+		var err error
+		if args[1] == "-" {
+			body, err = io.ReadAll(os.Stdin)
+		} else {
+			body, err = os.ReadFile(args[1])
+		}
+		if err != nil {
+			logger.ErrorWithExit("could not read faults - %s", err)
+		}
+		b = c.call(http.MethodPost, "/faults", nil, bytes.NewReader(body), &s)
+	default:
+		logger.ErrorWithExit("faults takes no arguments, \"set <file>\" or \"reset\"")
+	}
+
+	c.show(b, func() {
+		t := newTable()
+		fmt.Fprintf(t, "Out\t%s\n", rulesString(s.Out))
+		fmt.Fprintf(t, "In\t%s\n", rulesString(s.In))
+		for _, name := range slices.Sorted(maps.Keys(s.Partitions)) {
+			fmt.Fprintf(t, "Group %s\t%s\n", name, strings.Join(s.Partitions[name], " "))
+		}
+		st := s.Stats
+		fmt.Fprintf(t, "Hit\t%d dropped, %d delayed, %d duplicated, %d reordered, %d corrupted, %d partitioned\n",
+			st.Dropped, st.Delayed, st.Duplicated, st.Reordered, st.Corrupted, st.Partitioned)
+		t.Flush()
+	})
+}
+
+func rulesString(r fault.Rules) string {
+	if r.Drop == 0 && r.Delay == 0 && r.Duplicate == 0 && r.Reorder == 0 && r.Corrupt == 0 {
+		return "none"
+	}
+	peers := "all peers"
+	if len(r.Peers) != 0 {
+		peers = strings.Join(r.Peers, " ")
+	}
+	return fmt.Sprintf("drop %.2f, delay %.2f by %d-%dms, duplicate %.2f, reorder %.2f, corrupt %.2f - %s",
+		r.Drop, r.Delay, r.DelayMin, r.DelayMax, r.Duplicate, r.Reorder, r.Corrupt, peers)
+}
+
+// action asks the node to do something, and prints what it answered.
+func action(c *client, path string) {
+	var result any
+	b := c.call(http.MethodPost, path, nil, nil, &result)
+	c.show(b, func() {
+		if m, ok := result.(map[string]any); ok && m["Result"] != nil {
+			fmt.Println(m["Result"])
+			return
+		}
+		os.Stdout.Write(b)
+	})
+}
+
+func main() {
+	admin := flag.String("admin", defaultAdminAddress, "the address the admin API of the node is served on")
+	rawJSON := flag.Bool("json", false, "print the answers of the node as JSON")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long to wait for the node to answer")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logging.Setup(logging.Config{Writer: os.Stderr, Level: slog.LevelInfo})
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{base: "http://" + *admin, http: &http.Client{Timeout: *timeout}, rawJSON: *rawJSON}
+	args := flag.Args()[1:]
+
+	switch flag.Arg(0) {
+	case "status":
+		status(c)
+	case "peers":
+		peers(c)
+	case "topology":
+		topology(c, args)
+	case "crawl":
+		crawl(c, args)
+	case "stats":
+		stats(c)
+	case "send":
+		send(c, args)
+	case "leave":
+		action(c, "/actions/leave")
+	case "loglevel":
+		loglevel(c, args)
+	case "lifeline":
+		action(c, "/actions/lifeline")
+	case "deathcheck":
+		action(c, "/actions/deathcheck")
+	case "faults":
+		faults(c, args)
+	default:
+		logger.ErrorWithExit("unknown command %q - run overlayctl -h for the list of commands", flag.Arg(0))
+	}
+}
@@ -0,0 +1,88 @@
+// topomerge merges the topology exports of many nodes, the ones printed by "overlayctl topology -format graph",
+// into one picture of the network, where what the nodes do not agree on is highlighted.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/topology"
+)
+
+var logger = logging.Component("topomerge")
+
+func readGraph(path string) *topology.Graph {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+
+	g := &topology.Graph{}
+	if err = json.Unmarshal(b, g); err != nil {
+		logger.ErrorWithExit("could not parse topology export %s - %s", path, err)
+	}
+	return g
+}
+
+func main() {
+	format := flag.String("format", "dot", "the format of the merged topology: dot (Graphviz) or json")
+	output := flag.String("o", "", "the file to write the merged topology to (default stdout)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: topomerge [-format dot|json] [-o file] export.json...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logging.Setup(logging.Config{Writer: os.Stderr, Level: slog.LevelInfo})
+
+	if *format != "dot" && *format != "json" {
+		logger.ErrorWithExit("format must be \"dot\" or \"json\", got %q", *format)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	graphs := make([]*topology.Graph, 0, flag.NArg())
+	for _, path := range flag.Args() {
+		graphs = append(graphs, readGraph(path))
+	}
+	merged := topology.Merge(graphs...)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var err error
+	if *format == "dot" {
+		err = merged.WriteDOT(w)
+	} else {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(merged)
+	}
+	if err != nil {
+		logger.ErrorWithExit("could not write merged topology - %s", err)
+	}
+
+	logger.Info("merged %d exports: %d nodes, %d links, %d inconsistencies", len(graphs), len(merged.Nodes), len(merged.Edges), len(merged.Inconsistencies))
+	for _, inc := range merged.Inconsistencies {
+		short := make([]string, 0, len(inc.Nodes))
+		for _, id := range inc.Nodes {
+			short = append(short, id.Short())
+		}
+		logger.Warn("%s inconsistency about %s: %s", inc.Kind, strings.Join(short, "-"), inc.Detail)
+	}
+}
@@ -0,0 +1,131 @@
+package admission
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+var ErrNotAdmitted = errors.New("joining node is not admitted in the network")
+
+// LoadNetworkKey reads the shared network secret from a file. Surrounding whitespace is ignored, so that the file can be written by hand.
+func LoadNetworkKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read network key file %s - %s", path, err)
+	}
+
+	key := []byte(strings.TrimSpace(string(b)))
+	if len(key) < 16 {
+		return nil, fmt.Errorf("network key in %s is too short - must have at least 16 characters", path)
+	}
+	return key, nil
+}
+
+// ProveNetworkKey returns the proof that the joining node knows the network key, bound to its ID and to the moment it joins.
+// The key itself never leaves the node.
+func ProveNetworkKey(key []byte, joiner identity.NodeID, timestamp int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(joiner))
+	binary.Write(mac, binary.BigEndian, timestamp)
+	return mac.Sum(nil)
+}
+
+// CheckNetworkKeyProof checks a proof made with ProveNetworkKey.
+func CheckNetworkKeyProof(key []byte, joiner identity.NodeID, timestamp int64, proof []byte) bool {
+	return hmac.Equal(ProveNetworkKey(key, joiner, timestamp), proof)
+}
+
+// Token is an invitation to join the network, issued and signed by a member of the network.
+// When Invitee is set, only the node with that ID can use it. Each node accepts a token only once,
+// and a token without Invitee is only accepted by its issuer, thus it can only be used once in the whole network.
+type Token struct {
+	Issuer    identity.NodeID `json:"Issuer"`
+	IssuerKey []byte          `json:"IssuerKey"`
+	Invitee   identity.NodeID `json:"Invitee,omitempty"`
+	Expires   int64           `json:"Expires"`
+	Nonce     string          `json:"Nonce"`
+	Signature []byte          `json:"Signature"`
+}
+
+func (t *Token) signedPayload() []byte {
+	b := make([]byte, 0, len(t.Issuer)+len(t.Invitee)+len(t.Nonce)+8)
+	b = append(b, t.Issuer...)
+	b = append(b, t.Invitee...)
+	b = binary.BigEndian.AppendUint64(b, uint64(t.Expires))
+	return append(b, t.Nonce...)
+}
+
+// NewToken issues a token signed by the identity, valid for the given duration.
+func NewToken(issuer *identity.Identity, invitee identity.NodeID, validFor time.Duration) (Token, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return Token{}, fmt.Errorf("cannot generate token nonce - %s", err)
+	}
+
+	t := Token{
+		Issuer:    issuer.ID(),
+		IssuerKey: issuer.PublicKey,
+		Invitee:   invitee,
+		Expires:   time.Now().Add(validFor).UnixMilli(),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+	t.Signature = ed25519.Sign(issuer.PrivateKey, t.signedPayload())
+	return t, nil
+}
+
+// Verify checks that the token has been signed by its issuer, that it has not expired and that the joining node may use it.
+// It is up to the caller to decide if the issuer is a member of the network.
+func (t *Token) Verify(joiner identity.NodeID, now time.Time) error {
+	if len(t.IssuerKey) != ed25519.PublicKeySize || identity.IDFromPublicKey(t.IssuerKey) != t.Issuer {
+		return fmt.Errorf("token key does not match the issuer %s", t.Issuer.Short())
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(t.IssuerKey), t.signedPayload(), t.Signature) {
+		return errors.New("token signature is not valid")
+	}
+
+	if now.UnixMilli() > t.Expires {
+		return fmt.Errorf("token expired at %s", time.UnixMilli(t.Expires).Format(time.DateTime))
+	}
+
+	if t.Invitee != "" && t.Invitee != joiner {
+		return fmt.Errorf("token has been issued for node %s", t.Invitee.Short())
+	}
+	return nil
+}
+
+// Encode turns the token into a string that can be passed around by hand.
+func (t *Token) Encode() (string, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecodeToken parses a token made with Encode.
+func DecodeToken(s string) (Token, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return Token{}, fmt.Errorf("cannot decode token - %s", err)
+	}
+
+	t := Token{}
+	if err = json.Unmarshal(b, &t); err != nil {
+		return Token{}, fmt.Errorf("cannot parse token - %s", err)
+	}
+	return t, nil
+}
@@ -0,0 +1,67 @@
+package admission
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+func TestNetworkKeyProofIsBoundToJoinerAndTime(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	joiner, other := identity.NodeID("A"), identity.NodeID("B")
+	proof := ProveNetworkKey(key, joiner, 1000)
+
+	if !CheckNetworkKeyProof(key, joiner, 1000, proof) {
+		t.Fatal("valid proof was rejected")
+	}
+	if CheckNetworkKeyProof([]byte("another network key"), joiner, 1000, proof) {
+		t.Error("proof made with another key was accepted")
+	}
+	if CheckNetworkKeyProof(key, other, 1000, proof) {
+		t.Error("proof of another node was accepted")
+	}
+	if CheckNetworkKeyProof(key, joiner, 1001, proof) {
+		t.Error("proof made at another time was accepted")
+	}
+}
+
+func TestTokenChecks(t *testing.T) {
+	issuer, _ := identity.Generate()
+	invitee, _ := identity.Generate()
+	other, _ := identity.Generate()
+	now := time.Now()
+
+	token, err := NewToken(issuer, invitee.ID(), time.Minute)
+	if err != nil {
+		t.Fatalf("could not issue token - %s", err)
+	}
+	s, err := token.Encode()
+	if err != nil {
+		t.Fatalf("could not encode token - %s", err)
+	}
+	if token, err = DecodeToken(s); err != nil {
+		t.Fatalf("could not decode token - %s", err)
+	}
+
+	if err = token.Verify(invitee.ID(), now); err != nil {
+		t.Errorf("invitee could not use its token - %s", err)
+	}
+	if err = token.Verify(other.ID(), now); err == nil {
+		t.Error("token was used by another node than its invitee")
+	}
+	if err = token.Verify(invitee.ID(), now.Add(2*time.Minute)); err == nil {
+		t.Error("expired token was accepted")
+	}
+
+	forged := token
+	forged.Expires = now.Add(time.Hour).UnixMilli()
+	if err = forged.Verify(invitee.ID(), now.Add(2*time.Minute)); err == nil {
+		t.Error("token with a changed expiry was accepted")
+	}
+	forged = token
+	forged.Issuer = other.ID()
+	if err = forged.Verify(invitee.ID(), now); err == nil {
+		t.Error("token claiming another issuer was accepted")
+	}
+}
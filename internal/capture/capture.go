@@ -0,0 +1,159 @@
+// Package capture records the envelopes a node sends and receives to a file, one JSON record per line, such that the
+// traffic of a node can be looked at, or replayed into another node, later on.
+package capture
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+var log = logging.Component("capture")
+
+// The directions of the records.
+const (
+	// In is an envelope the node accepted in its queue. Peer is the address it came from.
+	In = "in"
+	// Out is an envelope the node sent. Peer is the address it was sent to.
+	Out = "out"
+	// Start is the state of the node when the capture started, before it joined the network.
+	Start = "start"
+	// Joined is the state of the node once it joined the network, which a replay starts from when there is one.
+	Joined = "joined"
+)
+
+// Record is one line of a capture. Time is in microseconds.
+// Data holds the envelope, or the state of the node for the Start and Joined records. Bytes that are not JSON are kept in Raw.
+type Record struct {
+	Time      int64           `json:"Time"`
+	Direction string          `json:"Direction"`
+	Peer      string          `json:"Peer,omitempty"`
+	Data      json.RawMessage `json:"Data,omitempty"`
+	Raw       []byte          `json:"Raw,omitempty"`
+	Error     string          `json:"Error,omitempty"`
+}
+
+// Recorder writes the records to a capture. A nil recorder records nothing.
+type Recorder struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w, enc: json.NewEncoder(w)}
+}
+
+// Create creates the capture file, along with its directory, replacing the capture that was there.
+func Create(path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create capture directory - %s", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create capture file - %s", err)
+	}
+	return NewRecorder(f), nil
+}
+
+func (r *Recorder) write(rec Record) error {
+	rec.Time = time.Now().UnixMicro()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(&rec)
+}
+
+// Record records an envelope going in the given direction.
+func (r *Recorder) Record(direction string, peer string, b []byte, sendErr error) error {
+	if r == nil {
+		return nil
+	}
+
+	rec := Record{Direction: direction, Peer: peer}
+	if json.Valid(b) {
+		rec.Data = b
+	} else {
+		rec.Raw = b
+	}
+	if sendErr != nil {
+		rec.Error = sendErr.Error()
+	}
+	return r.write(rec)
+}
+
+// RecordStart records the state of the node when the capture starts.
+func (r *Recorder) RecordStart(state any) error {
+	return r.recordState(Start, state)
+}
+
+// RecordJoined records the state of the node once it joined the network.
+func (r *Recorder) RecordJoined(state any) error {
+	return r.recordState(Joined, state)
+}
+
+func (r *Recorder) recordState(direction string, state any) error {
+	if r == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not serialize node state - %s", err)
+	}
+	return r.write(Record{Direction: direction, Data: b})
+}
+
+// Close closes the capture file, when the recorder writes to one.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	if c, ok := r.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Read reads all the records of a capture.
+func Read(rd io.Reader) ([]Record, error) {
+	var recs []Record
+	dec := json.NewDecoder(rd)
+	for {
+		rec := Record{}
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, fmt.Errorf("could not read record %d - %s", len(recs)+1, err)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// Transport records each message before handing it to Next. When Next is nil, the messages are only recorded, and never sent.
+type Transport struct {
+	Next     network.Transport
+	Recorder *Recorder
+}
+
+func (t Transport) Send(msg []byte, dest network.IpPortPair, id identity.NodeID, timeoutInSecs time.Duration) error {
+	var err error
+	if t.Next != nil {
+		err = t.Next.Send(msg, dest, id, timeoutInSecs)
+	}
+	if recErr := t.Recorder.Record(Out, dest.NetString(), msg, err); recErr != nil {
+		log.Error("could not capture envelope sent to %s - %s", dest.NetString(), recErr)
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+func TestTransportRecordsWithoutSending(t *testing.T) {
+	b := &bytes.Buffer{}
+	r := NewRecorder(b)
+	dest := network.IpPortPair{Ip: net.ParseIP("127.0.0.1"), Port: 8080}
+
+	if err := r.RecordStart(map[string]int{"Conns": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Record(In, "127.0.0.1:9090", []byte(`{"Type":1}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Transport{Recorder: r}).Send([]byte("not json"), dest, "", 1); err != nil {
+		t.Fatalf("expected no error without a next transport, got %s", err)
+	}
+	if err := r.Record(Out, dest.NetString(), []byte(`{}`), errors.New("refused")); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(recs))
+	}
+	if recs[0].Direction != Start || string(recs[0].Data) != `{"Conns":2}` {
+		t.Errorf("unexpected start record %+v", recs[0])
+	}
+	if recs[1].Direction != In || string(recs[1].Data) != `{"Type":1}` {
+		t.Errorf("unexpected in record %+v", recs[1])
+	}
+	if recs[2].Direction != Out || recs[2].Peer != "127.0.0.1:8080" || string(recs[2].Raw) != "not json" || recs[2].Data != nil {
+		t.Errorf("unexpected out record %+v", recs[2])
+	}
+	if recs[3].Error != "refused" {
+		t.Errorf("expected the send error to be recorded, got %+v", recs[3])
+	}
+	for i := 1; i < len(recs); i++ {
+		if recs[i].Time < recs[i-1].Time {
+			t.Errorf("record %d is older than the one before it", i)
+		}
+	}
+}
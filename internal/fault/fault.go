@@ -0,0 +1,337 @@
+// Package fault injects faults in the messages between the nodes: it drops, delays, duplicates, reorders and corrupts them,
+// and splits the nodes in groups that cannot reach one another, such that the failure handling of the nodes can be tested on purpose.
+//
+// The messages a node sends go through a Transport, the ones it receives through Injector.Receive.
+// When all the nodes run in the same process, the Transport alone sees every message, thus the faults must not also be injected on receive.
+//
+// The nodes are named by their address or their ID in the rules and partitions, and never by what the messages claim.
+// A message received over plain TCP only comes with the address the peer connected from, thus on receive, the peers are
+// only told apart by their ID, over TLS. The messages sent are always matched, since their destination is known.
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+var log = logging.Component("fault")
+
+// ErrPartitioned is the error of the sends between two nodes in different groups of a partition.
+var ErrPartitioned = errors.New("partitioned")
+
+// How long a reordered message is held back at most, when no other message comes after it.
+const maxHold = time.Second
+
+// Rules are the faults injected in the messages going one way. The faults are given as the share of the messages they hit, between 0 and 1.
+// A delayed message is delayed between DelayMin and DelayMax milliseconds. A reordered message is held back until the next message to or from the same peer.
+type Rules struct {
+	Drop      float64 `json:"Drop,omitempty"`
+	Delay     float64 `json:"Delay,omitempty"`
+	DelayMin  uint32  `json:"DelayMin,omitempty"`
+	DelayMax  uint32  `json:"DelayMax,omitempty"`
+	Duplicate float64 `json:"Duplicate,omitempty"`
+	Reorder   float64 `json:"Reorder,omitempty"`
+	Corrupt   float64 `json:"Corrupt,omitempty"`
+	// Peers are the addresses or IDs of the nodes the rules apply to, all of them when empty.
+	Peers []string `json:"Peers,omitempty"`
+}
+
+func (r *Rules) validate() error {
+	for name, p := range map[string]float64{"drop": r.Drop, "delay": r.Delay, "duplicate": r.Duplicate, "reorder": r.Reorder, "corrupt": r.Corrupt} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("%s share must be between 0 and 1, got %v", name, p)
+		}
+	}
+	if r.DelayMin > r.DelayMax {
+		return fmt.Errorf("delay min %dms is greater than delay max %dms", r.DelayMin, r.DelayMax)
+	}
+	return nil
+}
+
+func (r *Rules) appliesTo(peer Endpoint) bool {
+	return len(r.Peers) == 0 || slices.Contains(r.Peers, peer.Addr) || (peer.ID != "" && slices.Contains(r.Peers, string(peer.ID)))
+}
+
+// Endpoint is one end of a message: the address of the node, and its ID when it is known.
+type Endpoint struct {
+	Addr string
+	ID   identity.NodeID
+}
+
+func (e Endpoint) String() string {
+	if e.ID != "" {
+		return e.ID.Short() + "@" + e.Addr
+	}
+	return e.Addr
+}
+
+// Stats count the messages hit by each fault.
+type Stats struct {
+	Dropped     uint64 `json:"Dropped"`
+	Delayed     uint64 `json:"Delayed"`
+	Duplicated  uint64 `json:"Duplicated"`
+	Reordered   uint64 `json:"Reordered"`
+	Corrupted   uint64 `json:"Corrupted"`
+	Partitioned uint64 `json:"Partitioned"`
+}
+
+// State is what the injector does: the rules of the messages sent and received, and the groups of nodes, by name, that only reach the nodes of their group.
+// The nodes of the groups are given by their address or their ID.
+// The nodes in no group reach all the others.
+type State struct {
+	Out        Rules               `json:"Out"`
+	In         Rules               `json:"In"`
+	Partitions map[string][]string `json:"Partitions,omitempty"`
+	Stats      Stats               `json:"Stats"`
+}
+
+// held is a message held back to be reordered.
+type held struct {
+	msg     []byte
+	deliver func([]byte) error
+}
+
+// Injector decides which faults hit each message. It injects none until it is told to.
+type Injector struct {
+	mu         sync.Mutex
+	rng        *rand.Rand
+	out, in    Rules
+	partitions map[string][]string
+	// groups has the name of the group of each node in a partition, by address or ID.
+	groups map[string]string
+	held   map[string]*held
+	stats  Stats
+}
+
+func New(seed uint64) *Injector {
+	return &Injector{
+		rng:    rand.New(rand.NewPCG(seed, seed)),
+		groups: map[string]string{},
+		held:   map[string]*held{},
+	}
+}
+
+// Set replaces the rules and the partitions with the ones of the state. The stats are kept.
+func (i *Injector) Set(s State) error {
+	if err := s.Out.validate(); err != nil {
+		return fmt.Errorf("invalid rules of the messages sent - %s", err)
+	}
+	if err := s.In.validate(); err != nil {
+		return fmt.Errorf("invalid rules of the messages received - %s", err)
+	}
+	groups := map[string]string{}
+	for name, addrs := range s.Partitions {
+		for _, addr := range addrs {
+			if other, ok := groups[addr]; ok && other != name {
+				return fmt.Errorf("node %s is in both groups %q and %q", addr, other, name)
+			}
+			groups[addr] = name
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.out, i.in = s.Out, s.In
+	i.partitions = maps.Clone(s.Partitions)
+	i.groups = groups
+	log.Info("injecting faults: out=%+v in=%+v partitions=%v", s.Out, s.In, s.Partitions)
+	return nil
+}
+
+// SetOut replaces the rules of the messages sent.
+func (i *Injector) SetOut(r Rules) error {
+	s := i.State()
+	s.Out = r
+	return i.Set(s)
+}
+
+// SetIn replaces the rules of the messages received.
+func (i *Injector) SetIn(r Rules) error {
+	s := i.State()
+	s.In = r
+	return i.Set(s)
+}
+
+// Partition splits the nodes in the given groups, replacing the partitions there were.
+func (i *Injector) Partition(groups map[string][]string) error {
+	s := i.State()
+	s.Partitions = groups
+	return i.Set(s)
+}
+
+// Heal removes the partitions.
+func (i *Injector) Heal() {
+	i.Partition(nil)
+}
+
+// Reset stops injecting faults, and sends the messages held back right away.
+func (i *Injector) Reset() {
+	i.Set(State{})
+
+	i.mu.Lock()
+	hs := i.held
+	i.held = map[string]*held{}
+	i.mu.Unlock()
+	for _, h := range hs {
+		h.deliver(h.msg)
+	}
+}
+
+func (i *Injector) State() State {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return State{Out: i.out, In: i.in, Partitions: maps.Clone(i.partitions), Stats: i.stats}
+}
+
+// group returns the group of the node, found by its address or its ID. Must be called while holding mu.
+func (i *Injector) group(e Endpoint) (string, bool) {
+	if g, ok := i.groups[e.Addr]; ok {
+		return g, true
+	}
+	if e.ID == "" {
+		return "", false
+	}
+	g, ok := i.groups[string(e.ID)]
+	return g, ok
+}
+
+// partitioned tells if the two nodes are in different groups. Must be called while holding mu.
+func (i *Injector) partitioned(from Endpoint, to Endpoint) bool {
+	gFrom, okFrom := i.group(from)
+	gTo, okTo := i.group(to)
+	return okFrom && okTo && gFrom != gTo
+}
+
+// Send injects the faults in a message sent from the node to the peer, and hands it to deliver as many times as it must, now or later.
+// Only the errors of the messages delivered right away are returned, the others are logged.
+func (i *Injector) Send(msg []byte, from Endpoint, to Endpoint, deliver func([]byte) error) error {
+	return i.inject(msg, from, to, to, "out", deliver)
+}
+
+// Receive injects the faults in a message the node received from the peer, and hands it to deliver as many times as it must, now or later.
+// The peer must be what the link tells about it, not what the message claims.
+func (i *Injector) Receive(msg []byte, from Endpoint, self Endpoint, deliver func([]byte) error) error {
+	return i.inject(msg, from, self, from, "in", deliver)
+}
+
+func (i *Injector) inject(msg []byte, from Endpoint, to Endpoint, peer Endpoint, direction string, deliver func([]byte) error) error {
+	lg := log.With("from", from.String(), "to", to.String(), "direction", direction)
+
+	i.mu.Lock()
+	if i.partitioned(from, to) {
+		i.stats.Partitioned++
+		i.mu.Unlock()
+		lg.Debug("message crosses a partition")
+		return fmt.Errorf("cannot reach node %s - %w", to.Addr, ErrPartitioned)
+	}
+
+	r := &i.out
+	if direction == "in" {
+		r = &i.in
+	}
+	if !r.appliesTo(peer) {
+		i.mu.Unlock()
+		return deliver(msg)
+	}
+
+	if i.rng.Float64() < r.Drop {
+		i.stats.Dropped++
+		i.mu.Unlock()
+		lg.Debug("dropped message")
+		return nil
+	}
+	if i.rng.Float64() < r.Corrupt {
+		i.stats.Corrupted++
+		msg = slices.Clone(msg)
+		if len(msg) != 0 {
+			msg[i.rng.IntN(len(msg))] ^= byte(1 + i.rng.IntN(255))
+		}
+		lg.Debug("corrupted message")
+	}
+	copies := 1
+	if i.rng.Float64() < r.Duplicate {
+		i.stats.Duplicated++
+		copies = 2
+		lg.Debug("duplicated message")
+	}
+	var delay time.Duration
+	if i.rng.Float64() < r.Delay {
+		i.stats.Delayed++
+		delay = time.Duration(r.DelayMin+uint32(i.rng.Int64N(int64(r.DelayMax-r.DelayMin)+1))) * time.Millisecond
+		lg.Debug("delayed message by %v", delay)
+	}
+
+	key := direction + " " + peer.String()
+	prev := i.held[key]
+	delete(i.held, key)
+	if prev == nil && i.rng.Float64() < r.Reorder {
+		i.stats.Reordered++
+		h := &held{msg: msg, deliver: deliver}
+		i.held[key] = h
+		i.mu.Unlock()
+		lg.Debug("holding message back")
+		time.AfterFunc(maxHold, func() { i.release(key, h) })
+		return nil
+	}
+	i.mu.Unlock()
+
+	send := func() error {
+		var err error
+		for range copies {
+			err = errors.Join(err, deliver(msg))
+		}
+		// The message held back comes after this one.
+		if prev != nil {
+			if prevErr := prev.deliver(prev.msg); prevErr != nil {
+				lg.Error("could not deliver message held back - %s", prevErr)
+			}
+		}
+		return err
+	}
+	if delay == 0 {
+		return send()
+	}
+	time.AfterFunc(delay, func() {
+		if err := send(); err != nil {
+			lg.Error("could not deliver delayed message - %s", err)
+		}
+	})
+	return nil
+}
+
+// release delivers the message held back, if no other message came after it meanwhile.
+func (i *Injector) release(key string, h *held) {
+	i.mu.Lock()
+	if i.held[key] != h {
+		i.mu.Unlock()
+		return
+	}
+	delete(i.held, key)
+	i.mu.Unlock()
+
+	if err := h.deliver(h.msg); err != nil {
+		log.Error("could not deliver message held back - %s", err)
+	}
+}
+
+// Transport injects the faults of the injector in the messages the From node sends, before handing them to Next.
+type Transport struct {
+	Next     network.Transport
+	Injector *Injector
+	From     Endpoint
+}
+
+func (t Transport) Send(msg []byte, dest network.IpPortPair, id identity.NodeID, timeoutInSecs time.Duration) error {
+	return t.Injector.Send(msg, t.From, Endpoint{Addr: dest.NetString(), ID: id}, func(b []byte) error {
+		return t.Next.Send(b, dest, id, timeoutInSecs)
+	})
+}
@@ -0,0 +1,183 @@
+package fault
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+type sent struct {
+	msg  []byte
+	dest string
+}
+
+// recordingTransport records the messages instead of sending them.
+type recordingTransport struct {
+	mu   sync.Mutex
+	sent []sent
+}
+
+func (rt *recordingTransport) Send(msg []byte, dest network.IpPortPair, _ identity.NodeID, timeoutInSecs time.Duration) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.sent = append(rt.sent, sent{msg: msg, dest: dest.NetString()})
+	return nil
+}
+
+func (rt *recordingTransport) messages() []sent {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([]sent(nil), rt.sent...)
+}
+
+func addr(port uint16) network.IpPortPair {
+	return network.IpPortPair{Ip: net.ParseIP("127.0.0.1"), Port: port}
+}
+
+func host(port uint16) string {
+	a := addr(port)
+	return a.NetString()
+}
+
+func envelopeFrom(port uint16, data string) []byte {
+	return []byte(fmt.Sprintf(`{"Sender":{"Locator":{"Ip":"127.0.0.1","Port":%d}},"Data":%q}`, port, data))
+}
+
+func TestRulesHitMessages(t *testing.T) {
+	rt := &recordingTransport{}
+	in := New(1)
+	tr := Transport{Next: rt, Injector: in, From: Endpoint{Addr: host(1)}}
+
+	msg := envelopeFrom(1, "a")
+	if err := in.SetOut(Rules{Drop: 1}); err != nil {
+		t.Fatal(err)
+	}
+	tr.Send(msg, addr(2), "", 1)
+	if len(rt.messages()) != 0 {
+		t.Fatal("dropped message was sent")
+	}
+
+	in.SetOut(Rules{Duplicate: 1})
+	tr.Send(msg, addr(2), "", 1)
+	if len(rt.messages()) != 2 {
+		t.Fatalf("expected the message sent twice, got %d messages", len(rt.messages()))
+	}
+
+	in.SetOut(Rules{Corrupt: 1})
+	tr.Send(msg, addr(2), "", 1)
+	if got := rt.messages()[2].msg; bytes.Equal(got, msg) || len(got) != len(msg) {
+		t.Errorf("expected the message corrupted, got %q", got)
+	}
+
+	// The rules only hit the peers they are for.
+	in.SetOut(Rules{Drop: 1, Peers: []string{host(3), "NODE3"}})
+	tr.Send(msg, addr(2), "", 1)
+	if len(rt.messages()) != 4 {
+		t.Errorf("message to a peer without faults was dropped")
+	}
+	// The peers are also found by their ID.
+	tr.Send(msg, addr(4), "NODE3", 1)
+	if len(rt.messages()) != 4 {
+		t.Errorf("message to a peer named by its ID was not dropped")
+	}
+
+	if err := in.SetOut(Rules{Drop: 2}); err == nil {
+		t.Error("share greater than 1 was accepted")
+	}
+
+	st := in.State().Stats
+	if st.Dropped != 2 || st.Duplicated != 1 || st.Corrupted != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestReorderAndDelay(t *testing.T) {
+	rt := &recordingTransport{}
+	in := New(1)
+	tr := Transport{Next: rt, Injector: in, From: Endpoint{Addr: host(1)}}
+
+	first, second := envelopeFrom(1, "first"), envelopeFrom(1, "second")
+	in.SetOut(Rules{Reorder: 1})
+	tr.Send(first, addr(2), "", 1)
+	in.SetOut(Rules{})
+	tr.Send(second, addr(2), "", 1)
+
+	got := rt.messages()
+	if len(got) != 2 || !bytes.Equal(got[0].msg, second) || !bytes.Equal(got[1].msg, first) {
+		t.Fatalf("expected the messages swapped, got %v", got)
+	}
+
+	in.SetOut(Rules{Delay: 1, DelayMin: 50, DelayMax: 50})
+	start := time.Now()
+	tr.Send(first, addr(2), "", 1)
+	if len(rt.messages()) != 2 {
+		t.Fatal("delayed message was sent right away")
+	}
+	for len(rt.messages()) != 3 {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("delayed message was never sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("message was delayed by %v only", time.Since(start))
+	}
+}
+
+func TestPartitionSplitsGroups(t *testing.T) {
+	rt := &recordingTransport{}
+	in := New(1)
+	tr := Transport{Next: rt, Injector: in, From: Endpoint{Addr: host(1)}}
+
+	err := in.Partition(map[string][]string{
+		"a": {host(1), host(2)},
+		"b": {host(3)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tr.Send(envelopeFrom(1, "x"), addr(3), "", 1); !errors.Is(err, ErrPartitioned) {
+		t.Errorf("expected the send across the partition to fail, got %v", err)
+	}
+	if err = tr.Send(envelopeFrom(1, "x"), addr(2), "", 1); err != nil {
+		t.Errorf("send in the same group failed - %s", err)
+	}
+	// Node 4 is in no group, thus it reaches everybody.
+	if err = tr.Send(envelopeFrom(1, "x"), addr(4), "", 1); err != nil {
+		t.Errorf("send to a node in no group failed - %s", err)
+	}
+	delivered := false
+	in.Receive(envelopeFrom(3, "x"), Endpoint{Addr: host(3)}, Endpoint{Addr: host(1)}, func([]byte) error {
+		delivered = true
+		return nil
+	})
+	if delivered {
+		t.Error("message received across the partition was delivered")
+	}
+	// The sender the envelope claims is not trusted, only the peer of the link is.
+	delivered = false
+	in.Receive(envelopeFrom(3, "x"), Endpoint{Addr: "127.0.0.1:50000"}, Endpoint{Addr: host(1)}, func([]byte) error {
+		delivered = true
+		return nil
+	})
+	if !delivered {
+		t.Error("message from a peer in no group was not delivered")
+	}
+
+	in.Heal()
+	if err = tr.Send(envelopeFrom(1, "x"), addr(3), "", 1); err != nil {
+		t.Errorf("send failed once the partition is healed - %s", err)
+	}
+
+	if err = in.Partition(map[string][]string{"a": {host(1)}, "b": {host(1)}}); err == nil {
+		t.Error("node in two groups was accepted")
+	}
+}
@@ -0,0 +1,111 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long a node certificate is valid for. There is no CA to renew it, thus a new one is simply generated when it expires.
+const certificateValidity = 10 * 365 * 24 * time.Hour
+
+// NewCertificate creates a self-signed certificate for the identity, with the node ID as the common name.
+func NewCertificate(id *Identity) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot generate certificate serial - %s", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: string(id.ID())},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, id.PublicKey, id.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot create certificate - %s", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: id.PrivateKey}, nil
+}
+
+// LoadOrCreateCertificate reads the PEM encoded certificate of the identity stored at path.
+// If the file does not exist, or the certificate in it has expired, a new one is generated and stored there.
+func LoadOrCreateCertificate(path string, id *Identity) (tls.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createCertificate(path, id)
+	} else if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot read certificate file %s - %s", path, err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("certificate file %s does not contain a PEM block", path)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot parse certificate file %s - %s", path, err)
+	}
+
+	if pub, ok := cert.PublicKey.(ed25519.PublicKey); !ok || !pub.Equal(id.PublicKey) {
+		return tls.Certificate{}, fmt.Errorf("certificate file %s does not belong to node %s", path, id.ID().Short())
+	}
+
+	if time.Now().After(cert.NotAfter) {
+		return createCertificate(path, id)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{block.Bytes}, PrivateKey: id.PrivateKey, Leaf: cert}, nil
+}
+
+func createCertificate(path string, id *Identity) (tls.Certificate, error) {
+	cert, err := NewCertificate(id)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot create directory for certificate file %s - %s", path, err)
+	}
+
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot write certificate file %s - %s", path, err)
+	}
+
+	return cert, nil
+}
+
+// IDFromCertificate checks that the certificate is a valid self-signed node certificate, and returns the ID of the node it belongs to.
+// The ID is derived from the key, the common name is only there for humans.
+func IDFromCertificate(cert *x509.Certificate) (NodeID, error) {
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return "", errors.New("certificate does not hold an ed25519 key")
+	}
+
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return "", fmt.Errorf("certificate is not self-signed - %s", err)
+	}
+
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return "", fmt.Errorf("certificate is valid only between %s and %s", cert.NotBefore, cert.NotAfter)
+	}
+
+	return IDFromPublicKey(pub), nil
+}
@@ -0,0 +1,59 @@
+package identity
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const encryptionKeyDomain = "overlay-network x25519 key"
+
+// EncryptionKey returns the X25519 key the node decrypts sealed payloads with.
+// It is derived from the seed of the identity, thus the node keeps it between restarts without storing it.
+func (id *Identity) EncryptionKey() (*ecdh.PrivateKey, error) {
+	h := sha256.New()
+	h.Write([]byte(encryptionKeyDomain))
+	h.Write(id.PrivateKey.Seed())
+	return ecdh.X25519().NewPrivateKey(h.Sum(nil))
+}
+
+// EncryptionKeyRecord is the public encryption key of a node, signed with its identity key.
+// Any node can pass it along, since nobody else can make one for the node.
+type EncryptionKeyRecord struct {
+	PublicKey     []byte `json:"PublicKey"`
+	EncryptionKey []byte `json:"EncryptionKey"`
+	Signature     []byte `json:"Signature"`
+}
+
+func encryptionKeyPayload(encKey []byte) []byte {
+	return append([]byte(encryptionKeyDomain), encKey...)
+}
+
+// NewEncryptionKeyRecord creates the signed record of the encryption key of the identity.
+func (id *Identity) NewEncryptionKeyRecord() (*EncryptionKeyRecord, error) {
+	encKey, err := id.EncryptionKey()
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive encryption key - %s", err)
+	}
+
+	pub := encKey.PublicKey().Bytes()
+	return &EncryptionKeyRecord{
+		PublicKey:     id.PublicKey,
+		EncryptionKey: pub,
+		Signature:     ed25519.Sign(id.PrivateKey, encryptionKeyPayload(pub)),
+	}, nil
+}
+
+// Verify checks that the record has been signed by the node with the given ID.
+func (r *EncryptionKeyRecord) Verify(owner NodeID) error {
+	if len(r.PublicKey) != ed25519.PublicKeySize || IDFromPublicKey(r.PublicKey) != owner {
+		return fmt.Errorf("encryption key record does not belong to node %s", owner.Short())
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(r.PublicKey), encryptionKeyPayload(r.EncryptionKey), r.Signature) {
+		return errors.New("encryption key record signature is not valid")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// NodeID uniquely identifies a node, no matter the address it can be found at.
+// It is the hex encoded SHA-256 of the public key of the node.
+type NodeID string
+
+// Short returns the first 8 characters of the ID, which is enough for logs.
+func (id NodeID) Short() string {
+	if len(id) < 8 {
+		return string(id)
+	}
+	return string(id[:8])
+}
+
+// IDFromPublicKey derives the node ID from a public key.
+func IDFromPublicKey(pub ed25519.PublicKey) NodeID {
+	return NodeID(fmt.Sprintf("%X", sha256.Sum256(pub)))
+}
+
+// Identity is the key pair of a node.
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// Generate creates a new random identity.
+func Generate() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate key pair - %s", err)
+	}
+	return &Identity{PublicKey: pub, PrivateKey: priv}, nil
+}
+
+// ID returns the node ID of the identity.
+func (id *Identity) ID() NodeID {
+	return IDFromPublicKey(id.PublicKey)
+}
+
+// LoadOrCreate reads the identity stored at path as a PEM encoded PKCS #8 private key.
+// If the file does not exist, a new identity is generated and stored there, so that the node keeps its ID between restarts.
+func LoadOrCreate(path string) (*Identity, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return create(path)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read key file %s - %s", path, err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("key file %s does not contain a PEM block", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key file %s - %s", path, err)
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key file %s does not contain an ed25519 key", path)
+	}
+
+	return &Identity{PublicKey: priv.Public().(ed25519.PublicKey), PrivateKey: priv}, nil
+}
+
+func create(path string) (*Identity, error) {
+	id, err := Generate()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := x509.MarshalPKCS8PrivateKey(id.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal private key - %s", err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("cannot create directory for key file %s - %s", path, err)
+	}
+
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		return nil, fmt.Errorf("cannot write key file %s - %s", path, err)
+	}
+
+	return id, nil
+}
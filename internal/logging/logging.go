@@ -1,30 +1,254 @@
-// This is a primitive way of logging. It WILL change in the future but I don't know when.
+// Package logging gives each subsystem of the node its own structured logger, built on log/slog.
+// The messages keep the printf style used all over the code, and key/value fields are added with With.
+// Every component has its own level, which can be changed at any time.
 package logging
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var DebugFlag bool = false
 var defaultTimeFormat string = "02/01/2006 15:04:05"
 
-func LogDebug(format string, args ...any) {
-	if DebugFlag {
-		fmt.Printf(fmt.Sprintf("[DBG] [%s] %s\n", time.Now().Format(defaultTimeFormat), format), args...)
+// DefaultComponent is the component of the loggers that do not have one, such as a nil Logger.
+const DefaultComponent = "default"
+
+// Config is where and how all the loggers write.
+type Config struct {
+	Writer io.Writer
+	JSON   bool
+	// Level is the level of the components that are not in Levels.
+	Level  slog.Level
+	Levels map[string]slog.Level
+}
+
+type registry struct {
+	mu     sync.Mutex
+	config Config
+	levels map[string]*slog.LevelVar
+	// handlers is only replaced, never changed, such that logging does not take mu once the handler of the component is built.
+	handlers atomic.Pointer[map[string]slog.Handler]
+}
+
+var reg = newRegistry()
+
+func newRegistry() *registry {
+	r := &registry{
+		config: Config{Writer: os.Stdout, Level: slog.LevelInfo},
+		levels: map[string]*slog.LevelVar{},
+	}
+	r.handlers.Store(&map[string]slog.Handler{})
+	return r
+}
+
+// Setup changes where and how all the loggers write, the ones already created included.
+func Setup(config Config) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if config.Writer == nil {
+		config.Writer = os.Stdout
+	}
+	reg.config = config
+	reg.handlers.Store(&map[string]slog.Handler{})
+	for component, lv := range reg.levels {
+		lv.Set(reg.levelOf(component))
+	}
+}
+
+func (r *registry) levelOf(component string) slog.Level {
+	if level, ok := r.config.Levels[component]; ok {
+		return level
+	}
+	return r.config.Level
+}
+
+func (r *registry) handler(component string) slog.Handler {
+	if h, ok := (*r.handlers.Load())[component]; ok {
+		return h
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	handlers := *r.handlers.Load()
+	if h, ok := handlers[component]; ok {
+		return h
+	}
+
+	lv, ok := r.levels[component]
+	if !ok {
+		lv = &slog.LevelVar{}
+		lv.Set(r.levelOf(component))
+		r.levels[component] = lv
+	}
+
+	// The handler keeps the config it was built with, Setup builds new ones.
+	config := r.config
+	opts := &slog.HandlerOptions{
+		Level: lv,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey && !config.JSON {
+				return slog.String(slog.TimeKey, a.Value.Time().Format(defaultTimeFormat))
+			}
+			return a
+		},
+	}
+
+	var h slog.Handler
+	if config.JSON {
+		h = slog.NewJSONHandler(config.Writer, opts)
+	} else {
+		h = slog.NewTextHandler(config.Writer, opts)
+	}
+	h = h.WithAttrs([]slog.Attr{slog.String("component", component)})
+
+	updated := maps.Clone(handlers)
+	updated[component] = h
+	r.handlers.Store(&updated)
+	return h
+}
+
+// SetLevel changes the level of a component while the node is running.
+func SetLevel(component string, level slog.Level) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.config.Levels == nil {
+		reg.config.Levels = map[string]slog.Level{}
+	}
+	reg.config.Levels[component] = level
+	if lv, ok := reg.levels[component]; ok {
+		lv.Set(level)
+	}
+}
+
+// SetDefaultLevel changes the level of all the components that do not have their own level, while the node is running.
+func SetDefaultLevel(level slog.Level) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.config.Level = level
+	for component, lv := range reg.levels {
+		lv.Set(reg.levelOf(component))
+	}
+}
+
+// Levels returns the level of each component that has logged so far, or that has its own level.
+func Levels() map[string]string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	levels := map[string]string{}
+	for component := range reg.config.Levels {
+		levels[component] = reg.levelOf(component).String()
+	}
+	for component, lv := range reg.levels {
+		levels[component] = lv.Level().String()
+	}
+	return levels
+}
+
+// ParseLevels parses levels in the "info,network=debug,node=warn" format: the level of all the components,
+// followed by the levels of specific components. Either part may be missing.
+func ParseLevels(s string) (slog.Level, map[string]slog.Level, error) {
+	level := slog.LevelInfo
+	levels := map[string]slog.Level{}
+
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		component, name, found := strings.Cut(part, "=")
+		if !found {
+			name = component
+		}
+
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(name)); err != nil {
+			return level, nil, fmt.Errorf("invalid log level %q - %s", name, err)
+		}
+
+		if found {
+			levels[component] = l
+		} else {
+			level = l
+		}
+	}
+	return level, levels, nil
+}
+
+// Logger is the logger of a component, along with the fields it adds to every message.
+// A nil Logger logs as the default component, so that it is always safe to use.
+type Logger struct {
+	component string
+	attrs     []any
+}
+
+// Component returns the logger of a subsystem, such as "node" or "network".
+func Component(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// With returns a logger adding the key/value pairs to every message, on top of the ones this logger already adds.
+func (lg *Logger) With(args ...any) *Logger {
+	if lg == nil {
+		lg = Component(DefaultComponent)
 	}
+	return &Logger{component: lg.component, attrs: append(slices.Clip(lg.attrs), args...)}
+}
+
+// Enabled checks if the messages of the given level are written, to skip building expensive messages for nothing.
+func (lg *Logger) Enabled(level slog.Level) bool {
+	if lg == nil {
+		lg = Component(DefaultComponent)
+	}
+	return reg.handler(lg.component).Enabled(context.Background(), level)
+}
+
+func (lg *Logger) log(level slog.Level, format string, args []any) {
+	if lg == nil {
+		lg = Component(DefaultComponent)
+	}
+
+	h := reg.handler(lg.component)
+	if !h.Enabled(context.Background(), level) {
+		return
+	}
+
+	record := slog.NewRecord(time.Now(), level, fmt.Sprintf(format, args...), 0)
+	record.Add(lg.attrs...)
+	h.Handle(context.Background(), record)
+}
+
+func (lg *Logger) Debug(format string, args ...any) {
+	lg.log(slog.LevelDebug, format, args)
+}
+
+func (lg *Logger) Info(format string, args ...any) {
+	lg.log(slog.LevelInfo, format, args)
 }
 
-func LogInfo(format string, args ...any) {
-	fmt.Printf(fmt.Sprintf("[INF] [%s] %s\n", time.Now().Format(defaultTimeFormat), format), args...)
+func (lg *Logger) Warn(format string, args ...any) {
+	lg.log(slog.LevelWarn, format, args)
 }
 
-func LogError(format string, args ...any) {
-	fmt.Printf(fmt.Sprintf("[ERR] [%s] %s\n", time.Now().Format(defaultTimeFormat), format), args...)
+func (lg *Logger) Error(format string, args ...any) {
+	lg.log(slog.LevelError, format, args)
 }
 
-func LogErrorWithExit(format string, args ...any) {
-	LogError(format, args...)
+func (lg *Logger) ErrorWithExit(format string, args ...any) {
+	lg.Error(format, args...)
 	os.Exit(1)
 }
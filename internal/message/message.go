@@ -3,8 +3,12 @@ package message
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/TheJ0lly/Overlay-Network/internal/admission"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
 	"github.com/TheJ0lly/Overlay-Network/internal/network"
+	"github.com/TheJ0lly/Overlay-Network/internal/tracing"
 )
 
 type MessageType uint16
@@ -16,6 +20,13 @@ const (
 	NetLifeLine
 	NetDeathAnnouncement
 	NetUpdate
+	NetLifeLineDigest
+	NetPing
+	NetPong
+	NetSealed
+	NetOnion
+	NetConnsRequest
+	NetConnsResponse
 )
 
 func (mt MessageType) String() string {
@@ -32,17 +43,85 @@ func (mt MessageType) String() string {
 		return "NetDeathAnnouncement"
 	case NetUpdate:
 		return "NetUpdate"
+	case NetLifeLineDigest:
+		return "NetLifeLineDigest"
+	case NetPing:
+		return "NetPing"
+	case NetPong:
+		return "NetPong"
+	case NetSealed:
+		return "NetSealed"
+	case NetOnion:
+		return "NetOnion"
+	case NetConnsRequest:
+		return "NetConnsRequest"
+	case NetConnsResponse:
+		return "NetConnsResponse"
 	default:
 		return "unknown"
 	}
 }
 
+// MaxEnvelopeSize is the size of the biggest envelope a node reads from a connection.
+const MaxEnvelopeSize = 1 << 20
+
+// MaxSize returns the size of the biggest Data a message of this type may have.
+// Only the messages carrying parts of the vision graph may be big.
+func (mt MessageType) MaxSize() int {
+	switch mt {
+	case NetUpdate, NetLifeLineDigest:
+		return 512 << 10
+	case NetOnion:
+		return 256 << 10
+	case NetDeathAnnouncement, NetSealed, NetConnsResponse:
+		return 64 << 10
+	case NetPing, NetPong:
+		return 256
+	default:
+		return 8 << 10
+	}
+}
+
+// NodeRef is how a node is referred to in messages: by its ID, along with the locator where it can be currently found.
+// The locator may change during the lifetime of a node, the ID never does.
+type NodeRef struct {
+	ID      identity.NodeID    `json:"ID"`
+	Locator network.IpPortPair `json:"Locator"`
+}
+
+// IsNull checks if the reference points to no node at all.
+func (ref NodeRef) IsNull() bool {
+	return ref.ID == ""
+}
+
+// Is checks if the reference points to the node with the given ID.
+func (ref NodeRef) Is(id identity.NodeID) bool {
+	return !ref.IsNull() && ref.ID == id
+}
+
+func (ref NodeRef) String() string {
+	return fmt.Sprintf("%s@%s", ref.ID.Short(), ref.Locator.NetString())
+}
+
 // MessageEnvelope covers the message such that it will be easier to find out what message type it contains.
+// The envelope is signed by the original sender, thus only Sender and Trace may change while it is forwarded.
+// Trace is set when the message is traced, and each node puts there the span it forwards the message from.
+// EnqueuedAt is when the node put the envelope in its queue, and it is never sent.
 type MessageEnvelope struct {
-	Type           MessageType        `json:"Type"`
-	Data           json.RawMessage    `json:"Data"`
-	Sender         network.IpPortPair `json:"Sender"`
-	OriginalSender network.IpPortPair `json:"OriginalSender"`
+	Type           MessageType      `json:"Type"`
+	Data           json.RawMessage  `json:"Data"`
+	Sender         NodeRef          `json:"Sender"`
+	OriginalSender NodeRef          `json:"OriginalSender"`
+	Timestamp      int64            `json:"Timestamp"`
+	Nonce          string           `json:"Nonce"`
+	OriginKey      []byte           `json:"OriginKey"`
+	Signature      []byte           `json:"Signature"`
+	Trace          *tracing.Context `json:"Trace,omitempty"`
+	EnqueuedAt     time.Time        `json:"-"`
+	// Link is the ID the peer proved over TLS, and it is empty when the envelope did not come over TLS.
+	Link identity.NodeID `json:"-"`
+	// LinkKey is the key the receiving node knows the peer of the link by, to penalize it for what it sends.
+	LinkKey string `json:"-"`
 }
 
 // SerializeMessageEnvelope takes a message envelope and turns it into a byte slice.
@@ -59,37 +138,39 @@ type SerializableMessage interface {
 	Serialize() ([]byte, error)
 }
 
-func CreateMessageEnvelope(mt MessageType, msg SerializableMessage, sender network.IpPortPair, ogSender network.IpPortPair) (MessageEnvelope, error) {
+func CreateMessageEnvelope(mt MessageType, msg SerializableMessage, sender NodeRef, ogSender NodeRef) (MessageEnvelope, error) {
 	if b, err := msg.Serialize(); err != nil {
 		return MessageEnvelope{}, fmt.Errorf("failed to marshal message - %s", err)
 	} else {
 		return MessageEnvelope{
-			Type:   mt,
-			Data:   b,
-			Sender: sender,
+			Type:           mt,
+			Data:           b,
+			Sender:         sender,
+			OriginalSender: ogSender,
 		}, nil
 	}
 }
 
-func SerializeNewMessageEnvelope(mt MessageType, msg SerializableMessage, sender network.IpPortPair, ogSender network.IpPortPair) ([]byte, error) {
+func SerializeNewMessageEnvelope(mt MessageType, msg SerializableMessage, sender NodeRef, ogSender NodeRef) ([]byte, error) {
 	if b, err := msg.Serialize(); err != nil {
 		return nil, fmt.Errorf("failed to serialize message data - %s", err)
 	} else {
 		return SerializeMessageEnvelope(&MessageEnvelope{
-			Type:   mt,
-			Data:   b,
-			Sender: sender,
+			Type:           mt,
+			Data:           b,
+			Sender:         sender,
+			OriginalSender: ogSender,
 		})
 	}
 }
 
 // NetNewNodeJoinMessage is the message a node receives when a new node has queried and find a place to attach.
 type NetNewNodeJoinMessage struct {
-	JoiningNode        network.IpPortPair `json:"JoiningNode"`
-	AttachedNode       network.IpPortPair `json:"AttachedNode"`
-	ReplacedNode       network.IpPortPair `json:"ReplacedNode"`
-	JoiningNodeView    uint8              `json:"JoiningNodeView"`
-	JoiningNodeConnCap uint8              `json:"JoiningNodeConnCap"`
+	JoiningNode        NodeRef `json:"JoiningNode"`
+	AttachedNode       NodeRef `json:"AttachedNode"`
+	ReplacedNode       NodeRef `json:"ReplacedNode"`
+	JoiningNodeView    uint8   `json:"JoiningNodeView"`
+	JoiningNodeConnCap uint8   `json:"JoiningNodeConnCap"`
 }
 
 func (msg *NetNewNodeJoinMessage) Serialize() ([]byte, error) {
@@ -97,8 +178,13 @@ func (msg *NetNewNodeJoinMessage) Serialize() ([]byte, error) {
 }
 
 // NetNewNodeJoinConfirmMessage is the message that a node will receive when a new node determines that this node is the best place to attach
+// When the network controls who can join, the joining node proves it is admitted either with a proof that it knows the network key,
+// made at Timestamp, or with an invitation token.
 type NetNewNodeJoinConfirmMessage struct {
-	IsSuitable bool `json:"IsSuitable"`
+	IsSuitable      bool             `json:"IsSuitable"`
+	Timestamp       int64            `json:"Timestamp,omitempty"`
+	NetworkKeyProof []byte           `json:"NetworkKeyProof,omitempty"`
+	Invitation      *admission.Token `json:"Invitation,omitempty"`
 }
 
 func (msg *NetNewNodeJoinConfirmMessage) Serialize() ([]byte, error) {
@@ -108,8 +194,8 @@ func (msg *NetNewNodeJoinConfirmMessage) Serialize() ([]byte, error) {
 // NetNewNodeJoinQueryMessage is the message a node sends when joining a network for the FIRST TIME ever. It will also be used for RTT.
 // The fields represent the data of the sending node, since this message is used as a request and a response.
 type NetNewNodeJoinQueryMessage struct {
-	NewNode   network.IpPortPair `json:"NewNode"`
-	Timestamp int64              `json:"Timestamp"`
+	NewNode   NodeRef `json:"NewNode"`
+	Timestamp int64   `json:"Timestamp"`
 }
 
 func (msg *NetNewNodeJoinQueryMessage) Serialize() ([]byte, error) {
@@ -117,27 +203,105 @@ func (msg *NetNewNodeJoinQueryMessage) Serialize() ([]byte, error) {
 }
 
 // NetLifeLineMessage is a message that will be sent periodically to let the other nodes that this node is alive.
+// Incarnation is the counter the node bumps every time it has to refute its own death.
+// EncryptionKey is the key other nodes seal payloads for the node with.
 type NetLifeLineMessage struct {
-	Node network.IpPortPair `json:"Node"`
+	Node          NodeRef                       `json:"Node"`
+	Incarnation   uint64                        `json:"Incarnation"`
+	Health        *NodeHealth                   `json:"Health,omitempty"`
+	EncryptionKey *identity.EncryptionKeyRecord `json:"EncryptionKey,omitempty"`
+}
+
+// NetLifeLineDigestMessage is the aggregated heartbeat a node sends to its direct neighbours only, instead of flooding its own lifeline.
+// It contains the freshest liveness info the node knows about every node in its vision, itself included.
+type NetLifeLineDigestMessage struct {
+	Entries []LifeLineDigestEntry `json:"Entries"`
+}
+
+func (msg *NetLifeLineDigestMessage) Serialize() ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// LifeLineDigestEntry is the liveness info about one node. LastSeenAgo is relative, in milliseconds, so that the clocks of the nodes do not need to be in sync.
+type LifeLineDigestEntry struct {
+	Node          NodeRef                       `json:"Node"`
+	LastSeenAgo   int64                         `json:"LastSeenAgo"`
+	Incarnation   uint64                        `json:"Incarnation"`
+	Health        *NodeHealth                   `json:"Health,omitempty"`
+	EncryptionKey *identity.EncryptionKeyRecord `json:"EncryptionKey,omitempty"`
+}
+
+// NetPingMessage is sent periodically to each primary connection to measure the RTT. The same message is echoed back as a NetPong.
+// Timestamp is in microseconds, and it only has a meaning for the node that sent the ping.
+type NetPingMessage struct {
+	Timestamp int64 `json:"Timestamp"`
+}
+
+func (msg *NetPingMessage) Serialize() ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// NodeHealth is the optional record a node puts in its lifelines, describing how loaded it is.
+// LoadScore goes from 0 (idle) to 1 (full queue and no free connection slots).
+type NodeHealth struct {
+	QueueLength   uint16  `json:"QueueLength"`
+	FreeConnSlots uint8   `json:"FreeConnSlots"`
+	DepthVision   uint8   `json:"DepthVision"`
+	Uptime        uint64  `json:"Uptime"`
+	Version       string  `json:"Version"`
+	LoadScore     float64 `json:"LoadScore"`
 }
 
 func (msg *NetLifeLineMessage) Serialize() ([]byte, error) {
 	return json.Marshal(msg)
 }
 
+// NetDeathAnnouncementMessage is the message flooded when a node finds out that some of its connections are dead.
+// Incarnations holds the incarnation the announcer knew for each dead node, keyed by its ID.
+// Reporter is the node that found out about the deaths, and it stays the same while the message is forwarded.
 type NetDeathAnnouncementMessage struct {
-	DeadNodes []network.IpPortPair `json:"DeadNodes"`
+	DeadNodes    []NodeRef                  `json:"DeadNodes"`
+	Incarnations map[identity.NodeID]uint64 `json:"Incarnations"`
+	Reporter     NodeRef                    `json:"Reporter"`
 }
 
 func (msg *NetDeathAnnouncementMessage) Serialize() ([]byte, error) {
 	return json.Marshal(msg)
 }
 
+// NetUpdateMessage carries the connections of the nodes around the updated node, keyed by the ID of the node that has them.
 type NetUpdateMessage struct {
-	UpdatedNode network.IpPortPair              `json:"UpdatedNode"`
-	Conns       map[string][]network.IpPortPair `json:"Conns"`
+	UpdatedNode NodeRef                       `json:"UpdatedNode"`
+	Conns       map[identity.NodeID][]NodeRef `json:"Conns"`
 }
 
 func (msg *NetUpdateMessage) Serialize() ([]byte, error) {
 	return json.Marshal(msg)
 }
+
+// NetConnsRequestMessage asks a node for its primary connections, and it is sent straight to it.
+// The nonce of the envelope identifies the request.
+type NetConnsRequestMessage struct{}
+
+func (msg *NetConnsRequestMessage) Serialize() ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// ConnInfo is a primary connection of a node, as the node sees it.
+type ConnInfo struct {
+	Node        NodeRef `json:"Node"`
+	State       string  `json:"State"`
+	Incarnation uint64  `json:"Incarnation"`
+	RTT         float64 `json:"RTT,omitempty"`
+}
+
+// NetConnsResponseMessage is the answer to a NetConnsRequest, sent straight back to the node that asked.
+type NetConnsResponseMessage struct {
+	RequestID   string     `json:"RequestID"`
+	Incarnation uint64     `json:"Incarnation"`
+	Conns       []ConnInfo `json:"Conns"`
+}
+
+func (msg *NetConnsResponseMessage) Serialize() ([]byte, error) {
+	return json.Marshal(msg)
+}
@@ -0,0 +1,85 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+// OnionSize is the size every layer of an onion is padded to before being sent, such that a hop cannot tell from the size of a layer
+// how far it is from the destination.
+const OnionSize = 16 * 1024
+
+// The room the padding field takes in a serialized layer, on top of the padding itself.
+var paddingOverhead = len(`,"Padding":""`)
+
+// OnionLayer is what a hop finds once it opens the layer sealed for it: the next hop, and the layer to send it.
+// The last hop has no next hop, and Inner is the payload itself.
+type OnionLayer struct {
+	Next  NodeRef `json:"Next"`
+	Inner []byte  `json:"Inner"`
+}
+
+// WrapOnion wraps the payload in one layer for each hop, the first hop being the outermost layer and the last hop the destination.
+// Each hop only learns the next hop, and only the destination can read the payload.
+// The layers of a NetOnion message are NetSealedMessages, each sealed for the hop it is sent to.
+func WrapOnion(payload []byte, hops []NodeRef, encKeys [][]byte) (NetSealedMessage, error) {
+	if len(hops) == 0 || len(hops) != len(encKeys) {
+		return NetSealedMessage{}, fmt.Errorf("need one encryption key for each of the %d hops, got %d", len(hops), len(encKeys))
+	}
+
+	var sealed NetSealedMessage
+	layer := OnionLayer{Inner: payload}
+	for i := len(hops) - 1; i >= 0; i-- {
+		b, err := json.Marshal(&layer)
+		if err != nil {
+			return NetSealedMessage{}, err
+		}
+
+		if sealed, err = SealPayload(b, hops[i], encKeys[i]); err != nil {
+			return NetSealedMessage{}, err
+		}
+
+		if b, err = sealed.Serialize(); err != nil {
+			return NetSealedMessage{}, err
+		}
+		layer = OnionLayer{Next: hops[i], Inner: b}
+	}
+
+	return sealed, nil
+}
+
+// PeelOnion opens the layer sealed for the identity.
+func PeelOnion(msg *NetSealedMessage, id *identity.Identity) (OnionLayer, error) {
+	b, err := OpenPayload(msg, id)
+	if err != nil {
+		return OnionLayer{}, err
+	}
+
+	layer := OnionLayer{}
+	if err = json.Unmarshal(b, &layer); err != nil {
+		return OnionLayer{}, fmt.Errorf("cannot parse onion layer - %s", err)
+	}
+	return layer, nil
+}
+
+// PadOnion pads the layer, such that it serializes to exactly OnionSize bytes.
+func PadOnion(msg *NetSealedMessage) error {
+	msg.Padding = ""
+	b, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+
+	missing := OnionSize - len(b)
+	if missing == 0 {
+		return nil
+	}
+	if missing <= paddingOverhead {
+		return fmt.Errorf("onion layer of %d bytes does not fit in %d bytes - use a smaller payload or fewer hops", len(b), OnionSize)
+	}
+	msg.Padding = strings.Repeat("0", missing-paddingOverhead)
+	return nil
+}
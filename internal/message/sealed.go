@@ -0,0 +1,122 @@
+package message
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+var ErrNotSealedForUs = errors.New("payload is sealed for another node")
+
+const sealedKeyInfo = "overlay-network sealed payload"
+
+// NetSealedMessage is an application payload that only the destination node can read.
+// The payload is encrypted with AES-GCM, under a key derived from an ephemeral X25519 key and the encryption key of the destination.
+// Who sent it is known from the signature of the envelope, which covers the whole message.
+type NetSealedMessage struct {
+	Destination  NodeRef `json:"Destination"`
+	EphemeralKey []byte  `json:"EphemeralKey"`
+	Nonce        []byte  `json:"Nonce"`
+	Ciphertext   []byte  `json:"Ciphertext"`
+	// Padding fills the onion layers up to OnionSize. It is not sealed, each hop pads the layer it sends.
+	Padding string `json:"Padding,omitempty"`
+}
+
+func (msg *NetSealedMessage) Serialize() ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func sealedCipher(shared []byte, ephemeralKey []byte, destKey []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeralKey...), destKey...)
+	key, err := hkdf.Key(sha256.New, shared, salt, sealedKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealPayload encrypts the payload for the destination node, given its public encryption key.
+func SealPayload(payload []byte, dest NodeRef, destEncKey []byte) (NetSealedMessage, error) {
+	destKey, err := ecdh.X25519().NewPublicKey(destEncKey)
+	if err != nil {
+		return NetSealedMessage{}, fmt.Errorf("invalid encryption key for node %s - %s", dest.ID.Short(), err)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return NetSealedMessage{}, fmt.Errorf("cannot generate ephemeral key - %s", err)
+	}
+
+	shared, err := ephemeral.ECDH(destKey)
+	if err != nil {
+		return NetSealedMessage{}, fmt.Errorf("cannot agree on a key with node %s - %s", dest.ID.Short(), err)
+	}
+
+	aead, err := sealedCipher(shared, ephemeral.PublicKey().Bytes(), destEncKey)
+	if err != nil {
+		return NetSealedMessage{}, fmt.Errorf("cannot create cipher - %s", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return NetSealedMessage{}, fmt.Errorf("cannot generate nonce - %s", err)
+	}
+
+	return NetSealedMessage{
+		Destination:  dest,
+		EphemeralKey: ephemeral.PublicKey().Bytes(),
+		Nonce:        nonce,
+		// The destination is authenticated as well, so that the payload cannot be redirected to another node.
+		Ciphertext: aead.Seal(nil, nonce, payload, []byte(dest.ID)),
+	}, nil
+}
+
+// OpenPayload decrypts a payload sealed for the identity.
+func OpenPayload(msg *NetSealedMessage, id *identity.Identity) ([]byte, error) {
+	if !msg.Destination.Is(id.ID()) {
+		return nil, ErrNotSealedForUs
+	}
+
+	encKey, err := id.EncryptionKey()
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive encryption key - %s", err)
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(msg.EphemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key - %s", err)
+	}
+
+	shared, err := encKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("cannot agree on a key - %s", err)
+	}
+
+	aead, err := sealedCipher(shared, msg.EphemeralKey, encKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher - %s", err)
+	}
+
+	if len(msg.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size %d", len(msg.Nonce))
+	}
+
+	payload, err := aead.Open(nil, msg.Nonce, msg.Ciphertext, []byte(msg.Destination.ID))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt payload - %s", err)
+	}
+	return payload, nil
+}
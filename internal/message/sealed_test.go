@@ -0,0 +1,90 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+func TestSealedPayloadOnlyOpensForDestination(t *testing.T) {
+	dest, _ := identity.Generate()
+	other, _ := identity.Generate()
+
+	record, err := dest.NewEncryptionKeyRecord()
+	if err != nil {
+		t.Fatalf("could not create encryption key record - %s", err)
+	}
+	if err = record.Verify(dest.ID()); err != nil {
+		t.Fatalf("encryption key record of the destination is not valid - %s", err)
+	}
+	if err = record.Verify(other.ID()); err == nil {
+		t.Error("encryption key record is valid for another node")
+	}
+
+	payload := []byte("only for the destination")
+	msg, err := SealPayload(payload, NodeRef{ID: dest.ID()}, record.EncryptionKey)
+	if err != nil {
+		t.Fatalf("could not seal payload - %s", err)
+	}
+
+	if opened, err := OpenPayload(&msg, dest); err != nil || !bytes.Equal(opened, payload) {
+		t.Errorf("destination could not open the payload - %v", err)
+	}
+
+	if _, err = OpenPayload(&msg, other); !errors.Is(err, ErrNotSealedForUs) {
+		t.Errorf("another node opened the payload - %v", err)
+	}
+
+	// Pretending the payload is for another node must not work either, since the destination is authenticated.
+	msg.Destination = NodeRef{ID: other.ID()}
+	if _, err = OpenPayload(&msg, other); err == nil {
+		t.Error("payload redirected to another node could be opened")
+	}
+}
+
+func TestOnionLayersHaveTheSameSize(t *testing.T) {
+	relay, _ := identity.Generate()
+	dest, _ := identity.Generate()
+
+	hops := []NodeRef{{ID: relay.ID()}, {ID: dest.ID()}}
+	var encKeys [][]byte
+	for _, id := range []*identity.Identity{relay, dest} {
+		record, err := id.NewEncryptionKeyRecord()
+		if err != nil {
+			t.Fatalf("could not create encryption key record - %s", err)
+		}
+		encKeys = append(encKeys, record.EncryptionKey)
+	}
+
+	outer, err := WrapOnion([]byte("hidden"), hops, encKeys)
+	if err != nil {
+		t.Fatalf("could not wrap onion - %s", err)
+	}
+	if err = PadOnion(&outer); err != nil {
+		t.Fatalf("could not pad outer layer - %s", err)
+	}
+
+	layer, err := PeelOnion(&outer, relay)
+	if err != nil {
+		t.Fatalf("relay could not peel its layer - %s", err)
+	}
+	inner := NetSealedMessage{}
+	if err = json.Unmarshal(layer.Inner, &inner); err != nil {
+		t.Fatalf("could not parse inner layer - %s", err)
+	}
+	if err = PadOnion(&inner); err != nil {
+		t.Fatalf("could not pad inner layer - %s", err)
+	}
+
+	for name, msg := range map[string]*NetSealedMessage{"outer": &outer, "inner": &inner} {
+		if b, _ := msg.Serialize(); len(b) != OnionSize {
+			t.Errorf("%s layer is %d bytes - expected %d", name, len(b), OnionSize)
+		}
+	}
+	if last, err := PeelOnion(&inner, dest); err != nil || string(last.Inner) != "hidden" {
+		t.Errorf("destination could not read the payload - %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package message
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+var ErrMissingSignature = errors.New("envelope is not signed")
+var ErrBadSignature = errors.New("envelope signature is not valid")
+
+// signedPayload returns the bytes covered by the signature of an envelope.
+// Only the fields set by the original sender are covered, since they must survive the forwarding of the envelope.
+// The locator of the original sender is covered along with its ID, since the nodes move it to where the envelope says it is.
+func signedPayload(env *MessageEnvelope) []byte {
+	// The same address can be held in 4 or 16 bytes, depending on how it was parsed.
+	ip := env.OriginalSender.Locator.Ip
+	if ip16 := ip.To16(); ip16 != nil {
+		ip = ip16
+	}
+
+	b := make([]byte, 0, 2+8+2+len(env.OriginalSender.ID)+2+len(ip)+2+2+len(env.Nonce)+len(env.Data))
+	b = binary.BigEndian.AppendUint16(b, uint16(env.Type))
+	b = binary.BigEndian.AppendUint64(b, uint64(env.Timestamp))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(env.OriginalSender.ID)))
+	b = append(b, env.OriginalSender.ID...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(ip)))
+	b = append(b, ip...)
+	b = binary.BigEndian.AppendUint16(b, env.OriginalSender.Locator.Port)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(env.Nonce)))
+	b = append(b, env.Nonce...)
+	return append(b, env.Data...)
+}
+
+// SignMessageEnvelope stamps the envelope with the time it is signed at and a random nonce, and signs it with the key of the original sender.
+func SignMessageEnvelope(env *MessageEnvelope, id *identity.Identity, now time.Time) error {
+	if !env.OriginalSender.Is(id.ID()) {
+		return fmt.Errorf("cannot sign envelope originally sent by %s with the key of %s", env.OriginalSender.ID.Short(), id.ID().Short())
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("cannot generate nonce - %s", err)
+	}
+
+	env.Timestamp = now.UnixMilli()
+	env.Nonce = hex.EncodeToString(nonce)
+	// Cloned, so that decoding into the envelope later on never touches the key of the node.
+	env.OriginKey = slices.Clone(id.PublicKey)
+	env.Signature = ed25519.Sign(id.PrivateKey, signedPayload(env))
+	return nil
+}
+
+// VerifyMessageEnvelope checks that the envelope has been signed by the key its original sender ID is derived from.
+func VerifyMessageEnvelope(env *MessageEnvelope) error {
+	if len(env.Signature) == 0 || len(env.OriginKey) == 0 {
+		return ErrMissingSignature
+	}
+
+	if len(env.OriginKey) != ed25519.PublicKeySize || identity.IDFromPublicKey(env.OriginKey) != env.OriginalSender.ID {
+		return fmt.Errorf("%w - the origin key does not match the original sender %s", ErrBadSignature, env.OriginalSender.ID.Short())
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(env.OriginKey), signedPayload(env), env.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
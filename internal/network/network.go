@@ -2,12 +2,16 @@ package network
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"slices"
 	"time"
 
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
 	"github.com/TheJ0lly/Overlay-Network/internal/logging"
 )
 
@@ -38,16 +42,78 @@ func CompareIpPortPair(p1, p2 IpPortPair) bool {
 	return slices.Compare(p1.Ip, p2.Ip) == 0 && p1.Port == p2.Port
 }
 
-func SendToDest(msg json.RawMessage, dest IpPortPair, timeoutInSecs time.Duration) error {
+var ErrMessageTooBig = errors.New("message is too big")
 
+// ReadMessage reads everything the peer sends on the connection, up to maxSize bytes and until the timeout passes.
+// A peer sending more than that, or too slowly, gets the connection dropped instead of stalling the node.
+func ReadMessage(conn net.Conn, maxSize int64, timeout time.Duration) ([]byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	b, err := io.ReadAll(io.LimitReader(conn, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(b)) > maxSize {
+		return nil, fmt.Errorf("%w - more than %d bytes", ErrMessageTooBig, maxSize)
+	}
+	return b, nil
+}
+
+// Transport delivers the messages to the other nodes. The id is the ID the destination must prove over TLS, and it is not checked when empty.
+type Transport interface {
+	Send(msg []byte, dest IpPortPair, id identity.NodeID, timeoutInSecs time.Duration) error
+}
+
+// Dest is a node the messages are sent to: its address, and the ID it must prove over TLS.
+type Dest struct {
+	ID   identity.NodeID
+	Addr IpPortPair
+}
+
+// Network is how a node reaches the other nodes: the transport its messages go through, and the TLS config of its links.
+// Each node has its own, such that the nodes running in the same process do not share them.
+type Network struct {
+	// Transport is what the messages go through. When nil, they are sent over TCP, or TLS if it is enabled.
+	Transport Transport
+	// TLS is the config of all the links of the node. When nil, the links are plain TCP.
+	TLS *tls.Config
+	// Trust is the policy of the links, which also tells the members of the network. When nil, any node is a member.
+	Trust *TrustPolicy
+	// Log is the logger of the network of the node. When nil, the network logs as the "network" component.
+	Log *logging.Logger
+}
+
+// Member tells if the node is a member of the network, such that what it signs is accepted.
+func (nw *Network) Member(id identity.NodeID) bool {
+	return nw.Trust == nil || nw.Trust.Allows(id)
+}
+
+func (nw *Network) log() *logging.Logger {
+	if nw.Log == nil {
+		return logging.Component("network")
+	}
+	return nw.Log
+}
+
+// tcpTransport opens a connection to the destination for each message, over TLS if the network enables it.
+type tcpTransport struct {
+	nw *Network
+}
+
+func (t tcpTransport) Send(msg []byte, dest IpPortPair, id identity.NodeID, timeoutInSecs time.Duration) error {
 	destNodeHostString := dest.NetString()
 
-	conn, err := net.DialTimeout("tcp", destNodeHostString, time.Second*time.Duration(timeoutInSecs))
+	conn, err := t.nw.dial(destNodeHostString, id, time.Second*time.Duration(timeoutInSecs))
 	if err != nil {
 		return fmt.Errorf("cannot send message to node %s - %s", destNodeHostString, err)
 	}
 	defer conn.Close()
 
+	// A peer that does not read must not hold the sender forever.
+	conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(timeoutInSecs)))
 	size, err := conn.Write(msg)
 	if err != nil {
 		return fmt.Errorf("cannot send message to node %s - %s", destNodeHostString, err)
@@ -60,24 +126,37 @@ func SendToDest(msg json.RawMessage, dest IpPortPair, timeoutInSecs time.Duratio
 	return nil
 }
 
-func SendToMultipleDest(msg json.RawMessage, dests []IpPortPair, skipDests []IpPortPair, timeoutInSecs time.Duration) (sendErrors uint64) {
+// CurrentTransport returns the transport the messages go through, such that it can be wrapped.
+func (nw *Network) CurrentTransport() Transport {
+	if nw.Transport == nil {
+		return tcpTransport{nw}
+	}
+	return nw.Transport
+}
+
+// SendToDest sends the message to the node at dest, which must prove the given ID over TLS, unless it is empty.
+func (nw *Network) SendToDest(msg json.RawMessage, dest IpPortPair, id identity.NodeID, timeoutInSecs time.Duration) error {
+	return nw.CurrentTransport().Send(msg, dest, id, timeoutInSecs)
+}
+
+func (nw *Network) SendToMultipleDest(msg json.RawMessage, dests []Dest, skipDests []IpPortPair, timeoutInSecs time.Duration) (sendErrors uint64) {
 	sendErrors = 0
 	for i := range dests {
 		d := dests[i]
 
 		if slices.ContainsFunc(skipDests, func(skipIpp IpPortPair) bool {
-			return CompareIpPortPair(d, skipIpp)
+			return CompareIpPortPair(d.Addr, skipIpp)
 		}) {
-			logging.LogDebug("jumping over node: %s", d.NetString())
+			nw.log().With("dest", d.Addr.NetString()).Debug("jumping over node")
 			continue
 		}
 
-		if err := SendToDest(msg, d, timeoutInSecs); err != nil {
-			logging.LogError("could not forward message - %s", err)
+		if err := nw.SendToDest(msg, d.Addr, d.ID, timeoutInSecs); err != nil {
+			nw.log().With("dest", d.Addr.NetString()).Error("could not forward message - %s", err)
 			sendErrors++
 			continue
 		}
-		logging.LogDebug("forwarded message to node: %s", d.NetString())
+		nw.log().With("dest", d.Addr.NetString()).Debug("forwarded message to node")
 	}
 	return sendErrors
 }
@@ -0,0 +1,167 @@
+package network
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+// TrustPolicy decides which nodes we accept links with, once they proved their ID.
+// A policy without trusted IDs accepts no node, unless AnyNode is set.
+type TrustPolicy struct {
+	TrustedIDs map[identity.NodeID]bool
+	// AnyNode makes the policy accept any node that proves its ID.
+	AnyNode bool
+}
+
+// LoadTrustPolicy reads the IDs of the trusted nodes from a file, one per line. Empty lines and lines starting with '#' are skipped.
+func LoadTrustPolicy(path string) (TrustPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return TrustPolicy{}, fmt.Errorf("cannot open trust file %s - %s", path, err)
+	}
+	defer f.Close()
+
+	tp := TrustPolicy{TrustedIDs: map[identity.NodeID]bool{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tp.TrustedIDs[identity.NodeID(strings.ToUpper(line))] = true
+	}
+
+	if err = scanner.Err(); err != nil {
+		return TrustPolicy{}, fmt.Errorf("cannot read trust file %s - %s", path, err)
+	}
+	return tp, nil
+}
+
+// Allows checks if a link with the node is accepted by the policy.
+func (tp TrustPolicy) Allows(id identity.NodeID) bool {
+	return tp.AnyNode || tp.TrustedIDs[id]
+}
+
+// Empty tells if the policy accepts no node at all.
+func (tp TrustPolicy) Empty() bool {
+	return !tp.AnyNode && len(tp.TrustedIDs) == 0
+}
+
+// peerIDFromRawCerts returns the ID proved by the certificate the peer presented.
+func peerIDFromRawCerts(rawCerts [][]byte) (identity.NodeID, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("peer did not present a certificate")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return "", fmt.Errorf("cannot parse peer certificate - %s", err)
+	}
+	return identity.IDFromCertificate(cert)
+}
+
+// NewTLSConfig creates the config for mutually authenticated links: both sides present their self-signed node certificate,
+// and the peer is accepted only if its certificate is valid and the trust policy allows its ID.
+// There is no CA involved, the identity of a node is its key.
+func NewTLSConfig(cert tls.Certificate, trust TrustPolicy) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		// The standard verification needs a CA, thus it is replaced with ours, for both the client and the server side.
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			id, err := peerIDFromRawCerts(rawCerts)
+			if err != nil {
+				return err
+			}
+
+			if !trust.Allows(id) {
+				return fmt.Errorf("node %s is not trusted", id.Short())
+			}
+			return nil
+		},
+	}
+}
+
+// Listen starts listening on the address, over TLS if it is enabled.
+func (nw *Network) Listen(address string) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil || nw.TLS == nil {
+		return l, err
+	}
+	return tls.NewListener(l, nw.TLS), nil
+}
+
+// Handshake completes the TLS handshake of an accepted connection, such that the peer is known before anything is read.
+// It does nothing for plain TCP connections.
+func Handshake(conn net.Conn, timeout time.Duration) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	return tlsConn.Handshake()
+}
+
+// PeerID returns the ID the peer proved during the TLS handshake. It is false for plain TCP connections.
+func PeerID(conn net.Conn) (identity.NodeID, bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+
+	id, err := identity.IDFromCertificate(state.PeerCertificates[0])
+	if err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// dial connects to the node at the address. Over TLS, the node must also prove the given ID, unless it is empty,
+// such that a trusted node cannot stand in for another one.
+func (nw *Network) dial(address string, id identity.NodeID, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if nw.TLS == nil {
+		return dialer.Dial("tcp", address)
+	}
+	if id == "" {
+		return tls.DialWithDialer(dialer, "tcp", address, nw.TLS)
+	}
+
+	config := nw.TLS.Clone()
+	verify := config.VerifyPeerCertificate
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+		got, err := peerIDFromRawCerts(rawCerts)
+		if err != nil {
+			return err
+		}
+		if got != id {
+			return fmt.Errorf("node at %s is %s - expected %s", address, got.Short(), id.Short())
+		}
+		return nil
+	}
+	return tls.DialWithDialer(dialer, "tcp", address, config)
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+func createTLSConfig(t *testing.T, trusted ...identity.NodeID) (*identity.Identity, *tls.Config) {
+	id, err := identity.Generate()
+	if err != nil {
+		t.Fatal("could not generate identity")
+	}
+
+	cert, err := identity.NewCertificate(id)
+	if err != nil {
+		t.Fatalf("could not create certificate - %s", err)
+	}
+
+	// Without trusted IDs, any node is accepted.
+	trust := TrustPolicy{TrustedIDs: map[identity.NodeID]bool{}, AnyNode: len(trusted) == 0}
+	for _, tid := range trusted {
+		trust.TrustedIDs[tid] = true
+	}
+	return id, NewTLSConfig(cert, trust)
+}
+
+// acceptOne accepts a single connection on the listener, and sends back the ID of the peer, or "" if the link failed.
+func acceptOne(l net.Listener) chan identity.NodeID {
+	peers := make(chan identity.NodeID, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			peers <- ""
+			return
+		}
+		defer conn.Close()
+
+		if _, err = io.ReadAll(conn); err != nil {
+			peers <- ""
+			return
+		}
+		id, _ := PeerID(conn)
+		peers <- id
+	}()
+	return peers
+}
+
+func listenLoopback(t *testing.T, config *tls.Config) (net.Listener, IpPortPair) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen on loopback - %s", err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	return tls.NewListener(l, config), IpPortPair{Ip: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestTLSLinkProvesIdentity(t *testing.T) {
+	clientID, clientConfig := createTLSConfig(t)
+	_, serverConfig := createTLSConfig(t, clientID.ID())
+	l, dest := listenLoopback(t, serverConfig)
+	defer l.Close()
+	peers := acceptOne(l)
+
+	nw := &Network{TLS: clientConfig}
+
+	if err := nw.SendToDest([]byte("hello"), dest, "", 1); err != nil {
+		t.Fatalf("could not send over TLS - %s", err)
+	}
+
+	if peer := <-peers; peer != clientID.ID() {
+		t.Errorf("server saw peer %q - expected %q", peer, clientID.ID())
+	}
+}
+
+func TestTLSLinkChecksServerID(t *testing.T) {
+	serverID, serverConfig := createTLSConfig(t)
+	l, dest := listenLoopback(t, serverConfig)
+	defer l.Close()
+	_, clientConfig := createTLSConfig(t)
+	nw := &Network{TLS: clientConfig}
+
+	peers := acceptOne(l)
+	if err := nw.SendToDest([]byte("hello"), dest, serverID.ID(), 1); err != nil {
+		t.Fatalf("could not send to the expected server - %s", err)
+	}
+	<-peers
+
+	// A trusted node answering in place of another one is refused.
+	peers = acceptOne(l)
+	if err := nw.SendToDest([]byte("hello"), dest, "SOMEONEELSE", 1); err == nil {
+		t.Error("client sent to a server with another ID")
+	}
+	<-peers
+}
+
+func TestEmptyTrustPolicyAcceptsNobody(t *testing.T) {
+	if (TrustPolicy{}).Allows("SOMEONE") {
+		t.Error("empty trust policy accepted a node")
+	}
+	if !(TrustPolicy{AnyNode: true}).Allows("SOMEONE") {
+		t.Error("trust policy of any node refused a node")
+	}
+}
+
+func TestTLSLinkRejectsUntrustedNodes(t *testing.T) {
+	_, serverConfig := createTLSConfig(t, "SOMEONEELSE")
+	l, dest := listenLoopback(t, serverConfig)
+	defer l.Close()
+	peers := acceptOne(l)
+
+	_, clientConfig := createTLSConfig(t)
+	nw := &Network{TLS: clientConfig}
+
+	// The client may finish its side of the handshake before the server rejects it, thus only the server side is checked.
+	nw.SendToDest([]byte("hello"), dest, "", 1)
+	if peer := <-peers; peer != "" {
+		t.Errorf("server accepted untrusted peer %q", peer)
+	}
+
+	// A plain TCP client must not get through either.
+	peers = acceptOne(l)
+	(&Network{}).SendToDest([]byte("hello"), dest, "", 1)
+	if peer := <-peers; peer != "" {
+		t.Errorf("server accepted plain TCP peer %q", peer)
+	}
+
+	// And the client must refuse a server it does not trust.
+	_, clientConfig = createTLSConfig(t, "SOMEONEELSE")
+	nw.TLS = clientConfig
+	peers = acceptOne(l)
+	if err := nw.SendToDest([]byte("hello"), dest, "", 1); err == nil {
+		t.Error("client sent to an untrusted server")
+	}
+	<-peers
+}
@@ -0,0 +1,386 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/fault"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+)
+
+// NodeView is what the admin API shows of a node in the vision.
+type NodeView struct {
+	ID            identity.NodeID     `json:"ID"`
+	Address       string              `json:"Address"`
+	State         string              `json:"State"`
+	Incarnation   uint64              `json:"Incarnation"`
+	DepthVision   uint8               `json:"DepthVision,omitempty"`
+	LastTimeAlive int64               `json:"LastTimeAlive,omitempty"`
+	SmoothedRTT   float64             `json:"SmoothedRTT,omitempty"`
+	RTTJitter     float64             `json:"RTTJitter,omitempty"`
+	EncryptionKey bool                `json:"EncryptionKey"`
+	Health        *message.NodeHealth `json:"Health,omitempty"`
+	Conns         []NodeView          `json:"Conns,omitempty"`
+}
+
+func (n *Node) view(layers uint8) NodeView {
+	v := NodeView{
+		ID:            n.ID,
+		Address:       n.GetNodeAddress(),
+		State:         n.livenessState().String(),
+		Incarnation:   n.Incarnation,
+		DepthVision:   n.DepthVision,
+		LastTimeAlive: n.LastTimeAlive,
+		SmoothedRTT:   n.SmoothedRTT,
+		RTTJitter:     n.RTTJitter,
+		EncryptionKey: n.EncryptionKey != nil,
+		Health:        n.Health,
+	}
+
+	if layers == 0 {
+		return v
+	}
+	for i := range n.Conns {
+		v.Conns = append(v.Conns, n.Conns[i].view(layers-1))
+	}
+	return v
+}
+
+// NodeConfig is the configuration of a running node, as shown by the admin API.
+type NodeConfig struct {
+	ID                 identity.NodeID   `json:"ID"`
+	Address            string            `json:"Address"`
+	Incarnation        uint64            `json:"Incarnation"`
+	Uptime             string            `json:"Uptime"`
+	ConnCap            int               `json:"ConnCap"`
+	QueueCap           int               `json:"QueueCap"`
+	LifeLineTimer      uint8             `json:"LifeLineTimer"`
+	DeathTimer         uint8             `json:"DeathTimer"`
+	DepthVision        uint8             `json:"DepthVision"`
+	DeathQuorum        uint8             `json:"DeathQuorum"`
+	DeathQuorumWindow  uint8             `json:"DeathQuorumWindow"`
+	AdvertiseHealth    bool              `json:"AdvertiseHealth"`
+	AggregateLifeLines bool              `json:"AggregateLifeLines"`
+	OnionHops          uint8             `json:"OnionHops"`
+	NetworkKey         bool              `json:"NetworkKey"`
+	RequireInvitation  bool              `json:"RequireInvitation"`
+	MaxInboundConns    uint16            `json:"MaxInboundConns"`
+	ReadTimeout        uint8             `json:"ReadTimeout"`
+	RateLimit          float64           `json:"RateLimit"`
+	RateBurst          float64           `json:"RateBurst"`
+	BanDuration        uint16            `json:"BanDuration"`
+	ReplayWindow       uint8             `json:"ReplayWindow"`
+	StatsInterval      uint8             `json:"StatsInterval"`
+	LogLevels          map[string]string `json:"LogLevels"`
+}
+
+func (n *Node) config() NodeConfig {
+	return NodeConfig{
+		ID:                 n.ID,
+		Address:            n.GetNodeAddress(),
+		Incarnation:        n.Incarnation,
+		Uptime:             clock.Now().Sub(n.StartTime).Round(time.Second).String(),
+		ConnCap:            int(n.ConnCap),
+		QueueCap:           n.Queue.Capacity(),
+		LifeLineTimer:      n.LifeLineTimer,
+		DeathTimer:         n.DeathTimer,
+		DepthVision:        n.DepthVision,
+		DeathQuorum:        n.DeathQuorum,
+		DeathQuorumWindow:  n.DeathQuorumWindow,
+		AdvertiseHealth:    n.AdvertiseHealth,
+		AggregateLifeLines: n.AggregateLifeLines,
+		OnionHops:          n.OnionHops,
+		NetworkKey:         n.NetworkKey != nil,
+		RequireInvitation:  n.RequireInvitation,
+		MaxInboundConns:    n.MaxInboundConns,
+		ReadTimeout:        n.ReadTimeout,
+		RateLimit:          n.RateLimit,
+		RateBurst:          n.RateBurst,
+		BanDuration:        n.BanDuration,
+		ReplayWindow:       n.ReplayWindow,
+		StatsInterval:      n.StatsInterval,
+		LogLevels:          logging.Levels(),
+	}
+}
+
+// QueueView is the state of the message queue, as shown by the admin API.
+type QueueView struct {
+	Length   int            `json:"Length"`
+	Capacity int            `json:"Capacity"`
+	Types    map[string]int `json:"Types"`
+}
+
+// maxAdminPayload is the size of the biggest payload sent through the admin API, which leaves room for the onion layers.
+const maxAdminPayload = 32 << 10
+
+var errNoFaults = errors.New("fault injection is turned off on this node")
+
+// resolveNodeID finds the node of our vision whose ID starts with the prefix, which must match a single node.
+func (n *Node) resolveNodeID(prefix string) (identity.NodeID, error) {
+	prefix = strings.ToUpper(prefix)
+	if prefix == "" {
+		return "", fmt.Errorf("no destination given")
+	}
+
+	vg := &visionGraph{nodes: map[identity.NodeID]*Node{}, links: map[identity.NodeID][]identity.NodeID{}}
+	collectVisionGraph(n, vg, n.DepthVision)
+
+	var found []identity.NodeID
+	for id := range vg.nodes {
+		if strings.HasPrefix(string(id), prefix) {
+			found = append(found, id)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no node of our vision has an ID starting with %s", prefix)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("%d nodes of our vision have an ID starting with %s", len(found), prefix)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"Error": err.Error()})
+}
+
+// AdminHandler serves the admin API of the node, which shows its state and lets the operator act on it.
+// It must only be served on a local address, since anyone reaching it controls the node.
+// The vision is only read and changed through Do, the responses being built from what Do returned.
+//
+//	GET  /config              the configuration of the node
+//	GET  /peers               the primary connections, with their liveness
+//	GET  /topology            the whole vision of the node, as a tree, or flat with ?format=graph, or in Graphviz DOT with ?format=dot,
+//	                          or flat along with the settings topology.Check needs with ?format=vision
+//	GET  /crawl               crawl the whole network, waiting ?timeout= seconds for each step, and show the report and graph, only the graph with ?format=graph, or in Graphviz DOT with ?format=dot
+//	GET  /queue               the messages waiting in the queue
+//	GET  /stats               the stats of the node
+//	GET  /loglevel            the log level of each component
+//	POST /loglevel            change the log level, of all the components or of ?component= only, to ?level=
+//	POST /send                send the body as a sealed payload to ?dest=, a node ID or a unique prefix of it, through an onion with ?onion=true
+//	GET  /faults              the faults injected in the messages, with how many messages they hit
+//	POST /faults              inject the faults of the body, a fault.State, instead of the ones injected until now
+//	DELETE /faults            stop injecting faults
+//	POST /actions/lifeline    send a lifeline now
+//	POST /actions/deathcheck  look for dead primary connections now
+//	POST /actions/leave       announce that the node leaves the network, and stop it
+func (n *Node) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		var config NodeConfig
+		n.Do(func() { config = n.config() })
+		writeJSON(w, http.StatusOK, config)
+	})
+
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		var peers []NodeView
+		n.Do(func() {
+			peers = make([]NodeView, 0, len(n.Conns))
+			for i := range n.Conns {
+				peers = append(peers, n.Conns[i].view(0))
+			}
+		})
+		writeJSON(w, http.StatusOK, peers)
+	})
+
+	mux.HandleFunc("GET /topology", func(w http.ResponseWriter, r *http.Request) {
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "tree":
+			var v NodeView
+			n.Do(func() { v = n.view(n.DepthVision) })
+			writeJSON(w, http.StatusOK, v)
+		case "graph":
+			writeJSON(w, http.StatusOK, n.Topology())
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			n.Topology().WriteDOT(w)
+		case "vision":
+			writeJSON(w, http.StatusOK, n.Vision())
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown topology format %q - must be tree, graph, dot or vision", format))
+		}
+	})
+
+	mux.HandleFunc("GET /crawl", func(w http.ResponseWriter, r *http.Request) {
+		timeout := uint64(DefaultCrawlTimeout)
+		if t := r.URL.Query().Get("timeout"); t != "" {
+			var err error
+			if timeout, err = strconv.ParseUint(t, 10, 8); err != nil || timeout == 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid crawl timeout %q - must be between 1 and 255 seconds", t))
+				return
+			}
+		}
+
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "report" && format != "graph" && format != "dot" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown crawl format %q - must be report, graph or dot", format))
+			return
+		}
+
+		res, err := n.Crawl(uint8(timeout))
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+
+		switch format {
+		case "graph":
+			writeJSON(w, http.StatusOK, res.Graph)
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			res.Graph.WriteDOT(w)
+		default:
+			writeJSON(w, http.StatusOK, res)
+		}
+	})
+
+	mux.HandleFunc("GET /queue", func(w http.ResponseWriter, r *http.Request) {
+		qv := QueueView{Capacity: n.Queue.Capacity(), Types: map[string]int{}}
+		for _, env := range n.Queue.FindAllByFunc(func(message.MessageEnvelope) bool { return true }) {
+			qv.Types[env.Type.String()]++
+			qv.Length++
+		}
+		writeJSON(w, http.StatusOK, qv)
+	})
+
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := n.Stats()
+		writeJSON(w, http.StatusOK, &stats)
+	})
+
+	mux.HandleFunc("GET /loglevel", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, logging.Levels())
+	})
+
+	mux.HandleFunc("POST /loglevel", func(w http.ResponseWriter, r *http.Request) {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid log level - %s", err))
+			return
+		}
+
+		if component := r.URL.Query().Get("component"); component != "" {
+			logging.SetLevel(component, level)
+		} else {
+			logging.SetDefaultLevel(level)
+		}
+		n.Log.Info("log level changed to %s for %q", level, r.URL.Query().Get("component"))
+		writeJSON(w, http.StatusOK, logging.Levels())
+	})
+
+	mux.HandleFunc("POST /send", func(w http.ResponseWriter, r *http.Request) {
+		payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminPayload))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("could not read payload - %s", err))
+			return
+		}
+
+		var dest identity.NodeID
+		var resolveErr error
+		onion := r.URL.Query().Get("onion") == "true"
+		n.Do(func() {
+			if dest, resolveErr = n.resolveNodeID(r.URL.Query().Get("dest")); resolveErr != nil {
+				return
+			}
+			if onion {
+				err = n.SendOnion(dest, payload)
+			} else {
+				err = n.SendSealed(dest, payload)
+			}
+		})
+		if resolveErr != nil {
+			writeError(w, http.StatusBadRequest, resolveErr)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"Result": "payload sent", "Destination": dest, "Onion": onion})
+	})
+
+	mux.HandleFunc("GET /faults", func(w http.ResponseWriter, r *http.Request) {
+		if n.Faults == nil {
+			writeError(w, http.StatusNotFound, errNoFaults)
+			return
+		}
+		writeJSON(w, http.StatusOK, n.Faults.State())
+	})
+
+	mux.HandleFunc("POST /faults", func(w http.ResponseWriter, r *http.Request) {
+		if n.Faults == nil {
+			writeError(w, http.StatusNotFound, errNoFaults)
+			return
+		}
+
+		s := fault.State{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminPayload)).Decode(&s); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse faults - %s", err))
+			return
+		}
+		if err := n.Faults.Set(s); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		n.Log.Warn("injecting faults on request")
+		writeJSON(w, http.StatusOK, n.Faults.State())
+	})
+
+	mux.HandleFunc("DELETE /faults", func(w http.ResponseWriter, r *http.Request) {
+		if n.Faults == nil {
+			writeError(w, http.StatusNotFound, errNoFaults)
+			return
+		}
+		n.Faults.Reset()
+		n.Log.Info("stopped injecting faults on request")
+		writeJSON(w, http.StatusOK, n.Faults.State())
+	})
+
+	mux.HandleFunc("POST /actions/lifeline", func(w http.ResponseWriter, r *http.Request) {
+		n.Log.Info("sending lifeline on request")
+		n.Do(n.sendLifeLine)
+		writeJSON(w, http.StatusOK, map[string]string{"Result": "lifeline sent"})
+	})
+
+	mux.HandleFunc("POST /actions/deathcheck", func(w http.ResponseWriter, r *http.Request) {
+		n.Log.Info("checking for dead nodes on request")
+		var peers []NodeView
+		n.Do(func() {
+			n.checkDeaths()
+			peers = n.view(1).Conns
+		})
+		writeJSON(w, http.StatusOK, peers)
+	})
+
+	mux.HandleFunc("POST /actions/leave", func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		n.Do(func() { err = n.Leave() })
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"Result": "left the network"})
+	})
+
+	return mux
+}
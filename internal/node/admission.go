@@ -0,0 +1,87 @@
+package node
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/admission"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+)
+
+// admissionControlled checks if the node only lets admitted nodes join the network through it.
+func (n *Node) admissionControlled() bool {
+	return n.NetworkKey != nil || n.RequireInvitation
+}
+
+// admit checks that the joining node proved it is allowed in the network, when the node controls who can join.
+// A node knowing the network key is admitted, and so is a node holding an invitation from a member we know.
+func (n *Node) admit(joiner identity.NodeID, msg *message.NetNewNodeJoinConfirmMessage) error {
+	if !n.admissionControlled() {
+		return nil
+	}
+
+	if n.NetworkKey != nil && msg.NetworkKeyProof != nil {
+		window := (time.Duration(n.ReplayWindow) * time.Second).Milliseconds()
+		if now := clock.Now().UnixMilli(); now-msg.Timestamp > window || msg.Timestamp-now > window {
+			return fmt.Errorf("%w - network key proof made %d ms away from now", admission.ErrNotAdmitted, now-msg.Timestamp)
+		}
+		if !admission.CheckNetworkKeyProof(n.NetworkKey, joiner, msg.Timestamp, msg.NetworkKeyProof) {
+			return fmt.Errorf("%w - wrong network key proof", admission.ErrNotAdmitted)
+		}
+		return nil
+	}
+
+	if msg.Invitation != nil {
+		return n.acceptInvitation(joiner, msg.Invitation)
+	}
+
+	return fmt.Errorf("%w - no network key proof nor invitation", admission.ErrNotAdmitted)
+}
+
+// acceptInvitation checks the invitation and uses it up, so that it cannot be used again with this node.
+// An invitation anyone can use is only accepted by its issuer, such that it cannot be used once with each member of the network.
+func (n *Node) acceptInvitation(joiner identity.NodeID, token *admission.Token) error {
+	now := clock.Now()
+	if err := token.Verify(joiner, now); err != nil {
+		return fmt.Errorf("%w - %s", admission.ErrNotAdmitted, err)
+	}
+
+	if token.Invitee == "" && token.Issuer != n.ID {
+		return fmt.Errorf("%w - invitation without invitee issued by %s, it can only be used with its issuer", admission.ErrNotAdmitted, token.Issuer.Short())
+	}
+
+	if token.Issuer != n.ID && findNodeByIDInNode(n, token.Issuer, n.DepthVision) == nil {
+		return fmt.Errorf("%w - invitation issued by %s, who is not a member we know", admission.ErrNotAdmitted, token.Issuer.Short())
+	}
+
+	// Expired invitations are rejected anyway, thus there is no need to remember them.
+	for key, expires := range n.usedInvitations {
+		if expires < now.UnixMilli() {
+			delete(n.usedInvitations, key)
+		}
+	}
+
+	key := string(token.Issuer) + token.Nonce
+	if _, ok := n.usedInvitations[key]; ok {
+		return fmt.Errorf("%w - invitation has already been used", admission.ErrNotAdmitted)
+	}
+	n.usedInvitations[key] = token.Expires
+
+	n.Log.Info("node %s joins with an invitation from %s", joiner.Short(), token.Issuer.Short())
+	return nil
+}
+
+// joinAdmitted checks that a join message comes from a node that has been let in.
+// We only attach nodes we confirmed, and we only take into account the joins announced by the node the new one attached to.
+func (n *Node) joinAdmitted(msg *message.NetNewNodeJoinMessage, env *message.MessageEnvelope) bool {
+	if !n.admissionControlled() {
+		return true
+	}
+
+	if msg.AttachedNode.Is(n.ID) {
+		return slices.Contains(n.Stat.JoinQueriesOngoing, msg.JoiningNode.ID)
+	}
+	return env.OriginalSender.Is(msg.AttachedNode.ID)
+}
@@ -0,0 +1,80 @@
+package node
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/admission"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+)
+
+func TestAdmitChecksNetworkKeyProof(t *testing.T) {
+	n := createSignedNode(t, 8080)
+	n.NetworkKey = []byte("0123456789abcdef")
+	joiner := identity.NodeID("A")
+
+	now := time.Now().UnixMilli()
+	confirm := &message.NetNewNodeJoinConfirmMessage{Timestamp: now, NetworkKeyProof: admission.ProveNetworkKey(n.NetworkKey, joiner, now)}
+	if err := n.admit(joiner, confirm); err != nil {
+		t.Errorf("node proving the network key was not admitted - %s", err)
+	}
+
+	old := now - (time.Duration(n.ReplayWindow+1) * time.Second).Milliseconds()
+	confirm = &message.NetNewNodeJoinConfirmMessage{Timestamp: old, NetworkKeyProof: admission.ProveNetworkKey(n.NetworkKey, joiner, old)}
+	if err := n.admit(joiner, confirm); !errors.Is(err, admission.ErrNotAdmitted) {
+		t.Errorf("proof out of the replay window was accepted - %v", err)
+	}
+
+	confirm = &message.NetNewNodeJoinConfirmMessage{Timestamp: now, NetworkKeyProof: admission.ProveNetworkKey([]byte("another network key"), joiner, now)}
+	if err := n.admit(joiner, confirm); !errors.Is(err, admission.ErrNotAdmitted) {
+		t.Errorf("proof made with another key was accepted - %v", err)
+	}
+
+	if err := n.admit(joiner, &message.NetNewNodeJoinConfirmMessage{}); !errors.Is(err, admission.ErrNotAdmitted) {
+		t.Errorf("node without proof nor invitation was admitted - %v", err)
+	}
+}
+
+func TestInvitationChecks(t *testing.T) {
+	n, member := createSignedNode(t, 8080), createSignedNode(t, 8081)
+	n.RequireInvitation = true
+	n.DepthVision = 2
+	n.Conns = append(n.Conns, CreatePrimaryConnectionNode(member.GetNodeRef()))
+	invitee, _ := identity.Generate()
+
+	invite := func(issuer *Node, invitee identity.NodeID, validFor time.Duration) *message.NetNewNodeJoinConfirmMessage {
+		token, err := admission.NewToken(issuer.Identity, invitee, validFor)
+		if err != nil {
+			t.Fatalf("could not issue token - %s", err)
+		}
+		return &message.NetNewNodeJoinConfirmMessage{Invitation: &token}
+	}
+
+	confirm := invite(member, invitee.ID(), time.Minute)
+	if err := n.admit(invitee.ID(), confirm); err != nil {
+		t.Fatalf("invitee of a member was not admitted - %s", err)
+	}
+	if err := n.admit(invitee.ID(), confirm); !errors.Is(err, admission.ErrNotAdmitted) {
+		t.Errorf("invitation was used twice - %v", err)
+	}
+
+	if err := n.admit("A", invite(member, invitee.ID(), time.Minute)); !errors.Is(err, admission.ErrNotAdmitted) {
+		t.Errorf("invitation was used by another node than its invitee - %v", err)
+	}
+	if err := n.admit(invitee.ID(), invite(member, invitee.ID(), -time.Second)); !errors.Is(err, admission.ErrNotAdmitted) {
+		t.Errorf("expired invitation was accepted - %v", err)
+	}
+	if err := n.admit(invitee.ID(), invite(member, "", time.Minute)); !errors.Is(err, admission.ErrNotAdmitted) {
+		t.Errorf("open invitation was accepted by another node than its issuer - %v", err)
+	}
+	if err := n.admit(invitee.ID(), invite(n, "", time.Minute)); err != nil {
+		t.Errorf("open invitation was not accepted by its issuer - %s", err)
+	}
+
+	stranger := createSignedNode(t, 8082)
+	if err := n.admit(invitee.ID(), invite(stranger, invitee.ID(), time.Minute)); !errors.Is(err, admission.ErrNotAdmitted) {
+		t.Errorf("invitation from a node we do not know was accepted - %v", err)
+	}
+}
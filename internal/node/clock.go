@@ -0,0 +1,31 @@
+package node
+
+import "time"
+
+// Clock is where the nodes get the time from, how they wait, and how they do things in the background.
+// The simulator replaces it with its own, such that the protocol runs on simulated time.
+// The envelopes are signed and checked against the replay window with it as well, such that simulated time does not make them look old.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// Go runs f in the background.
+	Go(f func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+func (realClock) Go(f func())           { go f() }
+
+var clock Clock = realClock{}
+
+// SetClock makes all the nodes use the given clock. It must be called before any node is created.
+func SetClock(c Clock) {
+	clock = c
+}
+
+// CurrentClock returns the clock the nodes use, such that it can be put back once replaced.
+func CurrentClock() Clock {
+	return clock
+}
@@ -0,0 +1,226 @@
+package node
+
+import (
+	"errors"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+	"github.com/TheJ0lly/Overlay-Network/internal/topology"
+)
+
+// DefaultCrawlTimeout is how long, in seconds, a crawl waits for the nodes at the same distance to answer.
+const DefaultCrawlTimeout = 3
+
+// A crawl stops asking new nodes once it has found this many.
+const maxCrawlNodes = 4096
+
+// pendingCrawl is a request for connections waiting for its answer, which must come from the node it was sent to.
+type pendingCrawl struct {
+	node    identity.NodeID
+	answers chan<- crawlAnswer
+}
+
+type crawlAnswer struct {
+	from message.NodeRef
+	msg  message.NetConnsResponseMessage
+}
+
+// CrawlResult is the whole network, as found by a crawl. Unreachable holds the nodes that did not answer in time.
+// Truncated is set when the crawl stopped at maxCrawlNodes nodes, thus the graph is only part of the network.
+type CrawlResult struct {
+	Graph       *topology.Graph   `json:"Graph"`
+	Report      topology.Report   `json:"Report"`
+	Unreachable []message.NodeRef `json:"Unreachable"`
+	Truncated   bool              `json:"Truncated"`
+}
+
+// connsInfo describes the primary connections of the node, as it sees them.
+func (n *Node) connsInfo() []message.ConnInfo {
+	conns := make([]message.ConnInfo, 0, len(n.Conns))
+	for _, conn := range n.Conns {
+		conns = append(conns, message.ConnInfo{
+			Node:        conn.GetNodeRef(),
+			State:       conn.livenessState().String(),
+			Incarnation: conn.Incarnation,
+			RTT:         conn.SmoothedRTT,
+		})
+	}
+	return conns
+}
+
+// connsGraph is the graph of a node and its primary connections, as the node sees them.
+func connsGraph(ref message.NodeRef, incarnation uint64, conns []message.ConnInfo) *topology.Graph {
+	g := topology.New(ref.ID)
+	g.AddNode(topology.Node{ID: ref.ID, Address: ref.Locator.NetString(), State: topology.StateAlive, Incarnation: incarnation})
+	for _, c := range conns {
+		g.AddNode(topology.Node{ID: c.Node.ID, Address: c.Node.Locator.NetString(), State: c.State, Incarnation: c.Incarnation})
+		g.AddEdge(topology.Edge{From: ref.ID, To: c.Node.ID, State: c.State, RTT: c.RTT})
+	}
+	return g
+}
+
+// processNetConnsRequestMessage answers straight to the node asking for our primary connections, where our vision says it is.
+// The crawler is mostly beyond our vision, then it is answered at the locator it signed, and only when it asked us itself, as crawls do.
+func (n *Node) processNetConnsRequestMessage(env *message.MessageEnvelope) {
+	dest := network.Dest{ID: env.OriginalSender.ID, Addr: env.OriginalSender.Locator}
+	if nd := findNodeByIDInNode(n, env.OriginalSender.ID, n.DepthVision); nd != nil && nd != n {
+		dest = nd.dest()
+	} else if !env.Sender.Is(env.OriginalSender.ID) {
+		n.Log.Error("dropped connections request of %s relayed by %s", env.OriginalSender.ID.Short(), env.Sender.ID.Short())
+		return
+	}
+
+	b, err := n.serializeTracedEnvelope(env.Trace, message.NetConnsResponse, &message.NetConnsResponseMessage{
+		RequestID:   env.Nonce,
+		Incarnation: n.Incarnation,
+		Conns:       n.connsInfo(),
+	})
+	if err != nil {
+		n.Log.Error("could not create connections response envelope: %s", err)
+		return
+	}
+
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[message.NetConnsResponse.String()]++ })
+	timeout := time.Duration(n.DeathTimer)
+	clock.Go(func() {
+		if err := n.Net.SendToDest(b, dest.Addr, dest.ID, timeout); err != nil {
+			n.Log.Error("could not send connections response - %s", err)
+			n.updateStats(func(s *Stats) { s.SendErrors++ })
+		}
+	})
+}
+
+// processNetConnsResponseMessage hands the answer to the crawl waiting for it. Answers nobody waits for, or coming from another node, are dropped.
+func (n *Node) processNetConnsResponseMessage(msg *message.NetConnsResponseMessage, env *message.MessageEnvelope) {
+	n.crawlMu.Lock()
+	p, ok := n.crawls[msg.RequestID]
+	if ok && p.node == env.OriginalSender.ID {
+		delete(n.crawls, msg.RequestID)
+	}
+	n.crawlMu.Unlock()
+
+	if !ok || p.node != env.OriginalSender.ID {
+		n.Log.Debug("dropping unexpected connections response %s from %s", msg.RequestID, env.OriginalSender)
+		return
+	}
+	// The channel has room for all the answers of the crawl step, thus this never blocks.
+	p.answers <- crawlAnswer{from: env.OriginalSender, msg: *msg}
+}
+
+// askConns sends a connections request to each node, and collects the answers that come within the timeout.
+func (n *Node) askConns(nodes []message.NodeRef, timeout uint8) ([]crawlAnswer, []message.NodeRef) {
+	answers := make(chan crawlAnswer, len(nodes))
+	asked := map[string]message.NodeRef{}
+
+	for _, ref := range nodes {
+		env, err := n.CreateEnvelope(message.NetConnsRequest, &message.NetConnsRequestMessage{})
+		if err != nil {
+			n.Log.Error("could not create connections request envelope: %s", err)
+			continue
+		}
+		b, err := message.SerializeMessageEnvelope(&env)
+		if err != nil {
+			n.Log.Error("could not serialize connections request envelope: %s", err)
+			continue
+		}
+
+		n.crawlMu.Lock()
+		n.crawls[env.Nonce] = pendingCrawl{node: ref.ID, answers: answers}
+		n.crawlMu.Unlock()
+		asked[env.Nonce] = ref
+
+		clock.Go(func() {
+			if err := n.Net.SendToDest(b, ref.Locator, ref.ID, time.Duration(timeout)); err != nil {
+				n.Log.Debug("could not send connections request to %s - %s", ref, err)
+			}
+		})
+	}
+
+	var got []crawlAnswer
+	timer := time.NewTimer(time.Second * time.Duration(timeout))
+	defer timer.Stop()
+wait:
+	for len(got) != len(asked) {
+		select {
+		case a := <-answers:
+			got = append(got, a)
+		case <-timer.C:
+			break wait
+		}
+	}
+
+	// Whatever is still pending did not answer in time.
+	var missing []message.NodeRef
+	n.crawlMu.Lock()
+	for nonce, ref := range asked {
+		if _, ok := n.crawls[nonce]; ok {
+			delete(n.crawls, nonce)
+			missing = append(missing, ref)
+		}
+	}
+	n.crawlMu.Unlock()
+	return got, missing
+}
+
+// Crawl finds the whole network, by asking each node it can reach for its primary connections, starting from the ones of this node.
+// The nodes at the same distance are asked at the same time, and each of them has timeout seconds to answer.
+// It waits for the processing goroutine, thus it must not be called from it.
+func (n *Node) Crawl(timeout uint8) (*CrawlResult, error) {
+	if n.Identity == nil {
+		return nil, errors.New("cannot crawl the network without an identity")
+	}
+	if timeout == 0 {
+		return nil, errors.New("the crawl timeout must be at least 1 second")
+	}
+
+	// The crawl waits for answers processed by the processing goroutine, thus only our own connections are read through Do.
+	var own []message.ConnInfo
+	var graphs []*topology.Graph
+	n.Do(func() {
+		own = n.connsInfo()
+		graphs = []*topology.Graph{connsGraph(n.GetNodeRef(), n.Incarnation, own)}
+	})
+	found := map[identity.NodeID]bool{n.ID: true}
+	res := &CrawlResult{Unreachable: []message.NodeRef{}}
+
+	// Only the nodes that are not known to be dead are asked, the others are in the graph already.
+	next := func(conns []message.ConnInfo) []message.NodeRef {
+		var refs []message.NodeRef
+		for _, c := range conns {
+			if found[c.Node.ID] {
+				continue
+			}
+			if len(found) >= maxCrawlNodes {
+				res.Truncated = true
+				continue
+			}
+			found[c.Node.ID] = true
+			if c.State != topology.StateDead {
+				refs = append(refs, c.Node)
+			}
+		}
+		return refs
+	}
+
+	for step := next(own); len(step) != 0; {
+		n.Log.Debug("crawl asking %d nodes", len(step))
+		answers, missing := n.askConns(step, timeout)
+		res.Unreachable = append(res.Unreachable, missing...)
+
+		step = nil
+		for _, a := range answers {
+			graphs = append(graphs, connsGraph(a.from, a.msg.Incarnation, a.msg.Conns))
+			step = append(step, next(a.msg.Conns)...)
+		}
+	}
+
+	res.Graph = topology.Merge(graphs...)
+	res.Report = topology.Analyze(res.Graph)
+	n.Log.Info("crawl found %d nodes and %d links, %d nodes did not answer", len(res.Graph.Nodes), len(res.Graph.Edges), len(res.Unreachable))
+	if res.Truncated {
+		n.Log.Warn("crawl stopped at %d nodes - the result is only part of the network", maxCrawlNodes)
+	}
+	return res, nil
+}
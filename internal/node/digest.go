@@ -0,0 +1,118 @@
+package node
+
+import (
+	"slices"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+// gatherDigestEntries walks the vision of the node and gathers the liveness info of every node that is not dead.
+func gatherDigestEntries(n *Node, entries []message.LifeLineDigestEntry, layer uint8, now int64) []message.LifeLineDigestEntry {
+	if layer == 0 {
+		return entries
+	}
+
+	for i := range n.Conns {
+		conn := n.Conns[i]
+		if conn.livenessState() == stateDead || conn.LastTimeAlive == 0 {
+			continue
+		}
+
+		if !slices.ContainsFunc(entries, func(e message.LifeLineDigestEntry) bool {
+			return e.Node.Is(conn.ID)
+		}) {
+			entries = append(entries, message.LifeLineDigestEntry{
+				Node:          conn.GetNodeRef(),
+				LastSeenAgo:   now - conn.LastTimeAlive,
+				Incarnation:   conn.Incarnation,
+				Health:        conn.Health,
+				EncryptionKey: conn.EncryptionKey,
+			})
+		}
+		entries = gatherDigestEntries(conn, entries, layer-1, now)
+	}
+
+	return entries
+}
+
+// sendLifeLineDigest sends the liveness info this node knows, its own included, to its alive direct neighbours.
+func (n *Node) sendLifeLineDigest() {
+	n.Log.Debug("starting lifeline digest")
+
+	entries := []message.LifeLineDigestEntry{{
+		Node:          n.GetNodeRef(),
+		LastSeenAgo:   0,
+		Incarnation:   n.Incarnation,
+		Health:        n.createHealthRecord(),
+		EncryptionKey: n.EncryptionKey,
+	}}
+	entries = gatherDigestEntries(n, entries, n.DepthVision, clock.Now().UnixMilli())
+
+	b, err := n.SerializeNewEnvelope(message.NetLifeLineDigest, &message.NetLifeLineDigestMessage{Entries: entries})
+	if err != nil {
+		n.Log.Error("could not create lifeline digest envelope: %s", err)
+		return
+	}
+
+	dests := make([]network.Dest, 0, len(n.Conns))
+	for i := range n.Conns {
+		if n.Conns[i].livenessState() != stateDead {
+			dests = append(dests, n.Conns[i].dest())
+		}
+	}
+
+	n.Log.Debug("sending lifeline digest with %d entries to %v", len(entries), dests)
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[message.NetLifeLineDigest.String()]++ })
+	clock.Go(func() {
+		sendErrors := n.Net.SendToMultipleDest(b, dests, nil, time.Duration(n.DeathTimer))
+		n.updateStats(func(s *Stats) { s.SendErrors += sendErrors })
+	})
+}
+
+// processNetLifeLineDigestMessage merges the liveness info of the digest with the one this node has, keeping the freshest of the two.
+// Only the digests of our primary connections are merged, since digests are only sent to direct neighbours. The entry of the sender
+// about itself is its own signed lifeline, thus it may change its incarnation and locator. The other entries are hearsay: they only
+// refresh the nodes that are still alive at the incarnation we know.
+// Digests are never forwarded, our own digest will carry the merged info to our neighbours.
+func (n *Node) processNetLifeLineDigestMessage(msg *message.NetLifeLineDigestMessage, env *message.MessageEnvelope) {
+	sender := env.OriginalSender
+	if !slices.ContainsFunc(n.Conns, func(conn *Node) bool { return conn.ID == sender.ID }) {
+		n.envelopeLog(env).Debug("dropped lifeline digest from node %s - not a primary connection", sender.ID.Short())
+		return
+	}
+
+	now := clock.Now().UnixMilli()
+	for i := range msg.Entries {
+		entry := msg.Entries[i]
+		if entry.Node.Is(n.ID) {
+			continue
+		}
+
+		own := entry.Node.Is(sender.ID)
+		nd := n.locateNode(entry.Node, sender.ID)
+		if nd == nil || nd == n {
+			continue
+		}
+		n.learnEncryptionKey(nd, entry.EncryptionKey)
+
+		// A node cannot have been seen in the future, which would keep it from ever being declared dead.
+		lastSeen := min(now-max(entry.LastSeenAgo, 0), now)
+		incarnation := nd.Incarnation
+		if own {
+			incarnation = entry.Incarnation
+		}
+		if incarnation <= nd.Incarnation && lastSeen <= nd.LastTimeAlive {
+			continue
+		}
+
+		if n.applyConnLiveness(nd, stateAlive, incarnation) || nd.livenessState() == stateAlive {
+			nd.LastTimeAlive = max(nd.LastTimeAlive, lastSeen)
+			if own && entry.Health != nil {
+				nd.Health = entry.Health
+			}
+		}
+	}
+	n.Log.Debug("merged lifeline digest with %d entries from %v", len(msg.Entries), sender)
+}
@@ -0,0 +1,36 @@
+package node
+
+import (
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+)
+
+// Version is the version of the node, advertised in the health record of the lifelines.
+const Version = "0.1.0"
+
+// loadScore weighs how full the queue is and how many connection slots are taken, both equally.
+func (n *Node) loadScore() float64 {
+	var queueLoad, connLoad float64
+	if n.Queue.Capacity() != 0 {
+		queueLoad = float64(n.Queue.Length()) / float64(n.Queue.Capacity())
+	}
+	if n.ConnCap != 0 {
+		connLoad = float64(len(n.Conns)) / float64(n.ConnCap)
+	}
+	return (queueLoad + connLoad) / 2
+}
+
+// createHealthRecord returns the health record of this node, or nil if the node does not advertise it.
+func (n *Node) createHealthRecord() *message.NodeHealth {
+	if !n.AdvertiseHealth {
+		return nil
+	}
+
+	return &message.NodeHealth{
+		QueueLength:   uint16(n.Queue.Length()),
+		FreeConnSlots: uint8(max(int(n.ConnCap)-len(n.Conns), 0)),
+		DepthVision:   n.DepthVision,
+		Uptime:        uint64(clock.Now().Sub(n.StartTime).Seconds()),
+		Version:       Version,
+		LoadScore:     n.loadScore(),
+	}
+}
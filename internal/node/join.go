@@ -0,0 +1,318 @@
+package node
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/admission"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+	"github.com/TheJ0lly/Overlay-Network/internal/tracing"
+)
+
+// JoinQueryWindow is the duration the joining node waits for the candidates to answer its join query.
+const JoinQueryWindow = 5 * time.Second
+
+// JoinCandidate is a node that answered the join query, along with how long it took.
+type JoinCandidate struct {
+	Node message.NodeRef
+	RTT  time.Duration
+}
+
+// ConfirmWindow is the duration the joining node waits for the candidate to answer the confirmation.
+func (c JoinCandidate) ConfirmWindow() time.Duration {
+	return 3 * c.RTT
+}
+
+// Joiner is a join done one step at a time, for the callers that cannot wait for the answers, such as the simulator.
+// The query goes to a node of the network, the candidates answer it, and the node attaches to the fastest candidate that accepts it.
+type Joiner struct {
+	n          *Node
+	invitation *admission.Token
+	span       *tracing.Span
+	sentAt     time.Time
+	candidates []JoinCandidate
+}
+
+// NewJoiner starts a join of the node. End must be called once the join is over.
+func (n *Node) NewJoiner(invitation *admission.Token) *Joiner {
+	// All the messages of the join belong to the same trace, when it is sampled.
+	return &Joiner{n: n, invitation: invitation, span: n.Tracer.Start(n.Tracer.NewTrace(), "join", "")}
+}
+
+func (j *Joiner) End() {
+	j.span.End()
+}
+
+// Query returns the join query, which is sent to a node of the network. The candidates answer it from then on.
+func (j *Joiner) Query() ([]byte, error) {
+	j.sentAt = clock.Now()
+	b, err := j.n.serializeTracedEnvelope(
+		j.span.Context(),
+		message.NetNewNodeJoinQuery,
+		&message.NetNewNodeJoinQueryMessage{
+			NewNode:   j.n.GetNodeRef(),
+			Timestamp: j.sentAt.UnixMilli(),
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create join query message - %s", err)
+	}
+	return b, nil
+}
+
+// AddCandidate takes in an answer to the join query. A candidate can only answer for itself, and only once.
+func (j *Joiner) AddCandidate(b []byte) error {
+	// A fresh envelope, so that nothing from the previous response is left in it.
+	env := message.MessageEnvelope{}
+	if err := message.DeserializeMessageEnvelope(&env, b); err != nil {
+		return fmt.Errorf("error while deserializing message envelope - %s", err)
+	}
+
+	if err := j.n.verifySignature(&env); err != nil {
+		return fmt.Errorf("rejected join query response from %v - %s", env.Sender, err)
+	}
+
+	if env.Type != message.NetNewNodeJoinQuery {
+		return fmt.Errorf("rejected %v from %v - expected a join query response", env.Type, env.Sender)
+	}
+
+	msg := message.NetNewNodeJoinQueryMessage{}
+	if err := json.Unmarshal(env.Data, &msg); err != nil {
+		return fmt.Errorf("error while deserializing message - %s", err)
+	}
+
+	if msg.NewNode.ID != env.OriginalSender.ID {
+		return fmt.Errorf("rejected join query response from %v - it offers node %v", env.OriginalSender, msg.NewNode)
+	}
+	if slices.ContainsFunc(j.candidates, func(c JoinCandidate) bool { return c.Node.ID == msg.NewNode.ID }) {
+		return fmt.Errorf("rejected join query response from %v - it already answered", env.OriginalSender)
+	}
+
+	c := JoinCandidate{Node: msg.NewNode, RTT: max(clock.Now().Sub(j.sentAt).Truncate(time.Millisecond), time.Millisecond)}
+	j.candidates = append(j.candidates, c)
+	j.n.Log.Debug("new response from %v with RTT: %v", c.Node, c.RTT)
+	j.n.updateStats(func(s *Stats) { s.JoinCandidateResponses++ })
+	return nil
+}
+
+// Candidates returns the nodes that answered the query, the fastest first.
+// An invitation without invitee is only accepted by its issuer, thus it is the only candidate then.
+func (j *Joiner) Candidates() []JoinCandidate {
+	candidates := slices.Clone(j.candidates)
+	if j.invitation != nil && j.invitation.Invitee == "" {
+		candidates = slices.DeleteFunc(candidates, func(c JoinCandidate) bool { return !c.Node.Is(j.invitation.Issuer) })
+	}
+	slices.SortStableFunc(candidates, func(a, b JoinCandidate) int {
+		return cmp.Compare(a.RTT, b.RTT)
+	})
+	return candidates
+}
+
+// Confirm returns the confirmation sent to the candidates, one at a time, until one of them accepts the node.
+func (j *Joiner) Confirm() ([]byte, error) {
+	confirmMsg := message.NetNewNodeJoinConfirmMessage{
+		// As of now does not matter, but maybe we add some RTT exclusion over X
+		IsSuitable: true,
+		Invitation: j.invitation,
+	}
+	// The candidates may control who can join, thus we prove what we can.
+	if j.n.NetworkKey != nil {
+		confirmMsg.Timestamp = clock.Now().UnixMilli()
+		confirmMsg.NetworkKeyProof = admission.ProveNetworkKey(j.n.NetworkKey, j.n.ID, confirmMsg.Timestamp)
+	}
+
+	b, err := j.n.serializeTracedEnvelope(j.span.Context(), message.NetNewNodeJoinConfirm, &confirmMsg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create message envelope for join confirm: %s", err)
+	}
+	return b, nil
+}
+
+// Attach takes in the answer of the candidate to the confirmation, and attaches the node to it if it accepts the node.
+func (j *Joiner) Attach(c JoinCandidate, answer []byte) (bool, error) {
+	env := message.MessageEnvelope{}
+	if err := json.Unmarshal(answer, &env); err != nil {
+		return false, fmt.Errorf("could not unmarshal message envelope: %s", err)
+	}
+
+	if err := j.n.verifySignature(&env); err != nil || !env.OriginalSender.Is(c.Node.ID) {
+		return false, fmt.Errorf("rejected join confirm response from %v - %v", env.Sender, err)
+	}
+
+	msg := message.NetNewNodeJoinConfirmMessage{}
+	if err := json.Unmarshal(env.Data, &msg); err != nil {
+		return false, fmt.Errorf("could not unmarshal message: %s", err)
+	}
+
+	if !msg.IsSuitable {
+		j.n.Log.Info("candidate node %v refused attachment - moving on", c.Node)
+		j.n.updateStats(func(s *Stats) { s.JoinCandidateRejects++ })
+		return false, nil
+	}
+
+	n := j.n
+	if len(n.Conns) >= int(n.ConnCap) {
+		return false, fmt.Errorf("no free connection slot left for %v", c.Node)
+	}
+	newNode := CreatePrimaryConnectionNode(c.Node)
+	newNode.LastTimeAlive = clock.Now().UnixMilli()
+	n.Conns = append(n.Conns, newNode)
+	n.Log.Debug("added new node - %s", newNode)
+	n.Log.Debug("attached node state - %s", n)
+	n.updateStats(func(s *Stats) { s.PrimaryConnections++ })
+	return true, nil
+}
+
+// JoinMessage returns the join message, which is sent to the candidate the node attached to. It ends the join.
+func (j *Joiner) JoinMessage(c JoinCandidate) ([]byte, error) {
+	b, err := j.n.serializeTracedEnvelope(
+		j.span.Context(),
+		message.NetNewNodeJoin,
+		&message.NetNewNodeJoinMessage{
+			AttachedNode:       c.Node,
+			JoiningNode:        j.n.GetNodeRef(),
+			ReplacedNode:       message.NodeRef{},
+			JoiningNodeView:    j.n.DepthVision,
+			JoiningNodeConnCap: j.n.ConnCap,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the join message envelope: %s", err)
+	}
+	return b, nil
+}
+
+// Join makes the node join the network the bootstrap node is part of. It must be called before MainLoop, since it listens on the address of the node.
+func (n *Node) Join(bootstrap network.IpPortPair, invitation *admission.Token) error {
+	j := n.NewJoiner(invitation)
+	defer j.End()
+
+	query, err := j.Query()
+	if err != nil {
+		return err
+	}
+
+	// The listener is up before the query leaves, otherwise the fastest candidates could answer before anyone listens.
+	list, err := n.Net.Listen(n.GetNodeAddress())
+	if err != nil {
+		return fmt.Errorf("could not start listener for the initial message - %s", err)
+	}
+
+	if err = n.Net.SendToDest(query, bootstrap, "", time.Duration(n.DeathTimer)); err != nil {
+		list.Close()
+		return fmt.Errorf("could not sent message envelope to node %s - %s", bootstrap.NetString(), err)
+	}
+	n.Log.Info("sent join query to %s", bootstrap.NetString())
+
+	n.collectJoinCandidates(j, list)
+	candidates := j.Candidates()
+	if len(candidates) == 0 {
+		return fmt.Errorf("could not find a suitable node to attach to")
+	}
+
+	confirm, err := j.Confirm()
+	if err != nil {
+		return err
+	}
+
+	// At this point the candidates are sorted based on their RTT, thus we get the best ones first.
+	for _, c := range candidates {
+		answer, err := n.askJoinCandidate(c, confirm)
+		if err != nil {
+			n.Log.Error("%s", err)
+			continue
+		}
+
+		if ok, err := j.Attach(c, answer); err != nil {
+			n.Log.Error("%s", err)
+			continue
+		} else if !ok {
+			continue
+		}
+
+		join, err := j.JoinMessage(c)
+		if err != nil {
+			return err
+		}
+		if err = n.Net.SendToDest(join, c.Node.Locator, c.Node.ID, time.Duration(n.DeathTimer)); err != nil {
+			return fmt.Errorf("could not send join message: %s", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("none of the %d candidates accepted the attachment", len(candidates))
+}
+
+// collectJoinCandidates gathers the answers to the join query, until the query window closes.
+func (n *Node) collectJoinCandidates(j *Joiner, list net.Listener) {
+	go func() {
+		time.Sleep(JoinQueryWindow)
+		list.Close()
+	}()
+
+	for {
+		conn, err := list.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			n.Log.Info("received timeout - closing join query window")
+			return
+		} else if err != nil {
+			n.Log.Error("error while accepting incoming connections - %s", err)
+			continue
+		}
+
+		b, err := network.ReadMessage(conn, message.MaxEnvelopeSize, time.Duration(n.ReadTimeout)*time.Second)
+		conn.Close()
+		if err != nil {
+			n.Log.Error("error while reading from the connection - %s", err)
+			continue
+		}
+
+		if err = j.AddCandidate(b); err != nil {
+			n.Log.Error("%s", err)
+		}
+	}
+}
+
+// askJoinCandidate sends the confirmation to the candidate, and returns its answer.
+func (n *Node) askJoinCandidate(c JoinCandidate, confirm []byte) ([]byte, error) {
+	list, err := n.Net.Listen(n.GetNodeAddress())
+	if err != nil {
+		return nil, fmt.Errorf("could not start listener for the confirm response - %s", err)
+	}
+	defer list.Close()
+
+	if err = n.Net.SendToDest(confirm, c.Node.Locator, c.Node.ID, time.Duration(n.DeathTimer)); err != nil {
+		return nil, fmt.Errorf("could not send net join message - %s", err)
+	}
+	n.Log.Info("sent join confirm to responsive node %s", c.Node)
+
+	gotConn := make(chan struct{})
+	defer close(gotConn)
+	go func() {
+		timer := time.NewTimer(c.ConfirmWindow())
+		defer timer.Stop()
+		select {
+		case <-gotConn:
+		case <-timer.C:
+			n.Log.Info("timeout for node - %v", c.Node)
+			list.Close()
+		}
+	}()
+
+	conn, err := list.Accept()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	b, err := network.ReadMessage(conn, message.MaxEnvelopeSize, time.Duration(n.ReadTimeout)*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("could not read all bytes: %s", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,93 @@
+package node
+
+import "slices"
+
+// livenessState is the state a node is in, from the point of view of the node that holds it in its vision.
+type livenessState uint8
+
+const (
+	stateAlive livenessState = iota
+	stateSuspect
+	stateDead
+)
+
+func (ls livenessState) String() string {
+	switch ls {
+	case stateAlive:
+		return "alive"
+	case stateSuspect:
+		return "suspect"
+	case stateDead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+func (n *Node) livenessState() livenessState {
+	if !n.Alive {
+		return stateDead
+	}
+	if n.Suspect {
+		return stateSuspect
+	}
+	return stateAlive
+}
+
+// applyLiveness applies a liveness claim about the node, following these precedence rules:
+//   - alive(i) overrides anything with a smaller incarnation, and alive/suspect with the same incarnation.
+//   - suspect is only set locally, when we have not heard from a node for DeathTimer seconds, and it only applies over alive.
+//   - dead(i) overrides anything with the same or a smaller incarnation.
+//
+// Which means a node that was declared dead can only come back with a greater incarnation, and it returns true if the claim changed the state of the node.
+func (n *Node) applyLiveness(state livenessState, incarnation uint64) bool {
+	if incarnation < n.Incarnation {
+		n.Log.Debug("ignoring %s claim for %v with stale incarnation %d < %d", state, n.GetNodeRef(), incarnation, n.Incarnation)
+		return false
+	}
+
+	curr := n.livenessState()
+	switch state {
+	case stateAlive:
+		if incarnation == n.Incarnation && curr == stateDead {
+			return false
+		}
+		n.Alive = true
+		n.Suspect = false
+	case stateSuspect:
+		if curr != stateAlive {
+			return false
+		}
+		n.Suspect = true
+	case stateDead:
+		n.Alive = false
+		n.Suspect = false
+	}
+	n.Incarnation = incarnation
+
+	n.Log.Debug("node %v went from %s to %s with incarnation %d", n.GetNodeRef(), curr, state, incarnation)
+	return curr != state
+}
+
+// applyConnLiveness applies the liveness claim to a node of our vision, and keeps the count of the primary connections in step
+// when one of them dies or comes back.
+func (n *Node) applyConnLiveness(nd *Node, state livenessState, incarnation uint64) bool {
+	prev := nd.livenessState()
+	changed := nd.applyLiveness(state, incarnation)
+	if !changed || !slices.Contains(n.Conns, nd) {
+		return changed
+	}
+
+	switch curr := nd.livenessState(); {
+	case prev == stateDead && curr != stateDead:
+		n.updateStats(func(s *Stats) { s.PrimaryConnections++ })
+	case prev != stateDead && curr == stateDead:
+		// The connections we were given by hand were never counted, thus the gauge must not wrap around.
+		n.updateStats(func(s *Stats) {
+			if s.PrimaryConnections > 0 {
+				s.PrimaryConnections--
+			}
+		})
+	}
+	return changed
+}
@@ -0,0 +1,164 @@
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// The upper bounds of the buckets, in milliseconds.
+var rttBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+var processingBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250}
+
+// Histogram counts the observed values falling under each of its buckets.
+// Counts[i] is the number of values lower or equal to Buckets[i], and the values above the last bucket are only counted in Count.
+// It has no lock of its own, the histograms of the stats are only observed through updateStats.
+type Histogram struct {
+	Buckets []float64 `json:"Buckets"`
+	Counts  []uint64  `json:"Counts"`
+	Sum     float64   `json:"Sum"`
+	Count   uint64    `json:"Count"`
+}
+
+func NewHistogram(buckets ...float64) *Histogram {
+	return &Histogram{Buckets: buckets, Counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) clone() *Histogram {
+	if h == nil {
+		return nil
+	}
+	c := *h
+	c.Buckets = slices.Clone(h.Buckets)
+	c.Counts = slices.Clone(h.Counts)
+	return &c
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i := range h.Buckets {
+		if v <= h.Buckets[i] {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += v
+	h.Count++
+}
+
+// MetricsHandler serves the stats of the node in the Prometheus text format.
+func (n *Node) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		// A copy, such that a slow client does not hold the stats lock.
+		stats := n.Stats()
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw, &stats)
+		if err := bw.Flush(); err != nil {
+			n.Log.Debug("could not write metrics to %s - %s", r.RemoteAddr, err)
+		}
+	})
+}
+
+// metricsWriter writes metrics in the Prometheus text format, with the overlay_ prefix.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(mw.w, "# HELP overlay_%s %s\n# TYPE overlay_%s %s\n", name, help, name, kind)
+}
+
+func (mw metricsWriter) sample(name string, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(mw.w, "overlay_%s%s %v\n", name, labels, v)
+}
+
+func (mw metricsWriter) counter(name string, help string, v uint64) {
+	mw.header(name, "counter", help)
+	mw.sample(name, "", float64(v))
+}
+
+func (mw metricsWriter) gauge(name string, help string, v uint64) {
+	mw.header(name, "gauge", help)
+	mw.sample(name, "", float64(v))
+}
+
+// labeled writes one sample for each entry of the map, labeled with its key.
+func labeled[V any](mw metricsWriter, name string, kind string, help string, label string, m map[string]V, value func(V) float64) {
+	mw.header(name, kind, help)
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		mw.sample(name, fmt.Sprintf("%s=\"%s\"", label, labelEscaper.Replace(k)), value(m[k]))
+	}
+}
+
+func (mw metricsWriter) histogram(name string, help string, h *Histogram) {
+	mw.header(name, "histogram", help)
+	for i := range h.Buckets {
+		mw.sample(name+"_bucket", fmt.Sprintf("le=\"%v\"", h.Buckets[i]), float64(h.Counts[i]))
+	}
+	mw.sample(name+"_bucket", "le=\"+Inf\"", float64(h.Count))
+	mw.sample(name+"_sum", "", h.Sum)
+	mw.sample(name+"_count", "", float64(h.Count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetrics(w io.Writer, s *Stats) {
+	mw := metricsWriter{w: w}
+	count := func(v uint64) float64 { return float64(v) }
+
+	labeled(mw, "messages_received_total", "counter", "Envelopes accepted into the queue, by message type.", "type", s.MessagesReceived, count)
+	labeled(mw, "messages_forwarded_total", "counter", "Envelopes sent or relayed, by message type.", "type", s.MessagesForwarded, count)
+	labeled(mw, "messages_dropped_total", "counter", "Envelopes dropped before reaching the queue, by reason.", "reason", map[string]uint64{
+		"queue_full":     s.QueueDrops,
+		"duplicate":      s.DuplicatedMessages,
+		"bad_signature":  s.SignatureRejects,
+		"replay":         s.ReplayRejects,
+		"link_mismatch":  s.LinkRejects,
+		"oversized":      s.OversizedRejects,
+		"rate_limit":     s.RateLimitDrops,
+		"banned_peer":    s.BannedPeerDrops,
+		"too_many_conns": s.InboundConnRejects,
+	}, count)
+	mw.counter("send_errors_total", "Envelopes that could not be sent.", s.SendErrors)
+
+	mw.counter("join_candidate_responses_total", "Answers to the join query received while joining.", s.JoinCandidateResponses)
+	mw.counter("join_candidate_rejects_total", "Candidate nodes that refused to attach us while joining.", s.JoinCandidateRejects)
+	mw.counter("admission_rejects_total", "Joining nodes refused by admission control.", s.AdmissionRejects)
+	mw.counter("new_node_rejects_total", "Joining nodes refused for lack of room.", s.NewNodeRejects)
+	mw.counter("nodes_replaced_total", "Dead primary connections replaced by a joining node.", s.NodesReplaced)
+
+	mw.counter("death_announcements_sent_total", "Death announcements sent.", s.DeathAnnouncementsSent)
+	mw.counter("death_announcements_received_total", "Death announcements received.", s.DeathAnnouncementsReceived)
+	mw.counter("death_refutations_sent_total", "Announcements of our own death refuted.", s.DeathRefutationsSent)
+	mw.counter("stale_death_claims_total", "Death claims ignored for their stale incarnation.", s.StaleDeathClaims)
+	mw.counter("death_reports_ignored_total", "Death reports that did not reach the quorum.", s.DeathReportsIgnored)
+	mw.counter("dead_hop_attempts_total", "Forwards that had to jump over a dead node.", s.DeadHopAttempts)
+	mw.counter("dead_hop_nodes_gathered_total", "Nodes gathered while jumping over dead nodes.", s.DeadHopNodesGathered)
+
+	mw.counter("peers_banned_total", "Peers banned for misbehaving.", s.PeersBanned)
+	mw.counter("sealed_sent_total", "Sealed payloads sent.", s.SealedSent)
+	mw.counter("sealed_received_total", "Sealed payloads opened.", s.SealedReceived)
+	mw.counter("sealed_open_failures_total", "Sealed payloads for us that could not be opened.", s.SealedOpenFailures)
+	mw.counter("onion_sent_total", "Onions sent.", s.OnionSent)
+	mw.counter("onion_relayed_total", "Onion layers peeled and relayed.", s.OnionRelayed)
+	mw.counter("onion_received_total", "Onion payloads received.", s.OnionReceived)
+	mw.counter("onion_failures_total", "Onion layers that could not be peeled or relayed.", s.OnionFailures)
+
+	mw.gauge("queue_length", "Envelopes waiting in the queue.", s.QueueLength)
+	mw.gauge("inbound_connections", "Inbound connections being read.", s.InboundConns)
+	mw.gauge("primary_connections", "Primary connections of the node.", s.PrimaryConnections)
+
+	labeled(mw, "rtt_smoothed_milliseconds", "gauge", "Smoothed RTT of each primary connection.", "peer", s.RTTs, func(r RTTStat) float64 { return r.SmoothedRTT })
+	labeled(mw, "rtt_jitter_milliseconds", "gauge", "RTT jitter of each primary connection.", "peer", s.RTTs, func(r RTTStat) float64 { return r.Jitter })
+	labeled(mw, "peer_score", "gauge", "Score of the peers that misbehaved lately, from 0 to 100.", "peer", s.PeerScores, func(p PeerScore) float64 { return p.Score })
+
+	mw.histogram("rtt_milliseconds", "RTT samples of the primary connections.", s.RTTHistogram)
+	mw.histogram("processing_latency_milliseconds", "Time spent handling each message taken from the queue.", s.ProcessingLatency)
+}
@@ -0,0 +1,378 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/fault"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/topology"
+	"github.com/TheJ0lly/Overlay-Network/internal/tracing"
+)
+
+type receivedPayload struct {
+	from    message.NodeRef
+	payload []byte
+}
+
+func freePort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not find a free port - %s", err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// startTestNetwork starts one node for each entry of links, connected to the nodes listed in it, all running in this process.
+// The vision of each node is built by hand, as if all the nodes had already joined and exchanged their lifelines.
+// The setup functions are called on each node before it starts.
+func startTestNetwork(t *testing.T, links [][]int, depth uint8, setup ...func(i int, nd *Node)) ([]*Node, []chan receivedPayload) {
+	nodes := make([]*Node, len(links))
+	payloads := make([]chan receivedPayload, len(links))
+	for i := range nodes {
+		nd, err := Create("127.0.0.1", freePort(t), uint8(len(links[i])), 100)
+		if err != nil {
+			t.Fatalf("could not create node - %s", err)
+		}
+
+		id, _ := identity.Generate()
+		if err = nd.SetIdentity(id); err != nil {
+			t.Fatalf("could not set identity - %s", err)
+		}
+		nd.DepthVision = depth
+		nd.LifeLineTimer = 1
+		nd.DeathTimer = 5
+
+		payloads[i] = make(chan receivedPayload, 1)
+		nd.OnPayload = func(from message.NodeRef, payload []byte) {
+			payloads[i] <- receivedPayload{from: from, payload: payload}
+		}
+		nodes[i] = nd
+		t.Cleanup(func() { nd.Stop() })
+	}
+
+	var visionOf func(i int, parent int, layers uint8) []*Node
+	visionOf = func(i int, parent int, layers uint8) []*Node {
+		conns := make([]*Node, 0, len(links[i]))
+		for _, j := range links[i] {
+			if j == parent {
+				continue
+			}
+			conn := CreatePrimaryConnectionNode(nodes[j].GetNodeRef())
+			conn.EncryptionKey = nodes[j].EncryptionKey
+			conn.DepthVision = depth
+			conn.LastTimeAlive = time.Now().UnixMilli()
+			if layers > 1 {
+				conn.Conns = visionOf(j, i, layers-1)
+			}
+			conns = append(conns, conn)
+		}
+		return conns
+	}
+
+	for i := range nodes {
+		nodes[i].Conns = visionOf(i, -1, depth)
+		for _, f := range setup {
+			f(i, nodes[i])
+		}
+		go nodes[i].MainLoop()
+	}
+
+	for i := range nodes {
+		waitListening(t, nodes[i])
+	}
+	return nodes, payloads
+}
+
+// waitListening waits for MainLoop to open the listener, without connecting to it, which would feed the node an empty envelope.
+func waitListening(t *testing.T, nd *Node) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		nd.listenerMu.Lock()
+		listening := nd.listener != nil
+		nd.listenerMu.Unlock()
+		if listening {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %s did not start listening", nd.GetNodeAddress())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func expectPayload(t *testing.T, payloads chan receivedPayload) receivedPayload {
+	select {
+	case p := <-payloads:
+		return p
+	case <-time.After(3 * time.Second):
+		t.Fatal("payload did not arrive")
+		return receivedPayload{}
+	}
+}
+
+func TestOnionHidesSenderFromDestination(t *testing.T) {
+	// A line, thus the onion has to go through all the nodes in the middle.
+	nodes, payloads := startTestNetwork(t, [][]int{{1}, {0, 2}, {1, 3}, {2, 4}, {3}}, 4)
+	nodes[0].OnionHops = 3
+
+	payload := []byte("who sent this?")
+	if err := nodes[0].SendOnion(nodes[4].ID, payload); err != nil {
+		t.Fatalf("could not send onion - %s", err)
+	}
+
+	p := expectPayload(t, payloads[4])
+	if !bytes.Equal(p.payload, payload) {
+		t.Errorf("destination got %q - expected %q", p.payload, payload)
+	}
+	if !p.from.IsNull() {
+		t.Errorf("destination learned the sender %v", p.from)
+	}
+
+	for i := 1; i < 4; i++ {
+		select {
+		case <-payloads[i]:
+			t.Errorf("relay %d got the payload", i)
+		default:
+		}
+	}
+}
+
+func TestOnionNeedsEnoughRelays(t *testing.T) {
+	nodes, _ := startTestNetwork(t, [][]int{{1}, {0, 2}, {1}}, 2)
+	nodes[0].OnionHops = 2
+
+	if err := nodes[0].SendOnion(nodes[2].ID, []byte("too short")); err == nil {
+		t.Error("onion sent through a path without enough relays")
+	}
+}
+
+func TestSealedPayloadIsForwardedToDestination(t *testing.T) {
+	nodes, payloads := startTestNetwork(t, [][]int{{1}, {0, 2}, {1}}, 2)
+
+	payload := []byte("only for node 2")
+	if err := nodes[0].SendSealed(nodes[2].ID, payload); err != nil {
+		t.Fatalf("could not send sealed payload - %s", err)
+	}
+
+	p := expectPayload(t, payloads[2])
+	if !bytes.Equal(p.payload, payload) || !p.from.Is(nodes[0].ID) {
+		t.Errorf("destination got %q from %v - expected %q from %v", p.payload, p.from, payload, nodes[0].GetNodeRef())
+	}
+
+	select {
+	case <-payloads[1]:
+		t.Error("relay got the sealed payload")
+	default:
+	}
+}
+
+func TestCrawlFindsNodesBeyondVision(t *testing.T) {
+	// A line of 5 nodes, each seeing only its direct neighbours.
+	nodes, _ := startTestNetwork(t, [][]int{{1}, {0, 2}, {1, 3}, {2, 4}, {3}}, 1)
+
+	res, err := nodes[0].Crawl(2)
+	if err != nil {
+		t.Fatalf("could not crawl - %s", err)
+	}
+	if len(res.Unreachable) != 0 {
+		t.Errorf("nodes did not answer the crawl: %v", res.Unreachable)
+	}
+	if res.Report.Nodes != 5 || res.Report.Links != 4 || !res.Report.Connected || res.Report.Diameter != 4 {
+		t.Errorf("crawl report %+v - expected 5 connected nodes, 4 links and a diameter of 4", res.Report)
+	}
+	if len(res.Graph.Inconsistencies) != 0 {
+		t.Errorf("crawl found inconsistencies in a stable network: %v", res.Graph.Inconsistencies)
+	}
+}
+
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []tracing.Span
+}
+
+func (me *memoryExporter) ExportSpans(spans []tracing.Span) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.spans = append(me.spans, spans...)
+	return nil
+}
+
+func TestTraceFollowsMessageAcrossHops(t *testing.T) {
+	exp := &memoryExporter{}
+	// Only the first node starts traces, the others follow them.
+	nodes, payloads := startTestNetwork(t, [][]int{{1}, {0, 2}, {1}}, 2, func(i int, nd *Node) {
+		rate := 0.0
+		if i == 0 {
+			rate = 1
+		}
+		nd.Tracer = tracing.New(tracing.Endpoint{ServiceName: fmt.Sprint(i)}, rate, exp)
+	})
+
+	if err := nodes[0].SendSealed(nodes[2].ID, []byte("traced")); err != nil {
+		t.Fatalf("could not send sealed payload - %s", err)
+	}
+	expectPayload(t, payloads[2])
+
+	// The spans are recorded once the message is done with, a bit after the payload is handed over.
+	var byID map[string]tracing.Span
+	var last tracing.Span
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, nd := range nodes {
+			nd.FlushTraces()
+		}
+
+		exp.mu.Lock()
+		byID = map[string]tracing.Span{}
+		for _, s := range exp.spans {
+			byID[s.ID] = s
+			if s.LocalEndpoint.ServiceName == "2" && s.Name == "process NetSealed" {
+				last = s
+			}
+		}
+		exp.mu.Unlock()
+		if last.ID != "" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if last.ID == "" {
+		t.Fatal("destination did not record the processing of the sealed message")
+	}
+
+	// From the destination back to the sender, each span is the child of the previous one.
+	var path []string
+	for s, ok := last, true; ok; s, ok = byID[s.ParentID] {
+		if s.TraceID != last.TraceID {
+			t.Fatalf("span %s/%s is in trace %s - expected %s", s.LocalEndpoint.ServiceName, s.Name, s.TraceID, last.TraceID)
+		}
+		path = append(path, s.LocalEndpoint.ServiceName+"/"+s.Name)
+	}
+	expected := []string{"2/process NetSealed", "2/receive NetSealed", "1/forward NetSealed", "1/process NetSealed", "1/receive NetSealed", "0/forward NetSealed"}
+	if !slices.Equal(path, expected) {
+		t.Errorf("trace of the sealed message is %v - expected %v", path, expected)
+	}
+}
+
+func TestJoinAttachesToBootstrap(t *testing.T) {
+	nodes := make([]*Node, 2)
+	stopped := make(chan error, len(nodes))
+	for i := range nodes {
+		nd, err := Create("127.0.0.1", freePort(t), 2, 100)
+		if err != nil {
+			t.Fatalf("could not create node - %s", err)
+		}
+		id, _ := identity.Generate()
+		if err = nd.SetIdentity(id); err != nil {
+			t.Fatalf("could not set identity - %s", err)
+		}
+		nd.DepthVision = 2
+		nd.LifeLineTimer = 1
+		nd.DeathTimer = 5
+		nodes[i] = nd
+	}
+
+	go func() { stopped <- nodes[0].MainLoop() }()
+	waitListening(t, nodes[0])
+	if err := nodes[1].Join(nodes[0].GetIpPortPair(), nil); err != nil {
+		t.Fatalf("could not join - %s", err)
+	}
+	go func() { stopped <- nodes[1].MainLoop() }()
+
+	if len(nodes[1].Conns) != 1 || !nodes[0].GetNodeRef().Is(nodes[1].Conns[0].ID) {
+		t.Fatalf("joining node should be attached to the bootstrap node, got %v", nodes[1].Conns)
+	}
+
+	for _, nd := range nodes {
+		if err := nd.Stop(); err != nil {
+			t.Fatalf("could not stop node - %s", err)
+		}
+	}
+	for range nodes {
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Errorf("main loop ended with %s", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("main loop did not return once the node was stopped")
+		}
+	}
+}
+
+func TestPartitionedNodeIsHoppedOver(t *testing.T) {
+	faults := fault.New(1)
+	nodes, payloads := startTestNetwork(t, [][]int{{1}, {0, 2}, {1}}, 2, func(i int, nd *Node) {
+		nd.DeathTimer = 1
+		nd.Net.Transport = fault.Transport{Next: nd.Net.CurrentTransport(), Injector: faults, From: fault.Endpoint{Addr: nd.GetNodeAddress(), ID: nd.ID}}
+	})
+	err := faults.Partition(map[string][]string{
+		"ends":   {nodes[0].GetNodeAddress(), nodes[2].GetNodeAddress()},
+		"middle": {nodes[1].GetNodeAddress()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Node 1 cannot send its lifelines anymore, thus the ends find it dead.
+	middleAlive := func(nd *Node) bool {
+		var alive bool
+		nd.Do(func() { alive = nd.Conns[0].Alive })
+		return alive
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for middleAlive(nodes[0]) || middleAlive(nodes[2]) {
+		if time.Now().After(deadline) {
+			t.Fatal("partitioned node was not found dead")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	payload := []byte("around node 1")
+	nodes[0].Do(func() { err = nodes[0].SendSealed(nodes[2].ID, payload) })
+	if err != nil {
+		t.Fatalf("could not send sealed payload - %s", err)
+	}
+	if p := expectPayload(t, payloads[2]); !bytes.Equal(p.payload, payload) {
+		t.Errorf("destination got %q - expected %q", p.payload, payload)
+	}
+	if nodes[0].Stats().DeadHopAttempts == 0 {
+		t.Error("sender did not hop over the dead node")
+	}
+	if faults.State().Stats.Partitioned == 0 {
+		t.Error("no message crossed the partition")
+	}
+}
+
+func TestCheckFindsGhostOfStoppedNode(t *testing.T) {
+	nodes, _ := startTestNetwork(t, [][]int{{1}, {0, 2}, {1}}, 2)
+	visions := func(nodes []*Node) []topology.Vision {
+		var vs []topology.Vision
+		for _, nd := range nodes {
+			vs = append(vs, nd.Vision())
+		}
+		return vs
+	}
+	if incs := topology.Check(visions(nodes)); len(incs) != 0 {
+		t.Fatalf("visions of a stable network have inconsistencies: %v", incs)
+	}
+
+	// The others still see node 2 alive, until they find it dead.
+	if err := nodes[2].Stop(); err != nil {
+		t.Fatalf("could not stop node - %s", err)
+	}
+	incs := topology.Check(visions(nodes[:2]))
+	if !slices.ContainsFunc(incs, func(inc topology.Inconsistency) bool {
+		return inc.Kind == topology.InconsistentGhost && inc.Nodes[0] == nodes[2].ID
+	}) {
+		t.Errorf("stopped node is not reported as a ghost: %v", incs)
+	}
+}
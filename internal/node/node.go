@@ -2,45 +2,156 @@ package node
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/TheJ0lly/Overlay-Network/internal/capture"
+	"github.com/TheJ0lly/Overlay-Network/internal/fault"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
 	"github.com/TheJ0lly/Overlay-Network/internal/logging"
 	"github.com/TheJ0lly/Overlay-Network/internal/message"
 	"github.com/TheJ0lly/Overlay-Network/internal/network"
 	"github.com/TheJ0lly/Overlay-Network/internal/queue"
+	"github.com/TheJ0lly/Overlay-Network/internal/tracing"
 )
 
+const DefaultMaxInboundConns = 64
+const DefaultReadTimeout = 5
+
+// How long the node waits before accepting connections again, after failing to accept one.
+const acceptRetryDelay = 100 * time.Millisecond
+
 // The base structure for all nodes in the network.
-// Maybe add an OwnerID (or whatever), to uniquely identify who sent what message
+// A node is identified by its ID, the Ip and Port are only the locator where it can be currently found.
 type Node struct {
+	ID             identity.NodeID                             `json:"ID"`
+	Identity       *identity.Identity                          `json:"-"`
 	Ip             net.IP                                      `json:"Ip"`
 	Port           uint16                                      `json:"Port"`
 	Conns          []*Node                                     `json:"Conns"`
 	Queue          queue.MessageQueue[message.MessageEnvelope] `json:"-"`
 	Alive          bool                                        `json:"-"`
+	Suspect        bool                                        `json:"-"`
+	Incarnation    uint64                                      `json:"-"`
 	LifeLineTimer  uint8                                       `json:"-"`
 	LifeLineTicker *time.Ticker                                `json:"-"`
 	DeathTimer     uint8                                       `json:"-"`
 	LastTimeAlive  int64                                       `json:"-"`
 	DepthVision    uint8                                       `json:"-"`
 	Stat           Stats                                       `json:"-"`
+
+	// ConnCap is the number of primary connections the node may have, as it was created with.
+	// The capacity of Conns is not to be trusted for it, since appending past it grows it.
+	ConnCap uint8 `json:"-"`
+
+	// When DeathQuorum is greater than 1, a death announcement only takes effect after DeathQuorum distinct neighbours
+	// of the dead node have reported it within DeathQuorumWindow seconds, or all the ones we can see when there are fewer.
+	DeathQuorum       uint8                             `json:"-"`
+	DeathQuorumWindow uint8                             `json:"-"`
+	DeathReports      map[identity.NodeID][]DeathReport `json:"-"`
+
+	// When AdvertiseHealth is set, the lifelines of this node carry its health record.
+	// Health is the last health record received from the node, and it is nil if the node does not advertise it.
+	AdvertiseHealth bool                `json:"-"`
+	Health          *message.NodeHealth `json:"-"`
+	StartTime       time.Time           `json:"-"`
+
+	// When AggregateLifeLines is set, the node sends a digest of the liveness info it knows to its direct neighbours,
+	// instead of flooding its own lifeline.
+	AggregateLifeLines bool `json:"-"`
+
+	// The smoothed RTT and jitter are in milliseconds, and they are only measured for primary connections.
+	SmoothedRTT float64 `json:"-"`
+	RTTJitter   float64 `json:"-"`
+	RTTSamples  uint64  `json:"-"`
+
+	// EncryptionKey is the signed key payloads are sealed for the node with, and it is nil until we receive it.
+	// OnPayload is called on the processing goroutine with the payloads sealed for this node. When nil, they are only logged.
+	EncryptionKey *identity.EncryptionKeyRecord              `json:"-"`
+	OnPayload     func(from message.NodeRef, payload []byte) `json:"-"`
+
+	// OnionHops is the number of relays an onion goes through before reaching its destination.
+	OnionHops uint8 `json:"-"`
+
+	// When NetworkKey is set, joining nodes must prove they know it. When RequireInvitation is set, they must hold an invitation from a member.
+	// Either way, a node holding a valid invitation is let in.
+	NetworkKey        []byte           `json:"-"`
+	RequireInvitation bool             `json:"-"`
+	usedInvitations   map[string]int64 `json:"-"`
+
+	// At most MaxInboundConns connections are read at the same time, and each of them for at most ReadTimeout seconds.
+	MaxInboundConns uint16     `json:"-"`
+	ReadTimeout     uint8      `json:"-"`
+	statMu          sync.Mutex `json:"-"`
+	captureMu       sync.Mutex `json:"-"`
+
+	// Each node may sign at most RateLimit messages per second of each type, in bursts of at most RateBurst messages, be they relayed to us or not. A RateLimit of 0 turns it off.
+	// Peers misbehaving too much are banned for BanDuration seconds.
+	RateLimit   float64    `json:"-"`
+	RateBurst   float64    `json:"-"`
+	BanDuration uint16     `json:"-"`
+	peers       *peerTable `json:"-"`
+
+	// ReplayWindow is the duration in seconds an envelope is accepted for after it has been signed.
+	// verifier checks the signatures of the envelopes we receive, and it is nil unless the simulator changed it.
+	ReplayWindow uint8 `json:"-"`
+	seenNonces   *nonceCache
+	verifier     func(env *message.MessageEnvelope) error
+
+	// Every StatsInterval seconds, the stats are passed to all the StatsSinks.
+	StatsInterval uint8       `json:"-"`
+	StatsSinks    []StatsSink `json:"-"`
+	inboundConns  atomic.Int32
+
+	// listener is set while MainLoop runs, and Stop closes it, along with done, which ends the goroutines MainLoop started.
+	listener   net.Listener
+	listenerMu sync.Mutex
+	stopping   bool
+	done       chan struct{}
+
+	// tasks are the functions Do runs on the processing goroutine. loopDone is closed once that goroutine returns, and it is nil until MainLoop starts it.
+	tasks    chan func()
+	loopDone chan struct{}
+
+	// crawls holds the connections requests of the running crawls, keyed by the nonce of the request.
+	crawls  map[string]pendingCrawl
+	crawlMu sync.Mutex
+
+	// Tracer records the spans of the traced messages going through the node. When nil, the traces only go through.
+	Tracer *tracing.Tracer `json:"-"`
+
+	// Capture records the envelopes the node accepts in its queue. The ones it sends are recorded by a capture.Transport in Net.
+	Capture *capture.Recorder `json:"-"`
+
+	// Faults injects faults in the envelopes the node receives, and is controlled through the admin API. The ones it sends go through a fault.Transport in Net.
+	Faults *fault.Injector `json:"-"`
+
+	// Net is how the node reaches the other nodes: the transport its messages go through, and the TLS config of its links.
+	Net *network.Network `json:"-"`
+
+	// Log is the logger of the node. Once the node has an identity, its messages carry the ID of the node.
+	Log *logging.Logger `json:"-"`
 }
 
-type NodeIPPMap = map[string][]network.IpPortPair
+type NodeRefMap = map[identity.NodeID][]message.NodeRef
 
 func (n *Node) String() string {
-	return fmt.Sprintf("[ip=%s, port=%d, conns=%v]", n.Ip, n.Port, n.Conns)
+	return fmt.Sprintf("[id=%s, ip=%s, port=%d, conns=%v]", n.ID.Short(), n.Ip, n.Port, n.Conns)
 }
 
-func CreatePrimaryConnectionNode(ipp network.IpPortPair) *Node {
+func CreatePrimaryConnectionNode(ref message.NodeRef) *Node {
 	return &Node{
-		Ip:    ipp.Ip,
-		Port:  ipp.Port,
+		ID:    ref.ID,
+		Ip:    ref.Locator.Ip,
+		Port:  ref.Locator.Port,
 		Alive: true,
+		Log:   logging.Component("node"),
 	}
 }
 
@@ -51,17 +162,38 @@ func Create(ip string, port uint16, connCap uint8, queueCap uint16) (*Node, erro
 	}
 
 	return &Node{
-		Ip:            parsedIp,
-		Port:          port,
-		Conns:         make([]*Node, 0, connCap),
-		Queue:         queue.Create[message.MessageEnvelope](queueCap),
-		Alive:         true,
-		LifeLineTimer: 0,
-		Stat:          NewStats(),
+		Ip:              parsedIp,
+		Port:            port,
+		Conns:           make([]*Node, 0, connCap),
+		ConnCap:         connCap,
+		Queue:           queue.Create[message.MessageEnvelope](queueCap),
+		Alive:           true,
+		LifeLineTimer:   0,
+		Stat:            NewStats(),
+		DeathQuorum:     1,
+		DeathReports:    map[identity.NodeID][]DeathReport{},
+		StartTime:       clock.Now(),
+		ReplayWindow:    DefaultReplayWindow,
+		MaxInboundConns: DefaultMaxInboundConns,
+		ReadTimeout:     DefaultReadTimeout,
+		seenNonces:      newNonceCache(),
+		usedInvitations: map[string]int64{},
+		RateLimit:       DefaultRateLimit,
+		RateBurst:       DefaultRateBurst,
+		BanDuration:     DefaultBanDuration,
+		peers:           newPeerTable(),
+		OnionHops:       DefaultOnionHops,
+		StatsInterval:   DefaultStatsInterval,
+		StatsSinks:      []StatsSink{FileSink{Dir: DefaultStatsDir, Port: port}},
+		crawls:          map[string]pendingCrawl{},
+		done:            make(chan struct{}),
+		tasks:           make(chan func()),
+		Net:             &network.Network{Log: logging.Component("network")},
+		Log:             logging.Component("node"),
 	}, nil
 }
 
-func createIpPortPairMapForNode(n *Node, layers uint8, cont NodeIPPMap, skipNode *network.IpPortPair) {
+func createNodeRefMapForNode(n *Node, layers uint8, cont NodeRefMap, skipNode identity.NodeID) {
 	if layers == 0 {
 		return
 	}
@@ -69,31 +201,30 @@ func createIpPortPairMapForNode(n *Node, layers uint8, cont NodeIPPMap, skipNode
 	if len(n.Conns) == 0 {
 		return
 	}
-	ipportPairs := make([]network.IpPortPair, 0, len(n.Conns))
+	refs := make([]message.NodeRef, 0, len(n.Conns))
 
 	for i := range n.Conns {
-		connIpp := n.Conns[i].GetIpPortPair()
-		if skipNode != nil && network.CompareIpPortPair(*skipNode, connIpp) {
+		connRef := n.Conns[i].GetNodeRef()
+		if connRef.Is(skipNode) {
 			continue
 		}
-		logging.LogDebug("gathering node for update info: %s", connIpp)
-		ipportPairs = append(ipportPairs, connIpp)
-		createIpPortPairMapForNode(n.Conns[i], layers-1, cont, skipNode)
+		n.Log.Debug("gathering node for update info: %s", connRef)
+		refs = append(refs, connRef)
+		createNodeRefMapForNode(n.Conns[i], layers-1, cont, skipNode)
 	}
 
-	cont[n.GetIpPortPair().Hash()] = ipportPairs
+	cont[n.ID] = refs
 }
 
-func putIpPortPairsAsNodesInNode(n *Node, layers uint8, cont NodeIPPMap, skipNodes ...network.IpPortPair) {
+func putNodeRefsAsNodesInNode(n *Node, layers uint8, cont NodeRefMap, skipNodes ...identity.NodeID) {
 	if layers == 0 {
 		return
 	}
-	nodeHash := n.GetIpPortPair().Hash()
 
-	var nodesIpp []network.IpPortPair
+	var nodeRefs []message.NodeRef
 	var ok bool
-	// If we cannot find the nodes hash, it means it either does not have any connections, or the vision of the sender is limited
-	if nodesIpp, ok = cont[nodeHash]; !ok {
+	// If we cannot find the nodes ID, it means it either does not have any connections, or the vision of the sender is limited
+	if nodeRefs, ok = cont[n.ID]; !ok {
 		return
 	}
 
@@ -101,43 +232,57 @@ func putIpPortPairsAsNodesInNode(n *Node, layers uint8, cont NodeIPPMap, skipNod
 	// We reset the connections list, and add them once again
 	// n.Conns = make([]*Node, 0, nodeConnCap)
 
-	for i := range nodesIpp {
-		if slices.ContainsFunc(skipNodes, func(ipp network.IpPortPair) bool {
-			val := network.CompareIpPortPair(nodesIpp[i], ipp)
-			return val
-		}) {
+	for i := range nodeRefs {
+		if slices.Contains(skipNodes, nodeRefs[i].ID) {
 			continue
 		}
 
 		var conn *Node
 		if idx := slices.IndexFunc(n.Conns, func(no *Node) bool {
-			return network.CompareIpPortPair(nodesIpp[i], no.GetIpPortPair())
+			return nodeRefs[i].Is(no.ID)
 		}); idx != -1 {
 			conn = n.Conns[idx]
+			conn.setLocator(nodeRefs[i].Locator)
 		} else {
-			conn = CreatePrimaryConnectionNode(nodesIpp[i])
+			conn = CreatePrimaryConnectionNode(nodeRefs[i])
 			n.Conns = append(n.Conns, conn)
 		}
-		skipN := make([]network.IpPortPair, 0, len(skipNodes)+2)
+		skipN := make([]identity.NodeID, 0, len(skipNodes)+2)
 		skipN = append(skipN, skipNodes...)
-		skipN = append(skipN, n.GetIpPortPair())
-		skipN = append(skipN, conn.GetIpPortPair())
-		logging.LogDebug("new skipping list under %v: \n %v", conn, skipN)
-		putIpPortPairsAsNodesInNode(conn, layers-1, cont, skipN...)
+		skipN = append(skipN, n.ID)
+		skipN = append(skipN, conn.ID)
+		n.Log.Debug("new skipping list under %v: \n %v", conn, skipN)
+		putNodeRefsAsNodesInNode(conn, layers-1, cont, skipN...)
 	}
 }
 
 // listen function returns a net.Listener to handle incoming connections.
 func (n *Node) listen() (net.Listener, error) {
-	return net.Listen("tcp", fmt.Sprintf("%s:%d", n.Ip, n.Port))
+	return n.Net.Listen(n.GetNodeAddress())
 }
 
-func (n *Node) setLastAliveTimeForNode(pair network.IpPortPair, t int64) {
+// setLastAliveTimeForNode refreshes the primary connection the envelope came straight from. Only what is proven is trusted:
+// over TLS, the node the link proved, otherwise the signed original sender, and only when it sent the envelope itself.
+// The locator is only taken from the signed original sender.
+func (n *Node) setLastAliveTimeForNode(env *message.MessageEnvelope, t int64) {
+	id := env.Link
+	if id == "" {
+		if !env.Sender.Is(env.OriginalSender.ID) {
+			return
+		}
+		id = env.OriginalSender.ID
+	}
+
 	for i := range n.Conns {
-		if network.CompareIpPortPair(n.Conns[i].GetIpPortPair(), pair) {
-			n.Conns[i].LastTimeAlive = t
-			n.Conns[i].Alive = true
-			logging.LogDebug("setting last time for node: %v - %v", pair, t)
+		if n.Conns[i].ID == id {
+			if env.OriginalSender.Is(id) {
+				n.Conns[i].setLocator(env.OriginalSender.Locator)
+			}
+			// A message received directly from the node clears a suspicion, but a node declared dead must come back with a greater incarnation.
+			if n.applyConnLiveness(n.Conns[i], stateAlive, n.Conns[i].Incarnation) || n.Conns[i].livenessState() == stateAlive {
+				n.Conns[i].LastTimeAlive = t
+				n.Log.Debug("setting last time for node: %s - %v", id.Short(), t)
+			}
 		}
 	}
 }
@@ -150,242 +295,732 @@ func (n *Node) handleMessage(msgEnv *message.MessageEnvelope) error {
 		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
 			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
 		}
-		n.processNetNewNodeJoinMessage(&msg, msgEnv.Sender, msgEnv.OriginalSender)
-		n.setLastAliveTimeForNode(msgEnv.Sender, time.Now().UnixMilli())
+		n.processNetNewNodeJoinMessage(&msg, msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
 		return nil
 	case message.NetNewNodeJoinQuery:
 		msg := message.NetNewNodeJoinQueryMessage{}
 		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
 			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
 		}
-		n.processNetNewNodeQueryMessage(&msg, msgEnv.Sender, msgEnv.OriginalSender)
-		n.setLastAliveTimeForNode(msgEnv.Sender, time.Now().UnixMilli())
+		n.processNetNewNodeQueryMessage(&msg, msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
 		return nil
 	case message.NetLifeLine:
 		msg := message.NetLifeLineMessage{}
 		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
 			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
 		}
-		n.processNetLifeLineMessage(msg, msgEnv.Sender, msgEnv.OriginalSender)
-		n.setLastAliveTimeForNode(msgEnv.Sender, time.Now().UnixMilli())
+		n.processNetLifeLineMessage(msg, msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
 		return nil
 	case message.NetDeathAnnouncement:
 		msg := message.NetDeathAnnouncementMessage{}
 		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
 			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
 		}
-		n.Stat.DeathAnnouncementsReceived++
-		n.processDeathAnnouncementMessage(&msg, msgEnv.Sender, msgEnv.OriginalSender)
-		n.setLastAliveTimeForNode(msgEnv.Sender, time.Now().UnixMilli())
+		n.updateStats(func(s *Stats) { s.DeathAnnouncementsReceived++ })
+		n.processDeathAnnouncementMessage(&msg, msgEnv)
+		// A node announcing that it leaves is the only one that may send its own death.
+		if !slices.ContainsFunc(msg.DeadNodes, func(deadNode message.NodeRef) bool { return deadNode.Is(msgEnv.Sender.ID) }) {
+			n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
+		}
 		return nil
 	case message.NetNewNodeJoinConfirm:
 		msg := message.NetNewNodeJoinConfirmMessage{}
 		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
 			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
 		}
-		n.processNetNewNodeJoinConfirmMessage(msgEnv.Sender, msgEnv.OriginalSender)
-		n.setLastAliveTimeForNode(msgEnv.Sender, time.Now().UnixMilli())
+		n.processNetNewNodeJoinConfirmMessage(&msg, msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
 		return nil
 	case message.NetUpdate:
 		msg := message.NetUpdateMessage{}
 		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
 			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
 		}
-		n.processNetUpdateMessage(msg, msgEnv.Sender, msgEnv.OriginalSender)
-		n.setLastAliveTimeForNode(msgEnv.Sender, time.Now().UnixMilli())
+		n.processNetUpdateMessage(msg, msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
+		return nil
+	case message.NetPing:
+		msg := message.NetPingMessage{}
+		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
+			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
+		}
+		n.processNetPingMessage(&msg, msgEnv.OriginalSender)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
+		return nil
+	case message.NetPong:
+		msg := message.NetPingMessage{}
+		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
+			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
+		}
+		n.processNetPongMessage(&msg, msgEnv.OriginalSender)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
+		return nil
+	case message.NetSealed:
+		msg := message.NetSealedMessage{}
+		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
+			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
+		}
+		n.processNetSealedMessage(&msg, msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
+		return nil
+	case message.NetOnion:
+		msg := message.NetSealedMessage{}
+		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
+			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
+		}
+		n.processNetOnionMessage(&msg, msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
+		return nil
+	case message.NetLifeLineDigest:
+		msg := message.NetLifeLineDigestMessage{}
+		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
+			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
+		}
+		n.processNetLifeLineDigestMessage(&msg, msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
+		return nil
+	case message.NetConnsRequest:
+		n.processNetConnsRequestMessage(msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
+		return nil
+	case message.NetConnsResponse:
+		msg := message.NetConnsResponseMessage{}
+		if err := json.Unmarshal(msgEnv.Data, &msg); err != nil {
+			return fmt.Errorf("unmarshaling error for %s: %s", msgEnv.Type, err)
+		}
+		n.processNetConnsResponseMessage(&msg, msgEnv)
+		n.setLastAliveTimeForNode(msgEnv, clock.Now().UnixMilli())
 		return nil
 	default:
 		return fmt.Errorf("unknown message type: %d", msgEnv.Type)
 	}
 }
 
-// processMessageGoroutine handles the queue of messages and processes them.
-func (n *Node) processMessageGoroutine() {
+// processMessageGoroutine handles the queue of messages and processes them, along with the tasks passed to Do.
+// It is the only goroutine changing the vision of the node while MainLoop runs.
+func (n *Node) processMessageGoroutine(loopDone chan struct{}) {
+	defer close(loopDone)
 	for {
-		n.Queue.Wait()
+		select {
+		case <-n.done:
+			return
+		case f := <-n.tasks:
+			f()
+		case <-n.Queue.Notified():
+			if n.stopped() {
+				return
+			}
+			msg, err := n.Queue.PopFront()
+			if err != nil {
+				continue
+			}
+			// The notifications of the messages appended while we were busy have been merged into one, thus we keep going until the queue is empty.
+			if n.Queue.Length() != 0 {
+				n.Queue.Notify()
+			}
+			n.processMessage(&msg)
+		}
+	}
+}
+
+// Do runs f on the goroutine processing the messages, and waits for it to be done.
+// That goroutine owns the vision of the node, thus anything reading or changing the vision from another goroutine must go through Do.
+// When no goroutine processes the messages, before MainLoop, once the node stopped or in the simulator, f runs right away.
+// It must not be called from the processing goroutine itself, such as from OnPayload.
+func (n *Node) Do(f func()) {
+	n.listenerMu.Lock()
+	loopDone := n.loopDone
+	n.listenerMu.Unlock()
+	if loopDone == nil {
+		f()
+		return
+	}
+
+	finished := make(chan struct{})
+	select {
+	case n.tasks <- func() {
+		defer close(finished)
+		f()
+	}:
+		<-finished
+	case <-loopDone:
+		f()
+	}
+}
+
+// ProcessQueue processes the messages in the queue until it is empty, the ones queued meanwhile included.
+// It must not be used while MainLoop runs.
+func (n *Node) ProcessQueue() {
+	for n.Queue.Length() != 0 {
 		msg, err := n.Queue.PopFront()
 		if err != nil {
-			continue
+			return
 		}
+		n.processMessage(&msg)
+	}
+}
 
-		logging.LogInfo("started processing new message: type=%s data=%s sender=%v", msg.Type, msg.Data, msg.Sender)
-		if network.CompareIpPortPair(msg.OriginalSender, n.GetIpPortPair()) {
-			n.Stat.DuplicatedMessages++
-		}
+func (n *Node) processMessage(msg *message.MessageEnvelope) {
+	lg := n.envelopeLog(msg)
+	lg.Info("started processing new message: data=%s", msg.Data)
 
-		if err := n.handleMessage(&msg); err != nil {
-			logging.LogError("%s", err)
-		}
+	// The messages the node puts in its own queue have not waited for their turn the same way.
+	if !msg.EnqueuedAt.IsZero() {
+		n.Tracer.StartAt(msg.Trace, "queue "+msg.Type.String(), "", msg.EnqueuedAt).End()
+	}
+	span := n.Tracer.Start(msg.Trace, "process "+msg.Type.String(), "")
+	if ctx := span.Context(); ctx != nil {
+		msg.Trace = ctx
+	}
 
-		logging.LogInfo("finished processing message: type=%s data=%s sender=%v", msg.Type, msg.Data, msg.Sender)
-		logging.LogDebug("messages left in queue: %d", n.Queue.Length())
+	start := time.Now()
+	if err := n.handleMessage(msg); err != nil {
+		lg.Error("%s", err)
+		span.Tag("error", err.Error())
 	}
+	latency := float64(time.Since(start).Microseconds()) / 1000
+	n.updateStats(func(s *Stats) { s.ProcessingLatency.Observe(latency) })
+	span.End()
+
+	lg.Info("finished processing message")
+	lg.Debug("messages left in queue: %d", n.Queue.Length())
 }
 
 // checkQueueForLifelinesForDeadNodes will get the nodes marked as dead, and check if there are lifelines in the queue.
 // This mechanism is for reducing the network congestion due to state changes that are yet to be processed.
 // Meaning that when we mark a node as dead, we might have a message coming from that node in queue, thus we can remove the death announcement.
-func (n *Node) checkQueueForLifelinesForDeadNodes(deadNodes []network.IpPortPair) []network.IpPortPair {
-	return slices.DeleteFunc(deadNodes, func(pair network.IpPortPair) bool {
+func (n *Node) checkQueueForLifelinesForDeadNodes(deadNodes []message.NodeRef) []message.NodeRef {
+	return slices.DeleteFunc(deadNodes, func(ref message.NodeRef) bool {
 		return n.Queue.ContainsFunc(func(me message.MessageEnvelope) bool {
-			val := network.CompareIpPortPair(me.Sender, pair)
-			logging.LogDebug("found message in queue for possible dead node %v? - %v", pair, val)
+			val := me.Sender.Is(ref.ID)
+			n.Log.Debug("found message in queue for possible dead node %v? - %v", ref, val)
 			return val
 		})
 	})
 }
 
-func (n *Node) findExistingDeadNodes() []network.IpPortPair {
-	var deadNodes []network.IpPortPair = nil
+func (n *Node) findExistingDeadNodes() []message.NodeRef {
+	var deadNodes []message.NodeRef = nil
 	for i := range n.Conns {
 		pConn := n.Conns[i]
 		if pConn.Alive == false {
-			deadNodes = append(deadNodes, pConn.GetIpPortPair())
+			deadNodes = append(deadNodes, pConn.GetNodeRef())
 		}
 	}
 	return n.checkQueueForLifelinesForDeadNodes(deadNodes)
 }
 
-// findNewDeadNodes will get the IpPortPair of each node that has (time.Now - LastTimeAlive) > DeathTimer.
-func (n *Node) findNewDeadNodes() []network.IpPortPair {
+// suspectStaleNodes will mark as suspect each alive node that has (now - LastTimeAlive) > DeathTimer.
+// A suspect node gets one more DeathTimer window to show up before it is declared dead.
+func (n *Node) suspectStaleNodes() {
 	d := time.Second * time.Duration(n.DeathTimer)
-	now := time.Now().UnixMilli()
+	now := clock.Now().UnixMilli()
 
-	var deadNodes []network.IpPortPair = nil
 	for i := range n.Conns {
 		pConn := n.Conns[i]
-		if pConn.Alive == false {
+		if (now - pConn.LastTimeAlive) > d.Milliseconds() {
+			pConn.applyLiveness(stateSuspect, pConn.Incarnation)
+		}
+	}
+}
+
+// findNewDeadNodes will get the NodeRef of each suspect node that still has (now - LastTimeAlive) > DeathTimer.
+func (n *Node) findNewDeadNodes() []message.NodeRef {
+	d := time.Second * time.Duration(n.DeathTimer)
+	now := clock.Now().UnixMilli()
+
+	var deadNodes []message.NodeRef = nil
+	for i := range n.Conns {
+		pConn := n.Conns[i]
+		if pConn.livenessState() != stateSuspect {
 			continue
 		}
 
 		if (now - pConn.LastTimeAlive) > d.Milliseconds() {
-			logging.LogDebug("found possible dead node: %s", pConn)
-			deadNodes = append(deadNodes, pConn.GetIpPortPair())
+			n.Log.Debug("found possible dead node: %s", pConn)
+			deadNodes = append(deadNodes, pConn.GetNodeRef())
 		}
 	}
 	return n.checkQueueForLifelinesForDeadNodes(deadNodes)
 }
 
-func (n *Node) setNodesDead(deadNodes []network.IpPortPair) {
+func (n *Node) setNodesDead(deadNodes []message.NodeRef) {
 	for i := range n.Conns {
-		if slices.ContainsFunc(deadNodes, func(deadNode network.IpPortPair) bool {
-			return network.CompareIpPortPair(deadNode, n.Conns[i].GetIpPortPair())
+		if slices.ContainsFunc(deadNodes, func(deadNode message.NodeRef) bool {
+			return deadNode.Is(n.Conns[i].ID)
 		}) && n.Conns[i].Alive == true {
-			logging.LogDebug("new node has been marked as dead: %v - %v", n.Conns[i].Ip, n.Conns[i].Port)
-			n.Conns[i].Alive = false
-			n.Stat.PrimaryConnections--
+			n.Log.Debug("new node has been marked as dead: %v - %v", n.Conns[i].Ip, n.Conns[i].Port)
+			n.applyConnLiveness(n.Conns[i], stateDead, n.Conns[i].Incarnation)
 		}
 	}
 }
 
 func (n *Node) sendLifeLineAnnouncement() {
-	logging.LogDebug("starting lifeline announcement")
+	n.Log.Debug("starting lifeline announcement")
 
-	env, err := message.CreateMessageEnvelope(
+	env, err := n.CreateEnvelope(
 		message.NetLifeLine,
-		&message.NetLifeLineMessage{Node: n.GetIpPortPair()},
-		n.GetIpPortPair(),
-		n.GetIpPortPair(),
+		&message.NetLifeLineMessage{Node: n.GetNodeRef(), Incarnation: n.Incarnation, Health: n.createHealthRecord(), EncryptionKey: n.EncryptionKey},
 	)
 
 	if err != nil {
-		logging.LogError("could not serialize lifeline message for periodical update")
+		n.Log.Error("could not serialize lifeline message for periodical update")
 		return
 	}
 
-	logging.LogDebug("sending lifeline")
-	n.Stat.MessagesForwarded[env.Type.String()]++
-	go n.ForwardMessage(&env)
+	n.Log.Debug("sending lifeline")
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[env.Type.String()]++ })
+	n.forward(&env)
 }
 
-func (n *Node) sendDeathAnnouncement(deadNodes []network.IpPortPair) {
-	logging.LogDebug("starting death annoucement")
+func (n *Node) sendDeathAnnouncement(deadNodes []message.NodeRef) {
+	n.Log.Debug("starting death annoucement")
+
+	incarnations := make(map[identity.NodeID]uint64, len(deadNodes))
+	deadIDs := make([]identity.NodeID, 0, len(deadNodes))
+	for i := range deadNodes {
+		deadIDs = append(deadIDs, deadNodes[i].ID)
+		if deadNode := findNodeByIDInNode(n, deadNodes[i].ID, n.DepthVision); deadNode != nil {
+			incarnations[deadNodes[i].ID] = deadNode.Incarnation
+		}
+	}
 
-	env, err := message.CreateMessageEnvelope(message.NetDeathAnnouncement, &message.NetDeathAnnouncementMessage{
-		DeadNodes: deadNodes,
-	}, n.GetIpPortPair(), n.GetIpPortPair())
+	env, err := n.CreateEnvelope(message.NetDeathAnnouncement, &message.NetDeathAnnouncementMessage{
+		DeadNodes:    deadNodes,
+		Incarnations: incarnations,
+		Reporter:     n.GetNodeRef(),
+	})
 
 	if err != nil {
-		logging.LogError("could not create envelope for death announcement: %s", err)
+		n.Log.Error("could not create envelope for death announcement: %s", err)
 		return
 	}
-	n.Stat.DeathAnnouncementsSent++
-	logging.LogInfo("sending death announcement for: %v", deadNodes)
-	n.Stat.MessagesForwarded[env.Type.String()]++
-	go n.ForwardMessage(&env, deadNodes...)
+	n.updateStats(func(s *Stats) { s.DeathAnnouncementsSent++ })
+	n.Log.Info("sending death announcement for: %v", deadNodes)
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[env.Type.String()]++ })
+	n.forward(&env, deadIDs...)
+}
+
+// Leave announces to the network that this node leaves it, and stops the node once the announcement is sent.
+func (n *Node) Leave() error {
+	self := n.GetNodeRef()
+	env, err := n.CreateEnvelope(message.NetDeathAnnouncement, &message.NetDeathAnnouncementMessage{
+		DeadNodes:    []message.NodeRef{self},
+		Incarnations: map[identity.NodeID]uint64{n.ID: n.Incarnation},
+		Reporter:     self,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create envelope for leaving: %s", err)
+	}
+
+	n.Log.Info("leaving the network")
+	n.updateStats(func(s *Stats) { s.DeathAnnouncementsSent++ })
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[env.Type.String()]++ })
+	n.ForwardMessage(&env)
+	return n.Stop()
+}
+
+// sendLifeLine lets the network know this node is alive, in the way the node is configured to.
+func (n *Node) sendLifeLine() {
+	if n.AggregateLifeLines {
+		n.sendLifeLineDigest()
+	} else {
+		n.sendLifeLineAnnouncement()
+	}
+}
+
+// checkDeaths announces the death of the primary connections we have not heard from in a while, and suspects the nodes going quiet.
+func (n *Node) checkDeaths() {
+	if deadNodes := n.findNewDeadNodes(); deadNodes != nil {
+		n.setNodesDead(deadNodes)
+		n.sendDeathAnnouncement(deadNodes)
+	}
+	n.suspectStaleNodes()
+}
+
+// The periodical tasks of a node, which MainLoop runs on timers. Without MainLoop, such as in the simulator, they are run with RunTask.
+type Task int
+
+const (
+	// TaskLifeLine sends a lifeline, and pings the primary connections.
+	TaskLifeLine Task = iota
+	// TaskDeathCheck looks for dead primary connections.
+	TaskDeathCheck
+	// TaskStats exports the stats and the traces, and forgets the nonces and the death reports out of their window.
+	TaskStats
+)
+
+// RunTask runs the task on the processing goroutine, through Do.
+func (n *Node) RunTask(t Task) {
+	n.Do(func() {
+		switch t {
+		case TaskLifeLine:
+			n.sendLifeLine()
+			n.sendPings()
+		case TaskDeathCheck:
+			n.checkDeaths()
+		case TaskStats:
+			n.exportStats()
+			n.FlushTraces()
+			n.pruneSeenNonces()
+			n.pruneDeathReports()
+		}
+	})
 }
 
 // periodicalMessagesLoop is a method that will run in parallel to the main loop, and it will be used as the main place where messages/protocols are initiated.
 func (n *Node) periodicalMessagesLoop() {
 	n.LifeLineTicker = time.NewTicker(time.Duration(n.LifeLineTimer) * time.Second)
 	deathTicker := time.NewTicker(time.Duration(n.DeathTimer) * time.Second)
-	statsTicker := time.NewTicker(10 * time.Second)
+	statsTicker := time.NewTicker(time.Duration(n.StatsInterval) * time.Second)
 
 	for {
 		select {
+		case <-n.done:
+			n.LifeLineTicker.Stop()
+			deathTicker.Stop()
+			statsTicker.Stop()
+			return
 		case <-n.LifeLineTicker.C:
-			n.sendLifeLineAnnouncement()
+			n.RunTask(TaskLifeLine)
 			n.LifeLineTicker.Reset(time.Duration(n.LifeLineTimer) * time.Second)
 		case <-deathTicker.C:
-			if deadNodes := n.findNewDeadNodes(); deadNodes != nil {
-				n.setNodesDead(deadNodes)
-				n.sendDeathAnnouncement(deadNodes)
-			}
+			n.RunTask(TaskDeathCheck)
 			deathTicker.Reset(time.Duration(n.DeathTimer) * time.Second)
 		case <-statsTicker.C:
-			n.Stat.ExportJson(n.Port)
-			statsTicker.Reset(10 * time.Second)
+			n.RunTask(TaskStats)
+			statsTicker.Reset(time.Duration(n.StatsInterval) * time.Second)
 		}
 	}
 }
 
+// FlushTraces queues the spans recorded since the last flush for export.
+func (n *Node) FlushTraces() {
+	dropped, err := n.Tracer.Flush()
+	if err != nil {
+		n.Log.Error("could not export traces - %s", err)
+	}
+	if dropped != 0 {
+		n.Log.Warn("dropped %d spans - too many were recorded between two exports, or the exporter is too slow", dropped)
+	}
+}
+
+// closeTracer exports what is left of the spans when the node stops.
+func (n *Node) closeTracer() {
+	if err := n.Tracer.Close(); err != nil {
+		n.Log.Error("could not export traces - %s", err)
+	}
+}
+
 // MainLoop function runs the main loop of the node.
 // For now, you can run the node with this function, or simply look inside it and copy the code and use it. :)
 func (n *Node) MainLoop() error {
+	// The timers of the periodical messages cannot be 0, the tickers would panic.
+	if n.LifeLineTimer == 0 || n.DeathTimer == 0 || n.StatsInterval == 0 {
+		err := fmt.Errorf("cannot start node - lifeline timer (%d), death timer (%d) and stats interval (%d) must be greater than 0", n.LifeLineTimer, n.DeathTimer, n.StatsInterval)
+		n.Log.Error("%s", err)
+		return err
+	}
+
 	l, err := n.listen()
 	if err != nil {
-		logging.LogError("%s", err)
+		n.Log.Error("%s", err)
 		return err
 	}
 
-	logging.LogInfo("listening on: %s", l.Addr())
+	n.Log.Info("listening on: %s", l.Addr())
 
-	go n.processMessageGoroutine()
+	n.listenerMu.Lock()
+	n.listener = l
+	stopping := n.stopping
+	n.listenerMu.Unlock()
+	// The node may have been stopped while joining.
+	if stopping {
+		l.Close()
+		n.Log.Info("node stopped")
+		return nil
+	}
+
+	loopDone := make(chan struct{})
+	n.listenerMu.Lock()
+	n.loopDone = loopDone
+	n.listenerMu.Unlock()
+	go n.processMessageGoroutine(loopDone)
 	go n.periodicalMessagesLoop()
 
+	inboundSlots := make(chan struct{}, n.MaxInboundConns)
 	for {
 		conn, err := l.Accept()
-		if err != nil {
-			logging.LogError("%s", err)
+		if errors.Is(err, net.ErrClosed) {
+			if n.stopped() {
+				n.closeTracer()
+				n.Log.Info("node stopped")
+				return nil
+			}
+			n.Log.Error("%s", err)
 			return err
+		} else if err != nil {
+			// Running out of file descriptors and the like are temporary, thus the node keeps going.
+			n.Log.Error("could not accept connection - %s", err)
+			time.Sleep(acceptRetryDelay)
+			continue
 		}
 
-		b, err := io.ReadAll(conn)
-		if err != nil {
-			logging.LogError("%s", err)
+		select {
+		case inboundSlots <- struct{}{}:
+		default:
+			n.Log.Error("too many inbound connections (%d) - dropping connection from %s", n.MaxInboundConns, conn.RemoteAddr())
+			n.updateStats(func(s *Stats) { s.InboundConnRejects++ })
 			conn.Close()
-			return err
+			continue
 		}
 
-		env := message.MessageEnvelope{}
-		err = message.DeserializeMessageEnvelope(&env, b)
+		n.inboundConns.Add(1)
+		go func() {
+			defer func() {
+				n.inboundConns.Add(-1)
+				<-inboundSlots
+			}()
+			n.handleConnection(conn)
+		}()
+	}
+}
 
-		if err != nil {
-			logging.LogError("%s", err)
-			conn.Close()
-			continue
+// Stop makes MainLoop return, once it stopped accepting connections, and ends the processing and the periodical messages.
+// A node that is stopped cannot be started again.
+func (n *Node) Stop() error {
+	n.listenerMu.Lock()
+	defer n.listenerMu.Unlock()
+
+	if n.stopping {
+		return nil
+	}
+	n.stopping = true
+	close(n.done)
+	n.Queue.Notify()
+	// When MainLoop has not started yet, it returns as soon as it does.
+	if n.listener == nil {
+		return nil
+	}
+	return n.listener.Close()
+}
+
+func (n *Node) stopped() bool {
+	n.listenerMu.Lock()
+	defer n.listenerMu.Unlock()
+	return n.stopping
+}
+
+// handleConnection reads the envelope sent on an inbound connection, and puts it in the queue if it passes all the checks.
+// It runs in its own goroutine, thus it must only touch the stats through updateStats.
+func (n *Node) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+
+	// The peer is keyed by what the link proves, thus over TLS the handshake comes first.
+	if err := network.Handshake(conn, time.Duration(n.ReadTimeout)*time.Second); err != nil {
+		n.Log.Error("could not complete handshake with %s - %s", conn.RemoteAddr(), err)
+		n.updateStats(func(s *Stats) { s.LinkRejects++ })
+		return
+	}
+
+	key := peerKey(conn)
+	if n.peerBanned(key) {
+		n.dropFromBannedPeer(key)
+		return
+	}
+
+	b, err := network.ReadMessage(conn, message.MaxEnvelopeSize, time.Duration(n.ReadTimeout)*time.Second)
+	if err != nil {
+		n.Log.Error("could not read from %s - %s", conn.RemoteAddr(), err)
+		if errors.Is(err, network.ErrMessageTooBig) {
+			n.penalizePeer(key, penaltyOversized, "oversized envelope")
+			n.updateStats(func(s *Stats) { s.OversizedRejects++ })
+			return
 		}
+		n.updateStats(func(s *Stats) { s.LinkRejects++ })
+		return
+	}
 
-		if err = n.Queue.Append(env); err != nil {
-			logging.LogInfo("message queue error: %s", err)
-			conn.Close()
-			n.Stat.QueueDrops++
-			continue
+	if n.Faults == nil {
+		n.handleEnvelope(conn, key, b, start)
+		return
+	}
+	// The peer is named by what the link proves, since the envelope is not checked yet.
+	from := fault.Endpoint{Addr: conn.RemoteAddr().String()}
+	if peerID, ok := network.PeerID(conn); ok {
+		from.ID = peerID
+	}
+	// A delayed envelope is handled once the connection is closed, which only its addresses are still needed of.
+	if err = n.Faults.Receive(b, from, fault.Endpoint{Addr: n.GetNodeAddress(), ID: n.ID}, func(b []byte) error {
+		n.handleEnvelope(conn, key, b, start)
+		return nil
+	}); err != nil {
+		n.Log.Debug("dropped envelope from %s - %s", conn.RemoteAddr(), err)
+	}
+}
+
+// handleEnvelope puts the envelope read from the connection with the peer of the given key in the queue, if it passes all the checks.
+// Like handleConnection, it must only touch the stats through updateStats.
+func (n *Node) handleEnvelope(conn net.Conn, key string, b []byte, start time.Time) {
+	env := message.MessageEnvelope{}
+	err := message.DeserializeMessageEnvelope(&env, b)
+	if err != nil {
+		n.Log.Error("%s", err)
+		n.penalizePeer(key, penaltyMalformed, "malformed envelope")
+		return
+	}
+	env.LinkKey = key
+
+	span := n.Tracer.StartAt(env.Trace, "receive "+env.Type.String(), tracing.KindConsumer, start)
+	span.Tag("msg.id", env.Nonce)
+	span.Tag("peer", env.Sender.String())
+	defer span.End()
+
+	lg := n.envelopeLog(&env)
+	// The node on the other end of the link must be the one that claims to send the envelope.
+	if peerID, ok := network.PeerID(conn); ok && !env.Sender.Is(peerID) {
+		lg.Error("rejected envelope: sent over a link with node %s", peerID.Short())
+		n.penalizePeer(key, penaltyBadSignature, "sender does not match the link")
+		n.updateStats(func(s *Stats) { s.LinkRejects++ })
+		return
+	} else if ok {
+		env.Link = peerID
+	}
+
+	if !n.checkEnvelope(&env, key, span) {
+		return
+	}
+
+	if ctx := span.Context(); ctx != nil {
+		env.Trace = ctx
+	}
+	env.EnqueuedAt = time.Now()
+
+	if err = n.enqueue(env, conn.RemoteAddr().String(), b); err != nil {
+		lg.Info("message queue error: %s", err)
+		span.Tag("error", err.Error())
+	}
+}
+
+// enqueue puts the envelope in the queue, and captures it along with the raw bytes it came in, when there are any.
+// The envelopes are queued and captured under captureMu, such that the capture has them in the order of the queue,
+// without the file being written while holding statMu.
+func (n *Node) enqueue(env message.MessageEnvelope, peer string, b []byte) error {
+	n.captureMu.Lock()
+	err := n.Queue.Append(env)
+	if err == nil && b != nil {
+		if recErr := n.Capture.Record(capture.In, peer, b, nil); recErr != nil {
+			n.envelopeLog(&env).Error("could not capture envelope - %s", recErr)
 		}
-		n.Stat.MessagesReceived[env.Type.String()]++
-		conn.Close()
-		n.Queue.Notify()
 	}
+	n.captureMu.Unlock()
+
+	if err != nil {
+		n.updateStats(func(s *Stats) { s.QueueDrops++ })
+		return err
+	}
+	n.updateStats(func(s *Stats) { s.MessagesReceived[env.Type.String()]++ })
+	n.Queue.Notify()
+	return nil
+}
+
+// checkEnvelope runs the checks that do not need the connection on an envelope received from the peer with the given key, and tells if it passed them.
+// The peer is penalized for the envelopes it should not have sent at all, and the signer for going over the rate limit.
+// It must only touch the stats through updateStats.
+func (n *Node) checkEnvelope(env *message.MessageEnvelope, key string, span *tracing.Span) bool {
+	lg := n.envelopeLog(env)
+	if env.Type.String() == "unknown" {
+		lg.Error("rejected envelope: unknown message type %d", env.Type)
+		n.penalizePeer(key, penaltyUnknownType, "unknown message type")
+		return false
+	}
+
+	if len(env.Data) > env.Type.MaxSize() {
+		lg.Error("rejected envelope: %d bytes of data - at most %d allowed", len(env.Data), env.Type.MaxSize())
+		n.penalizePeer(key, penaltyOversized, "oversized "+env.Type.String())
+		n.updateStats(func(s *Stats) { s.OversizedRejects++ })
+		return false
+	}
+
+	if err := n.verifyEnvelope(env); err != nil {
+		// The floods reach a node through several of its links, thus the copies of an envelope are expected, and only counted as duplicates.
+		duplicate := errors.Is(err, errOwnEnvelope) || errors.Is(err, errDuplicateEnvelope)
+		n.updateStats(func(s *Stats) {
+			switch {
+			case duplicate:
+				s.DuplicatedMessages++
+			case errors.Is(err, errReplayedEnvelope):
+				s.ReplayRejects++
+			default:
+				s.SignatureRejects++
+			}
+		})
+		if !duplicate && !errors.Is(err, errReplayedEnvelope) {
+			lg.Error("rejected envelope: %s", err)
+			n.penalizePeer(key, penaltyBadSignature, "bad signature")
+		}
+		lg.Debug("dropped envelope: %s", err)
+		span.Tag("error", err.Error())
+		return false
+	}
+
+	// A valid signature only proves who signed the envelope, and any node can make up a key. Only the members are listened to.
+	if !n.Net.Member(env.OriginalSender.ID) {
+		lg.Error("rejected envelope: signed by node %s, which is not a member of the network", env.OriginalSender.ID.Short())
+		// The peer may only have relayed it, thus it is not penalized.
+		n.updateStats(func(s *Stats) { s.SignatureRejects++ })
+		span.Tag("error", "signer is not a member")
+		return false
+	}
+
+	// Only now is the signer known for sure, and the copies of the floods are already dropped.
+	origin := string(env.OriginalSender.ID)
+	if n.peerBanned(origin) {
+		n.dropFromBannedPeer(origin)
+		span.Tag("error", "banned signer")
+		return false
+	}
+	if !n.allowMessage(origin, env.Type) {
+		lg.Debug("dropped envelope: rate limit exceeded")
+		span.Tag("error", "rate limit exceeded")
+		n.updateStats(func(s *Stats) { s.RateLimitDrops++ })
+		return false
+	}
+	return true
+}
+
+// Receive takes in an envelope as if it came from a connection: it goes through the same checks, and is queued if it passes them.
+// It is meant for the envelopes that do not come from the network, such as the ones of the simulator.
+func (n *Node) Receive(env message.MessageEnvelope) bool {
+	key := string(env.Sender.ID)
+	env.LinkKey = key
+	if n.peerBanned(key) {
+		n.dropFromBannedPeer(key)
+		return false
+	}
+	if !n.checkEnvelope(&env, key, nil) {
+		return false
+	}
+
+	if err := n.enqueue(env, "", nil); err != nil {
+		n.envelopeLog(&env).Info("message queue error: %s", err)
+		return false
+	}
+	return true
+}
+
+// envelopeLog returns the logger of the node, adding the fields of the envelope to the messages.
+func (n *Node) envelopeLog(env *message.MessageEnvelope) *logging.Logger {
+	return n.Log.With("msg_type", env.Type.String(), "msg_id", env.Nonce, "peer", env.Sender.ID.Short())
+}
+
+func (n *Node) dropFromBannedPeer(key string) {
+	n.Log.Debug("dropped connection from banned peer %s", key)
+	n.updateStats(func(s *Stats) { s.BannedPeerDrops++ })
 }
 
 func (n *Node) GetNodeAddress() string {
@@ -393,7 +1028,7 @@ func (n *Node) GetNodeAddress() string {
 	return ipp.NetString()
 }
 
-func gatherNodesToSendTo(n *Node, dests []network.IpPortPair, layer uint8, skipNodes ...network.IpPortPair) []network.IpPortPair {
+func gatherNodesToSendTo(n *Node, dests []*Node, layer uint8, skipNodes ...identity.NodeID) []*Node {
 	if layer == 0 {
 		return dests
 	}
@@ -401,64 +1036,126 @@ func gatherNodesToSendTo(n *Node, dests []network.IpPortPair, layer uint8, skipN
 	for i := range n.Conns {
 		conn := n.Conns[i]
 
-		if conn.Alive && !slices.ContainsFunc(skipNodes, func(no network.IpPortPair) bool {
-			return network.CompareIpPortPair(no, conn.GetIpPortPair())
-		}) {
-			dests = append(dests, conn.GetIpPortPair())
+		if conn.Alive && !slices.Contains(skipNodes, conn.ID) {
+			dests = append(dests, conn)
 		} else {
-			logging.LogDebug("node %v is marked as dead or to be skipped, gathering its nodes", conn.GetIpPortPair())
-			n.Stat.DeadHopAttempts++
+			n.Log.Debug("node %v is marked as dead or to be skipped, gathering its nodes", conn.GetNodeRef())
 			dests = gatherNodesToSendTo(conn, dests, layer-1)
-			n.Stat.DeadHopNodesGathered += uint64(len(dests))
-
-			n.Stat.DeadHopNodesGatheredAvg = float64(n.Stat.DeadHopAttempts) / float64(n.Stat.DeadHopNodesGathered)
+			n.updateStats(func(s *Stats) {
+				s.DeadHopAttempts++
+				s.DeadHopNodesGathered += uint64(len(dests))
+				s.DeadHopNodesGatheredAvg = float64(s.DeadHopAttempts) / float64(s.DeadHopNodesGathered)
+			})
 		}
 	}
 
 	return dests
 }
 
-func (n *Node) ForwardMessage(env *message.MessageEnvelope, skipSenderList ...network.IpPortPair) {
+// ForwardMessage sends the envelope to the nodes of the vision it must reach, and waits for the sends.
+func (n *Node) ForwardMessage(env *message.MessageEnvelope, skipSenderList ...identity.NodeID) {
+	n.forwardTo(env, n.forwardDests(skipSenderList))
+}
+
+// forward does the same thing as ForwardMessage without waiting for the sends.
+// The destinations are gathered right away, since the vision may only be read by the processing goroutine.
+func (n *Node) forward(env *message.MessageEnvelope, skipSenderList ...identity.NodeID) {
+	dests := n.forwardDests(skipSenderList)
+	clock.Go(func() { n.forwardTo(env, dests) })
+}
+
+// forwardDests gathers the addresses of the nodes a message is forwarded to, skipping the given nodes.
+func (n *Node) forwardDests(skipSenderList []identity.NodeID) []network.Dest {
 	if len(n.Conns) == 0 {
-		logging.LogError("cannot forward, no other nodes connected to this node")
+		n.Log.Error("cannot forward, no other nodes connected to this node")
+		return nil
+	}
+
+	gathered := gatherNodesToSendTo(n, make([]*Node, 0), n.DepthVision)
+	destNodes := make([]network.Dest, 0, len(gathered))
+	for i := range gathered {
+		if slices.Contains(skipSenderList, gathered[i].ID) {
+			n.Log.Debug("jumping over node: %s", gathered[i].GetNodeRef())
+			continue
+		}
+		destNodes = append(destNodes, gathered[i].dest())
+	}
+	return destNodes
+}
+
+// forwardTo sends the envelope to the destinations.
+func (n *Node) forwardTo(env *message.MessageEnvelope, destNodes []network.Dest) {
+	span := n.Tracer.Start(env.Trace, "forward "+env.Type.String(), tracing.KindProducer)
+	defer span.End()
+
+	if destNodes == nil {
+		span.Tag("error", "no primary connections")
 		return
 	}
 
-	b, err := message.SerializeMessageEnvelope(env)
+	// The nodes we send to see the message coming from the forward span.
+	fwd := *env
+	if ctx := span.Context(); ctx != nil {
+		fwd.Trace = ctx
+	}
+	b, err := message.SerializeMessageEnvelope(&fwd)
 	if err != nil {
-		logging.LogError("cannot forward, cannot serialize original envelope")
+		n.Log.Error("cannot forward, cannot serialize original envelope")
 		return
 	}
 
-	destNodes := make([]network.IpPortPair, 0)
-	destNodes = gatherNodesToSendTo(n, destNodes, n.DepthVision)
-	logging.LogDebug("nodes to send message %v to %v", env.Type, destNodes)
-	n.Stat.SendErrors += network.SendToMultipleDest(b, destNodes, skipSenderList, time.Duration(n.DeathTimer))
+	n.Log.Debug("nodes to send message %v to %v", env.Type, destNodes)
+	sendErrors := n.Net.SendToMultipleDest(b, destNodes, nil, time.Duration(n.DeathTimer))
+	n.updateStats(func(s *Stats) { s.SendErrors += sendErrors })
+
+	span.Tag("dests", strconv.Itoa(len(destNodes)))
+	if sendErrors != 0 {
+		span.Tag("error", fmt.Sprintf("could not send to %d nodes", sendErrors))
+	}
 }
 
-func findNodeByIpPortPairInNode(node *Node, ipp network.IpPortPair, layer uint8) *Node {
-	if layer == 0 {
+func findNodeByIDInNode(node *Node, id identity.NodeID, layer uint8) *Node {
+	if layer == 0 || id == "" {
 		return nil
 	}
 
-	if network.CompareIpPortPair(node.GetIpPortPair(), ipp) {
+	if node.ID == id {
 		return node
 	}
 
 	for i := range node.Conns {
 		conn := node.Conns[i]
-		connIpp := conn.GetIpPortPair()
-		if network.CompareIpPortPair(connIpp, ipp) {
+		if conn.ID == id {
 			return conn
 		}
 
-		if toRet := findNodeByIpPortPairInNode(conn, ipp, layer-1); toRet != nil {
+		if toRet := findNodeByIDInNode(conn, id, layer-1); toRet != nil {
 			return toRet
 		}
 	}
 	return nil
 }
 
+// locateNode finds the referred node in the vision of this node. It is moved to the locator of the reference only when the reference
+// is about the signer of the envelope it comes from, since only a node says for sure where it is.
+func (n *Node) locateNode(ref message.NodeRef, signer identity.NodeID) *Node {
+	nd := findNodeByIDInNode(n, ref.ID, n.DepthVision)
+	if nd != nil && nd != n && ref.Is(signer) {
+		nd.setLocator(ref.Locator)
+	}
+	return nd
+}
+
+// setLocator changes the address the node can be found at, since a node keeps its ID when it changes its address.
+func (n *Node) setLocator(locator network.IpPortPair) {
+	if locator.Ip == nil || network.CompareIpPortPair(n.GetIpPortPair(), locator) {
+		return
+	}
+	n.Log.Info("node %s moved from %s to %s", n.ID.Short(), n.GetNodeAddress(), locator.NetString())
+	n.Ip = locator.Ip
+	n.Port = locator.Port
+}
+
 func (n *Node) GetIpPortPair() network.IpPortPair {
 	return network.IpPortPair{
 		Ip:   n.Ip,
@@ -466,14 +1163,59 @@ func (n *Node) GetIpPortPair() network.IpPortPair {
 	}
 }
 
-func (n *Node) replaceFirstDeadNode(newNode *Node) *network.IpPortPair {
+// dest returns the node as a destination of the messages, which must prove its ID over TLS.
+func (n *Node) dest() network.Dest {
+	return network.Dest{ID: n.ID, Addr: n.GetIpPortPair()}
+}
+
+func (n *Node) GetNodeRef() message.NodeRef {
+	return message.NodeRef{
+		ID:      n.ID,
+		Locator: n.GetIpPortPair(),
+	}
+}
+
+// SetIdentity sets the key pair of the node, and the ID and encryption key that come with it.
+func (n *Node) SetIdentity(id *identity.Identity) error {
+	record, err := id.NewEncryptionKeyRecord()
+	if err != nil {
+		return err
+	}
+
+	n.Identity = id
+	n.ID = id.ID()
+	n.EncryptionKey = record
+	n.tagLogs()
+	return nil
+}
+
+// tagLogs adds the ID of the node to its logs, and to the logs of its network.
+func (n *Node) tagLogs() {
+	n.Log = logging.Component("node").With("node", n.ID.Short())
+	n.Net.Log = logging.Component("network").With("node", n.ID.Short())
+}
+
+// takeOver makes the node hold the data of a new node, since it replaced it in the network.
+func (n *Node) takeOver(newNode *Node) {
+	n.ID = newNode.ID
+	n.Ip = newNode.Ip
+	n.Port = newNode.Port
+	n.Alive = true
+	n.Suspect = false
+	n.Incarnation = newNode.Incarnation
+	n.LastTimeAlive = clock.Now().UnixMilli()
+	n.Health = nil
+	n.EncryptionKey = newNode.EncryptionKey
+	n.SmoothedRTT, n.RTTJitter, n.RTTSamples = 0, 0, 0
+}
+
+func (n *Node) replaceFirstDeadNode(newNode *Node) *message.NodeRef {
 	if idx := slices.IndexFunc(n.Conns, func(nod *Node) bool {
-		logging.LogDebug("node %v is alive? %v", nod.GetIpPortPair(), nod.Alive)
+		n.Log.Debug("node %v is alive? %v", nod.GetNodeRef(), nod.Alive)
 		return !nod.Alive
 	}); idx != -1 {
-		oldNode := n.Conns[idx].GetIpPortPair()
-		n.Conns[idx].Ip = newNode.Ip
-		n.Conns[idx].Port = newNode.Port
+		oldNode := n.Conns[idx].GetNodeRef()
+		n.Conns[idx].takeOver(newNode)
 		con := make([]*Node, 0, cap(newNode.Conns))
 		con = append(con, n.Conns...)
 		n.Conns = con
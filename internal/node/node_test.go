@@ -5,15 +5,18 @@ import (
 	"net"
 	"testing"
 
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
 	"github.com/TheJ0lly/Overlay-Network/internal/message"
 	"github.com/TheJ0lly/Overlay-Network/internal/network"
 )
 
 func createNetNewNodeJoinMessage(ip string) message.NetNewNodeJoinMessage {
 	return message.NetNewNodeJoinMessage{
-		JoiningNode: network.IpPortPair{
-			Ip:   net.ParseIP(ip),
-			Port: 8080,
+		JoiningNode: message.NodeRef{
+			Locator: network.IpPortPair{
+				Ip:   net.ParseIP(ip),
+				Port: 8080,
+			},
 		},
 	}
 }
@@ -43,3 +46,154 @@ func TestProcessNetNewNodeJoinMessage(t *testing.T) {
 		t.Error("node should have one primary connection")
 	}
 }
+
+func TestApplyLivenessPrecedence(t *testing.T) {
+	nd := CreatePrimaryConnectionNode(message.NodeRef{ID: "A"})
+	steps := []struct {
+		state       livenessState
+		incarnation uint64
+		changed     bool
+		want        livenessState
+	}{
+		{stateSuspect, 0, true, stateSuspect},
+		{stateAlive, 0, true, stateAlive},
+		{stateDead, 0, true, stateDead},
+		// A dead node only comes back with a greater incarnation.
+		{stateAlive, 0, false, stateDead},
+		{stateSuspect, 1, false, stateDead},
+		{stateAlive, 1, true, stateAlive},
+		// The claims about an older incarnation are stale.
+		{stateDead, 0, false, stateAlive},
+		{stateDead, 1, true, stateDead},
+	}
+	for i, s := range steps {
+		if changed := nd.applyLiveness(s.state, s.incarnation); changed != s.changed || nd.livenessState() != s.want {
+			t.Fatalf("step %d: %s(%d) gave %s, changed=%v - expected %s, changed=%v", i, s.state, s.incarnation, nd.livenessState(), changed, s.want, s.changed)
+		}
+	}
+}
+
+func TestDirectMessageDoesNotReviveDeadConnection(t *testing.T) {
+	n, err := Create("127.0.0.1", 8080, 1, 1)
+	if err != nil {
+		t.Fatal("could not create node")
+	}
+	ref := message.NodeRef{ID: "A", Locator: network.IpPortPair{Ip: net.ParseIP("127.0.0.2"), Port: 8080}}
+	conn := CreatePrimaryConnectionNode(ref)
+	n.Conns = append(n.Conns, conn)
+	n.setNodesDead([]message.NodeRef{ref})
+
+	n.setLastAliveTimeForNode(&message.MessageEnvelope{Sender: ref, OriginalSender: ref}, 1000)
+	if conn.livenessState() != stateDead || conn.LastTimeAlive != 0 {
+		t.Fatalf("message at the same incarnation revived the dead connection")
+	}
+
+	// The refutation of the node brings it back, and it is counted again.
+	n.applyConnLiveness(conn, stateAlive, 1)
+	if conn.livenessState() != stateAlive || n.Stats().PrimaryConnections != 1 {
+		t.Errorf("refuted connection is %s with %d primary connections counted", conn.livenessState(), n.Stats().PrimaryConnections)
+	}
+}
+
+func TestRefuteOwnDeath(t *testing.T) {
+	n, err := Create("127.0.0.1", 8080, 1, 1)
+	if err != nil {
+		t.Fatal("could not create node")
+	}
+	id, _ := identity.Generate()
+	if err = n.SetIdentity(id); err != nil {
+		t.Fatalf("could not set identity - %s", err)
+	}
+	n.Incarnation = 3
+
+	if n.refuteOwnDeath(2) {
+		t.Error("refuted a death claim about an older incarnation")
+	}
+	if !n.refuteOwnDeath(3) || n.Incarnation != 4 {
+		t.Errorf("refutation left the incarnation at %d - expected 4", n.Incarnation)
+	}
+	if n.Stats().DeathRefutationsSent != 1 {
+		t.Errorf("counted %d refutations - expected 1", n.Stats().DeathRefutationsSent)
+	}
+}
+
+func TestDeathQuorumCountsVisibleNeighbours(t *testing.T) {
+	n, err := Create("127.0.0.1", 8080, 2, 1)
+	if err != nil {
+		t.Fatal("could not create node")
+	}
+	n.DepthVision = 3
+	n.DeathQuorum = 2
+	n.DeathQuorumWindow = 10
+
+	// We see B linked to A and C, and the leaf D only linked to C.
+	a, b, c, d := message.NodeRef{ID: "A"}, message.NodeRef{ID: "B"}, message.NodeRef{ID: "C"}, message.NodeRef{ID: "D"}
+	connA, connC := CreatePrimaryConnectionNode(a), CreatePrimaryConnectionNode(c)
+	connA.Conns = []*Node{CreatePrimaryConnectionNode(b)}
+	connC.Conns = []*Node{CreatePrimaryConnectionNode(b), CreatePrimaryConnectionNode(d)}
+	n.Conns = []*Node{connA, connC}
+
+	if n.recordDeathReport(b, d) {
+		t.Error("report from a node we do not see linked to the dead node was counted")
+	}
+	if !n.recordDeathReport(d, c) {
+		t.Error("the only neighbour of a leaf could not reach the quorum")
+	}
+	if n.recordDeathReport(b, a) {
+		t.Error("a single report reached the quorum of 2")
+	}
+	if !n.recordDeathReport(b, c) {
+		t.Error("two neighbours could not reach the quorum of 2")
+	}
+}
+
+func TestForgedLifeLineIsDropped(t *testing.T) {
+	n, err := Create("127.0.0.1", 8080, 1, 1)
+	if err != nil {
+		t.Fatal("could not create node")
+	}
+	victim := message.NodeRef{ID: "A", Locator: network.IpPortPair{Ip: net.ParseIP("127.0.0.2"), Port: 8080}}
+	forger := message.NodeRef{ID: "B", Locator: network.IpPortPair{Ip: net.ParseIP("127.0.0.3"), Port: 8080}}
+	conn := CreatePrimaryConnectionNode(victim)
+	n.Conns = append(n.Conns, conn)
+	n.setNodesDead([]message.NodeRef{victim})
+
+	forged := message.NetLifeLineMessage{Node: message.NodeRef{ID: "A", Locator: forger.Locator}, Incarnation: ^uint64(0)}
+	n.processNetLifeLineMessage(forged, &message.MessageEnvelope{Type: message.NetLifeLine, Sender: forger, OriginalSender: forger})
+	if conn.livenessState() != stateDead || conn.Incarnation != 0 || !conn.GetIpPortPair().Ip.Equal(victim.Locator.Ip) {
+		t.Fatalf("lifeline signed by another node changed the connection: %s, incarnation %d, at %s", conn.livenessState(), conn.Incarnation, conn.GetNodeAddress())
+	}
+	if score := n.Stats().PeerScores[string(forger.ID)]; score.Score >= peerMaxScore {
+		t.Errorf("forger was not penalized, score %.1f", score.Score)
+	}
+}
+
+func TestJoinCandidatesAnswerForThemselvesOnce(t *testing.T) {
+	j := createSignedNode(t, 8080).NewJoiner(nil)
+	defer j.End()
+	candidate, other := createSignedNode(t, 8081), createSignedNode(t, 8082)
+
+	answer := func(from *Node, mt message.MessageType, offered *Node) error {
+		b, err := from.SerializeNewEnvelope(mt, &message.NetNewNodeJoinQueryMessage{NewNode: offered.GetNodeRef()})
+		if err != nil {
+			t.Fatalf("could not create answer - %s", err)
+		}
+		return j.AddCandidate(b)
+	}
+
+	if err := answer(candidate, message.NetNewNodeJoinQuery, candidate); err != nil {
+		t.Fatalf("valid answer was rejected - %s", err)
+	}
+	if answer(candidate, message.NetNewNodeJoinQuery, candidate) == nil {
+		t.Error("second answer of the same candidate was accepted")
+	}
+	if answer(candidate, message.NetNewNodeJoinQuery, other) == nil {
+		t.Error("answer offering another node was accepted")
+	}
+	if answer(other, message.NetNewNodeJoinConfirm, other) == nil {
+		t.Error("envelope of another type was accepted as an answer")
+	}
+	if c := j.Candidates(); len(c) != 1 || c[0].Node.ID != candidate.ID {
+		t.Errorf("candidates are %v - expected only %s", c, candidate.ID.Short())
+	}
+}
@@ -0,0 +1,216 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+const DefaultOnionHops = 2
+
+// The search for an onion path gives up after trying this many nodes, since it can be slow in a large vision with few usable relays.
+const maxOnionPathSteps = 10000
+
+// visionGraph is the vision of the node flattened by ID, since the same node can show up in many places of it.
+type visionGraph struct {
+	nodes map[identity.NodeID]*Node
+	links map[identity.NodeID][]identity.NodeID
+}
+
+// link links a and b, once, however many times they show up next to each other in the vision.
+func (vg *visionGraph) link(a, b identity.NodeID) {
+	if a == b || slices.Contains(vg.links[a], b) {
+		return
+	}
+	vg.links[a] = append(vg.links[a], b)
+	vg.links[b] = append(vg.links[b], a)
+}
+
+// collectVisionGraph walks the vision of the node, skipping the dead nodes.
+func collectVisionGraph(n *Node, vg *visionGraph, layer uint8) {
+	if layer == 0 {
+		return
+	}
+
+	for i := range n.Conns {
+		conn := n.Conns[i]
+		if conn.livenessState() == stateDead {
+			continue
+		}
+
+		// The copy we know the encryption key of is the one we want.
+		if known, ok := vg.nodes[conn.ID]; !ok || known.EncryptionKey == nil {
+			vg.nodes[conn.ID] = conn
+		}
+		vg.link(n.ID, conn.ID)
+		collectVisionGraph(conn, vg, layer-1)
+	}
+}
+
+// onionPath picks a random path from this node to the destination, along the links of the vision graph, going through exactly relays nodes.
+// All the nodes on the path must have sent us their encryption key.
+func (n *Node) onionPath(dest identity.NodeID, relays int) ([]*Node, error) {
+	vg := &visionGraph{nodes: map[identity.NodeID]*Node{}, links: map[identity.NodeID][]identity.NodeID{}}
+	collectVisionGraph(n, vg, n.DepthVision)
+
+	if nd, ok := vg.nodes[dest]; !ok || nd.EncryptionKey == nil {
+		return nil, fmt.Errorf("%w - node %s", ErrUnknownEncryptionKey, dest.Short())
+	}
+
+	visited := map[identity.NodeID]bool{n.ID: true}
+	path := make([]*Node, 0, relays+1)
+	steps := 0
+
+	var walk func(from identity.NodeID) bool
+	walk = func(from identity.NodeID) bool {
+		next := vg.links[from]
+		for _, i := range rand.Perm(len(next)) {
+			id := next[i]
+			if visited[id] {
+				continue
+			}
+			if steps++; steps > maxOnionPathSteps {
+				return false
+			}
+
+			if len(path) == relays {
+				if id == dest {
+					path = append(path, vg.nodes[dest])
+					return true
+				}
+				continue
+			}
+
+			if id == dest || vg.nodes[id].EncryptionKey == nil {
+				continue
+			}
+
+			visited[id] = true
+			path = append(path, vg.nodes[id])
+			if walk(id) {
+				return true
+			}
+			path = path[:len(path)-1]
+			visited[id] = false
+		}
+		return false
+	}
+
+	if !walk(n.ID) {
+		return nil, fmt.Errorf("no path to node %s through %d relays in our vision", dest.Short(), relays)
+	}
+	return path, nil
+}
+
+// SendOnion sends the payload to the destination node through OnionHops relays, such that the destination does not learn who sent it,
+// and each relay only learns the node before and after it.
+// It reads the vision, thus while MainLoop runs it must be called through Do.
+func (n *Node) SendOnion(dest identity.NodeID, payload []byte) error {
+	path, err := n.onionPath(dest, int(n.OnionHops))
+	if err != nil {
+		return err
+	}
+
+	hops := make([]message.NodeRef, 0, len(path))
+	encKeys := make([][]byte, 0, len(path))
+	for i := range path {
+		hops = append(hops, path[i].GetNodeRef())
+		encKeys = append(encKeys, path[i].EncryptionKey.EncryptionKey)
+	}
+	n.Log.Debug("sending onion through %v", hops)
+
+	msg, err := message.WrapOnion(payload, hops, encKeys)
+	if err != nil {
+		return err
+	}
+
+	return n.sendOnionLayer(&msg, path[0].dest(), func(err error) {
+		if err == nil {
+			n.updateStats(func(s *Stats) { s.OnionSent++ })
+		}
+	})
+}
+
+// sendOnionLayer pads the layer, and sends it straight to the hop, in an envelope signed by this node.
+// The send happens in the background, such that a slow hop does not hold the processing goroutine, and done is called once it is over.
+func (n *Node) sendOnionLayer(msg *message.NetSealedMessage, hop network.Dest, done func(err error)) error {
+	if err := message.PadOnion(msg); err != nil {
+		return err
+	}
+
+	b, err := n.SerializeNewEnvelope(message.NetOnion, msg)
+	if err != nil {
+		return fmt.Errorf("could not create onion envelope - %s", err)
+	}
+
+	timeout := time.Duration(n.DeathTimer)
+	clock.Go(func() {
+		err := n.Net.SendToDest(b, hop.Addr, hop.ID, timeout)
+		if err != nil {
+			n.Log.Error("could not send onion to %s - %s", hop.ID.Short(), err)
+			n.updateStats(func(s *Stats) { s.SendErrors++ })
+		}
+		done(err)
+	})
+	return nil
+}
+
+// processNetOnionMessage peels the layer sealed for us, and either passes the rest to the next hop, or delivers the payload.
+func (n *Node) processNetOnionMessage(msg *message.NetSealedMessage, env *message.MessageEnvelope) {
+	if n.Identity == nil {
+		n.Log.Error("cannot peel onion from %v - this node has no identity", env.Sender)
+		n.updateStats(func(s *Stats) { s.OnionFailures++ })
+		return
+	}
+
+	layer, err := message.PeelOnion(msg, n.Identity)
+	if err != nil {
+		n.Log.Error("cannot peel onion from %v - %s", env.Sender, err)
+		n.updateStats(func(s *Stats) { s.OnionFailures++ })
+		return
+	}
+
+	if layer.Next.IsNull() {
+		n.updateStats(func(s *Stats) { s.OnionReceived++ })
+		if n.OnPayload == nil {
+			n.Log.Info("received anonymous payload of %d bytes", len(layer.Inner))
+			return
+		}
+		// The sender is hidden on purpose, thus the payload comes from nobody.
+		n.OnPayload(message.NodeRef{}, layer.Inner)
+		return
+	}
+
+	// The layer only names the next hop, and we send to it where our vision says it is, not where the layer says.
+	next := findNodeByIDInNode(n, layer.Next.ID, n.DepthVision)
+	if next == nil || next == n {
+		n.Log.Error("cannot relay onion from %v - next hop %s is not in our vision", env.Sender, layer.Next.ID.Short())
+		n.updateStats(func(s *Stats) { s.OnionFailures++ })
+		return
+	}
+
+	inner := message.NetSealedMessage{}
+	if err = json.Unmarshal(layer.Inner, &inner); err != nil {
+		n.Log.Error("cannot parse inner onion layer from %v - %s", env.Sender, err)
+		n.updateStats(func(s *Stats) { s.OnionFailures++ })
+		return
+	}
+
+	err = n.sendOnionLayer(&inner, next.dest(), func(err error) {
+		if err != nil {
+			n.updateStats(func(s *Stats) { s.OnionFailures++ })
+			return
+		}
+		n.updateStats(func(s *Stats) { s.OnionRelayed++ })
+	})
+	if err != nil {
+		n.Log.Error("could not relay onion to %s - %s", next.ID.Short(), err)
+		n.updateStats(func(s *Stats) { s.OnionFailures++ })
+	}
+}
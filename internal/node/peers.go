@@ -0,0 +1,202 @@
+package node
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+const DefaultRateLimit = 20
+const DefaultRateBurst = 50
+const DefaultBanDuration = 60
+
+// The score a peer starts with, and recovers back to at peerScoreRecovery points per second.
+// A peer whose score drops to peerBanScore is banned for BanDuration seconds, and it comes back with a full score.
+const peerMaxScore = 100
+const peerBanScore = 0
+const peerScoreRecovery = 1
+
+// The points a peer loses for each kind of misbehaviour.
+const (
+	penaltyRateViolation = 1
+	penaltyUnknownType   = 5
+	penaltyRefutedDeath  = 5
+	penaltyForgedClaim   = 10
+	penaltyMalformed     = 10
+	penaltyOversized     = 10
+	penaltyBadSignature  = 20
+)
+
+// tokenBucket lets through rate messages per second, with bursts of at most burst messages.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) take(rate float64, burst float64, now time.Time) bool {
+	if tb.last.IsZero() {
+		tb.tokens = burst
+	} else {
+		tb.tokens = min(burst, tb.tokens+now.Sub(tb.last).Seconds()*rate)
+	}
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+type peerRecord struct {
+	score          float64
+	lastScored     time.Time
+	bannedUntil    time.Time
+	rateViolations uint64
+	buckets        map[message.MessageType]*tokenBucket
+}
+
+// recover gives the peer back the points it earned since it was last scored.
+func (pr *peerRecord) recover(now time.Time) {
+	// Banned peers only start recovering once the ban is over.
+	if now.Before(pr.lastScored) {
+		return
+	}
+	pr.score = min(peerMaxScore, pr.score+now.Sub(pr.lastScored).Seconds()*peerScoreRecovery)
+	pr.lastScored = now
+}
+
+// peerTable holds what we know about the behaviour of the peers sending us messages, and of the nodes signing them.
+// The peers of the links are keyed by the node ID they proved over TLS, or else by their address, and the signers by their node ID.
+// It is used both by the goroutines reading connections and by the one processing messages, thus it has its own lock.
+type peerTable struct {
+	mu    sync.Mutex
+	peers map[string]*peerRecord
+}
+
+func newPeerTable() *peerTable {
+	return &peerTable{peers: map[string]*peerRecord{}}
+}
+
+func (pt *peerTable) get(key string, now time.Time) *peerRecord {
+	pr, ok := pt.peers[key]
+	if !ok {
+		pr = &peerRecord{score: peerMaxScore, lastScored: now, buckets: map[message.MessageType]*tokenBucket{}}
+		pt.peers[key] = pr
+	}
+	pr.recover(now)
+	return pr
+}
+
+// peerKey returns the key the peer of the link is known by: the ID it proved over TLS, or else its address.
+// The sender of an envelope is only a claim, thus it is never used, such that a lying peer cannot hurt the score of another node.
+func peerKey(conn net.Conn) string {
+	if id, ok := network.PeerID(conn); ok {
+		return string(id)
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	return "addr " + host
+}
+
+// peerBanned checks if the peer is currently banned.
+func (n *Node) peerBanned(key string) bool {
+	n.peers.mu.Lock()
+	defer n.peers.mu.Unlock()
+
+	pr, ok := n.peers.peers[key]
+	return ok && clock.Now().Before(pr.bannedUntil)
+}
+
+// allowMessage takes a token from the bucket of the peer for the message type, and returns false if there is none left.
+// The envelopes are limited by the node that signed them, since a peer relaying the floods of the others sends much more than its own share.
+func (n *Node) allowMessage(key string, mt message.MessageType) bool {
+	if n.RateLimit == 0 {
+		return true
+	}
+
+	n.peers.mu.Lock()
+	now := clock.Now()
+	pr := n.peers.get(key, now)
+	tb, ok := pr.buckets[mt]
+	if !ok {
+		tb = &tokenBucket{}
+		pr.buckets[mt] = tb
+	}
+	allowed := tb.take(n.RateLimit, max(n.RateBurst, 1), now)
+	if !allowed {
+		pr.rateViolations++
+	}
+	n.peers.mu.Unlock()
+
+	if !allowed {
+		n.penalizePeer(key, penaltyRateViolation, "rate limit exceeded for "+mt.String())
+	}
+	return allowed
+}
+
+// penalizePeer takes points from the score of the peer, and bans it if the score gets too low.
+// The envelopes that did not come over a link, such as the replayed ones, have no peer to penalize.
+func (n *Node) penalizePeer(key string, points float64, reason string) {
+	if key == "" {
+		return
+	}
+	if !n.banPeerIfNeeded(key, points, reason) {
+		return
+	}
+
+	n.Log.Error("banning peer %s for %d seconds - last offence: %s", key, n.BanDuration, reason)
+	n.updateStats(func(s *Stats) { s.PeersBanned++ })
+}
+
+func (n *Node) banPeerIfNeeded(key string, points float64, reason string) bool {
+	n.peers.mu.Lock()
+	defer n.peers.mu.Unlock()
+
+	now := clock.Now()
+	pr := n.peers.get(key, now)
+	if now.Before(pr.bannedUntil) {
+		return false
+	}
+
+	pr.score -= points
+	n.Log.Debug("peer %s lost %.0f points (%s) - score %.1f", key, points, reason, pr.score)
+	if pr.score > peerBanScore {
+		return false
+	}
+
+	pr.bannedUntil = now.Add(time.Duration(n.BanDuration) * time.Second)
+	pr.score = peerMaxScore
+	pr.lastScored = pr.bannedUntil
+	return true
+}
+
+// exportPeerScores copies the scores of the peers into the stats, and forgets the peers that have nothing to tell anymore.
+// It must be called while holding statMu.
+func (n *Node) exportPeerScores() {
+	n.peers.mu.Lock()
+	defer n.peers.mu.Unlock()
+
+	now := clock.Now()
+	scores := make(map[string]PeerScore, len(n.peers.peers))
+	for key, pr := range n.peers.peers {
+		pr.recover(now)
+		banned := now.Before(pr.bannedUntil)
+		if !banned && pr.score >= peerMaxScore {
+			delete(n.peers.peers, key)
+			continue
+		}
+		score := pr.score
+		if banned {
+			score = peerBanScore
+		}
+		scores[key] = PeerScore{Score: score, Banned: banned, RateViolations: pr.rateViolations}
+	}
+	n.Stat.PeerScores = scores
+}
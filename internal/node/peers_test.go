@@ -0,0 +1,113 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+)
+
+// fakeClock only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time        { return c.now }
+func (c *fakeClock) Sleep(d time.Duration) { c.now = c.now.Add(d) }
+func (c *fakeClock) Go(f func())           { f() }
+
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	previous := CurrentClock()
+	SetClock(c)
+	t.Cleanup(func() { SetClock(previous) })
+	return c
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tb := tokenBucket{}
+	for i := range 3 {
+		if !tb.take(1, 3, now) {
+			t.Fatalf("message %d of the burst was refused", i)
+		}
+	}
+	if tb.take(1, 3, now) {
+		t.Fatal("message over the burst was let through")
+	}
+	if !tb.take(1, 3, now.Add(time.Second)) || tb.take(1, 3, now.Add(time.Second)) {
+		t.Error("bucket did not refill one token after one second")
+	}
+	// The bucket never holds more than the burst.
+	later := now.Add(time.Hour)
+	for range 3 {
+		tb.take(1, 3, later)
+	}
+	if tb.take(1, 3, later) {
+		t.Error("bucket refilled over the burst")
+	}
+}
+
+func TestRateLimitPenalizesThePeer(t *testing.T) {
+	useFakeClock(t)
+	n, err := Create("127.0.0.1", 8080, 1, 1)
+	if err != nil {
+		t.Fatal("could not create node")
+	}
+	n.RateLimit, n.RateBurst = 1, 2
+
+	for range 2 {
+		if !n.allowMessage("A", message.NetLifeLine) {
+			t.Fatal("message within the burst was refused")
+		}
+	}
+	if n.allowMessage("A", message.NetLifeLine) {
+		t.Fatal("message over the burst was let through")
+	}
+	// Each message type has its own bucket.
+	if !n.allowMessage("A", message.NetPing) {
+		t.Error("message of another type was refused")
+	}
+
+	score := n.Stats().PeerScores["A"]
+	if score.RateViolations != 1 || score.Score != peerMaxScore-penaltyRateViolation {
+		t.Errorf("peer over the rate limit has %d violations and a score of %.1f", score.RateViolations, score.Score)
+	}
+}
+
+func TestPeerScoreDecayAndBanExpiry(t *testing.T) {
+	c := useFakeClock(t)
+	n, err := Create("127.0.0.1", 8080, 1, 1)
+	if err != nil {
+		t.Fatal("could not create node")
+	}
+	n.BanDuration = 60
+
+	n.penalizePeer("A", 50, "test")
+	c.Sleep(10 * time.Second)
+	if score := n.Stats().PeerScores["A"].Score; score != 60 {
+		t.Errorf("score is %.1f after 10 seconds of recovery - expected 60", score)
+	}
+
+	n.penalizePeer("A", 60, "test")
+	if !n.peerBanned("A") || n.peerBanned("B") {
+		t.Fatal("peer with no score left was not banned, or another peer was")
+	}
+	if n.Stats().PeersBanned != 1 {
+		t.Errorf("counted %d bans - expected 1", n.Stats().PeersBanned)
+	}
+
+	// A banned peer is not penalized further, and it does not recover while banned.
+	n.penalizePeer("A", 100, "test")
+	c.Sleep(59 * time.Second)
+	if !n.peerBanned("A") {
+		t.Fatal("ban expired early")
+	}
+	c.Sleep(2 * time.Second)
+	if n.peerBanned("A") {
+		t.Fatal("ban did not expire")
+	}
+	if score := n.Stats().PeerScores; len(score) != 0 {
+		t.Errorf("peer back with a full score is still tracked: %v", score)
+	}
+}
@@ -1,280 +1,301 @@
 package node
 
 import (
-	"encoding/json"
 	"slices"
 	"time"
 
-	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
 	"github.com/TheJ0lly/Overlay-Network/internal/message"
-	"github.com/TheJ0lly/Overlay-Network/internal/network"
 )
 
-func (n *Node) processNetNewNodeJoinMessage(msg *message.NetNewNodeJoinMessage, sender network.IpPortPair, ogSender network.IpPortPair) {
-	newNode, err := Create(msg.JoiningNode.Ip.String(), msg.JoiningNode.Port, msg.JoiningNodeConnCap, 0)
+func (n *Node) processNetNewNodeJoinMessage(msg *message.NetNewNodeJoinMessage, env *message.MessageEnvelope) {
+	if !n.joinAdmitted(msg, env) {
+		n.Log.Error("dropping join of node %v attached to %v - it has not been admitted", msg.JoiningNode, msg.AttachedNode)
+		n.updateStats(func(s *Stats) { s.AdmissionRejects++ })
+		return
+	}
+
+	newNode, err := Create(msg.JoiningNode.Locator.Ip.String(), msg.JoiningNode.Locator.Port, msg.JoiningNodeConnCap, 0)
 	if err != nil {
-		logging.LogError("failed to create new node object: %s", err)
+		n.Log.Error("failed to create new node object: %s", err)
 		return
 	}
+	newNode.ID = msg.JoiningNode.ID
 	newNode.DepthVision = msg.JoiningNodeView
-	logging.LogDebug("new node has depth: %d", newNode.DepthVision)
+	n.Log.Debug("new node has depth: %d", newNode.DepthVision)
 
-	var skipNodes []network.IpPortPair = []network.IpPortPair{sender}
+	var skipNodes []identity.NodeID = []identity.NodeID{env.Sender.ID}
 
 	// It means we are the node that is being attached to, we need to skip the sender node
 	// As they append us themselves.
 	var attachedNode *Node
-	if attachedNode = findNodeByIpPortPairInNode(n, msg.AttachedNode, n.DepthVision); attachedNode == nil {
-		logging.LogInfo("couldn't find attached node %s in visible nodes", msg.AttachedNode.NetString())
-		env, err := message.CreateMessageEnvelope(
-			message.NetNewNodeJoin,
-			msg,
-			n.GetIpPortPair(),
-			ogSender,
-		)
-		if err != nil {
-			logging.LogError("failed to serialize response to net join message - %s", err)
-			return
-		}
-		n.Stat.MessagesForwarded[env.Type.String()]++
-
-		go n.ForwardMessage(
-			&env,
-			skipNodes...,
-		)
+	if attachedNode = n.locateNode(msg.AttachedNode, env.OriginalSender.ID); attachedNode == nil {
+		n.Log.Info("couldn't find attached node %s in visible nodes", msg.AttachedNode)
+		n.relayEnvelope(env, skipNodes...)
 		return
 	}
 
-	var updatedNodeConns NodeIPPMap = make(NodeIPPMap)
+	var updatedNodeConns NodeRefMap = make(NodeRefMap)
 
-	if network.CompareIpPortPair(attachedNode.GetIpPortPair(), n.GetIpPortPair()) {
-		logging.LogDebug("we are the node that is being attached to")
-		skipNodes = append(skipNodes, newNode.GetIpPortPair())
-		attachedNode = n
+	if attachedNode == n {
+		n.Log.Debug("we are the node that is being attached to")
+		skipNodes = append(skipNodes, newNode.ID)
 
 		// If we receive a join message with us being the attached node, it means we can remove the entry from the ongoing join queries list
-		n.Stat.JoinQueriesOngoing = slices.DeleteFunc(n.Stat.JoinQueriesOngoing, func(joinQueryOngoingPair network.IpPortPair) bool {
-			return network.CompareIpPortPair(newNode.GetIpPortPair(), joinQueryOngoingPair)
+		n.updateStats(func(s *Stats) {
+			s.JoinQueriesOngoing = slices.DeleteFunc(s.JoinQueriesOngoing, func(joinQueryOngoing identity.NodeID) bool {
+				return newNode.ID == joinQueryOngoing
+			})
 		})
 
-		if len(n.Conns) == cap(n.Conns) {
+		if len(n.Conns) >= int(n.ConnCap) {
 			if replacedNode := n.replaceFirstDeadNode(newNode); replacedNode != nil {
 				// Here we should forward an update message to update the connections of the new node
-				logging.LogDebug("replacing dead node %v with node %v", replacedNode, newNode.GetIpPortPair())
-				n.Stat.NodesReplaced++
+				n.Log.Debug("replacing dead node %v with node %v", replacedNode, newNode.GetNodeRef())
+				n.updateStats(func(s *Stats) { s.NodesReplaced++ })
 				msg.ReplacedNode = *replacedNode
 			}
 		} else {
-			logging.LogDebug("added new node - %s", newNode)
+			n.Log.Debug("added new node - %s", newNode)
 			n.Conns = append(n.Conns, newNode)
-			msg.ReplacedNode = network.NullIpPortPair
-			n.Stat.PrimaryConnections++
+			msg.ReplacedNode = message.NodeRef{}
+			n.updateStats(func(s *Stats) { s.PrimaryConnections++ })
 		}
 		// The manual addition of THIS node as a primary connection
-		newNodeKnownConns := make([]network.IpPortPair, 0, 1)
-		newNodeKnownConns = append(newNodeKnownConns, n.GetIpPortPair())
-		updatedNodeConns[newNode.GetIpPortPair().Hash()] = newNodeKnownConns
-		nIpp := n.GetIpPortPair()
-		createIpPortPairMapForNode(n, newNode.DepthVision-1, updatedNodeConns, &nIpp)
-		logging.LogDebug("creating update info for new node %s", newNode)
+		newNodeKnownConns := make([]message.NodeRef, 0, 1)
+		newNodeKnownConns = append(newNodeKnownConns, n.GetNodeRef())
+		updatedNodeConns[newNode.ID] = newNodeKnownConns
+		createNodeRefMapForNode(n, newNode.DepthVision-1, updatedNodeConns, n.ID)
+		n.Log.Debug("creating update info for new node %s", newNode)
 		// TODO: this is a temporary method. It is needed when we have a new node joining.
 		// If we make the new node alive, then this node will send the NetNewNodeJoinMessage to the new node.
 		// In case the new node is a replacement, it means the NetNewNodeJoinMessage will not reach the other nodes.
 		// Here we add the new node to the skip list, must see what better way to do this
 		// MUST FIX AFTER REFACTORIZATION.
-		skipNodes = append(skipNodes, newNode.GetIpPortPair())
+		skipNodes = append(skipNodes, newNode.ID)
 	} else {
 		// If there is a replced node, it means we must find the node and replace its data
-		if !network.CompareIpPortPair(network.NullIpPortPair, msg.ReplacedNode) {
-			if replacedNode := findNodeByIpPortPairInNode(n, msg.ReplacedNode, attachedNode.DepthVision); replacedNode != nil {
-				replacedNode.Ip = newNode.Ip
-				replacedNode.Port = newNode.Port
+		if !msg.ReplacedNode.IsNull() {
+			if replacedNode := findNodeByIDInNode(n, msg.ReplacedNode.ID, attachedNode.DepthVision); replacedNode != nil {
+				replacedNode.takeOver(newNode)
 				con := make([]*Node, 0, cap(newNode.Conns))
 				con = append(con, replacedNode.Conns...)
 				replacedNode.Conns = con
 			}
 		} else {
 			attachedNode.Conns = append(attachedNode.Conns, newNode)
-			logging.LogDebug("added new node - %s", newNode)
+			n.Log.Debug("added new node - %s", newNode)
 		}
 	}
-	logging.LogDebug("attached node state - %s", attachedNode)
-
-	env, err := message.CreateMessageEnvelope(
-		message.NetNewNodeJoin,
-		msg,
-		n.GetIpPortPair(),
-		ogSender,
-	)
-	if err != nil {
-		logging.LogError("failed to serialize response to net join message - %s", err)
+	n.Log.Debug("attached node state - %s", attachedNode)
+
+	// If we do not have have a direct interaction with the new node, the message is forwarded untouched.
+	if len(updatedNodeConns) == 0 {
+		n.relayEnvelope(env, skipNodes...)
 		return
 	}
-	n.Stat.MessagesForwarded[env.Type.String()]++
-
-	go n.ForwardMessage(
-		&env,
-		skipNodes...,
-	)
 
-	// If we do not have have a direct interaction with the new node, we won't be having to forward anything.
-	if len(updatedNodeConns) == 0 {
+	// Otherwise we have filled in the replaced node, thus the message is now ours to sign.
+	joinEnv, err := n.CreateTracedEnvelope(env.Trace, message.NetNewNodeJoin, msg)
+	if err != nil {
+		n.Log.Error("failed to serialize response to net join message - %s", err)
 		return
 	}
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[joinEnv.Type.String()]++ })
+
+	n.forward(&joinEnv, skipNodes...)
 
 	timeToWait := 100
 
 	// Artificial timer so that we do not risk sending an update for an inexistent node
-	logging.LogDebug("waiting for %d ms to send the update for the new node", timeToWait)
-	time.Sleep(time.Duration(timeToWait) * time.Millisecond)
+	n.Log.Debug("waiting for %d ms to send the update for the new node", timeToWait)
+	clock.Sleep(time.Duration(timeToWait) * time.Millisecond)
 
 	updateMsg := message.NetUpdateMessage{
-		UpdatedNode: newNode.GetIpPortPair(),
+		UpdatedNode: newNode.GetNodeRef(),
 		Conns:       updatedNodeConns,
 	}
 
-	env, err = message.CreateMessageEnvelope(message.NetUpdate, &updateMsg, n.GetIpPortPair(), ogSender)
+	updateEnv, err := n.CreateTracedEnvelope(env.Trace, message.NetUpdate, &updateMsg)
 	if err != nil {
-		logging.LogError("failed to create update message for new node - %s", err)
+		n.Log.Error("failed to create update message for new node - %s", err)
 		return
 	}
 
-	n.Queue.Insert(env, 0)
+	n.Queue.Insert(updateEnv, 0)
 	n.Queue.Notify()
 }
 
-func (n *Node) processNetNewNodeQueryMessage(msg *message.NetNewNodeJoinQueryMessage, sender network.IpPortPair, ogSender network.IpPortPair) {
+func (n *Node) processNetNewNodeQueryMessage(msg *message.NetNewNodeJoinQueryMessage, env *message.MessageEnvelope) {
 	var b []byte
 	var err error
 
 	// This is the response we send to the query.
-	if b, err = message.SerializeNewMessageEnvelope(
+	if b, err = n.serializeTracedEnvelope(
+		env.Trace,
 		message.NetNewNodeJoinQuery,
 		&message.NetNewNodeJoinQueryMessage{
-			NewNode:   n.GetIpPortPair(),
-			Timestamp: time.Now().UnixMilli(),
+			NewNode:   n.GetNodeRef(),
+			Timestamp: clock.Now().UnixMilli(),
 		},
-		n.GetIpPortPair(),
-		ogSender,
 	); err != nil {
-		logging.LogError("cannot marshal query response - will not proceed with new node query")
+		n.Log.Error("cannot marshal query response - will not proceed with new node query")
 		return
 	}
 
-	if err = network.SendToDest(b, msg.NewNode, time.Duration(n.DeathTimer)); err != nil {
-		logging.LogError("could not send join query response - %s", err)
+	if err = n.Net.SendToDest(b, msg.NewNode.Locator, msg.NewNode.ID, time.Duration(n.DeathTimer)); err != nil {
+		n.Log.Error("could not send join query response - %s", err)
 	}
 
 	// The forwarding begins
-	if b, err = json.Marshal(msg); err != nil {
-		logging.LogError("cannot marshal original query message - message will not be forwarded")
-		return
-	}
-
-	n.Stat.MessagesForwarded[message.NetNewNodeJoinQuery.String()]++
-
 	// We put both the original sender(the node who's joining) and the one possibly forwards the message to us.
 	// In the case of receiving the message directly from the joining node, the last 2 senders are the same.
-	go n.ForwardMessage(
-		&message.MessageEnvelope{
-			Type:   message.NetNewNodeJoinQuery,
-			Data:   b,
-			Sender: n.GetIpPortPair(),
-		},
-		msg.NewNode,
-		sender,
-	)
+	n.relayEnvelope(env, msg.NewNode.ID, env.Sender.ID)
 }
 
-func (n *Node) processNetLifeLineMessage(msg message.NetLifeLineMessage, sender network.IpPortPair, ogSender network.IpPortPair) {
-	var nd *Node
-	if nd = findNodeByIpPortPairInNode(n, msg.Node, n.DepthVision); nd == nil {
-		logging.LogDebug("could not find node: %s", msg.Node.NetString())
-	} else {
-		nd.Alive = true
-		nd.LastTimeAlive = time.Now().UnixMilli()
+// processNetLifeLineMessage refreshes the node the lifeline is about. A node only sends its own lifeline, thus a lifeline signed
+// by another node is a forgery, meant to keep a dead node alive or to pin its incarnation, and it is dropped.
+func (n *Node) processNetLifeLineMessage(msg message.NetLifeLineMessage, env *message.MessageEnvelope) {
+	if !msg.Node.Is(env.OriginalSender.ID) {
+		n.envelopeLog(env).Error("dropped lifeline of node %s signed by node %s", msg.Node.ID.Short(), env.OriginalSender.ID.Short())
+		n.penalizePeer(string(env.OriginalSender.ID), penaltyForgedClaim, "lifeline of another node")
+		return
 	}
-	logging.LogDebug("received lifeline for node: %s", sender.NetString())
 
-	if env, err := message.CreateMessageEnvelope(message.NetLifeLine, &msg, n.GetIpPortPair(), ogSender); err != nil {
-		logging.LogError("could not recreate death announcement envelope: %s", err)
-	} else {
-		n.Stat.MessagesForwarded[env.Type.String()]++
-		go n.ForwardMessage(&env, sender)
+	var nd *Node
+	if nd = n.locateNode(msg.Node, env.OriginalSender.ID); nd == nil {
+		n.Log.Debug("could not find node: %s", msg.Node)
+	} else if nd != n {
+		if n.applyConnLiveness(nd, stateAlive, msg.Incarnation) || nd.livenessState() == stateAlive {
+			nd.LastTimeAlive = clock.Now().UnixMilli()
+			if msg.Health != nil {
+				nd.Health = msg.Health
+			}
+		}
+		n.learnEncryptionKey(nd, msg.EncryptionKey)
 	}
+	n.Log.Debug("received lifeline for node: %s", env.Sender)
 
+	n.relayEnvelope(env, env.Sender.ID)
 }
 
-func (n *Node) processDeathAnnouncementMessage(msg *message.NetDeathAnnouncementMessage, sender network.IpPortPair, ogSender network.IpPortPair) {
+func (n *Node) processDeathAnnouncementMessage(msg *message.NetDeathAnnouncementMessage, env *message.MessageEnvelope) {
+	// Only the signer of the announcement is trusted to be the reporter, the Reporter field is not checked by anyone.
+	reporter := env.OriginalSender
+
 	for i := range msg.DeadNodes {
 		deadNode := msg.DeadNodes[i]
-		if node := findNodeByIpPortPairInNode(n, deadNode, n.DepthVision); node != nil {
-			node.Alive = false
+		incarnation := msg.Incarnations[deadNode.ID]
+
+		if deadNode.Is(n.ID) {
+			if n.refuteOwnDeath(incarnation) {
+				n.penalizePeer(env.LinkKey, penaltyRefutedDeath, "refuted death claim")
+			}
+			continue
+		}
+
+		if node := findNodeByIDInNode(n, deadNode.ID, n.DepthVision); node != nil {
+			// A node announcing its own death is leaving the network, thus there is nobody else to wait for.
+			leaving := deadNode.Is(env.OriginalSender.ID)
+			if node.livenessState() != stateDead && !leaving && !n.recordDeathReport(deadNode, reporter) {
+				continue
+			}
+			if !n.applyConnLiveness(node, stateDead, incarnation) && node.livenessState() != stateDead {
+				n.updateStats(func(s *Stats) { s.StaleDeathClaims++ })
+			}
 			continue
 		}
-		logging.LogDebug("the dead node %v is not known", deadNode)
+		n.Log.Debug("the dead node %v is not known", deadNode)
 	}
 
-	if env, err := message.CreateMessageEnvelope(message.NetDeathAnnouncement, msg, n.GetIpPortPair(), ogSender); err != nil {
-		logging.LogError("could not recreate death announcement envelope: %s", err)
-	} else {
-		n.Stat.MessagesForwarded[env.Type.String()]++
-		go n.ForwardMessage(&env, sender)
+	// We do not spread a claim about our own death any further, the refutation will take care of the nodes that already received it.
+	// The announcement is signed as a whole, thus it is either relayed untouched or not at all.
+	if slices.ContainsFunc(msg.DeadNodes, func(deadNode message.NodeRef) bool {
+		return deadNode.Is(n.ID)
+	}) {
+		return
+	}
+
+	n.relayEnvelope(env, env.Sender.ID)
+}
+
+// refuteOwnDeath bumps the incarnation of this node over the one it was declared dead with, and floods a lifeline with it.
+// It returns false if the claim was stale, thus there was nothing to refute.
+func (n *Node) refuteOwnDeath(incarnation uint64) bool {
+	if incarnation < n.Incarnation {
+		n.Log.Debug("ignoring stale death claim about us with incarnation %d < %d", incarnation, n.Incarnation)
+		return false
 	}
+
+	n.Incarnation = incarnation + 1
+	n.Log.Info("we have been declared dead - refuting with incarnation %d", n.Incarnation)
+	n.updateStats(func(s *Stats) { s.DeathRefutationsSent++ })
+	n.sendLifeLineAnnouncement()
+	return true
 }
 
-func (n *Node) processNetNewNodeJoinConfirmMessage(sender network.IpPortPair, ogSender network.IpPortPair) {
+func (n *Node) processNetNewNodeJoinConfirmMessage(msg *message.NetNewNodeJoinConfirmMessage, env *message.MessageEnvelope) {
 	confirmMessageData := message.NetNewNodeJoinConfirmMessage{
 		IsSuitable: true,
 	}
+
+	if err := n.admit(env.OriginalSender.ID, msg); err != nil {
+		n.Log.Error("refusing node %v - %s", env.OriginalSender, err)
+		n.updateStats(func(s *Stats) { s.AdmissionRejects++ })
+		confirmMessageData.IsSuitable = false
+		n.sendJoinConfirmResponse(&confirmMessageData, env)
+		return
+	}
+
 	// Here I sense a bug, due to the fact that if a node indeed finishes the joing process before this, they should be a part of the new join query, but that adds a lot of concurrency problems.
 	// Will think about it.
-	if cap(n.Conns) > len(n.Conns) && len(n.Stat.JoinQueriesOngoing) != 0 && len(n.Stat.JoinQueriesOngoing)+len(n.Conns) >= cap(n.Conns) {
-		logging.LogError("current node has the maximum allowed number of ongoing join queries - will not participate as a candidate")
+	if int(n.ConnCap) > len(n.Conns) && len(n.Stat.JoinQueriesOngoing) != 0 && len(n.Stat.JoinQueriesOngoing)+len(n.Conns) >= int(n.ConnCap) {
+		n.Log.Error("current node has the maximum allowed number of ongoing join queries - will not participate as a candidate")
 		confirmMessageData.IsSuitable = false
-	} else if cap(n.Conns) == len(n.Conns) {
-		logging.LogDebug("capacity of primary connections is full! checking for dead nodes")
+	} else if len(n.Conns) >= int(n.ConnCap) {
+		n.Log.Debug("capacity of primary connections is full! checking for dead nodes")
 		if len(n.findExistingDeadNodes()) == 0 {
-			logging.LogDebug("there is no dead node to replace")
+			n.Log.Debug("there is no dead node to replace")
 			confirmMessageData.IsSuitable = false
 		}
 	}
 
-	var err error
-	var b []byte
-	if b, err = message.SerializeNewMessageEnvelope(message.NetNewNodeJoinConfirm, &confirmMessageData, n.GetIpPortPair(), ogSender); err != nil {
-		logging.LogError("could not create join confirm envelope: %s", err)
+	if !n.sendJoinConfirmResponse(&confirmMessageData, env) {
 		return
 	}
+	n.updateStats(func(s *Stats) { s.JoinQueriesOngoing = append(s.JoinQueriesOngoing, env.OriginalSender.ID) })
+	if !confirmMessageData.IsSuitable {
+		n.updateStats(func(s *Stats) { s.NewNodeRejects++ })
+	}
+}
 
-	if err = network.SendToDest(b, sender, time.Duration(n.DeathTimer)); err != nil {
-		logging.LogError("could not send confirm message: %s", err)
-		return
+// sendJoinConfirmResponse answers the joining node, the one that signed env, and returns if the answer has been sent.
+func (n *Node) sendJoinConfirmResponse(msg *message.NetNewNodeJoinConfirmMessage, env *message.MessageEnvelope) bool {
+	joiningNode := env.OriginalSender
+	b, err := n.serializeTracedEnvelope(env.Trace, message.NetNewNodeJoinConfirm, msg)
+	if err != nil {
+		n.Log.Error("could not create join confirm envelope: %s", err)
+		return false
 	}
-	n.Stat.JoinQueriesOngoing = append(n.Stat.JoinQueriesOngoing, sender)
-	logging.LogDebug("sent confirm message with isSuitable=%v", confirmMessageData.IsSuitable)
-	if !confirmMessageData.IsSuitable {
-		n.Stat.NewNodeRejects++
+
+	if err = n.Net.SendToDest(b, joiningNode.Locator, joiningNode.ID, time.Duration(n.DeathTimer)); err != nil {
+		n.Log.Error("could not send confirm message: %s", err)
+		return false
 	}
+	n.Log.Debug("sent confirm message with isSuitable=%v", msg.IsSuitable)
+	return true
 }
 
-func (n *Node) processNetUpdateMessage(msg message.NetUpdateMessage, sender network.IpPortPair, ogSender network.IpPortPair) {
-	updatedNode := findNodeByIpPortPairInNode(n, msg.UpdatedNode, n.DepthVision)
+func (n *Node) processNetUpdateMessage(msg message.NetUpdateMessage, env *message.MessageEnvelope) {
+	updatedNode := n.locateNode(msg.UpdatedNode, env.OriginalSender.ID)
 	if updatedNode == nil {
-		logging.LogInfo("could not find the updated node")
+		n.Log.Info("could not find the updated node")
 	} else {
-		logging.LogInfo("found the updated node: %v", updatedNode)
-		logging.LogInfo("targeted node state before: %s", updatedNode)
-		nodeIpp := n.GetIpPortPair()
-		putIpPortPairsAsNodesInNode(n, updatedNode.DepthVision, msg.Conns, nodeIpp, updatedNode.GetIpPortPair())
-		logging.LogInfo("targeted node state after: %s", updatedNode)
+		n.Log.Info("found the updated node: %v", updatedNode)
+		n.Log.Info("targeted node state before: %s", updatedNode)
+		putNodeRefsAsNodesInNode(n, updatedNode.DepthVision, msg.Conns, n.ID, updatedNode.ID)
+		n.Log.Info("targeted node state after: %s", updatedNode)
 	}
 
-	env, err := message.CreateMessageEnvelope(message.NetUpdate, &msg, n.GetIpPortPair(), ogSender)
-	if err != nil {
-		logging.LogError("could not create update envelope: %s", err)
-		return
-	}
-	n.Stat.MessagesForwarded[env.Type.String()]++
-	go n.ForwardMessage(&env, sender)
+	n.relayEnvelope(env, env.Sender.ID)
 }
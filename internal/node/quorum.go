@@ -0,0 +1,89 @@
+package node
+
+import (
+	"slices"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+)
+
+// DeathReport is a claim made by a neighbour of a node that the node is dead.
+type DeathReport struct {
+	Reporter  message.NodeRef
+	Timestamp int64
+}
+
+// deathReporters returns the nodes of our vision that can report the death of the node: its neighbours that are not dead, other than us.
+// A node whose links we cannot see has no reporters.
+func (n *Node) deathReporters(deadNode identity.NodeID) map[identity.NodeID]bool {
+	reporters := map[identity.NodeID]bool{}
+	var walk func(nd *Node, layers uint8)
+	walk = func(nd *Node, layers uint8) {
+		if layers == 0 {
+			return
+		}
+		for _, conn := range nd.Conns {
+			if nd.ID == deadNode && conn.ID != n.ID && conn.livenessState() != stateDead {
+				reporters[conn.ID] = true
+			}
+			if conn.ID == deadNode && nd != n && nd.livenessState() != stateDead {
+				reporters[nd.ID] = true
+			}
+			walk(conn, layers-1)
+		}
+	}
+	walk(n, n.DepthVision)
+	return reporters
+}
+
+// recordDeathReport stores the report of the reporter about the dead node, and returns if the quorum has been reached.
+// Only the neighbours of the dead node we can see are counted, and the quorum is at most their number, such that a node with
+// fewer neighbours than the quorum can still be found dead. Reports older than DeathQuorumWindow seconds are dropped, and a reporter is only counted once.
+func (n *Node) recordDeathReport(deadNode message.NodeRef, reporter message.NodeRef) bool {
+	if n.DeathQuorum <= 1 {
+		return true
+	}
+
+	reporters := n.deathReporters(deadNode.ID)
+	if !reporters[reporter.ID] {
+		n.Log.Debug("ignoring death report about %v from %v - not a neighbour we can see", deadNode, reporter)
+		n.updateStats(func(s *Stats) { s.DeathReportsIgnored++ })
+		return false
+	}
+	quorum := min(int(n.DeathQuorum), len(reporters))
+
+	now := clock.Now().UnixMilli()
+	reports := slices.DeleteFunc(n.DeathReports[deadNode.ID], func(dr DeathReport) bool {
+		return now-dr.Timestamp > n.deathReportWindow() || dr.Reporter.Is(reporter.ID)
+	})
+	reports = append(reports, DeathReport{Reporter: reporter, Timestamp: now})
+	n.Log.Debug("death reports for %v: %d/%d", deadNode, len(reports), quorum)
+
+	if len(reports) < quorum {
+		n.DeathReports[deadNode.ID] = reports
+		return false
+	}
+
+	delete(n.DeathReports, deadNode.ID)
+	return true
+}
+
+func (n *Node) deathReportWindow() int64 {
+	return (time.Duration(n.DeathQuorumWindow) * time.Second).Milliseconds()
+}
+
+// pruneDeathReports drops the reports out of the window, and the nodes left without reports.
+func (n *Node) pruneDeathReports() {
+	now := clock.Now().UnixMilli()
+	for id, reports := range n.DeathReports {
+		reports = slices.DeleteFunc(reports, func(dr DeathReport) bool {
+			return now-dr.Timestamp > n.deathReportWindow()
+		})
+		if len(reports) == 0 {
+			delete(n.DeathReports, id)
+			continue
+		}
+		n.DeathReports[id] = reports
+	}
+}
@@ -0,0 +1,112 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+// Snapshot is the state a replay starts from: the configuration of the node and its vision.
+type Snapshot struct {
+	Config NodeConfig `json:"Config"`
+	Vision NodeView   `json:"Vision"`
+}
+
+func (n *Node) Snapshot() Snapshot {
+	return Snapshot{Config: n.config(), Vision: n.view(n.DepthVision)}
+}
+
+func parseAddress(address string) (network.IpPortPair, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return network.IpPortPair{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return network.IpPortPair{}, fmt.Errorf("invalid port in %s - %s", address, err)
+	}
+	return network.IpPortPair{Ip: net.ParseIP(host), Port: uint16(p)}, nil
+}
+
+func parseLivenessState(s string) livenessState {
+	for _, ls := range []livenessState{stateSuspect, stateDead} {
+		if ls.String() == s {
+			return ls
+		}
+	}
+	return stateAlive
+}
+
+// nodeFromView rebuilds a node of the vision, along with the part of the vision under it.
+func nodeFromView(v NodeView) (*Node, error) {
+	locator, err := parseAddress(v.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	nd := CreatePrimaryConnectionNode(message.NodeRef{ID: v.ID, Locator: locator})
+	nd.DepthVision = v.DepthVision
+	nd.LastTimeAlive = v.LastTimeAlive
+	nd.SmoothedRTT = v.SmoothedRTT
+	nd.RTTJitter = v.RTTJitter
+	nd.Health = v.Health
+	nd.applyLiveness(parseLivenessState(v.State), v.Incarnation)
+
+	for _, cv := range v.Conns {
+		conn, err := nodeFromView(cv)
+		if err != nil {
+			return nil, err
+		}
+		nd.Conns = append(nd.Conns, conn)
+	}
+	return nd, nil
+}
+
+// FromSnapshot creates a node in the state of the snapshot. The node has no identity, thus the envelopes it creates are not signed,
+// and the encryption keys of the nodes in its vision are not known.
+func FromSnapshot(s Snapshot) (*Node, error) {
+	c := s.Config
+	locator, err := parseAddress(c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address of the node - %s", err)
+	}
+
+	n, err := Create(locator.Ip.String(), locator.Port, uint8(c.ConnCap), uint16(c.QueueCap))
+	if err != nil {
+		return nil, err
+	}
+	n.ID = c.ID
+	n.tagLogs()
+	n.Incarnation = c.Incarnation
+	n.LifeLineTimer = c.LifeLineTimer
+	n.DeathTimer = c.DeathTimer
+	n.DepthVision = c.DepthVision
+	n.DeathQuorum = c.DeathQuorum
+	n.DeathQuorumWindow = c.DeathQuorumWindow
+	n.AdvertiseHealth = c.AdvertiseHealth
+	n.AggregateLifeLines = c.AggregateLifeLines
+	n.OnionHops = c.OnionHops
+	n.RequireInvitation = c.RequireInvitation
+	n.StatsSinks = nil
+
+	for _, cv := range s.Vision.Conns {
+		conn, err := nodeFromView(cv)
+		if err != nil {
+			return nil, err
+		}
+		n.Conns = append(n.Conns, conn)
+	}
+	return n, nil
+}
+
+// HandleEnvelope processes the envelope right away, as if it had just come out of the queue, and then the messages the node queued for itself meanwhile.
+// None of the checks done on received envelopes are done, thus it is only meant for the envelopes that passed them, e.g. the ones of a capture.
+// It must not be used while MainLoop runs.
+func (n *Node) HandleEnvelope(env *message.MessageEnvelope) error {
+	err := n.handleMessage(env)
+	n.ProcessQueue()
+	return err
+}
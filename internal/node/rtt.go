@@ -0,0 +1,89 @@
+package node
+
+import (
+	"math"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+// The gains used for smoothing the RTT and the jitter, same as TCP (RFC 6298).
+const rttAlpha = 0.125
+const rttBeta = 0.25
+
+// addRTTSample updates the smoothed RTT and jitter of the node with a new sample, in milliseconds.
+func (n *Node) addRTTSample(rtt float64) {
+	if n.RTTSamples == 0 {
+		n.SmoothedRTT = rtt
+		n.RTTJitter = rtt / 2
+	} else {
+		n.RTTJitter = (1-rttBeta)*n.RTTJitter + rttBeta*math.Abs(n.SmoothedRTT-rtt)
+		n.SmoothedRTT = (1-rttAlpha)*n.SmoothedRTT + rttAlpha*rtt
+	}
+	n.RTTSamples++
+}
+
+// sendPings sends a ping to each primary connection that is not dead.
+func (n *Node) sendPings() {
+	b, err := n.SerializeNewEnvelope(message.NetPing, &message.NetPingMessage{Timestamp: clock.Now().UnixMicro()})
+	if err != nil {
+		n.Log.Error("could not create ping envelope: %s", err)
+		return
+	}
+
+	dests := make([]network.Dest, 0, len(n.Conns))
+	for i := range n.Conns {
+		if n.Conns[i].livenessState() != stateDead {
+			dests = append(dests, n.Conns[i].dest())
+		}
+	}
+
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[message.NetPing.String()]++ })
+	clock.Go(func() {
+		sendErrors := n.Net.SendToMultipleDest(b, dests, nil, time.Duration(n.DeathTimer))
+		n.updateStats(func(s *Stats) { s.SendErrors += sendErrors })
+	})
+}
+
+// processNetPingMessage echoes the ping back to the node that signed it.
+func (n *Node) processNetPingMessage(msg *message.NetPingMessage, sender message.NodeRef) {
+	b, err := n.SerializeNewEnvelope(message.NetPong, msg)
+	if err != nil {
+		n.Log.Error("could not create pong envelope: %s", err)
+		return
+	}
+
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[message.NetPong.String()]++ })
+	clock.Go(func() {
+		if err := n.Net.SendToDest(b, sender.Locator, sender.ID, time.Duration(n.DeathTimer)); err != nil {
+			n.Log.Error("could not send pong - %s", err)
+			n.updateStats(func(s *Stats) { s.SendErrors++ })
+		}
+	})
+}
+
+// processNetPongMessage takes a new RTT sample for the primary connection that signed the pong, the unsigned Sender could be anyone.
+func (n *Node) processNetPongMessage(msg *message.NetPingMessage, sender message.NodeRef) {
+	rtt := float64(clock.Now().UnixMicro()-msg.Timestamp) / 1000
+
+	for i := range n.Conns {
+		conn := n.Conns[i]
+		if !sender.Is(conn.ID) {
+			continue
+		}
+
+		conn.addRTTSample(rtt)
+		n.updateStats(func(s *Stats) {
+			s.RTTHistogram.Observe(rtt)
+			s.RTTs[string(conn.ID)] = RTTStat{
+				SmoothedRTT: conn.SmoothedRTT,
+				Jitter:      conn.RTTJitter,
+				Samples:     conn.RTTSamples,
+			}
+		})
+		n.Log.Debug("rtt for %v: sample=%.3fms smoothed=%.3fms jitter=%.3fms", sender, rtt, conn.SmoothedRTT, conn.RTTJitter)
+		return
+	}
+	n.Log.Debug("received pong from %v, which is not a primary connection", sender)
+}
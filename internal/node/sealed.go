@@ -0,0 +1,84 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+)
+
+var ErrUnknownEncryptionKey = errors.New("the encryption key of the node is not known yet")
+
+// learnEncryptionKey stores the encryption key record of the node, if it has really been signed by it.
+func (n *Node) learnEncryptionKey(nd *Node, record *identity.EncryptionKeyRecord) {
+	if record == nil || nd.EncryptionKey != nil && string(nd.EncryptionKey.EncryptionKey) == string(record.EncryptionKey) {
+		return
+	}
+
+	if err := record.Verify(nd.ID); err != nil {
+		n.Log.Error("ignoring encryption key of %v - %s", nd.GetNodeRef(), err)
+		return
+	}
+	nd.EncryptionKey = record
+	n.Log.Debug("learned the encryption key of %v", nd.GetNodeRef())
+}
+
+// SendSealed sends the payload to the destination node, encrypted such that only it can read it.
+// Only the content is protected: the message is flooded to the vision like the others, with the destination in clear and signed
+// by this node, thus every node it goes through learns who talks to whom. SendOnion hides that as well.
+// The destination must be in the vision of this node, and we must have received its encryption key in a lifeline or a digest.
+// It reads the vision, thus while MainLoop runs it must be called through Do.
+func (n *Node) SendSealed(dest identity.NodeID, payload []byte) error {
+	nd := findNodeByIDInNode(n, dest, n.DepthVision)
+	if nd == nil {
+		return fmt.Errorf("node %s is not in our vision", dest.Short())
+	}
+	if nd.EncryptionKey == nil {
+		return fmt.Errorf("%w - node %s", ErrUnknownEncryptionKey, dest.Short())
+	}
+
+	msg, err := message.SealPayload(payload, nd.GetNodeRef(), nd.EncryptionKey.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	env, err := n.CreateEnvelope(message.NetSealed, &msg)
+	if err != nil {
+		return fmt.Errorf("could not create sealed envelope - %s", err)
+	}
+
+	n.Log.Debug("sending sealed payload of %d bytes to %v", len(payload), nd.GetNodeRef())
+	n.updateStats(func(s *Stats) { s.SealedSent++ })
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[env.Type.String()]++ })
+	n.forward(&env)
+	return nil
+}
+
+// processNetSealedMessage opens the payload if it is sealed for us, otherwise the message is forwarded as it is.
+func (n *Node) processNetSealedMessage(msg *message.NetSealedMessage, env *message.MessageEnvelope) {
+	if !msg.Destination.Is(n.ID) {
+		n.relayEnvelope(env, env.Sender.ID, env.OriginalSender.ID)
+		return
+	}
+
+	if n.Identity == nil {
+		n.Log.Error("cannot open sealed payload from %v - this node has no identity", env.OriginalSender)
+		n.updateStats(func(s *Stats) { s.SealedOpenFailures++ })
+		return
+	}
+
+	payload, err := message.OpenPayload(msg, n.Identity)
+	if err != nil {
+		n.Log.Error("cannot open sealed payload from %v - %s", env.OriginalSender, err)
+		n.updateStats(func(s *Stats) { s.SealedOpenFailures++ })
+		return
+	}
+	n.updateStats(func(s *Stats) { s.SealedReceived++ })
+
+	if n.OnPayload == nil {
+		n.Log.Info("received sealed payload of %d bytes from %v", len(payload), env.OriginalSender)
+		return
+	}
+	n.OnPayload(env.OriginalSender, payload)
+}
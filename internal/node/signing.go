@@ -0,0 +1,144 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/tracing"
+)
+
+// The default duration in seconds an envelope is accepted for after it has been signed.
+const DefaultReplayWindow = 30
+
+var errReplayedEnvelope = errors.New("envelope is out of the replay window")
+var errDuplicateEnvelope = errors.New("envelope has already been received")
+var errOwnEnvelope = errors.New("envelope has been originally sent by this node")
+
+// nonceCache holds the nonces of the envelopes seen in the replay window, keyed by the ID of the original sender.
+// It is used both by the accepting loop and by the goroutines creating envelopes, thus it has its own lock.
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]int64
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: map[string]int64{}}
+}
+
+// add stores the nonce, and returns false if it was already there.
+func (nc *nonceCache) add(origin identity.NodeID, nonce string, timestamp int64) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	key := string(origin) + nonce
+	if _, ok := nc.seen[key]; ok {
+		return false
+	}
+	nc.seen[key] = timestamp
+	return true
+}
+
+// prune drops the nonces of the envelopes signed before the given timestamp, since those envelopes are rejected anyway.
+func (nc *nonceCache) prune(before int64) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	for key, timestamp := range nc.seen {
+		if timestamp < before {
+			delete(nc.seen, key)
+		}
+	}
+}
+
+// CreateEnvelope creates an envelope for a message originally sent by this node, signed with its key.
+// Nodes without an identity create unsigned envelopes, which other nodes will reject.
+// The message starts a new trace, when it is sampled.
+func (n *Node) CreateEnvelope(mt message.MessageType, msg message.SerializableMessage) (message.MessageEnvelope, error) {
+	return n.CreateTracedEnvelope(nil, mt, msg)
+}
+
+// CreateTracedEnvelope does the same thing as CreateEnvelope, for a message sent as part of the trace, when it is not nil.
+func (n *Node) CreateTracedEnvelope(trace *tracing.Context, mt message.MessageType, msg message.SerializableMessage) (message.MessageEnvelope, error) {
+	env, err := message.CreateMessageEnvelope(mt, msg, n.GetNodeRef(), n.GetNodeRef())
+	if err != nil || n.Identity == nil {
+		return env, err
+	}
+
+	if err = message.SignMessageEnvelope(&env, n.Identity, clock.Now()); err != nil {
+		return message.MessageEnvelope{}, err
+	}
+	// So that we recognize our own messages when they come back to us.
+	n.seenNonces.add(n.ID, env.Nonce, env.Timestamp)
+
+	env.Trace = trace
+	if env.Trace == nil {
+		env.Trace = n.Tracer.NewTrace()
+	}
+	return env, nil
+}
+
+// SerializeNewEnvelope does the same thing as CreateEnvelope, but it returns the serialized envelope.
+func (n *Node) SerializeNewEnvelope(mt message.MessageType, msg message.SerializableMessage) ([]byte, error) {
+	return n.serializeTracedEnvelope(nil, mt, msg)
+}
+
+func (n *Node) serializeTracedEnvelope(trace *tracing.Context, mt message.MessageType, msg message.SerializableMessage) ([]byte, error) {
+	env, err := n.CreateTracedEnvelope(trace, mt, msg)
+	if err != nil {
+		return nil, err
+	}
+	return message.SerializeMessageEnvelope(&env)
+}
+
+// relayEnvelope forwards an envelope received from another node as it is, only the Sender being changed to this node.
+func (n *Node) relayEnvelope(env *message.MessageEnvelope, skipNodes ...identity.NodeID) {
+	relayed := *env
+	relayed.Sender = n.GetNodeRef()
+	n.updateStats(func(s *Stats) { s.MessagesForwarded[relayed.Type.String()]++ })
+	n.forward(&relayed, skipNodes...)
+}
+
+// verifySignature checks the signature of an envelope we receive.
+func (n *Node) verifySignature(env *message.MessageEnvelope) error {
+	if n.verifier != nil {
+		return n.verifier(env)
+	}
+	return message.VerifyMessageEnvelope(env)
+}
+
+// SetSignatureVerifier makes the node check the signatures with the given function, instead of verifying them.
+// Only the simulator uses it, since its nodes are all honest, and checking each signature at each node would be most of what it does.
+func (n *Node) SetSignatureVerifier(f func(env *message.MessageEnvelope) error) {
+	n.verifier = f
+}
+
+// verifyEnvelope checks the signature of the envelope, and that it is neither too old nor already received.
+func (n *Node) verifyEnvelope(env *message.MessageEnvelope) error {
+	if err := n.verifySignature(env); err != nil {
+		return err
+	}
+
+	window := (time.Duration(n.ReplayWindow) * time.Second).Milliseconds()
+	if now := clock.Now().UnixMilli(); now-env.Timestamp > window || env.Timestamp-now > window {
+		return fmt.Errorf("%w - signed %d ms away from now", errReplayedEnvelope, now-env.Timestamp)
+	}
+
+	if !n.seenNonces.add(env.OriginalSender.ID, env.Nonce, env.Timestamp) {
+		if env.OriginalSender.Is(n.ID) {
+			return errOwnEnvelope
+		}
+		return errDuplicateEnvelope
+	}
+	return nil
+}
+
+// pruneSeenNonces drops the nonces that are out of the replay window.
+func (n *Node) pruneSeenNonces() {
+	window := (time.Duration(n.ReplayWindow) * time.Second).Milliseconds()
+	n.seenNonces.prune(clock.Now().UnixMilli() - window)
+	n.Log.Debug("pruned nonces older than %d seconds", n.ReplayWindow)
+}
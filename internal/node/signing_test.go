@@ -0,0 +1,104 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+func createSignedNode(t *testing.T, port uint16) *Node {
+	n, err := Create("127.0.0.1", port, 1, 1)
+	if err != nil {
+		t.Fatal("could not create node")
+	}
+	id, _ := identity.Generate()
+	if err = n.SetIdentity(id); err != nil {
+		t.Fatalf("could not set identity - %s", err)
+	}
+	return n
+}
+
+func TestVerifyEnvelopeRejectsTampering(t *testing.T) {
+	n, sender := createSignedNode(t, 8080), createSignedNode(t, 8081)
+	lifeline := &message.NetLifeLineMessage{Node: sender.GetNodeRef(), Incarnation: 1}
+
+	tampers := map[string]func(env *message.MessageEnvelope){
+		"data":      func(env *message.MessageEnvelope) { env.Data = json.RawMessage(`{"Incarnation":2}`) },
+		"type":      func(env *message.MessageEnvelope) { env.Type = message.NetDeathAnnouncement },
+		"timestamp": func(env *message.MessageEnvelope) { env.Timestamp-- },
+		"locator": func(env *message.MessageEnvelope) {
+			env.OriginalSender.Locator = network.IpPortPair{Ip: net.ParseIP("10.0.0.1"), Port: 8081}
+		},
+	}
+	for name, tamper := range tampers {
+		env, err := sender.CreateEnvelope(message.NetLifeLine, lifeline)
+		if err != nil {
+			t.Fatalf("could not create envelope - %s", err)
+		}
+		tamper(&env)
+		if err = n.verifyEnvelope(&env); !errors.Is(err, message.ErrBadSignature) {
+			t.Errorf("envelope with tampered %s was not rejected for its signature - %v", name, err)
+		}
+	}
+
+	// The locator is signed the same way however its address is held.
+	env, _ := sender.CreateEnvelope(message.NetLifeLine, lifeline)
+	env.OriginalSender.Locator.Ip = env.OriginalSender.Locator.Ip.To4()
+	if err := n.verifyEnvelope(&env); err != nil {
+		t.Errorf("envelope with a 4 bytes address was rejected - %s", err)
+	}
+}
+
+func TestVerifyEnvelopeRejectsReplays(t *testing.T) {
+	n, sender := createSignedNode(t, 8080), createSignedNode(t, 8081)
+	lifeline := &message.NetLifeLineMessage{Node: sender.GetNodeRef(), Incarnation: 1}
+
+	env, _ := sender.CreateEnvelope(message.NetLifeLine, lifeline)
+	if err := n.verifyEnvelope(&env); err != nil {
+		t.Fatalf("valid envelope was rejected - %s", err)
+	}
+	if err := n.verifyEnvelope(&env); !errors.Is(err, errDuplicateEnvelope) {
+		t.Errorf("envelope received twice was not rejected as a duplicate - %v", err)
+	}
+
+	// Signed again, an old envelope gets a new nonce, and it is the window that rejects it.
+	old, _ := message.CreateMessageEnvelope(message.NetLifeLine, lifeline, sender.GetNodeRef(), sender.GetNodeRef())
+	signedAt := time.Now().Add(-time.Duration(n.ReplayWindow+1) * time.Second)
+	if err := message.SignMessageEnvelope(&old, sender.Identity, signedAt); err != nil {
+		t.Fatalf("could not sign envelope - %s", err)
+	}
+	if err := n.verifyEnvelope(&old); !errors.Is(err, errReplayedEnvelope) {
+		t.Errorf("envelope signed %d seconds ago was not rejected - %v", n.ReplayWindow+1, err)
+	}
+
+	// The nonces of the envelopes out of the window are forgotten, since the window rejects them anyway.
+	n.seenNonces.add(sender.ID, "old", signedAt.UnixMilli())
+	n.pruneSeenNonces()
+	if !n.seenNonces.add(sender.ID, "old", signedAt.UnixMilli()) {
+		t.Error("nonce out of the replay window was not pruned")
+	}
+	if n.seenNonces.add(sender.ID, env.Nonce, env.Timestamp) {
+		t.Error("nonce in the replay window was pruned")
+	}
+}
+
+func TestEnvelopesOfNonMembersAreRejected(t *testing.T) {
+	n, member, stranger := createSignedNode(t, 8080), createSignedNode(t, 8081), createSignedNode(t, 8082)
+	n.Net.Trust = &network.TrustPolicy{TrustedIDs: map[identity.NodeID]bool{member.ID: true}}
+
+	for _, sender := range []*Node{member, stranger} {
+		env, err := sender.CreateEnvelope(message.NetLifeLine, &message.NetLifeLineMessage{Node: sender.GetNodeRef()})
+		if err != nil {
+			t.Fatalf("could not create envelope - %s", err)
+		}
+		if accepted := n.checkEnvelope(&env, string(sender.ID), nil); accepted != (sender == member) {
+			t.Errorf("envelope signed by %s accepted=%v", sender.ID.Short(), accepted)
+		}
+	}
+}
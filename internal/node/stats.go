@@ -3,23 +3,31 @@ package node
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 
-	"github.com/TheJ0lly/Overlay-Network/internal/logging"
-	"github.com/TheJ0lly/Overlay-Network/internal/network"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
 )
 
+const DefaultStatsInterval = 10
+const DefaultStatsDir = "./stats"
+
 type Stats struct {
-	JoinQueriesOngoing []network.IpPortPair `json:"-"`
-	MessagesReceived   map[string]uint64    `json:"MessagesReceived"`
-	MessagesForwarded  map[string]uint64    `json:"MessagesForwarded"`
-	SendErrors         uint64               `json:"SendErrors"`
+	JoinQueriesOngoing []identity.NodeID `json:"-"`
+	MessagesReceived   map[string]uint64 `json:"MessagesReceived"`
+	MessagesForwarded  map[string]uint64 `json:"MessagesForwarded"`
+	SendErrors         uint64            `json:"SendErrors"`
 
 	JoinCandidateResponses uint64 `json:"JoinCandidateResponses"`
 	JoinCandidateRejects   uint64 `json:"JoinCandidateRejects"`
 
 	DeathAnnouncementsSent     uint64 `json:"DeathAnnouncementsSent"`
 	DeathAnnouncementsReceived uint64 `json:"DeathAnnouncementsReceived"`
+	DeathRefutationsSent       uint64 `json:"DeathRefutationsSent"`
+	StaleDeathClaims           uint64 `json:"StaleDeathClaims"`
+	DeathReportsIgnored        uint64 `json:"DeathReportsIgnored"`
 
 	DeadHopAttempts         uint64  `json:"DeadHopAttempts"`
 	DeadHopNodesGathered    uint64  `json:"DeadHopNodesGathered"`
@@ -30,12 +38,56 @@ type Stats struct {
 	NodesReplaced      uint64 `json:"NodesReplaced"`
 	NewNodeRejects     uint64 `json:"NewNodeRejects"`
 	DuplicatedMessages uint64 `json:"DuplicatedMessages"`
+	SignatureRejects   uint64 `json:"SignatureRejects"`
+	ReplayRejects      uint64 `json:"ReplayRejects"`
+	LinkRejects        uint64 `json:"LinkRejects"`
+	AdmissionRejects   uint64 `json:"AdmissionRejects"`
+	OversizedRejects   uint64 `json:"OversizedRejects"`
+	InboundConnRejects uint64 `json:"InboundConnRejects"`
+	RateLimitDrops     uint64 `json:"RateLimitDrops"`
+	BannedPeerDrops    uint64 `json:"BannedPeerDrops"`
+	PeersBanned        uint64 `json:"PeersBanned"`
+
+	SealedSent         uint64 `json:"SealedSent"`
+	SealedReceived     uint64 `json:"SealedReceived"`
+	SealedOpenFailures uint64 `json:"SealedOpenFailures"`
+	OnionSent          uint64 `json:"OnionSent"`
+	OnionRelayed       uint64 `json:"OnionRelayed"`
+	OnionReceived      uint64 `json:"OnionReceived"`
+	OnionFailures      uint64 `json:"OnionFailures"`
 	PrimaryConnections uint64 `json:"PrimaryConnections"`
+
+	// The gauges are only filled in when the stats are exported.
+	QueueLength  uint64 `json:"QueueLength"`
+	InboundConns uint64 `json:"InboundConns"`
+
+	RTTs map[string]RTTStat `json:"RTTs"`
+
+	// RTTHistogram holds every RTT sample, and ProcessingLatency the time spent handling each message, in milliseconds.
+	RTTHistogram      *Histogram `json:"RTTHistogram"`
+	ProcessingLatency *Histogram `json:"ProcessingLatency"`
+
+	// Only the peers that misbehaved lately are listed.
+	PeerScores map[string]PeerScore `json:"PeerScores"`
+}
+
+// PeerScore is how well a peer behaved lately, from 0 to 100.
+type PeerScore struct {
+	Score          float64 `json:"Score"`
+	Banned         bool    `json:"Banned"`
+	RateViolations uint64  `json:"RateViolations"`
+}
+
+// RTTStat is the smoothed RTT and jitter, in milliseconds, of a primary connection.
+type RTTStat struct {
+	SmoothedRTT float64 `json:"SmoothedRTT"`
+	Jitter      float64 `json:"Jitter"`
+	Samples     uint64  `json:"Samples"`
 }
 
 func NewStats() Stats {
 	return Stats{
-		JoinQueriesOngoing:         []network.IpPortPair{},
+		JoinQueriesOngoing:         []identity.NodeID{},
 		MessagesReceived:           map[string]uint64{},
 		MessagesForwarded:          map[string]uint64{},
 		SendErrors:                 0,
@@ -43,21 +95,108 @@ func NewStats() Stats {
 		JoinCandidateRejects:       0,
 		DeathAnnouncementsSent:     0,
 		DeathAnnouncementsReceived: 0,
+		DeathRefutationsSent:       0,
+		StaleDeathClaims:           0,
+		DeathReportsIgnored:        0,
 		DeadHopAttempts:            0,
 		QueueDrops:                 0,
 		NodesReplaced:              0,
 		NewNodeRejects:             0,
 		DuplicatedMessages:         0,
+		SignatureRejects:           0,
+		ReplayRejects:              0,
+		LinkRejects:                0,
+		AdmissionRejects:           0,
+		OversizedRejects:           0,
+		InboundConnRejects:         0,
+		RateLimitDrops:             0,
+		BannedPeerDrops:            0,
+		PeersBanned:                0,
+		SealedSent:                 0,
+		SealedReceived:             0,
+		SealedOpenFailures:         0,
+		OnionSent:                  0,
+		OnionRelayed:               0,
+		OnionReceived:              0,
+		OnionFailures:              0,
+		PeerScores:                 map[string]PeerScore{},
+		RTTs:                       map[string]RTTStat{},
+		RTTHistogram:               NewHistogram(rttBuckets...),
+		ProcessingLatency:          NewHistogram(processingBuckets...),
 	}
 }
 
-func (s *Stats) ExportJson(port uint16) {
-	if b, err := json.MarshalIndent(s, "", "\t"); err != nil {
-		logging.LogError("could not export stats - could not marshal data")
-	} else {
-		if err = os.WriteFile(fmt.Sprintf("./stats/Stats_Node_%d.json", port), b, 0666); err != nil {
-			logging.LogError("could not export stats - could not create file")
-		}
+// StatsSink receives the stats of the node every StatsInterval seconds.
+type StatsSink interface {
+	ExportStats(s *Stats) error
+}
+
+// FileSink writes the stats of the node as JSON in Dir/Stats_Node_<port>.json.
+type FileSink struct {
+	Dir  string
+	Port uint16
+}
+
+func (fs FileSink) ExportStats(s *Stats) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return fmt.Errorf("could not export stats - could not marshal data - %s", err)
 	}
 
+	if err = os.MkdirAll(fs.Dir, 0755); err != nil {
+		return fmt.Errorf("could not export stats - could not create directory - %s", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(fs.Dir, fmt.Sprintf("Stats_Node_%d.json", fs.Port)), b, 0666); err != nil {
+		return fmt.Errorf("could not export stats - could not create file - %s", err)
+	}
+	return nil
+}
+
+// updateStats changes the stats while holding statMu, since they are read from other goroutines by the exports and the APIs.
+// Every change to the stats goes through it, except for the gauges filled in by refreshStats.
+func (n *Node) updateStats(f func(s *Stats)) {
+	n.statMu.Lock()
+	defer n.statMu.Unlock()
+	f(&n.Stat)
+}
+
+// refreshStats fills in the gauges of the stats. It must be called while holding statMu.
+func (n *Node) refreshStats() {
+	n.exportPeerScores()
+	n.Stat.QueueLength = uint64(n.Queue.Length())
+	n.Stat.InboundConns = uint64(n.inboundConns.Load())
+}
+
+// Stats returns a copy of the stats, with the gauges filled in, such that it can be read from any goroutine.
+func (n *Node) Stats() Stats {
+	n.statMu.Lock()
+	defer n.statMu.Unlock()
+
+	n.refreshStats()
+	return n.Stat.clone()
+}
+
+// clone returns a deep copy of the stats, which shares nothing with them.
+func (s *Stats) clone() Stats {
+	c := *s
+	c.JoinQueriesOngoing = slices.Clone(s.JoinQueriesOngoing)
+	c.MessagesReceived = maps.Clone(s.MessagesReceived)
+	c.MessagesForwarded = maps.Clone(s.MessagesForwarded)
+	c.RTTs = maps.Clone(s.RTTs)
+	c.PeerScores = maps.Clone(s.PeerScores)
+	c.RTTHistogram = s.RTTHistogram.clone()
+	c.ProcessingLatency = s.ProcessingLatency.clone()
+	return c
+}
+
+// exportStats passes the stats to all the sinks of the node.
+// They get a copy, such that their file I/O does not hold the stats lock.
+func (n *Node) exportStats() {
+	stats := n.Stats()
+	for _, sink := range n.StatsSinks {
+		if err := sink.ExportStats(&stats); err != nil {
+			n.Log.Error("%s", err)
+		}
+	}
 }
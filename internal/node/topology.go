@@ -0,0 +1,42 @@
+package node
+
+import (
+	"github.com/TheJ0lly/Overlay-Network/internal/topology"
+)
+
+// Topology flattens the vision of the node into a graph. The graph is built on the processing goroutine, through Do.
+func (n *Node) Topology() *topology.Graph {
+	var g *topology.Graph
+	n.Do(func() { g = n.topology() })
+	return g
+}
+
+// topology walks the vision layer by layer, thus what the node knows first-hand about its primary connections wins over what it heard about them.
+func (n *Node) topology() *topology.Graph {
+	g := topology.New(n.ID)
+	g.AddNode(topology.Node{ID: n.ID, Address: n.GetNodeAddress(), State: topology.StateAlive, Incarnation: n.Incarnation})
+
+	layer := []*Node{n}
+	for depth := n.DepthVision; depth > 0 && len(layer) != 0; depth-- {
+		var next []*Node
+		for _, parent := range layer {
+			for _, conn := range parent.Conns {
+				state := conn.livenessState().String()
+				g.AddNode(topology.Node{ID: conn.ID, Address: conn.GetNodeAddress(), State: state, Incarnation: conn.Incarnation})
+				g.AddEdge(topology.Edge{From: parent.ID, To: conn.ID, State: state, RTT: conn.SmoothedRTT})
+				next = append(next, conn)
+			}
+		}
+		layer = next
+	}
+
+	g.Sort()
+	return g
+}
+
+// Vision is the vision graph of the node, along with the settings it is checked against by topology.Check. It is taken through Do, like Topology.
+func (n *Node) Vision() topology.Vision {
+	var v topology.Vision
+	n.Do(func() { v = topology.Vision{Graph: n.topology(), ConnCap: int(n.ConnCap), DepthVision: n.DepthVision} })
+	return v
+}
@@ -3,9 +3,12 @@ package queue
 import (
 	"fmt"
 	"slices"
+	"sync"
 )
 
+// MessageQueue is safe to use from multiple goroutines, the functions passed to it must not use the queue themselves.
 type MessageQueue[T any] struct {
+	mu     sync.Mutex
 	q      []T
 	notify chan struct{}
 }
@@ -30,7 +33,15 @@ func (mq *MessageQueue[T]) Wait() {
 	<-mq.notify
 }
 
+// Notified returns the channel Wait blocks on, such that the wait can be part of a select.
+func (mq *MessageQueue[T]) Notified() <-chan struct{} {
+	return mq.notify
+}
+
 func (mq *MessageQueue[T]) PopFront() (T, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
 	var zeroT T
 	if len(mq.q) == 0 {
 		return zeroT, fmt.Errorf("empty queue")
@@ -42,11 +53,17 @@ func (mq *MessageQueue[T]) PopFront() (T, error) {
 }
 
 func (mq *MessageQueue[T]) LookFront() T {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
 	toret := mq.q[0]
 	return toret
 }
 
 func (mq *MessageQueue[T]) Append(item T) error {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
 	if len(mq.q) >= cap(mq.q) {
 		return fmt.Errorf("queue is full (%d)! new message will be discarded", cap(mq.q))
 	}
@@ -56,6 +73,9 @@ func (mq *MessageQueue[T]) Append(item T) error {
 }
 
 func (mq *MessageQueue[T]) Insert(item T, idx int) error {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
 	if len(mq.q) >= cap(mq.q) {
 		return fmt.Errorf("queue is full (%d)! new message will be discarded", cap(mq.q))
 	}
@@ -66,6 +86,9 @@ func (mq *MessageQueue[T]) Insert(item T, idx int) error {
 
 // FindAllByFunc returns a slice of copies of the objects inside the actual queue. The `find` function condition must return `true` for the item to be found.
 func (mq *MessageQueue[T]) FindAllByFunc(find func(T) bool) []T {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
 	var sToRet []T
 
 	for i := range mq.q {
@@ -78,13 +101,29 @@ func (mq *MessageQueue[T]) FindAllByFunc(find func(T) bool) []T {
 }
 
 func (mq *MessageQueue[T]) ContainsFunc(contains func(T) bool) bool {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
 	return slices.ContainsFunc(mq.q, contains)
 }
 
 func (mq *MessageQueue[T]) RemoveByFunc(del func(T) bool) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
 	mq.q = slices.DeleteFunc(mq.q, del)
 }
 
 func (mq *MessageQueue[T]) Length() int {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
 	return len(mq.q)
 }
+
+func (mq *MessageQueue[T]) Capacity() int {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	return cap(mq.q)
+}
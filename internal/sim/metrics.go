@@ -0,0 +1,362 @@
+package sim
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/node"
+	"github.com/TheJ0lly/Overlay-Network/internal/topology"
+)
+
+// pendingJoin is a node that joined, whose vision and neighbourhood have not converged yet.
+type pendingJoin struct {
+	sn    *simNode
+	gen   int
+	start time.Time
+}
+
+type metrics struct {
+	starts, restarts, kills, leaves int
+	joins, failedJoins              int
+
+	pending      []pendingJoin
+	convergence  []time.Duration
+	notConverged int
+
+	deaths, falseDeaths int
+
+	messages, bytes  uint64
+	lost, sendErrors uint64
+	byType           map[string]uint64
+
+	// The stats of the nodes that stopped, since their node is replaced when they start again.
+	duplicates, rateLimitDrops, queueDrops, deadHops uint64
+
+	partitions      int
+	partitionEvents []PartitionEvent
+}
+
+func newMetrics() metrics {
+	return metrics{byType: map[string]uint64{}, partitions: 1}
+}
+
+func (m *metrics) sent(from *simNode, env message.MessageEnvelope, size int) {
+	m.messages++
+	m.bytes += uint64(size)
+	m.byType[env.Type.String()]++
+	from.sent++
+	from.sentBytes += uint64(size)
+}
+
+func (m *metrics) joined(sn *simNode) {
+	m.joins++
+	m.pending = append(m.pending, pendingJoin{sn: sn, gen: sn.gen, start: sn.joinStart})
+}
+
+func (m *metrics) addNodeStats(nd *node.Node) {
+	m.duplicates += nd.Stat.ReplayRejects + nd.Stat.DuplicatedMessages
+	m.rateLimitDrops += nd.Stat.RateLimitDrops
+	m.queueDrops += nd.Stat.QueueDrops
+	m.deadHops += nd.Stat.DeadHopAttempts
+}
+
+// neighbours returns the nodes that are up among the primary connections of the node.
+func (s *Simulator) neighbours(sn *simNode) []*simNode {
+	var ns []*simNode
+	for _, conn := range sn.nd.Conns {
+		if m := s.byID[conn.ID]; m != nil && m.state == stateUp && m != sn {
+			ns = append(ns, m)
+		}
+	}
+	return ns
+}
+
+// hops returns how many hops away from the node the nodes up to depth hops away are, through the links that really exist.
+func (s *Simulator) hops(from *simNode, depth int) map[*simNode]int {
+	dist := map[*simNode]int{from: 0}
+	layer := []*simNode{from}
+	for d := 1; d <= depth && len(layer) != 0; d++ {
+		var next []*simNode
+		for _, sn := range layer {
+			for _, m := range s.neighbours(sn) {
+				if _, ok := dist[m]; !ok {
+					dist[m] = d
+					next = append(next, m)
+				}
+			}
+		}
+		layer = next
+	}
+	return dist
+}
+
+func seesAlive(g *topology.Graph, id identity.NodeID) bool {
+	return slices.ContainsFunc(g.Nodes, func(nd topology.Node) bool { return nd.ID == id && nd.State == topology.StateAlive })
+}
+
+// converged tells if the node sees all the nodes within its depth vision alive, and if all of them that should see it do.
+func (s *Simulator) converged(sn *simNode) bool {
+	vision := sn.nd.Topology()
+	for m, d := range s.hops(sn, int(sn.nd.DepthVision)) {
+		if m == sn {
+			continue
+		}
+		if !seesAlive(vision, m.id.ID()) {
+			return false
+		}
+		if d <= int(m.nd.DepthVision) && !seesAlive(m.nd.Topology(), sn.id.ID()) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendsTo returns the nodes that are up among the ones the node sends its messages to: its primary connections it sees alive,
+// and in place of the ones it sees dead, their own connections, as far as the node sees them.
+func (s *Simulator) sendsTo(sn *simNode) []*simNode {
+	var ns []*simNode
+	var gather func(nd *node.Node, layer uint8)
+	gather = func(nd *node.Node, layer uint8) {
+		if layer == 0 {
+			return
+		}
+		for _, conn := range nd.Conns {
+			if !conn.Alive {
+				gather(conn, layer-1)
+			} else if m := s.byID[conn.ID]; m != nil && m.state == stateUp && m != sn {
+				ns = append(ns, m)
+			}
+		}
+	}
+	gather(sn.nd, sn.nd.DepthVision)
+	return ns
+}
+
+// countPartitions returns the number of partitions of the nodes that are up, and the size of the biggest one.
+// Two nodes are in the same partition when the messages can go from one to the other, which is why the links are the ones of sendsTo.
+// The links are followed both ways, since a node may not know yet about a node attached to it.
+func (s *Simulator) countPartitions() (int, int) {
+	adj := map[*simNode][]*simNode{}
+	for _, sn := range s.nodes {
+		if sn.state != stateUp {
+			continue
+		}
+		for _, m := range s.sendsTo(sn) {
+			adj[sn] = append(adj[sn], m)
+			adj[m] = append(adj[m], sn)
+		}
+	}
+
+	seen := map[*simNode]bool{}
+	partitions, biggest := 0, 0
+	for _, sn := range s.nodes {
+		if sn.state != stateUp || seen[sn] {
+			continue
+		}
+		partitions++
+		size := 0
+		queue := []*simNode{sn}
+		seen[sn] = true
+		for len(queue) != 0 {
+			cur := queue[0]
+			queue = queue[1:]
+			size++
+			for _, m := range adj[cur] {
+				if !seen[m] {
+					seen[m] = true
+					queue = append(queue, m)
+				}
+			}
+		}
+		biggest = max(biggest, size)
+	}
+	return partitions, biggest
+}
+
+// probe checks the joins that have not converged yet, and if the network split or merged.
+func (s *Simulator) probe() {
+	m := &s.metrics
+	m.pending = slices.DeleteFunc(m.pending, func(p pendingJoin) bool {
+		switch {
+		case p.sn.state != stateUp || p.sn.gen != p.gen:
+			// The node went down before its join converged, thus there is nothing to measure.
+			return true
+		case s.converged(p.sn):
+			m.convergence = append(m.convergence, s.now.Sub(p.start))
+			return true
+		case s.now.Sub(p.start) > s.cfg.ConvergenceTimeout:
+			m.notConverged++
+			return true
+		}
+		return false
+	})
+
+	if partitions, biggest := s.countPartitions(); partitions != m.partitions && partitions != 0 {
+		m.partitionEvents = append(m.partitionEvents, PartitionEvent{At: s.now.Sub(epoch), Partitions: partitions, Biggest: biggest})
+		m.partitions = partitions
+	}
+	s.after(s.cfg.ProbeInterval, s.probe)
+}
+
+// Distribution sums up durations.
+type Distribution struct {
+	Count int           `json:"Count"`
+	Mean  time.Duration `json:"Mean"`
+	P50   time.Duration `json:"P50"`
+	P95   time.Duration `json:"P95"`
+	Max   time.Duration `json:"Max"`
+}
+
+func distributionOf(ds []time.Duration) Distribution {
+	if len(ds) == 0 {
+		return Distribution{}
+	}
+	ds = slices.Clone(ds)
+	slices.Sort(ds)
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	return Distribution{
+		Count: len(ds),
+		Mean:  sum / time.Duration(len(ds)),
+		P50:   ds[len(ds)/2],
+		P95:   ds[len(ds)*95/100],
+		Max:   ds[len(ds)-1],
+	}
+}
+
+// PartitionEvent is when the number of partitions of the network changed, At the time since the start of the simulation.
+type PartitionEvent struct {
+	At         time.Duration `json:"At"`
+	Partitions int           `json:"Partitions"`
+	Biggest    int           `json:"Biggest"`
+}
+
+// NodeLoad is how much a node sent, per second it was up.
+type NodeLoad struct {
+	Node              int     `json:"Node"`
+	MessagesPerSecond float64 `json:"MessagesPerSecond"`
+	BytesPerSecond    float64 `json:"BytesPerSecond"`
+}
+
+// Report is what happened during a simulation.
+type Report struct {
+	SimulatedTime time.Duration `json:"SimulatedTime"`
+	WallTime      time.Duration `json:"WallTime"`
+	NodesUp       int           `json:"NodesUp"`
+
+	Starts      int `json:"Starts"`
+	Restarts    int `json:"Restarts"`
+	Kills       int `json:"Kills"`
+	Leaves      int `json:"Leaves"`
+	Joins       int `json:"Joins"`
+	FailedJoins int `json:"FailedJoins"`
+
+	// The convergence of a join is the time from its query until the node sees all the nodes within its depth vision alive,
+	// and all of them that have it within their depth vision see it alive.
+	Convergence  Distribution `json:"Convergence"`
+	NotConverged int          `json:"NotConverged"`
+
+	// A death is false when the dead node has been up for the two death timers before it was announced.
+	Deaths         int     `json:"Deaths"`
+	FalseDeaths    int     `json:"FalseDeaths"`
+	FalseDeathRate float64 `json:"FalseDeathRate"`
+
+	Messages       uint64            `json:"Messages"`
+	Bytes          uint64            `json:"Bytes"`
+	MessagesByType map[string]uint64 `json:"MessagesByType"`
+	MessagesLost   uint64            `json:"MessagesLost"`
+	SendErrors     uint64            `json:"SendErrors"`
+	// The overhead per node is per second the node was up. Busiest holds the nodes sending the most.
+	MessagesPerNodeSecond float64    `json:"MessagesPerNodeSecond"`
+	BytesPerNodeSecond    float64    `json:"BytesPerNodeSecond"`
+	Busiest               []NodeLoad `json:"Busiest"`
+
+	// Summed over all the nodes.
+	DuplicatesDropped uint64 `json:"DuplicatesDropped"`
+	RateLimitDrops    uint64 `json:"RateLimitDrops"`
+	QueueDrops        uint64 `json:"QueueDrops"`
+	DeadHopAttempts   uint64 `json:"DeadHopAttempts"`
+
+	PartitionEvents []PartitionEvent `json:"PartitionEvents"`
+	// Topology is the shape of the network at the end of the simulation, with the links the messages go through.
+	Topology topology.Report `json:"Topology"`
+	// Inconsistencies are the ones between the visions of the nodes at the end of the simulation, the joining nodes included.
+	Inconsistencies []topology.Inconsistency `json:"Inconsistencies"`
+}
+
+func (s *Simulator) report(wallTime time.Duration) *Report {
+	m := &s.metrics
+	r := &Report{
+		SimulatedTime:     s.cfg.Duration,
+		WallTime:          wallTime,
+		Starts:            m.starts,
+		Restarts:          m.restarts,
+		Kills:             m.kills,
+		Leaves:            m.leaves,
+		Joins:             m.joins,
+		FailedJoins:       m.failedJoins,
+		Convergence:       distributionOf(m.convergence),
+		NotConverged:      m.notConverged,
+		Deaths:            m.deaths,
+		FalseDeaths:       m.falseDeaths,
+		Messages:          m.messages,
+		Bytes:             m.bytes,
+		MessagesByType:    m.byType,
+		MessagesLost:      m.lost,
+		SendErrors:        m.sendErrors,
+		DuplicatesDropped: m.duplicates,
+		RateLimitDrops:    m.rateLimitDrops,
+		QueueDrops:        m.queueDrops,
+		DeadHopAttempts:   m.deadHops,
+		PartitionEvents:   m.partitionEvents,
+	}
+	if m.deaths != 0 {
+		r.FalseDeathRate = float64(m.falseDeaths) / float64(m.deaths)
+	}
+
+	g := &topology.Graph{Nodes: []topology.Node{}, Edges: []topology.Edge{}}
+	var visions []topology.Vision
+	var upTime time.Duration
+	for _, sn := range s.nodes {
+		if sn.state != stateDown {
+			visions = append(visions, sn.nd.Vision())
+		}
+		nodeUpTime := sn.upTime
+		if sn.state == stateUp {
+			r.NodesUp++
+			nodeUpTime += s.now.Sub(sn.upSince)
+			r.DuplicatesDropped += sn.nd.Stat.ReplayRejects + sn.nd.Stat.DuplicatedMessages
+			r.RateLimitDrops += sn.nd.Stat.RateLimitDrops
+			r.QueueDrops += sn.nd.Stat.QueueDrops
+			r.DeadHopAttempts += sn.nd.Stat.DeadHopAttempts
+
+			g.Nodes = append(g.Nodes, topology.Node{ID: sn.id.ID(), Address: sn.addr.NetString(), State: topology.StateAlive})
+			for _, m := range s.sendsTo(sn) {
+				if sn.index < m.index || !slices.Contains(s.sendsTo(m), sn) {
+					g.Edges = append(g.Edges, topology.Edge{From: sn.id.ID(), To: m.id.ID(), State: topology.StateAlive})
+				}
+			}
+		}
+		upTime += nodeUpTime
+
+		if nodeUpTime > 0 {
+			secs := nodeUpTime.Seconds()
+			r.Busiest = append(r.Busiest, NodeLoad{Node: sn.index, MessagesPerSecond: float64(sn.sent) / secs, BytesPerSecond: float64(sn.sentBytes) / secs})
+		}
+	}
+	if upTime > 0 {
+		r.MessagesPerNodeSecond = float64(m.messages) / upTime.Seconds()
+		r.BytesPerNodeSecond = float64(m.bytes) / upTime.Seconds()
+	}
+	slices.SortFunc(r.Busiest, func(a, b NodeLoad) int { return cmp.Compare(b.MessagesPerSecond, a.MessagesPerSecond) })
+	r.Busiest = r.Busiest[:min(len(r.Busiest), 5)]
+
+	r.Topology = topology.Analyze(g)
+	r.Inconsistencies = topology.Check(visions)
+	return r
+}
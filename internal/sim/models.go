@@ -0,0 +1,68 @@
+package sim
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Latency is how long the messages take to arrive. Each link gets a delay between Min and Max, picked once,
+// and each message sent over it takes up to Jitter more. The messages of a link may thus arrive out of order, as they do over separate connections.
+type Latency struct {
+	Min    time.Duration `json:"Min"`
+	Max    time.Duration `json:"Max"`
+	Jitter time.Duration `json:"Jitter"`
+}
+
+func (l Latency) link(rng *rand.Rand) time.Duration {
+	return l.Min + uniform(rng, l.Max-l.Min)
+}
+
+func (l Latency) message(rng *rand.Rand, link time.Duration) time.Duration {
+	return link + uniform(rng, l.Jitter)
+}
+
+// Loss is how the messages are lost, with a Gilbert-Elliott model: each link is either good or bad, and it loses the messages
+// with Rate, or BadRate while it is bad. After each message, a good link turns bad with EnterBad, and a bad one turns good again with LeaveBad.
+// Without EnterBad, the messages are lost independently of each other, with Rate.
+type Loss struct {
+	Rate     float64 `json:"Rate"`
+	BadRate  float64 `json:"BadRate,omitempty"`
+	EnterBad float64 `json:"EnterBad,omitempty"`
+	LeaveBad float64 `json:"LeaveBad,omitempty"`
+}
+
+// lost tells if the message sent over the link is lost, and moves the link to its next state.
+func (l Loss) lost(rng *rand.Rand, bad *bool) bool {
+	rate := l.Rate
+	if *bad {
+		rate = l.BadRate
+	}
+	lost := rate > 0 && rng.Float64() < rate
+
+	if *bad && rng.Float64() < l.LeaveBad {
+		*bad = false
+	} else if !*bad && l.EnterBad > 0 && rng.Float64() < l.EnterBad {
+		*bad = true
+	}
+	return lost
+}
+
+// Churn is how the nodes come and go once they joined. The time a node stays up and the time it stays down are exponentially distributed,
+// with MeanUptime and MeanDowntime. LeaveRatio of the nodes going down leave the network, the others are killed.
+// A node coming back keeps its ID and joins the network again. Without MeanUptime, the nodes never go down.
+type Churn struct {
+	MeanUptime   time.Duration `json:"MeanUptime"`
+	MeanDowntime time.Duration `json:"MeanDowntime"`
+	LeaveRatio   float64       `json:"LeaveRatio"`
+}
+
+func uniform(rng *rand.Rand, d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int64N(int64(d) + 1))
+}
+
+func exponential(rng *rand.Rand, mean time.Duration) time.Duration {
+	return time.Duration(rng.ExpFloat64() * float64(mean))
+}
@@ -0,0 +1,245 @@
+package sim
+
+import (
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+	"github.com/TheJ0lly/Overlay-Network/internal/node"
+)
+
+var logger = logging.Component("sim")
+
+// How long a node that could not join waits before trying again, through another node.
+const joinRetryDelay = 5 * time.Second
+
+// The states of a simulated node. A joining node first collects the answers to its query, then asks the candidates one at a time.
+const (
+	stateDown = iota
+	stateQuerying
+	stateConfirming
+	stateUp
+)
+
+// simNode is a node of the simulation, which keeps its ID and address across its restarts.
+type simNode struct {
+	index int
+	id    *identity.Identity
+	addr  network.IpPortPair
+	nd    *node.Node
+	state int
+	// gen changes each time the node starts, stops or tries to join again, thus the events scheduled for it before are dropped.
+	gen int
+
+	joiner     *node.Joiner
+	joinStart  time.Time
+	candidates []node.JoinCandidate
+	asking     int
+	confirm    []byte
+
+	upSince   time.Time
+	upTime    time.Duration
+	downAt    time.Time
+	sent      uint64
+	sentBytes uint64
+}
+
+// inGen returns do, which is only done if the node is still in the same generation.
+func (s *Simulator) inGen(sn *simNode, do func()) func() {
+	gen := sn.gen
+	return func() {
+		if sn.gen == gen {
+			do()
+		}
+	}
+}
+
+// timeout is the timeout in seconds of the sends the simulator makes for the node, which is the one the node uses itself.
+func (s *Simulator) timeout() time.Duration {
+	return time.Duration(s.cfg.Death)
+}
+
+// start creates the node, and makes it join the network through a node that is up, if there is any.
+func (s *Simulator) start(sn *simNode) {
+	nd, err := node.Create(sn.addr.Ip.String(), sn.addr.Port, s.cfg.ConnCap, s.cfg.QueueCap)
+	if err == nil {
+		err = nd.SetIdentity(sn.id)
+	}
+	if err != nil {
+		logger.Error("could not create node %d - %s", sn.index, err)
+		return
+	}
+	nd.LifeLineTimer = s.cfg.LifeLine
+	nd.DeathTimer = s.cfg.Death
+	nd.DepthVision = s.cfg.Depth
+	nd.AggregateLifeLines = s.cfg.AggregateLifeLines
+	nd.StatsSinks = nil
+	nd.Net.Transport = simTransport{s}
+	nd.SetSignatureVerifier(s.verify)
+	if s.cfg.Configure != nil {
+		s.cfg.Configure(nd)
+	}
+	sn.nd = nd
+	s.metrics.starts++
+
+	bootstrap := s.randomUpNode(sn)
+	if bootstrap == nil {
+		s.up(sn)
+		return
+	}
+	s.join(sn, bootstrap)
+}
+
+func (s *Simulator) randomUpNode(except *simNode) *simNode {
+	var up []*simNode
+	for _, sn := range s.nodes {
+		if sn.state == stateUp && sn != except {
+			up = append(up, sn)
+		}
+	}
+	if len(up) == 0 {
+		return nil
+	}
+	return up[s.rng.IntN(len(up))]
+}
+
+// join goes through the steps of node.Joiner, with the events of the simulation instead of the listeners and timers of Join.
+func (s *Simulator) join(sn *simNode, bootstrap *simNode) {
+	sn.gen++
+	sn.state = stateQuerying
+	sn.joinStart = s.clockNow()
+	sn.joiner = sn.nd.NewJoiner(nil)
+	sn.candidates = nil
+	sn.asking = -1
+
+	query, err := sn.joiner.Query()
+	if err == nil {
+		err = sn.nd.Net.SendToDest(query, bootstrap.addr, "", s.timeout())
+	}
+	if err != nil {
+		logger.Error("node %d could not send join query - %s", sn.index, err)
+		s.joinFailed(sn)
+		return
+	}
+	s.after(node.JoinQueryWindow, s.inGen(sn, func() { s.confirmJoin(sn) }))
+}
+
+func (s *Simulator) confirmJoin(sn *simNode) {
+	sn.candidates = sn.joiner.Candidates()
+	confirm, err := sn.joiner.Confirm()
+	if len(sn.candidates) == 0 || err != nil {
+		s.joinFailed(sn)
+		return
+	}
+	sn.state = stateConfirming
+	sn.confirm = confirm
+	s.askNextCandidate(sn)
+}
+
+func (s *Simulator) askNextCandidate(sn *simNode) {
+	for sn.asking++; sn.asking < len(sn.candidates); sn.asking++ {
+		c := sn.candidates[sn.asking]
+		if err := sn.nd.Net.SendToDest(sn.confirm, c.Node.Locator, c.Node.ID, s.timeout()); err != nil {
+			continue
+		}
+		asking := sn.asking
+		s.after(c.ConfirmWindow(), s.inGen(sn, func() {
+			if sn.asking == asking {
+				s.askNextCandidate(sn)
+			}
+		}))
+		return
+	}
+	s.joinFailed(sn)
+}
+
+// receiveJoinAnswer takes in what the joining node receives: the answers to its query, and the one of the candidate it asks.
+func (s *Simulator) receiveJoinAnswer(sn *simNode, env *message.MessageEnvelope, b []byte) {
+	switch {
+	case sn.state == stateQuerying && env.Type == message.NetNewNodeJoinQuery:
+		if err := sn.joiner.AddCandidate(b); err != nil {
+			logger.Debug("node %d - %s", sn.index, err)
+		}
+	case sn.state == stateConfirming && env.Type == message.NetNewNodeJoinConfirm && env.OriginalSender.Is(sn.candidates[sn.asking].Node.ID):
+		c := sn.candidates[sn.asking]
+		if ok, err := sn.joiner.Attach(c, b); err != nil || !ok {
+			s.askNextCandidate(sn)
+			return
+		}
+
+		join, err := sn.joiner.JoinMessage(c)
+		if err == nil {
+			err = sn.nd.Net.SendToDest(join, c.Node.Locator, c.Node.ID, s.timeout())
+		}
+		if err != nil {
+			logger.Error("node %d could not send join message - %s", sn.index, err)
+			s.joinFailed(sn)
+			return
+		}
+		sn.joiner.End()
+		s.up(sn)
+		s.metrics.joined(sn)
+	}
+}
+
+// joinFailed makes the node try again later, as a new node, since it may have attached itself to a candidate already.
+func (s *Simulator) joinFailed(sn *simNode) {
+	sn.joiner.End()
+	sn.gen++
+	sn.state = stateDown
+	s.metrics.failedJoins++
+	s.after(joinRetryDelay, s.inGen(sn, func() { s.start(sn) }))
+}
+
+// up starts the periodical tasks of the node, and its churn.
+func (s *Simulator) up(sn *simNode) {
+	sn.gen++
+	sn.state = stateUp
+	sn.upSince = s.clockNow()
+
+	s.every(sn, time.Duration(s.cfg.LifeLine)*time.Second, node.TaskLifeLine)
+	s.every(sn, time.Duration(s.cfg.Death)*time.Second, node.TaskDeathCheck)
+	s.every(sn, time.Duration(sn.nd.StatsInterval)*time.Second, node.TaskStats)
+
+	if s.cfg.Churn.MeanUptime == 0 {
+		return
+	}
+	s.after(exponential(s.rng, s.cfg.Churn.MeanUptime), s.inGen(sn, func() {
+		s.stop(sn, s.rng.Float64() < s.cfg.Churn.LeaveRatio)
+		s.after(exponential(s.rng, s.cfg.Churn.MeanDowntime), s.inGen(sn, func() {
+			s.metrics.restarts++
+			s.start(sn)
+		}))
+	}))
+}
+
+// every runs the task of the node once per period, from a random point of the first period, thus the nodes do not all run it at once.
+func (s *Simulator) every(sn *simNode, period time.Duration, t node.Task) {
+	var run func()
+	run = s.inGen(sn, func() {
+		sn.nd.RunTask(t)
+		sn.nd.ProcessQueue()
+		s.after(period, run)
+	})
+	s.after(uniform(s.rng, period), run)
+}
+
+// stop kills the node, or makes it leave the network.
+func (s *Simulator) stop(sn *simNode, leave bool) {
+	if leave {
+		s.metrics.leaves++
+		if err := sn.nd.Leave(); err != nil {
+			logger.Error("node %d could not leave - %s", sn.index, err)
+		}
+	} else {
+		s.metrics.kills++
+		sn.nd.Stop()
+	}
+	s.metrics.addNodeStats(sn.nd)
+	sn.upTime += s.clockNow().Sub(sn.upSince)
+	sn.downAt = s.clockNow()
+	sn.gen++
+	sn.state = stateDown
+}
@@ -0,0 +1,233 @@
+// Package sim runs the node protocol on a simulated network and clock, thus thousands of nodes can be run on one machine in seconds.
+// The nodes are the real ones: they sign, check, process and forward the messages with the code of the node package,
+// but the messages go through the simulated network, and the time only passes from one event to the next.
+package sim
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+	"github.com/TheJ0lly/Overlay-Network/internal/node"
+)
+
+// Config is what is simulated. Node i starts i*JoinInterval after the start of the simulation, and joins through a node that is up,
+// and the simulation ends Duration after its start.
+type Config struct {
+	Nodes        int           `json:"Nodes"`
+	JoinInterval time.Duration `json:"JoinInterval"`
+	Duration     time.Duration `json:"Duration"`
+	Seed         uint64        `json:"Seed"`
+
+	ConnCap            uint8  `json:"ConnCap"`
+	QueueCap           uint16 `json:"QueueCap"`
+	LifeLine           uint8  `json:"LifeLine"`
+	Death              uint8  `json:"Death"`
+	Depth              uint8  `json:"Depth"`
+	AggregateLifeLines bool   `json:"AggregateLifeLines"`
+	// Configure is called with each node once it is created, for the settings Config does not have.
+	Configure func(nd *node.Node) `json:"-"`
+
+	Latency Latency `json:"Latency"`
+	Loss    Loss    `json:"Loss"`
+	Churn   Churn   `json:"Churn"`
+
+	// Every ProbeInterval, the simulator checks which joins have converged, and if the network is partitioned.
+	// A join that has not converged ConvergenceTimeout after it started never does.
+	ProbeInterval      time.Duration `json:"ProbeInterval"`
+	ConvergenceTimeout time.Duration `json:"ConvergenceTimeout"`
+}
+
+// DefaultConfig is 200 nodes with the default settings of the overlay, joining 100 ms apart on a network with 5 to 50 ms between the nodes.
+func DefaultConfig() Config {
+	return Config{
+		Nodes:              200,
+		JoinInterval:       100 * time.Millisecond,
+		Duration:           2 * time.Minute,
+		Seed:               1,
+		ConnCap:            3,
+		QueueCap:           1000,
+		LifeLine:           2,
+		Death:              4,
+		Depth:              3,
+		Latency:            Latency{Min: 5 * time.Millisecond, Max: 50 * time.Millisecond, Jitter: 5 * time.Millisecond},
+		ProbeInterval:      250 * time.Millisecond,
+		ConvergenceTimeout: 30 * time.Second,
+	}
+}
+
+func (c *Config) validate() error {
+	if c.Nodes <= 0 || c.Nodes > 1<<24 {
+		return fmt.Errorf("nodes is %d - must be between 1 and %d", c.Nodes, 1<<24)
+	}
+	if c.Duration <= 0 || c.JoinInterval < 0 || c.ProbeInterval <= 0 || c.ConvergenceTimeout <= 0 {
+		return fmt.Errorf("duration and probe interval and convergence timeout must be greater than 0, and join interval must not be negative")
+	}
+	if c.ConnCap == 0 || c.QueueCap == 0 || c.LifeLine == 0 || c.Death == 0 {
+		return fmt.Errorf("conns capacity, queue capacity, lifeline and death must be greater than 0")
+	}
+	if c.Depth < 2 {
+		return fmt.Errorf("depth vision must be at least 2")
+	}
+	if c.Latency.Min < 0 || c.Latency.Max < c.Latency.Min || c.Latency.Jitter < 0 {
+		return fmt.Errorf("latency must be between a minimum that is not negative and a maximum, with a jitter that is not negative")
+	}
+	for _, p := range []float64{c.Loss.Rate, c.Loss.BadRate, c.Loss.EnterBad, c.Loss.LeaveBad, c.Churn.LeaveRatio} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("loss rates and leave ratio must be between 0 and 1")
+		}
+	}
+	if c.Churn.MeanUptime < 0 || c.Churn.MeanDowntime < 0 {
+		return fmt.Errorf("churn times must not be negative")
+	}
+	return nil
+}
+
+// event is something that happens at a point in simulated time. The events happening at the same time happen in the order they were scheduled.
+type event struct {
+	at  time.Time
+	seq uint64
+	do  func()
+}
+
+type eventHeap []*event
+
+func (h eventHeap) Len() int { return len(h) }
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h eventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *eventHeap) Push(x any)   { *h = append(*h, x.(*event)) }
+func (h *eventHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// epoch is when the simulated time starts.
+var epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Simulator runs a simulation. Since the nodes use the clock and the transport of their packages, only one simulator may run at a time.
+type Simulator struct {
+	cfg    Config
+	rng    *rand.Rand
+	events eventHeap
+	seq    uint64
+	now    time.Time
+	// offset is how long the node handling the current event has slept, thus its clock is ahead of the others.
+	offset time.Duration
+
+	nodes  []*simNode
+	byAddr map[string]*simNode
+	byID   map[identity.NodeID]*simNode
+	links  map[[2]int]*link
+
+	// The last envelope sent, since a node sends the same bytes to all the nodes it forwards to.
+	lastSent    []byte
+	lastEnv     message.MessageEnvelope
+	deathNonces map[string]bool
+
+	metrics metrics
+}
+
+// New creates a simulator, with the nodes that are going to be started.
+func New(cfg Config) (*Simulator, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Simulator{
+		cfg:         cfg,
+		rng:         rand.New(rand.NewPCG(cfg.Seed, cfg.Seed)),
+		now:         epoch,
+		byAddr:      map[string]*simNode{},
+		byID:        map[identity.NodeID]*simNode{},
+		links:       map[[2]int]*link{},
+		deathNonces: map[string]bool{},
+		metrics:     newMetrics(),
+	}
+	for i := range cfg.Nodes {
+		id, err := identity.Generate()
+		if err != nil {
+			return nil, err
+		}
+		// Each node has its own IP, thus the simulation is not limited by the number of ports.
+		sn := &simNode{index: i, id: id, addr: network.IpPortPair{Ip: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4(), Port: 9000}}
+		s.nodes = append(s.nodes, sn)
+		s.byAddr[sn.addr.NetString()] = sn
+		s.byID[id.ID()] = sn
+	}
+	return s, nil
+}
+
+// simClock is the clock of the nodes during the simulation. What the nodes do in the background is done right away,
+// since the messages they send are delivered later anyway.
+type simClock struct {
+	s *Simulator
+}
+
+func (c simClock) Now() time.Time { return c.s.clockNow() }
+
+// Sleep moves the clock of the node handling the current event forward, thus what it does afterwards happens later.
+func (c simClock) Sleep(d time.Duration) { c.s.offset += d }
+func (c simClock) Go(f func())           { f() }
+
+// clockNow is the time of the node handling the current event.
+func (s *Simulator) clockNow() time.Time {
+	return s.now.Add(s.offset)
+}
+
+func (s *Simulator) at(t time.Time, do func()) {
+	s.seq++
+	heap.Push(&s.events, &event{at: t, seq: s.seq, do: do})
+}
+
+func (s *Simulator) after(d time.Duration, do func()) {
+	s.at(s.clockNow().Add(d), do)
+}
+
+// verify only checks that the envelope is signed. All the nodes of the simulation are honest, and checking the signatures
+// would be most of what the simulation does otherwise.
+func (s *Simulator) verify(env *message.MessageEnvelope) error {
+	if len(env.Signature) == 0 {
+		return message.ErrMissingSignature
+	}
+	return nil
+}
+
+// Run runs the simulation, and reports what happened.
+func (s *Simulator) Run() *Report {
+	clock := node.CurrentClock()
+	node.SetClock(simClock{s})
+	defer node.SetClock(clock)
+
+	wallStart := time.Now()
+	for i, sn := range s.nodes {
+		s.at(epoch.Add(time.Duration(i)*s.cfg.JoinInterval), func() { s.start(sn) })
+	}
+	s.at(epoch.Add(s.cfg.ProbeInterval), s.probe)
+
+	end := epoch.Add(s.cfg.Duration)
+	for len(s.events) != 0 {
+		e := heap.Pop(&s.events).(*event)
+		if e.at.After(end) {
+			break
+		}
+		s.now = e.at
+		s.offset = 0
+		e.do()
+	}
+	s.now = end
+	s.offset = 0
+
+	return s.report(time.Since(wallStart))
+}
@@ -0,0 +1,43 @@
+package sim
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/logging"
+)
+
+func TestJoinsConvergeWithoutChurn(t *testing.T) {
+	logging.Setup(logging.Config{Writer: io.Discard, Level: slog.LevelError})
+
+	cfg := DefaultConfig()
+	cfg.Nodes = 15
+	cfg.JoinInterval = time.Second
+	cfg.Duration = 45 * time.Second
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := s.Run()
+	if r.NodesUp != cfg.Nodes || r.Joins != cfg.Nodes-1 {
+		t.Fatalf("expected all %d nodes up after %d joins, got %d up after %d joins", cfg.Nodes, cfg.Nodes-1, r.NodesUp, r.Joins)
+	}
+	if r.Convergence.Count+r.NotConverged != r.Joins || r.Convergence.Count == 0 {
+		t.Errorf("expected the joins to be measured, got %d converged and %d not", r.Convergence.Count, r.NotConverged)
+	}
+	if !r.Topology.Connected {
+		t.Errorf("expected a connected network, got %d partitions", len(r.Topology.Partitions))
+	}
+	if r.Kills != 0 || r.FalseDeaths != 0 {
+		t.Errorf("expected no kills and no false deaths, got %d kills and %d false deaths", r.Kills, r.FalseDeaths)
+	}
+	if len(r.Inconsistencies) != 0 {
+		t.Errorf("expected the visions to agree, got %v", r.Inconsistencies)
+	}
+	if r.MessagesByType["NetLifeLine"] == 0 {
+		t.Errorf("expected the nodes to send lifelines, got %v", r.MessagesByType)
+	}
+}
@@ -0,0 +1,107 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+	"github.com/TheJ0lly/Overlay-Network/internal/message"
+	"github.com/TheJ0lly/Overlay-Network/internal/network"
+)
+
+// link is the state of the link between two nodes, in one direction.
+type link struct {
+	latency time.Duration
+	bad     bool
+}
+
+// simTransport delivers the messages of the nodes with the events of the simulator, after the latency of the link, unless the loss model drops them.
+// Like a connection to a process that is not running, sending to a node that is down fails right away.
+type simTransport struct {
+	s *Simulator
+}
+
+func (t simTransport) Send(msg []byte, dest network.IpPortPair, _ identity.NodeID, timeoutInSecs time.Duration) error {
+	s := t.s
+	to := s.byAddr[dest.NetString()]
+	if to == nil || to.state == stateDown {
+		s.metrics.sendErrors++
+		return fmt.Errorf("cannot send message to node %s - connection refused", dest.NetString())
+	}
+
+	env, err := s.decode(msg)
+	if err != nil {
+		return err
+	}
+	from := s.byID[env.Sender.ID]
+	if from == nil {
+		return fmt.Errorf("cannot send message from unknown node %s", env.Sender.ID.Short())
+	}
+	s.metrics.sent(from, env, len(msg))
+	s.checkDeathAnnouncement(env)
+
+	key := [2]int{from.index, to.index}
+	l := s.links[key]
+	if l == nil {
+		l = &link{latency: s.cfg.Latency.link(s.rng)}
+		s.links[key] = l
+	}
+	if s.cfg.Loss.lost(s.rng, &l.bad) {
+		s.metrics.lost++
+		return nil
+	}
+
+	s.after(s.cfg.Latency.message(s.rng, l.latency), s.inGen(to, func() { s.deliver(to, env, msg) }))
+	return nil
+}
+
+// decode decodes the envelope, once for all the nodes the same bytes are sent to.
+func (s *Simulator) decode(msg []byte) (message.MessageEnvelope, error) {
+	if len(msg) != 0 && len(msg) == len(s.lastSent) && &msg[0] == &s.lastSent[0] {
+		return s.lastEnv, nil
+	}
+
+	env := message.MessageEnvelope{}
+	if err := message.DeserializeMessageEnvelope(&env, msg); err != nil {
+		return env, fmt.Errorf("could not decode sent envelope - %s", err)
+	}
+	s.lastSent, s.lastEnv = msg, env
+	return env, nil
+}
+
+func (s *Simulator) deliver(to *simNode, env message.MessageEnvelope, b []byte) {
+	switch to.state {
+	case stateQuerying, stateConfirming:
+		s.receiveJoinAnswer(to, &env, b)
+	case stateUp:
+		if to.nd.Receive(env) {
+			to.nd.ProcessQueue()
+		}
+	}
+}
+
+// checkDeathAnnouncement counts the deaths announced by the nodes that noticed them, and the ones that are false:
+// the dead node has been up for two death timers before the announcement, thus it could not have been silent for one.
+func (s *Simulator) checkDeathAnnouncement(env message.MessageEnvelope) {
+	if env.Type != message.NetDeathAnnouncement || !env.Sender.Is(env.OriginalSender.ID) || s.deathNonces[env.Nonce] {
+		return
+	}
+	s.deathNonces[env.Nonce] = true
+
+	msg := message.NetDeathAnnouncementMessage{}
+	if err := json.Unmarshal(env.Data, &msg); err != nil {
+		return
+	}
+	for _, dead := range msg.DeadNodes {
+		// The node leaving announces its own death.
+		if dead.Is(env.OriginalSender.ID) {
+			continue
+		}
+		s.metrics.deaths++
+		sn := s.byID[dead.ID]
+		if sn != nil && sn.state != stateDown && s.clockNow().Sub(sn.downAt) > 2*time.Duration(s.cfg.Death)*time.Second {
+			s.metrics.falseDeaths++
+		}
+	}
+}
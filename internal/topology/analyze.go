@@ -0,0 +1,124 @@
+package topology
+
+import (
+	"slices"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+// Report describes the shape of a graph. Dead nodes and dead links are left out of it, since nothing goes through them.
+type Report struct {
+	Nodes     int `json:"Nodes"`
+	Links     int `json:"Links"`
+	DeadNodes int `json:"DeadNodes"`
+
+	// The graph is connected when it has a single partition. Partitions are sorted from the biggest to the smallest.
+	Connected  bool                `json:"Connected"`
+	Partitions [][]identity.NodeID `json:"Partitions"`
+
+	// Diameter is the longest of the shortest paths, in hops, of the biggest partition.
+	Diameter int `json:"Diameter"`
+
+	// DegreeDistribution holds the number of nodes having each degree.
+	DegreeDistribution map[int]int `json:"DegreeDistribution"`
+	MinDegree          int         `json:"MinDegree"`
+	MaxDegree          int         `json:"MaxDegree"`
+	AverageDegree      float64     `json:"AverageDegree"`
+}
+
+// adjacency returns the neighbours of each node that is not dead, through the links that are not dead.
+func (g *Graph) adjacency() map[identity.NodeID][]identity.NodeID {
+	adj := map[identity.NodeID][]identity.NodeID{}
+	for _, nd := range g.Nodes {
+		if nd.State != StateDead {
+			adj[nd.ID] = nil
+		}
+	}
+
+	for _, e := range g.Edges {
+		if e.State == StateDead {
+			continue
+		}
+		_, okFrom := adj[e.From]
+		_, okTo := adj[e.To]
+		if !okFrom || !okTo || e.From == e.To {
+			continue
+		}
+		adj[e.From] = append(adj[e.From], e.To)
+		adj[e.To] = append(adj[e.To], e.From)
+	}
+	return adj
+}
+
+// distances returns the number of hops from the node to each node it can reach.
+func distances(adj map[identity.NodeID][]identity.NodeID, from identity.NodeID) map[identity.NodeID]int {
+	dist := map[identity.NodeID]int{from: 0}
+	queue := []identity.NodeID{from}
+	for len(queue) != 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, next := range adj[cur] {
+			if _, ok := dist[next]; !ok {
+				dist[next] = dist[cur] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+	return dist
+}
+
+// Analyze reports the connectivity, the diameter and the degrees of the graph.
+func Analyze(g *Graph) Report {
+	adj := g.adjacency()
+	r := Report{
+		Nodes:              len(adj),
+		DeadNodes:          len(g.Nodes) - len(adj),
+		Partitions:         [][]identity.NodeID{},
+		DegreeDistribution: map[int]int{},
+	}
+
+	ids := make([]identity.NodeID, 0, len(adj))
+	for id := range adj {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	for i, id := range ids {
+		degree := len(adj[id])
+		r.Links += degree
+		r.DegreeDistribution[degree]++
+		if i == 0 || degree < r.MinDegree {
+			r.MinDegree = degree
+		}
+		r.MaxDegree = max(r.MaxDegree, degree)
+	}
+	r.Links /= 2
+	if r.Nodes != 0 {
+		r.AverageDegree = float64(2*r.Links) / float64(r.Nodes)
+	}
+
+	seen := map[identity.NodeID]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		var part []identity.NodeID
+		for reached := range distances(adj, id) {
+			seen[reached] = true
+			part = append(part, reached)
+		}
+		slices.Sort(part)
+		r.Partitions = append(r.Partitions, part)
+	}
+	slices.SortStableFunc(r.Partitions, func(a, b []identity.NodeID) int { return len(b) - len(a) })
+	r.Connected = len(r.Partitions) == 1
+
+	if len(r.Partitions) != 0 {
+		for _, id := range r.Partitions[0] {
+			for _, d := range distances(adj, id) {
+				r.Diameter = max(r.Diameter, d)
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,150 @@
+package topology
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+// The kinds of inconsistencies found by Check.
+const (
+	// A node has a primary connection with a node that does not have it.
+	InconsistentAsymmetry = "asymmetry"
+	// A node has more links than its cap, first-hand or in the view of one of its neighbours.
+	InconsistentCap = "cap"
+	// A node that is gone is still in the vision of a node: seen alive, or remembered while nobody is connected to it anymore.
+	InconsistentGhost = "ghost"
+	// A node sees the links of one of its primary connections differently than the connection itself.
+	InconsistentNeighbourhood = "neighbourhood"
+)
+
+// Vision is the vision graph of a node, along with the settings of the node it is checked against.
+type Vision struct {
+	Graph       *Graph `json:"Graph"`
+	ConnCap     int    `json:"ConnCap"`
+	DepthVision uint8  `json:"DepthVision"`
+}
+
+func (v *Vision) observer() identity.NodeID {
+	return v.Graph.Observers[0]
+}
+
+// state returns the state the observer sees the node in, which is empty when it does not see it.
+func (v *Vision) state(id identity.NodeID) string {
+	if i := v.Graph.findNode(id); i != -1 {
+		return v.Graph.Nodes[i].State
+	}
+	return ""
+}
+
+func linkStrings(g *Graph, ids []identity.NodeID) string {
+	if len(ids) == 0 {
+		return "none"
+	}
+	ss := make([]string, 0, len(ids))
+	for _, id := range ids {
+		s := id.Short()
+		if i := g.findEdge(g.Observers[0], id); i != -1 && g.Edges[i].State != StateAlive {
+			s += "(" + g.Edges[i].State + ")"
+		}
+		ss = append(ss, s)
+	}
+	return strings.Join(ss, ", ")
+}
+
+// Check looks for the inconsistencies between the visions of the nodes, once they should have converged.
+// The visions must be the ones of all the nodes running, since the nodes without a vision are taken as gone.
+// The dead primary connections are kept until they are replaced, thus a gone node seen dead by its neighbours is fine.
+func Check(visions []Vision) []Inconsistency {
+	byID := map[identity.NodeID]*Vision{}
+	primaries := map[identity.NodeID][]identity.NodeID{}
+	for i := range visions {
+		v := &visions[i]
+		byID[v.observer()] = v
+		primaries[v.observer()] = v.Graph.Neighbours(v.observer())
+	}
+
+	var incs []Inconsistency
+	for _, id := range slices.Sorted(maps.Keys(byID)) {
+		v := byID[id]
+
+		if v.ConnCap != 0 && len(primaries[id]) > v.ConnCap {
+			incs = append(incs, Inconsistency{
+				Kind:   InconsistentCap,
+				Nodes:  []identity.NodeID{id},
+				Detail: fmt.Sprintf("%s has %d primary connections, its cap is %d", id.Short(), len(primaries[id]), v.ConnCap),
+			})
+		}
+
+		for _, conn := range primaries[id] {
+			cv, ok := byID[conn]
+			if !ok {
+				continue
+			}
+
+			if !slices.Contains(primaries[conn], id) {
+				incs = append(incs, Inconsistency{
+					Kind:   InconsistentAsymmetry,
+					Nodes:  []identity.NodeID{id, conn},
+					Detail: fmt.Sprintf("%s has %s as %s primary connection, %s does not have %s", id.Short(), conn.Short(), v.state(conn), conn.Short(), id.Short()),
+				})
+			}
+
+			// The links of the primary connections are only in the vision when it goes deeper than them.
+			if v.DepthVision < 2 {
+				continue
+			}
+			seen := v.Graph.Neighbours(conn)
+			slices.Sort(seen)
+			actual := slices.Clone(primaries[conn])
+			slices.Sort(actual)
+			if cv.ConnCap != 0 && len(seen) > cv.ConnCap {
+				incs = append(incs, Inconsistency{
+					Kind:   InconsistentCap,
+					Nodes:  []identity.NodeID{conn, id},
+					Detail: fmt.Sprintf("%s sees %s with %d links, its cap is %d", id.Short(), conn.Short(), len(seen), cv.ConnCap),
+				})
+			}
+			if !slices.Equal(seen, actual) {
+				incs = append(incs, Inconsistency{
+					Kind:   InconsistentNeighbourhood,
+					Nodes:  []identity.NodeID{conn, id},
+					Detail: fmt.Sprintf("%s sees %s linked to %s, %s has %s", id.Short(), conn.Short(), shortIDs(seen), conn.Short(), linkStrings(cv.Graph, actual)),
+				})
+			}
+		}
+	}
+
+	// A gone node is held by the nodes that still have it as primary connection, until they replace it.
+	held := map[identity.NodeID]bool{}
+	for id := range byID {
+		for _, conn := range primaries[id] {
+			held[conn] = true
+		}
+	}
+	ghosts := map[identity.NodeID][]identity.NodeID{}
+	for _, id := range slices.Sorted(maps.Keys(byID)) {
+		for _, nd := range byID[id].Graph.Nodes {
+			if _, running := byID[nd.ID]; running {
+				continue
+			}
+			if nd.State != StateDead || !held[nd.ID] {
+				ghosts[nd.ID] = append(ghosts[nd.ID], id)
+			}
+		}
+	}
+	for _, gone := range slices.Sorted(maps.Keys(ghosts)) {
+		incs = append(incs, Inconsistency{
+			Kind:   InconsistentGhost,
+			Nodes:  append([]identity.NodeID{gone}, ghosts[gone]...),
+			Detail: fmt.Sprintf("%s is gone, and still in the vision of %s", gone.Short(), shortIDs(ghosts[gone])),
+		})
+	}
+
+	slices.SortStableFunc(incs, func(a, b Inconsistency) int { return cmp.Compare(a.Kind, b.Kind) })
+	return incs
+}
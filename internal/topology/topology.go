@@ -0,0 +1,296 @@
+// Package topology turns the vision of nodes into flat graphs, which can be written as Graphviz DOT or JSON,
+// merged into one picture of the whole network, and checked against one another.
+package topology
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+// The liveness states a node can be seen in.
+const (
+	StateAlive   = "alive"
+	StateSuspect = "suspect"
+	StateDead    = "dead"
+)
+
+// Node is a node of the graph, as seen by the observers of the graph.
+type Node struct {
+	ID          identity.NodeID `json:"ID"`
+	Address     string          `json:"Address"`
+	State       string          `json:"State"`
+	Incarnation uint64          `json:"Incarnation"`
+}
+
+// Edge is a link between two nodes, as seen by the observers of the graph.
+// State is the liveness of the link, which is the one of the node at the far end of it from the point of view of the observer.
+// RTT is only known by the observers that are one of the ends of the link.
+type Edge struct {
+	From       identity.NodeID   `json:"From"`
+	To         identity.NodeID   `json:"To"`
+	State      string            `json:"State"`
+	RTT        float64           `json:"RTT,omitempty"`
+	ObservedBy []identity.NodeID `json:"ObservedBy,omitempty"`
+}
+
+// Inconsistency is something the observers of a merged graph do not agree on.
+type Inconsistency struct {
+	Kind   string            `json:"Kind"`
+	Nodes  []identity.NodeID `json:"Nodes"`
+	Detail string            `json:"Detail"`
+}
+
+// The kinds of inconsistencies found while merging graphs.
+const (
+	// Some observers see the node as dead, while others see it alive.
+	InconsistentState = "state"
+	// The node is seen at different addresses.
+	InconsistentAddress = "address"
+	// An observer does not have a link that others claim it has.
+	InconsistentLink = "link"
+)
+
+// Graph is the flat form of the vision of one or more observers.
+type Graph struct {
+	Observers       []identity.NodeID `json:"Observers"`
+	Nodes           []Node            `json:"Nodes"`
+	Edges           []Edge            `json:"Edges"`
+	Inconsistencies []Inconsistency   `json:"Inconsistencies,omitempty"`
+}
+
+// New creates an empty graph of the vision of the observer.
+func New(observer identity.NodeID) *Graph {
+	return &Graph{Observers: []identity.NodeID{observer}, Nodes: []Node{}, Edges: []Edge{}}
+}
+
+func (g *Graph) findNode(id identity.NodeID) int {
+	return slices.IndexFunc(g.Nodes, func(nd Node) bool { return nd.ID == id })
+}
+
+// linkKey is the same for both directions of a link.
+func linkKey(a, b identity.NodeID) [2]identity.NodeID {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]identity.NodeID{a, b}
+}
+
+func (g *Graph) findEdge(a, b identity.NodeID) int {
+	key := linkKey(a, b)
+	return slices.IndexFunc(g.Edges, func(e Edge) bool { return linkKey(e.From, e.To) == key })
+}
+
+// AddNode adds the node to the graph, unless it is already in it.
+func (g *Graph) AddNode(nd Node) {
+	if g.findNode(nd.ID) == -1 {
+		g.Nodes = append(g.Nodes, nd)
+	}
+}
+
+// AddEdge adds the link to the graph, unless it is already in it, in either direction.
+func (g *Graph) AddEdge(e Edge) {
+	if len(e.ObservedBy) == 0 {
+		e.ObservedBy = slices.Clone(g.Observers)
+	}
+	if g.findEdge(e.From, e.To) == -1 {
+		g.Edges = append(g.Edges, e)
+	}
+}
+
+// Neighbours returns the nodes linked to the node.
+func (g *Graph) Neighbours(id identity.NodeID) []identity.NodeID {
+	var ns []identity.NodeID
+	for _, e := range g.Edges {
+		switch id {
+		case e.From:
+			ns = append(ns, e.To)
+		case e.To:
+			ns = append(ns, e.From)
+		}
+	}
+	return ns
+}
+
+// Sort orders the nodes and edges of the graph, such that the same graph is always written the same way.
+func (g *Graph) Sort() {
+	slices.SortFunc(g.Nodes, func(a, b Node) int { return cmp.Compare(a.ID, b.ID) })
+	for i := range g.Edges {
+		if g.Edges[i].From > g.Edges[i].To {
+			g.Edges[i].From, g.Edges[i].To = g.Edges[i].To, g.Edges[i].From
+		}
+	}
+	slices.SortFunc(g.Edges, func(a, b Edge) int {
+		return cmp.Or(cmp.Compare(a.From, b.From), cmp.Compare(a.To, b.To))
+	})
+}
+
+// Merge puts the graphs of many observers together. When the observers do not agree on a node, the claim with the greatest incarnation wins,
+// a dead claim winning over the others with the same incarnation, and the disagreement is recorded in the inconsistencies of the merged graph.
+func Merge(graphs ...*Graph) *Graph {
+	merged := &Graph{Observers: []identity.NodeID{}, Nodes: []Node{}, Edges: []Edge{}}
+
+	claims := map[identity.NodeID][]Node{}
+	for _, g := range graphs {
+		merged.Observers = append(merged.Observers, g.Observers...)
+		for _, nd := range g.Nodes {
+			claims[nd.ID] = append(claims[nd.ID], nd)
+		}
+
+		for _, e := range g.Edges {
+			if i := merged.findEdge(e.From, e.To); i != -1 {
+				me := &merged.Edges[i]
+				me.ObservedBy = append(me.ObservedBy, e.ObservedBy...)
+				if e.RTT != 0 {
+					me.RTT = e.RTT
+				}
+				if e.State == StateDead {
+					me.State = StateDead
+				}
+				continue
+			}
+			e.ObservedBy = slices.Clone(e.ObservedBy)
+			merged.Edges = append(merged.Edges, e)
+		}
+	}
+
+	for id, cs := range claims {
+		best := cs[0]
+		for _, c := range cs[1:] {
+			if c.Incarnation > best.Incarnation || (c.Incarnation == best.Incarnation && c.State == StateDead) {
+				best = c
+			}
+		}
+		merged.Nodes = append(merged.Nodes, best)
+
+		dead := slices.ContainsFunc(cs, func(c Node) bool { return c.State == StateDead })
+		alive := slices.ContainsFunc(cs, func(c Node) bool { return c.State != StateDead })
+		if dead && alive {
+			merged.Inconsistencies = append(merged.Inconsistencies, Inconsistency{
+				Kind:   InconsistentState,
+				Nodes:  []identity.NodeID{id},
+				Detail: fmt.Sprintf("seen as %s", describeClaims(cs, func(c Node) string { return fmt.Sprintf("%s(%d)", c.State, c.Incarnation) })),
+			})
+		}
+
+		if slices.ContainsFunc(cs, func(c Node) bool { return c.Address != best.Address }) {
+			merged.Inconsistencies = append(merged.Inconsistencies, Inconsistency{
+				Kind:   InconsistentAddress,
+				Nodes:  []identity.NodeID{id},
+				Detail: fmt.Sprintf("seen at %s", describeClaims(cs, func(c Node) string { return c.Address })),
+			})
+		}
+	}
+
+	// The primary connections of a node are first-hand knowledge, thus an observer not having a link others claim it has means they are behind.
+	observers := map[identity.NodeID]*Graph{}
+	for _, g := range graphs {
+		if len(g.Observers) == 1 {
+			observers[g.Observers[0]] = g
+		}
+	}
+	for _, e := range merged.Edges {
+		for _, end := range []identity.NodeID{e.From, e.To} {
+			g, ok := observers[end]
+			if !ok || g.findEdge(e.From, e.To) != -1 {
+				continue
+			}
+			merged.Inconsistencies = append(merged.Inconsistencies, Inconsistency{
+				Kind:   InconsistentLink,
+				Nodes:  []identity.NodeID{e.From, e.To},
+				Detail: fmt.Sprintf("%s does not have the link seen by %s", end.Short(), shortIDs(e.ObservedBy)),
+			})
+		}
+	}
+
+	merged.Sort()
+	slices.SortFunc(merged.Inconsistencies, func(a, b Inconsistency) int {
+		return cmp.Or(cmp.Compare(a.Kind, b.Kind), slices.Compare(a.Nodes, b.Nodes))
+	})
+	return merged
+}
+
+func describeClaims(cs []Node, describe func(Node) string) string {
+	seen := []string{}
+	for _, c := range cs {
+		if d := describe(c); !slices.Contains(seen, d) {
+			seen = append(seen, d)
+		}
+	}
+	return strings.Join(seen, ", ")
+}
+
+func shortIDs(ids []identity.NodeID) string {
+	short := make([]string, 0, len(ids))
+	for _, id := range ids {
+		short = append(short, id.Short())
+	}
+	return strings.Join(short, ", ")
+}
+
+// inconsistent returns the nodes and links involved in an inconsistency.
+func (g *Graph) inconsistent() (map[identity.NodeID]bool, map[[2]identity.NodeID]bool) {
+	nodes := map[identity.NodeID]bool{}
+	links := map[[2]identity.NodeID]bool{}
+	for _, inc := range g.Inconsistencies {
+		if inc.Kind == InconsistentLink || inc.Kind == InconsistentAsymmetry {
+			links[linkKey(inc.Nodes[0], inc.Nodes[1])] = true
+			continue
+		}
+		for _, id := range inc.Nodes {
+			nodes[id] = true
+		}
+	}
+	return nodes, links
+}
+
+var stateColors = map[string]string{
+	StateAlive:   "palegreen",
+	StateSuspect: "orange",
+	StateDead:    "gray",
+}
+
+// WriteDOT writes the graph in the Graphviz DOT format. The dead nodes and links are dashed, and the inconsistencies are red.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	badNodes, badLinks := g.inconsistent()
+
+	var b strings.Builder
+	b.WriteString("graph overlay {\n")
+	b.WriteString("\tnode [shape=box, style=filled, fontname=monospace];\n")
+
+	for _, nd := range g.Nodes {
+		attrs := fmt.Sprintf("label=\"%s\\n%s\\n%s(%d)\", fillcolor=%s", nd.ID.Short(), nd.Address, nd.State, nd.Incarnation, stateColors[nd.State])
+		if slices.Contains(g.Observers, nd.ID) {
+			attrs += ", peripheries=2"
+		}
+		if nd.State == StateDead {
+			attrs += ", style=\"filled,dashed\""
+		}
+		if badNodes[nd.ID] {
+			attrs += ", color=red, penwidth=3"
+		}
+		fmt.Fprintf(&b, "\t%q [%s];\n", nd.ID.Short(), attrs)
+	}
+
+	for _, e := range g.Edges {
+		attrs := []string{}
+		if e.RTT != 0 {
+			attrs = append(attrs, fmt.Sprintf("label=\"%.2fms\"", e.RTT))
+		}
+		if e.State == StateDead {
+			attrs = append(attrs, "style=dashed")
+		}
+		if badLinks[linkKey(e.From, e.To)] {
+			attrs = append(attrs, "color=red", "penwidth=3")
+		}
+		fmt.Fprintf(&b, "\t%q -- %q [%s];\n", e.From.Short(), e.To.Short(), strings.Join(attrs, ", "))
+	}
+
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,149 @@
+package topology
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
+)
+
+const (
+	a identity.NodeID = "AAAAAAAA01"
+	b identity.NodeID = "BBBBBBBB01"
+	c identity.NodeID = "CCCCCCCC01"
+)
+
+func hasInconsistency(g *Graph, kind string, id identity.NodeID) bool {
+	return slices.ContainsFunc(g.Inconsistencies, func(inc Inconsistency) bool {
+		return inc.Kind == kind && slices.Contains(inc.Nodes, id)
+	})
+}
+
+func TestMergeHighlightsInconsistencies(t *testing.T) {
+	// A sees B and C alive, B sees C dead at another address, and B does not have its link with A anymore.
+	ga := New(a)
+	ga.AddNode(Node{ID: a, Address: "10.0.0.1:1", State: StateAlive})
+	ga.AddNode(Node{ID: b, Address: "10.0.0.2:1", State: StateAlive})
+	ga.AddNode(Node{ID: c, Address: "10.0.0.3:1", State: StateAlive})
+	ga.AddEdge(Edge{From: a, To: b, State: StateAlive, RTT: 1.5})
+	ga.AddEdge(Edge{From: b, To: c, State: StateAlive})
+
+	gb := New(b)
+	gb.AddNode(Node{ID: b, Address: "10.0.0.2:1", State: StateAlive})
+	gb.AddNode(Node{ID: c, Address: "10.0.0.9:1", State: StateDead})
+	gb.AddEdge(Edge{From: b, To: c, State: StateDead})
+
+	merged := Merge(ga, gb)
+
+	if len(merged.Nodes) != 3 || len(merged.Edges) != 2 {
+		t.Fatalf("merged graph has %d nodes and %d edges - expected 3 and 2", len(merged.Nodes), len(merged.Edges))
+	}
+	if i := merged.findNode(c); merged.Nodes[i].State != StateDead {
+		t.Errorf("C is %s in the merged graph - the dead claim should win", merged.Nodes[i].State)
+	}
+	if i := merged.findEdge(c, b); len(merged.Edges[i].ObservedBy) != 2 {
+		t.Errorf("link B-C observed by %v - expected both observers", merged.Edges[i].ObservedBy)
+	}
+
+	if !hasInconsistency(merged, InconsistentState, c) {
+		t.Error("state of C is not reported as inconsistent")
+	}
+	if !hasInconsistency(merged, InconsistentAddress, c) {
+		t.Error("address of C is not reported as inconsistent")
+	}
+	if !hasInconsistency(merged, InconsistentLink, b) {
+		t.Error("link A-B missing from the export of B is not reported")
+	}
+	if hasInconsistency(merged, InconsistentState, b) || hasInconsistency(merged, InconsistentAddress, b) {
+		t.Error("B is reported as inconsistent, while both observers agree on it")
+	}
+
+	var dot strings.Builder
+	if err := merged.WriteDOT(&dot); err != nil {
+		t.Fatalf("could not write DOT - %s", err)
+	}
+	if !strings.Contains(dot.String(), `"AAAAAAAA" -- "BBBBBBBB" [label="1.50ms", color=red, penwidth=3]`) {
+		t.Errorf("inconsistent link A-B is not highlighted:\n%s", dot.String())
+	}
+}
+
+func TestAnalyzeFindsPartitions(t *testing.T) {
+	// A-B-C, where C is dead, and D-E apart from them.
+	const d, e identity.NodeID = "DDDDDDDD01", "EEEEEEEE01"
+	g := New(a)
+	for _, id := range []identity.NodeID{a, b, d, e} {
+		g.AddNode(Node{ID: id, State: StateAlive})
+	}
+	g.AddNode(Node{ID: c, State: StateDead})
+	g.AddEdge(Edge{From: a, To: b, State: StateAlive})
+	g.AddEdge(Edge{From: b, To: c, State: StateDead})
+	g.AddEdge(Edge{From: d, To: e, State: StateAlive})
+
+	r := Analyze(g)
+	if r.Nodes != 4 || r.DeadNodes != 1 || r.Links != 2 {
+		t.Errorf("report counts %d nodes, %d dead and %d links - expected 4, 1 and 2", r.Nodes, r.DeadNodes, r.Links)
+	}
+	if r.Connected || len(r.Partitions) != 2 {
+		t.Errorf("report has partitions %v - expected A-B and D-E", r.Partitions)
+	}
+	if r.Diameter != 1 || r.DegreeDistribution[1] != 4 || r.AverageDegree != 1 {
+		t.Errorf("report %+v - expected a diameter of 1 and all the nodes of degree 1", r)
+	}
+}
+
+// seenLink is a link in a vision, State being the one the observer sees To in.
+type seenLink struct {
+	From, To identity.NodeID
+	State    string
+}
+
+func visionOf(observer identity.NodeID, connCap int, links ...seenLink) Vision {
+	g := New(observer)
+	g.AddNode(Node{ID: observer, State: StateAlive})
+	for _, l := range links {
+		g.AddNode(Node{ID: l.To, State: l.State})
+		g.AddEdge(Edge{From: l.From, To: l.To, State: l.State})
+	}
+	return Vision{Graph: g, ConnCap: connCap, DepthVision: 2}
+}
+
+func hasKind(incs []Inconsistency, kind string, ids ...identity.NodeID) bool {
+	return slices.ContainsFunc(incs, func(inc Inconsistency) bool {
+		return inc.Kind == kind && slices.Equal(inc.Nodes[:len(ids)], ids)
+	})
+}
+
+func TestCheckFindsInconsistencies(t *testing.T) {
+	const d identity.NodeID = "DDDDDDDD01"
+	// A-B and B-C, as everybody sees them.
+	visions := []Vision{
+		visionOf(a, 1, seenLink{a, b, StateAlive}, seenLink{b, c, StateAlive}),
+		visionOf(b, 2, seenLink{b, a, StateAlive}, seenLink{b, c, StateAlive}),
+		visionOf(c, 1, seenLink{c, b, StateAlive}, seenLink{b, a, StateAlive}),
+	}
+	if incs := Check(visions); len(incs) != 0 {
+		t.Fatalf("consistent visions have inconsistencies: %v", incs)
+	}
+
+	// A also has C, which does not have it, and C still sees D, which is gone and nobody is linked to.
+	visions[0] = visionOf(a, 1, seenLink{a, b, StateAlive}, seenLink{b, c, StateAlive}, seenLink{a, c, StateAlive})
+	visions[2] = visionOf(c, 1, seenLink{c, b, StateAlive}, seenLink{b, a, StateAlive}, seenLink{b, d, StateDead})
+
+	incs := Check(visions)
+	if !hasKind(incs, InconsistentAsymmetry, a, c) {
+		t.Error("link A-C only A has is not reported")
+	}
+	if !hasKind(incs, InconsistentCap, a) {
+		t.Error("A over its cap is not reported")
+	}
+	if !hasKind(incs, InconsistentNeighbourhood, b, c) {
+		t.Error("C seeing B linked to D is not reported")
+	}
+	if !hasKind(incs, InconsistentGhost, d, c) {
+		t.Error("D is not reported as a ghost in the vision of C")
+	}
+	if hasKind(incs, InconsistentNeighbourhood, b, a) {
+		t.Error("A is reported as disagreeing with B, while it sees its links right")
+	}
+}
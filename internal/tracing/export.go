@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Exporter sends the spans somewhere they can be looked at.
+type Exporter interface {
+	ExportSpans(spans []Span) error
+}
+
+// FileExporter appends the spans to a file, one JSON span per line.
+// "jq -s . file" turns the file into the list of spans a Zipkin collector takes.
+type FileExporter struct {
+	Path string
+}
+
+func (fe FileExporter) ExportSpans(spans []Span) error {
+	if err := os.MkdirAll(filepath.Dir(fe.Path), 0o755); err != nil {
+		return fmt.Errorf("could not create trace directory - %s", err)
+	}
+
+	f, err := os.OpenFile(fe.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open trace file - %s", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range spans {
+		if err = enc.Encode(&spans[i]); err != nil {
+			return fmt.Errorf("could not write span - %s", err)
+		}
+	}
+	return w.Flush()
+}
+
+// ZipkinExporter posts the spans to a Zipkin collector, e.g. "http://127.0.0.1:9411/api/v2/spans".
+type ZipkinExporter struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewZipkinExporter(url string) ZipkinExporter {
+	return ZipkinExporter{URL: url, Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (ze ZipkinExporter) ExportSpans(spans []Span) error {
+	b, err := json.Marshal(spans)
+	if err != nil {
+		return fmt.Errorf("could not serialize spans - %s", err)
+	}
+
+	resp, err := ze.Client.Post(ze.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("could not reach the trace collector - %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("trace collector answered with %s", resp.Status)
+	}
+	return nil
+}
+
+// Exporters hands the spans to each of the exporters.
+type Exporters []Exporter
+
+func (es Exporters) ExportSpans(spans []Span) error {
+	var errs []error
+	for _, e := range es {
+		if err := e.ExportSpans(spans); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
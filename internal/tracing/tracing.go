@@ -0,0 +1,265 @@
+// Package tracing records how messages travel across the nodes as spans, in the Zipkin v2 format, such that one message
+// can be followed from the node that sent it to all the nodes that handled it.
+package tracing
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// The kinds of spans. The spans of local work have no kind.
+const (
+	KindProducer = "PRODUCER"
+	KindConsumer = "CONSUMER"
+)
+
+// A tracer keeps at most this many spans between two flushes, the others are dropped.
+const maxBufferedSpans = 10000
+
+// At most this many flushed batches wait for the exporter, the next ones are dropped. A slow collector thus costs memory
+// for a few batches, and never holds up the node.
+const maxQueuedBatches = 4
+
+// DefaultRemoteTraceRate is how many traces started by other nodes a tracer follows per second, by default.
+const DefaultRemoteTraceRate = 100
+
+// Context is what travels with a message: the trace it belongs to, and the span it was sent from.
+// Only the sampled traces travel, thus a message without a context is not traced.
+type Context struct {
+	TraceID string `json:"TraceID"`
+	SpanID  string `json:"SpanID,omitempty"`
+
+	// followed is set on the contexts of this node, whose trace the tracer already chose to record.
+	followed bool
+}
+
+// Endpoint is the node a span was recorded on.
+type Endpoint struct {
+	ServiceName string `json:"serviceName"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	Port        uint16 `json:"port,omitempty"`
+}
+
+// Span is a timed piece of work, as a Zipkin v2 span. Timestamp and Duration are in microseconds.
+type Span struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint Endpoint          `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+
+	tracer *Tracer
+	start  time.Time
+}
+
+// Tracer starts the traces of a node with a probability of SampleRate, and records the spans of the traces going through it.
+// The traces started by other nodes are followed up to RemoteTraceRate per second, such that a node sampling everything
+// cannot have all the others record every message it sends. When flushed, the spans are handed to the exporter from its own goroutine.
+// A nil tracer records nothing.
+type Tracer struct {
+	SampleRate      float64
+	RemoteTraceRate int
+	Endpoint        Endpoint
+	Exporter        Exporter
+
+	mu      sync.Mutex
+	spans   []Span
+	dropped uint64
+	errs    []error
+	closed  bool
+
+	// The remote traces followed in the current second, and in the one before, such that a trace going on across
+	// the turn of the second is still recorded.
+	window   int64
+	followed map[string]bool
+	previous map[string]bool
+
+	startExport sync.Once
+	queue       chan []Span
+	exported    chan struct{}
+}
+
+func New(endpoint Endpoint, sampleRate float64, exporter Exporter) *Tracer {
+	return &Tracer{SampleRate: sampleRate, RemoteTraceRate: DefaultRemoteTraceRate, Endpoint: endpoint, Exporter: exporter}
+}
+
+func randomID(bytes int) string {
+	b := make([]byte, 0, bytes)
+	for len(b) < bytes {
+		b = binary.BigEndian.AppendUint64(b, rand.Uint64())
+	}
+	return hex.EncodeToString(b[:bytes])
+}
+
+// NewTrace starts a trace, when it is sampled. Otherwise it returns nil, and nothing about it is recorded.
+func (t *Tracer) NewTrace() *Context {
+	if t == nil || t.SampleRate <= 0 || rand.Float64() >= t.SampleRate {
+		return nil
+	}
+	return &Context{TraceID: randomID(16), followed: true}
+}
+
+// follow tells whether the spans of the trace of parent are recorded. The traces of this node always are, the remote ones
+// only while the rate allows it.
+func (t *Tracer) follow(parent *Context, now time.Time) bool {
+	if parent.followed {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if second := now.Unix(); second != t.window {
+		t.previous, t.followed = t.followed, map[string]bool{}
+		if second != t.window+1 {
+			t.previous = nil
+		}
+		t.window = second
+	}
+	if t.followed[parent.TraceID] || t.previous[parent.TraceID] {
+		t.followed[parent.TraceID] = true
+		return true
+	}
+	if len(t.followed) >= t.RemoteTraceRate {
+		return false
+	}
+	t.followed[parent.TraceID] = true
+	return true
+}
+
+// Start starts a span of the trace of parent, unless the trace is not sampled or the tracer is nil.
+func (t *Tracer) Start(parent *Context, name string, kind string) *Span {
+	return t.StartAt(parent, name, kind, time.Now())
+}
+
+// StartAt does the same thing as Start, for a span that started earlier.
+func (t *Tracer) StartAt(parent *Context, name string, kind string, start time.Time) *Span {
+	if t == nil || parent == nil || !t.follow(parent, time.Now()) {
+		return nil
+	}
+	return &Span{
+		TraceID:       parent.TraceID,
+		ID:            randomID(8),
+		ParentID:      parent.SpanID,
+		Name:          name,
+		Kind:          kind,
+		Timestamp:     start.UnixMicro(),
+		LocalEndpoint: t.Endpoint,
+		tracer:        t,
+		start:         start,
+	}
+}
+
+// Context returns the context the messages sent from the span carry.
+func (s *Span) Context() *Context {
+	if s == nil {
+		return nil
+	}
+	return &Context{TraceID: s.TraceID, SpanID: s.ID, followed: true}
+}
+
+// Tag adds a tag to the span.
+func (s *Span) Tag(key string, value string) {
+	if s == nil {
+		return
+	}
+	if s.Tags == nil {
+		s.Tags = map[string]string{}
+	}
+	s.Tags[key] = value
+}
+
+// End records the span. It must not be used after that.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Duration = max(time.Since(s.start).Microseconds(), 1)
+
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.spans) >= maxBufferedSpans {
+		t.dropped++
+		return
+	}
+	t.spans = append(t.spans, *s)
+}
+
+// Flush queues the recorded spans for the exporter without waiting for it. It returns how many spans were dropped since the last flush,
+// the buffer or the queue being full, and the errors of the exports done since then.
+func (t *Tracer) Flush() (uint64, error) {
+	if t == nil {
+		return 0, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans, dropped, err := t.spans, t.dropped, errors.Join(t.errs...)
+	t.spans, t.dropped, t.errs = nil, 0, nil
+
+	if len(spans) == 0 || t.Exporter == nil || t.closed {
+		return dropped, err
+	}
+	t.startExport.Do(func() {
+		t.queue = make(chan []Span, maxQueuedBatches)
+		t.exported = make(chan struct{})
+		go t.export()
+	})
+	select {
+	case t.queue <- spans:
+	default:
+		dropped += uint64(len(spans))
+	}
+	return dropped, err
+}
+
+// export hands the queued batches to the exporter, until the tracer is closed.
+func (t *Tracer) export() {
+	defer close(t.exported)
+	for spans := range t.queue {
+		if err := t.Exporter.ExportSpans(spans); err != nil {
+			t.mu.Lock()
+			t.errs = append(t.errs, err)
+			t.mu.Unlock()
+		}
+	}
+}
+
+// Close flushes the recorded spans, and waits for the queued ones to be exported. Nothing is exported after that.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+
+	_, err := t.Flush()
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return err
+	}
+	t.closed = true
+	started := t.queue != nil
+	if started {
+		close(t.queue)
+	}
+	t.mu.Unlock()
+
+	if !started {
+		return err
+	}
+	<-t.exported
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = errors.Join(append([]error{err}, t.errs...)...)
+	t.errs = nil
+	return err
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpansFollowTheirParent(t *testing.T) {
+	if ctx := New(Endpoint{}, 0, nil).NewTrace(); ctx != nil {
+		t.Errorf("trace %v started with a sample rate of 0", ctx)
+	}
+
+	path := filepath.Join(t.TempDir(), "traces", "spans.json")
+	tr := New(Endpoint{ServiceName: "node-A"}, 1, FileExporter{Path: path})
+
+	root := tr.Start(tr.NewTrace(), "forward", KindProducer)
+	child := tr.Start(root.Context(), "receive", KindConsumer)
+	child.Tag("peer", "B")
+	child.End()
+	root.End()
+	// Without a parent, nothing is recorded.
+	tr.Start(nil, "process", "").End()
+
+	if err := tr.Close(); err != nil {
+		t.Fatalf("could not export spans - %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open exported spans - %s", err)
+	}
+	defer f.Close()
+
+	var spans []Span
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		s := Span{}
+		if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+			t.Fatalf("exported line is not a span - %s", err)
+		}
+		spans = append(spans, s)
+	}
+
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans - expected 2", len(spans))
+	}
+	recv, fwd := spans[0], spans[1]
+	if recv.TraceID != fwd.TraceID || recv.ParentID != fwd.ID || fwd.ParentID != "" {
+		t.Errorf("receive span %+v is not a child of root span %+v", recv, fwd)
+	}
+	if len(fwd.TraceID) != 32 || len(fwd.ID) != 16 || fwd.LocalEndpoint.ServiceName != "node-A" || recv.Tags["peer"] != "B" {
+		t.Errorf("spans are not valid Zipkin v2 spans: %+v %+v", fwd, recv)
+	}
+}
+
+func TestRemoteTracesAreRateCapped(t *testing.T) {
+	tr := New(Endpoint{}, 0, nil)
+	tr.RemoteTraceRate = 2
+
+	first, second, third := &Context{TraceID: "a"}, &Context{TraceID: "b"}, &Context{TraceID: "c"}
+	if tr.Start(first, "receive", KindConsumer) == nil || tr.Start(second, "receive", KindConsumer) == nil {
+		t.Fatal("remote traces within the rate were not followed")
+	}
+	if tr.Start(third, "receive", KindConsumer) != nil {
+		t.Error("remote trace over the rate was followed")
+	}
+	// The traces already followed keep being recorded.
+	if tr.Start(first, "process", "") == nil {
+		t.Error("followed remote trace stopped being recorded")
+	}
+}
@@ -1,284 +1,99 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
-	"io"
+	"fmt"
+	"log/slog"
+	"math"
 	"net"
-	"slices"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/TheJ0lly/Overlay-Network/internal/admission"
+	"github.com/TheJ0lly/Overlay-Network/internal/capture"
+	"github.com/TheJ0lly/Overlay-Network/internal/fault"
+	"github.com/TheJ0lly/Overlay-Network/internal/identity"
 	"github.com/TheJ0lly/Overlay-Network/internal/logging"
-	"github.com/TheJ0lly/Overlay-Network/internal/message"
 	"github.com/TheJ0lly/Overlay-Network/internal/network"
 	"github.com/TheJ0lly/Overlay-Network/internal/node"
+	"github.com/TheJ0lly/Overlay-Network/internal/tracing"
 )
 
 const defaultUninitInt = 0
 const defaultUninitString = ""
 const portMax = (1 << 16) - 1
 
-func JoinNewNetwork(currNode *node.Node, connectionIp *string, connectionPort *uint, port *uint, ip *string, connsCap *uint) {
-	if *connectionIp == defaultUninitString && *connectionPort == defaultUninitInt {
-		logging.LogErrorWithExit("one of these flags have been set, but not both - to join a new network use both flags \"connip\" + \"connport\"")
-	}
-
-	parsedIp := net.ParseIP(*connectionIp)
-	connectionIpPortPair := network.IpPortPair{
-		Ip:   parsedIp,
-		Port: uint16(*connectionPort),
-	}
-	initialTimestamp := time.Now()
-	var env message.MessageEnvelope
-	var b []byte
-	var err error
-	var list net.Listener
-	var conn net.Conn
-
-	if env, err = message.CreateMessageEnvelope(
-		message.NetNewNodeJoinQuery,
-		&message.NetNewNodeJoinQueryMessage{
-			NewNode:   currNode.GetIpPortPair(),
-			Timestamp: initialTimestamp.UnixMilli(),
-		},
-		currNode.GetIpPortPair(),
-		currNode.GetIpPortPair(),
-	); err != nil {
-		logging.LogErrorWithExit("could not create join query message - %s", err)
-	}
+var logger = logging.Component("main")
 
-	if b, err = message.SerializeMessageEnvelope(&env); err != nil {
-		logging.LogErrorWithExit("could not marshal initial message envelope for joining a new network - %s", err)
-	}
-
-	connectionPair := connectionIpPortPair.NetString()
-
-	if err = network.SendToDest(b, connectionIpPortPair, time.Duration(currNode.DeathTimer)); err != nil {
-		logging.LogErrorWithExit("could not sent message envelope to node %s", connectionPair)
+// serveHTTP serves the handler on the address, until the server is shut down.
+func serveHTTP(what string, address string, handler http.Handler) *http.Server {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		logger.ErrorWithExit("could not listen for %s - %s", what, err)
 	}
-	logging.LogInfo("sent message to %s: type=%s data=%s", connectionPair, env.Type, env.Data)
 
-	if list, err = net.Listen("tcp", currNode.GetNodeAddress()); err != nil {
-		logging.LogErrorWithExit("could not start listener for the initial message - %s", err)
-	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	logger.Info("serving %s on: http://%s", what, l.Addr())
 
-	timeoutChan := make(chan struct{}, 1)
 	go func() {
-		time.Sleep(time.Second * 5)
-		timeoutChan <- struct{}{}
-		list.Close()
+		if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("%s server stopped - %s", what, err)
+		}
 	}()
+	return server
+}
 
-	running := true
-
-	type ResponiveNode struct {
-		pair        network.IpPortPair
-		rttDuration int64
+// traceEndpoint is how the node is named in the spans it records.
+func traceEndpoint(n *node.Node) tracing.Endpoint {
+	ep := tracing.Endpoint{ServiceName: "node-" + n.ID.Short(), Port: n.Port}
+	if n.Ip.To4() != nil {
+		ep.IPv4 = n.Ip.String()
+	} else {
+		ep.IPv6 = n.Ip.String()
 	}
+	return ep
+}
 
-	var responsiveNodes []ResponiveNode
-
-	for running {
-		select {
-		case <-timeoutChan:
-			logging.LogInfo("received timeout - closing join query window")
-			running = false
-			continue
-		default:
-			conn, err = list.Accept()
-			if err != nil {
-				logging.LogError("error while accepting incoming connections - %s", err)
-				continue
-			}
-
-			b, err = io.ReadAll(conn)
-			if err != nil {
-				logging.LogError("error while reading from the connection - %s", err)
-				conn.Close()
-				continue
-			}
-
-			if err = message.DeserializeMessageEnvelope(&env, b); err != nil {
-				logging.LogError("error while deserializing message envelope - %s", err)
-				conn.Close()
-				continue
-			}
-
-			msg := message.NetNewNodeJoinQueryMessage{}
-			if err := json.Unmarshal(env.Data, &msg); err != nil {
-				logging.LogError("error while deserializing message - %s", err)
-				conn.Close()
-				continue
-			}
-
-			rttDuration := time.Since(initialTimestamp)
-			var rttValueMilli int64 = 1
-			if rttDuration.Milliseconds() != 0 {
-				rttValueMilli = rttDuration.Milliseconds()
-			}
-
-			responsiveNodes = append(responsiveNodes, ResponiveNode{
-				pair: network.IpPortPair{
-					Ip:   msg.NewNode.Ip,
-					Port: msg.NewNode.Port,
-				},
-				rttDuration: rttValueMilli,
-			})
-
-			logging.LogDebug("new response from %v with RTT: %v", responsiveNodes[len(responsiveNodes)-1].pair, responsiveNodes[len(responsiveNodes)-1].rttDuration)
-
-			currNode.Stat.JoinCandidateResponses++
-		}
+// isLocalAddress checks if the address only listens on the loopback interface.
+func isLocalAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
 	}
-
-	if len(responsiveNodes) == 0 {
-		logging.LogErrorWithExit("could not find a suitable node to attach to")
+	if host == "localhost" {
+		return true
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-	confirmEnv, err := message.CreateMessageEnvelope(
-		message.NetNewNodeJoinConfirm,
-		&message.NetNewNodeJoinConfirmMessage{
-			// As of now does not matter, but maybe we add some RTT exclusion over X
-			IsSuitable: true,
-		},
-		currNode.GetIpPortPair(), currNode.GetIpPortPair())
-
+// setupLogging makes all the loggers write to the log file, in the given format, with the given levels.
+func setupLogging(debug bool, levels string, format string, file string) {
+	level, componentLevels, err := logging.ParseLevels(levels)
 	if err != nil {
-		logging.LogErrorWithExit("could not create message envelope for join confirm: %s", err)
+		logger.ErrorWithExit("%s", err)
 	}
-
-	confirmEnvBytes, err := message.SerializeMessageEnvelope(&confirmEnv)
-	if err != nil {
-		logging.LogErrorWithExit("could not serialize net join message - %s", err)
+	if debug {
+		level = slog.LevelDebug
 	}
 
-	slices.SortStableFunc(responsiveNodes, func(a, b ResponiveNode) int {
-		return int(a.rttDuration - b.rttDuration)
-	})
-
-	var bestNode network.IpPortPair
-	var gotConnChan chan struct{} = make(chan struct{}, 1)
-
-	running = true
-	for i := range responsiveNodes {
-		// At this point we assume that the slice is sorted based on timestamp.
-		// Thus if we iterate over the slice, we should get the best candidates.
-		reNo := responsiveNodes[i]
-
-		if err = network.SendToDest(confirmEnvBytes, reNo.pair, time.Duration(currNode.DeathTimer)); err != nil {
-			logging.LogErrorWithExit("could not send net join message - %s", err)
-		}
-		logging.LogInfo("sent message to responsive node %s: type=%s data=%s", reNo.pair, confirmEnv.Type, confirmEnv.Data)
-
-		if list, err = net.Listen("tcp", currNode.GetNodeAddress()); err != nil {
-			logging.LogErrorWithExit("could not start listener for the initial message - %s", err)
-		}
-
-		// 3 * RTT is the window for accepting a new connection from a node.
-		go func() {
-			tick := time.NewTicker((time.Millisecond * time.Duration(responsiveNodes[i].rttDuration)) * 3)
-			select {
-			case <-gotConnChan:
-				tick.Stop()
-				logging.LogDebug("got a responsive node connected - timeout cancelled")
-				return
-			case <-tick.C:
-				logging.LogInfo("timeout for node - %v", responsiveNodes[i].pair)
-				list.Close()
-			}
-		}()
-
-		conn, err = list.Accept()
-		if err != nil {
-			logging.LogError("%s", err)
-			list.Close()
-			continue
-		}
-		gotConnChan <- struct{}{}
-
-		b, err := io.ReadAll(conn)
-		if err != nil {
-			logging.LogError("could not read all bytes: %s", err)
-			conn.Close()
-			list.Close()
-			continue
-		}
-
-		confirmEnvRespEnv := message.MessageEnvelope{}
-
-		if err := json.Unmarshal(b, &confirmEnvRespEnv); err != nil {
-			logging.LogError("could not unmarshal message envelope: %s", err)
-			conn.Close()
-			list.Close()
-			continue
-		}
-
-		msg := message.NetNewNodeJoinConfirmMessage{}
-		if err := json.Unmarshal(confirmEnvRespEnv.Data, &msg); err != nil {
-			logging.LogError("could not unmarshal message: %s", err)
-			conn.Close()
-			list.Close()
-			continue
-		}
-
-		if !msg.IsSuitable {
-			logging.LogInfo("candidate node %v refused attachment - moving on", responsiveNodes[i].pair)
-			conn.Close()
-			list.Close()
-			currNode.Stat.JoinCandidateRejects++
-			continue
-		}
-
-		// Maybe we replace this with a message, but maybe not
-		if cap(currNode.Conns) > len(currNode.Conns) {
-			if newNode, err := node.Create(reNo.pair.Ip.String(), reNo.pair.Port, 0, 0); err != nil {
-				logging.LogError("could not add the new node: %s - moving on", err)
-				conn.Close()
-				list.Close()
-				continue
-			} else {
-				currNode.Conns = append(currNode.Conns, newNode)
-				newNode.LastTimeAlive = time.Now().UnixMilli()
-				bestNode.Ip = reNo.pair.Ip
-				bestNode.Port = reNo.pair.Port
-				logging.LogDebug("added new node - %s", newNode)
-				logging.LogDebug("attached node state - %s", currNode)
-				currNode.Stat.PrimaryConnections++
-				list.Close()
-				conn.Close()
-				// Here we break out of the loop since we found a good node and it confirmed the attachment.
-				break
-			}
-		}
+	if format != "text" && format != "json" {
+		logger.ErrorWithExit("log format must be \"text\" or \"json\", got %q", format)
 	}
-	if env, err = message.CreateMessageEnvelope(
-		message.NetNewNodeJoin,
-		&message.NetNewNodeJoinMessage{
-			AttachedNode: bestNode,
-			JoiningNode: network.IpPortPair{
-				Ip:   net.ParseIP(*ip),
-				Port: uint16(*port),
-			},
-			ReplacedNode:       network.NullIpPortPair,
-			JoiningNodeView:    currNode.DepthVision,
-			JoiningNodeConnCap: uint8(cap(currNode.Conns)),
-		},
-		network.IpPortPair{
-			Ip:   net.ParseIP(*ip),
-			Port: uint16(*port),
-		},
-		currNode.GetIpPortPair(),
-	); err != nil {
-		logging.LogErrorWithExit("could not create the join message envelope: %s", err)
-	} else {
-		if b, err = message.SerializeMessageEnvelope(&env); err != nil {
-			logging.LogErrorWithExit("could not serialize the join message envelope: %s", err)
-		}
 
-		if err = network.SendToDest(b, bestNode, time.Duration(currNode.DeathTimer)); err != nil {
-			logging.LogErrorWithExit("could not send join message: %s", err)
+	config := logging.Config{Writer: os.Stdout, JSON: format == "json", Level: level, Levels: componentLevels}
+	if file != defaultUninitString {
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			logger.ErrorWithExit("could not open log file - %s", err)
 		}
+		config.Writer = f
 	}
+	logging.Setup(config)
 }
 
 func main() {
@@ -292,48 +107,313 @@ func main() {
 	lifelineTimer := flag.Uint("lifeline", defaultUninitInt, "the duration in seconds between lifeline messages")
 	deathannounceTimer := flag.Uint("death", defaultUninitInt, "the duration in seconds between last lifeline message until we announce its death")
 	depthVision := flag.Uint("depth", defaultUninitInt, "the vision depth of each node")
-	flag.BoolVar(&logging.DebugFlag, "debug", false, "turn on debug logging")
+	deathQuorum := flag.Uint("deathquorum", 1, "the number of distinct neighbours of a node that must report its death before it takes effect")
+	deathQuorumWindow := flag.Uint("deathwindow", defaultUninitInt, "the duration in seconds in which the death reports must reach the quorum")
+	advertiseHealth := flag.Bool("health", false, "add the health record of the node (queue length, free slots, uptime, load) to its lifelines")
+	aggregateLifeLines := flag.Bool("aggregate", false, "send a digest of the known liveness info to the direct neighbours, instead of flooding lifelines - \"death\" must leave room for the digests to travel \"depth\" hops")
+	keyFile := flag.String("keyfile", defaultUninitString, "the file holding the key pair of the node, created if missing (default \"./keys/Key_Node_<port>.pem\")")
+	useTLS := flag.Bool("tls", false, "encrypt the links between nodes with TLS, both sides proving their node ID with a self-signed certificate")
+	certFile := flag.String("certfile", defaultUninitString, "the file holding the self-signed certificate of the node, created if missing (default \"./keys/Cert_Node_<port>.pem\")")
+	trustFile := flag.String("trust", defaultUninitString, "the file holding the IDs of the nodes we accept TLS links with, one per line - needed along with \"tls\", unless \"trustany\" is set")
+	trustAny := flag.Bool("trustany", false, "accept TLS links with any node that proves its ID, on top of the nodes of \"trust\"")
+	maxInboundConns := flag.Uint("maxconns", node.DefaultMaxInboundConns, "the maximum number of inbound connections read at the same time - the others are dropped")
+	readTimeout := flag.Uint("readtimeout", node.DefaultReadTimeout, "the duration in seconds a peer has to send its message, before the connection is dropped")
+	rateLimit := flag.Float64("ratelimit", node.DefaultRateLimit, "the number of messages per second each node may sign of each type, relayed or not - 0 turns rate limiting off")
+	rateBurst := flag.Float64("rateburst", node.DefaultRateBurst, "the number of messages of each type a node may sign in a burst")
+	banDuration := flag.Uint("bantime", node.DefaultBanDuration, "the duration in seconds a misbehaving peer is banned for")
+	onionHops := flag.Uint("onionhops", node.DefaultOnionHops, "the number of relays the onion routed payloads go through")
+	statsDir := flag.String("statsdir", node.DefaultStatsDir, "the directory the stats are written to as JSON - an empty string turns it off")
+	statsInterval := flag.Uint("statsinterval", node.DefaultStatsInterval, "the duration in seconds between stats exports")
+	adminAddr := flag.String("admin", defaultUninitString, "the local address to serve the admin API on, e.g. \"127.0.0.1:9500\" - turned off when missing")
+	metricsAddr := flag.String("metrics", defaultUninitString, "the address to serve the Prometheus metrics on, under /metrics, e.g. \"127.0.0.1:9400\" - turned off when missing")
+	netKeyFile := flag.String("netkey", defaultUninitString, "the file holding the shared network key - joining nodes must prove they know it")
+	requireInvitation := flag.Bool("invite", false, "only let in the joining nodes holding an invitation from a member of the network")
+	invitationToken := flag.String("invitation", defaultUninitString, "the invitation token to join the network with, along with \"newnet\"")
+	makeToken := flag.Bool("mktoken", false, "print an invitation token signed with the key of the node, and exit - only \"keyfile\" or \"port\" are needed")
+	tokenInvitee := flag.String("invitee", defaultUninitString, "the ID of the only node that can use the invitation token - when missing, any node can use it once, by joining through the node issuing it")
+	tokenValidity := flag.Uint("tokenttl", 3600, "the duration in seconds the invitation token is valid for")
+	debug := flag.Bool("debug", false, "turn on debug logging for all the components, same as \"loglevel debug\"")
+	logLevels := flag.String("loglevel", "info", "the log level of all the components, followed by the levels of specific components (node, network, main), e.g. \"info,network=debug\"")
+	logFormat := flag.String("logformat", "text", "the format of the logs: text or json")
+	logFile := flag.String("logfile", defaultUninitString, "the file the logs are appended to (default stdout)")
+	faults := flag.Bool("faults", false, "let the admin API inject faults in the messages the node sends and receives, for chaos testing - needs \"admin\"")
+	captureFile := flag.String("capture", defaultUninitString, "the file every envelope the node sends and receives is recorded to, to be replayed with overlay-replay")
+	traceFile := flag.String("tracefile", defaultUninitString, "the file the spans of the traced messages are appended to, one Zipkin v2 JSON span per line - tracing is turned off when both this and \"tracecollector\" are missing")
+	traceCollector := flag.String("tracecollector", defaultUninitString, "the Zipkin collector the spans of the traced messages are sent to, e.g. \"http://127.0.0.1:9411/api/v2/spans\"")
+	traceSample := flag.Float64("tracesample", 0.01, "the probability for a message sent by this node to be traced")
+	traceRemote := flag.Int("traceremote", tracing.DefaultRemoteTraceRate, "how many traces started by other nodes are followed per second, at most")
 
 	flag.Parse()
 
+	setupLogging(*debug, *logLevels, *logFormat, *logFile)
+
+	if *keyFile == defaultUninitString {
+		*keyFile = fmt.Sprintf("./keys/Key_Node_%d.pem", *port)
+	}
+
+	if *makeToken {
+		printInvitationToken(*keyFile, identity.NodeID(strings.ToUpper(*tokenInvitee)), time.Duration(*tokenValidity)*time.Second)
+		return
+	}
+
 	if *ip == defaultUninitString {
-		logging.LogErrorWithExit("IP is an empty string")
+		logger.ErrorWithExit("IP is an empty string")
 	}
 	if *port > portMax {
-		logging.LogErrorWithExit("port is bigger than the max value allowed %d", portMax)
+		logger.ErrorWithExit("port is bigger than the max value allowed %d", portMax)
 	}
 	if *connsCap == defaultUninitInt {
-		logging.LogErrorWithExit("conns capacity is 0 - must be greater than 0")
+		logger.ErrorWithExit("conns capacity is 0 - must be greater than 0")
 	}
 	if *queueCap == defaultUninitInt {
-		logging.LogErrorWithExit("queue capacity is 0 - must be greater than 0")
+		logger.ErrorWithExit("queue capacity is 0 - must be greater than 0")
 	}
 	if *lifelineTimer == defaultUninitInt {
-		logging.LogErrorWithExit("lifeline duration is 0 - must be greater than 0")
+		logger.ErrorWithExit("lifeline duration is 0 - must be greater than 0")
 	}
 	if *deathannounceTimer == defaultUninitInt {
-		logging.LogErrorWithExit("death duration is 0 - must be greater than 0")
+		logger.ErrorWithExit("death duration is 0 - must be greater than 0")
 	}
 	if *depthVision == defaultUninitInt || *depthVision < 2 {
-		logging.LogErrorWithExit("depth vision must be greater than 2")
+		logger.ErrorWithExit("depth vision must be greater than 2")
+	}
+	if *maxInboundConns == defaultUninitInt {
+		logger.ErrorWithExit("max inbound connections is 0 - must be greater than 0")
+	}
+	if *readTimeout == defaultUninitInt {
+		logger.ErrorWithExit("read timeout is 0 - must be greater than 0")
+	}
+	if *rateLimit < 0 || *rateBurst < 1 {
+		logger.ErrorWithExit("rate limit must not be negative, and rate burst must be at least 1")
+	}
+	if *onionHops == defaultUninitInt || *onionHops > math.MaxUint8 {
+		logger.ErrorWithExit("onion hops must be between 1 and %d", math.MaxUint8)
+	}
+	if *statsInterval == defaultUninitInt || *statsInterval > math.MaxUint8 {
+		logger.ErrorWithExit("stats interval must be between 1 and %d", math.MaxUint8)
+	}
+	if *adminAddr != defaultUninitString && !isLocalAddress(*adminAddr) {
+		logger.ErrorWithExit("admin API must be served on a loopback address, got %s", *adminAddr)
+	}
+	if *faults && *adminAddr == defaultUninitString {
+		logger.ErrorWithExit("faults are injected through the admin API - use \"admin\" along with \"faults\"")
+	}
+	if *deathQuorum == defaultUninitInt {
+		logger.ErrorWithExit("death quorum is 0 - must be greater than 0")
+	}
+	if *deathQuorum > 1 && *deathQuorumWindow == defaultUninitInt {
+		logger.ErrorWithExit("death window is 0 - must be greater than 0 when using a death quorum")
+	}
+	if *traceSample < 0 || *traceSample > 1 {
+		logger.ErrorWithExit("trace sample must be between 0 and 1, got %v", *traceSample)
+	}
+	if *traceRemote < 0 {
+		logger.ErrorWithExit("remote trace rate cannot be negative, got %d", *traceRemote)
 	}
 
 	currNode, err := node.Create(*ip, uint16(*port), uint8(*connsCap), uint16(*queueCap))
 	if err != nil {
-		logging.LogErrorWithExit("%s", err)
+		logger.ErrorWithExit("%s", err)
+	}
+
+	nodeIdentity, err := identity.LoadOrCreate(*keyFile)
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+	if err = currNode.SetIdentity(nodeIdentity); err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+	logger = logger.With("node", currNode.ID.Short())
+	logger.Info("node ID: %s", currNode.ID)
+
+	if *useTLS {
+		if *certFile == defaultUninitString {
+			*certFile = fmt.Sprintf("./keys/Cert_Node_%d.pem", *port)
+		}
+		cert, err := identity.LoadOrCreateCertificate(*certFile, nodeIdentity)
+		if err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
+
+		trust := network.TrustPolicy{}
+		if *trustFile != defaultUninitString {
+			if trust, err = network.LoadTrustPolicy(*trustFile); err != nil {
+				logger.ErrorWithExit("%s", err)
+			}
+			logger.Debug("trusting %d nodes", len(trust.TrustedIDs))
+		}
+		trust.AnyNode = *trustAny
+		if trust.Empty() {
+			logger.ErrorWithExit("no node is trusted - give a trust file with \"trust\", or accept any node with \"trustany\"")
+		}
+		if trust.AnyNode {
+			logger.Warn("accepting TLS links with any node")
+		}
+		currNode.Net.TLS = network.NewTLSConfig(cert, trust)
+		// The nodes we do not accept links with are not members either, thus what they sign is not accepted when relayed to us.
+		currNode.Net.Trust = &trust
+		logger.Info("links are encrypted with TLS")
+	} else if *trustFile != defaultUninitString || *trustAny {
+		logger.ErrorWithExit("\"trust\" and \"trustany\" are only used along with \"tls\"")
 	}
 	currNode.LifeLineTimer = uint8(*lifelineTimer)
-	logging.LogDebug("setting lifeline timer duration to: %d", currNode.LifeLineTimer)
+	logger.Debug("setting lifeline timer duration to: %d", currNode.LifeLineTimer)
 
 	currNode.DeathTimer = uint8(*deathannounceTimer)
-	logging.LogDebug("setting death timer duration to: %d", currNode.DeathTimer)
+	logger.Debug("setting death timer duration to: %d", currNode.DeathTimer)
 
 	currNode.DepthVision = uint8(*depthVision)
-	logging.LogDebug("setting depth vision to: %d", currNode.DepthVision)
+	logger.Debug("setting depth vision to: %d", currNode.DepthVision)
+
+	currNode.DeathQuorum = uint8(*deathQuorum)
+	currNode.DeathQuorumWindow = uint8(*deathQuorumWindow)
+	logger.Debug("setting death quorum to: %d in %d seconds", currNode.DeathQuorum, currNode.DeathQuorumWindow)
+
+	currNode.AdvertiseHealth = *advertiseHealth
+	logger.Debug("setting health advertising to: %v", currNode.AdvertiseHealth)
+
+	currNode.AggregateLifeLines = *aggregateLifeLines
+	logger.Debug("setting lifeline aggregation to: %v", currNode.AggregateLifeLines)
+
+	currNode.MaxInboundConns = uint16(*maxInboundConns)
+	currNode.ReadTimeout = uint8(*readTimeout)
+	logger.Debug("setting inbound connections to: at most %d, read in %d seconds", currNode.MaxInboundConns, currNode.ReadTimeout)
+
+	currNode.OnionHops = uint8(*onionHops)
+	logger.Debug("setting onion hops to: %d", currNode.OnionHops)
+
+	currNode.StatsInterval = uint8(*statsInterval)
+	currNode.StatsSinks = nil
+	if *statsDir != defaultUninitString {
+		currNode.StatsSinks = append(currNode.StatsSinks, node.FileSink{Dir: *statsDir, Port: currNode.Port})
+	}
+	logger.Debug("setting stats export to: every %d seconds, in %q", currNode.StatsInterval, *statsDir)
+
+	var exporters tracing.Exporters
+	if *traceFile != defaultUninitString {
+		exporters = append(exporters, tracing.FileExporter{Path: *traceFile})
+	}
+	if *traceCollector != defaultUninitString {
+		exporters = append(exporters, tracing.NewZipkinExporter(*traceCollector))
+	}
+	if len(exporters) != 0 {
+		currNode.Tracer = tracing.New(traceEndpoint(currNode), *traceSample, exporters)
+		currNode.Tracer.RemoteTraceRate = *traceRemote
+		logger.Debug("setting tracing to: %.3f of the messages, at most %d remote traces per second, exported every %d seconds", *traceSample, *traceRemote, currNode.StatsInterval)
+	}
+
+	// The capture records the envelopes as the node sends them, before the faults.
+	if *faults {
+		currNode.Faults = fault.New(uint64(time.Now().UnixNano()))
+		currNode.Net.Transport = fault.Transport{
+			Next:     currNode.Net.CurrentTransport(),
+			Injector: currNode.Faults,
+			From:     fault.Endpoint{Addr: currNode.GetNodeAddress(), ID: currNode.ID},
+		}
+		logger.Warn("fault injection is turned on")
+	}
+
+	var recorder *capture.Recorder
+	if *captureFile != defaultUninitString {
+		if recorder, err = capture.Create(*captureFile); err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
+		defer recorder.Close()
+		currNode.Net.Transport = capture.Transport{Next: currNode.Net.CurrentTransport(), Recorder: recorder}
+		logger.Info("capturing envelopes to: %s", *captureFile)
+	}
+
+	var servers []*http.Server
+	if *metricsAddr != defaultUninitString {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", currNode.MetricsHandler())
+		servers = append(servers, serveHTTP("metrics", *metricsAddr, mux))
+	}
+	if *adminAddr != defaultUninitString {
+		servers = append(servers, serveHTTP("admin API", *adminAddr, currNode.AdminHandler()))
+	}
+
+	currNode.RateLimit = *rateLimit
+	currNode.RateBurst = *rateBurst
+	currNode.BanDuration = uint16(*banDuration)
+	logger.Debug("setting rate limit to: %.1f messages per second in bursts of %.0f, with bans of %d seconds", currNode.RateLimit, currNode.RateBurst, currNode.BanDuration)
+
+	if *netKeyFile != defaultUninitString {
+		if currNode.NetworkKey, err = admission.LoadNetworkKey(*netKeyFile); err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
+	}
+	currNode.RequireInvitation = *requireInvitation
+	logger.Debug("setting admission control to: network key=%v, invitation=%v", currNode.NetworkKey != nil, currNode.RequireInvitation)
+
+	var invitation *admission.Token
+	if *invitationToken != defaultUninitString {
+		token, err := admission.DecodeToken(*invitationToken)
+		if err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
+		invitation = &token
+	}
+
+	// The capture starts before the join, such that the join traffic is part of it.
+	if recorder != nil {
+		if err = recorder.RecordStart(currNode.Snapshot()); err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
+		currNode.Capture = recorder
+	}
 
 	if *newNet {
-		JoinNewNetwork(currNode, connectionIp, connectionPort, port, ip, connsCap)
+		if *connectionIp == defaultUninitString || *connectionPort == defaultUninitInt {
+			logger.ErrorWithExit("to join a new network use both flags \"connip\" + \"connport\"")
+		}
+		bootstrap := network.IpPortPair{Ip: net.ParseIP(*connectionIp), Port: uint16(*connectionPort)}
+		if err = currNode.Join(bootstrap, invitation); err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
+	}
+
+	// The replay starts from the node as it is once it joined.
+	if recorder != nil {
+		if err = recorder.RecordJoined(currNode.Snapshot()); err != nil {
+			logger.ErrorWithExit("%s", err)
+		}
 	}
 
 	currNode.MainLoop()
+	// The node closes its tracer when stopped, but not when MainLoop fails.
+	if err = currNode.Tracer.Close(); err != nil {
+		logger.Error("could not export traces - %s", err)
+	}
+
+	// The node may have been stopped through the admin API, which still has to answer.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		server.Shutdown(ctx)
+	}
+}
+
+// printInvitationToken prints an invitation to join the network, issued by the node with the key in keyFile.
+func printInvitationToken(keyFile string, invitee identity.NodeID, validFor time.Duration) {
+	// A fresh key would belong to no member, thus nobody would accept the invitation.
+	if _, err := os.Stat(keyFile); err != nil {
+		logger.ErrorWithExit("cannot use key file %s - the issuer must be a member of the network: %s", keyFile, err)
+	}
+
+	issuer, err := identity.LoadOrCreate(keyFile)
+	if err != nil {
+		logger.ErrorWithExit("%s", err)
+	}
+
+	token, err := admission.NewToken(issuer, invitee, validFor)
+	if err != nil {
+		logger.ErrorWithExit("could not create invitation token: %s", err)
+	}
+
+	encoded, err := token.Encode()
+	if err != nil {
+		logger.ErrorWithExit("could not encode invitation token: %s", err)
+	}
+	fmt.Println(encoded)
 }